@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var sink int
+
+func spin(n int) int {
+	x := 0
+	for i := 0; i < n; i++ {
+		x += i // breakpoint here
+	}
+	return x
+}
+
+func main() {
+	// keep the scheduler busy preempting goroutines that never yield
+	for i := 0; i < runtime.GOMAXPROCS(0)*2; i++ {
+		go func() {
+			for {
+				sink++
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		fmt.Println(spin(1 << 20))
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	// the first argument is the hex encoding of the remaining arguments,
+	// separated by NUL characters.
+	fmt.Printf("received args %q\n", os.Args)
+	if len(os.Args) < 2 {
+		os.Exit(2)
+	}
+	buf, err := hex.DecodeString(os.Args[1])
+	if err != nil {
+		os.Exit(2)
+	}
+	expected := strings.Split(string(buf), "\x00")
+	if len(expected) != len(os.Args)-2 {
+		os.Exit(1)
+	}
+	for i := range expected {
+		if expected[i] != os.Args[i+2] {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+)
+
+func work(n int) {
+	fmt.Println(n)
+}
+
+func main() {
+	for i, lvl := range []string{"low", "low", "high", "low"} {
+		pprof.Do(context.Background(), pprof.Labels("worker", lvl), func(context.Context) {
+			work(i)
+		})
+	}
+}
@@ -227,6 +227,11 @@ func (b *Builder) makeAbbrevTable() []byte {
 		util.EncodeULEB128(&abbrev, 0)
 		util.EncodeULEB128(&abbrev, 0)
 	}
+	// The table is terminated by a null entry, debug/dwarf reads
+	// abbreviations until it finds one and fails with an underflow error
+	// without it, this breaks every user of Builder, including
+	// TestDwarfExprRegisters and the other tests of pkg/proc.
+	util.EncodeULEB128(&abbrev, 0)
 
 	return abbrev.Bytes()
 }
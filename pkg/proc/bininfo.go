@@ -2,6 +2,7 @@ package proc
 
 import (
 	"bytes"
+	"container/list"
 	"debug/dwarf"
 	"debug/elf"
 	"debug/macho"
@@ -41,6 +42,13 @@ type BinaryInfo struct {
 	packageVars   []packageVar // packageVars is a list of all global/package variables in debug_info, sorted by address
 	gStructOffset uint64
 
+	// GoVersion is the version of Go used to build the executable, as read
+	// from runtime.buildVersion, empty if it couldn't be determined.
+	GoVersion string
+	// BuildID is the Go build ID of the executable, read from the
+	// .note.go.buildid ELF note.
+	BuildID string
+
 	// Functions is a list of all DW_TAG_subprogram entries in debug_info, sorted by entry point
 	Functions []Function
 	// Sources is a list of all source files found in debug_line.
@@ -50,17 +58,34 @@ type BinaryInfo struct {
 
 	typeCache map[dwarf.Offset]godwarf.Type
 
-	loadModuleDataOnce sync.Once
-	moduleData         []moduleData
-	nameOfRuntimeType  map[uintptr]nameOfRuntimeTypeEntry
+	nameOfRuntimeType map[uintptr]nameOfRuntimeTypeEntry
 
 	// consts[off] lists all the constants with the type defined at offset off.
 	consts constantsMap
 
+	shared *sharedBinaryInfo
+
+	// strictUnwind enables the checks of the stack unwinder meant for
+	// targets read through a remote stub, see SetStrictUnwind.
+	strictUnwind bool
+
+	dwarfReader *dwarf.Reader
+}
+
+// sharedBinaryInfo is the part of BinaryInfo that is guarded by a lock or
+// loaded on demand, it is kept behind a pointer so that NewBinaryInfo can
+// return a BinaryInfo value and its copies share the same state.
+type sharedBinaryInfo struct {
+	loadModuleDataOnce sync.Once
+	moduleData         []moduleData
+
+	loadWaitReasonsOnce sync.Once
+	waitReasons         []string // contents of runtime.waitReasonStrings, see WaitReasonString
+
 	loadErrMu sync.Mutex
 	loadErr   error
 
-	dwarfReader *dwarf.Reader
+	pcToLineCache pcToLineCache
 }
 
 var UnsupportedLinuxArchErr = errors.New("unsupported architecture - only linux/amd64 is supported")
@@ -218,7 +243,7 @@ func (e *loclistEntry) BaseAddressSelection() bool {
 }
 
 func NewBinaryInfo(goos, goarch string) BinaryInfo {
-	r := BinaryInfo{GOOS: goos, nameOfRuntimeType: make(map[uintptr]nameOfRuntimeTypeEntry), typeCache: make(map[dwarf.Offset]godwarf.Type)}
+	r := BinaryInfo{GOOS: goos, nameOfRuntimeType: make(map[uintptr]nameOfRuntimeTypeEntry), typeCache: make(map[dwarf.Offset]godwarf.Type), shared: &sharedBinaryInfo{}}
 
 	// TODO: find better way to determine proc arch (perhaps use executable file info)
 	switch goarch {
@@ -229,12 +254,23 @@ func NewBinaryInfo(goos, goarch string) BinaryInfo {
 	return r
 }
 
+// SetStrictUnwind makes the stack unwinder distrust BP in frames without a
+// frame descriptor entry, unwinding them using SP when BP doesn't point
+// inside the stack, and stop at return addresses read from outside of the
+// goroutine stack. It is used by the gdbserial backend, native and core
+// targets keep the default unwinder.
+func (bininfo *BinaryInfo) SetStrictUnwind(strict bool) {
+	bininfo.strictUnwind = strict
+}
+
 func (bininfo *BinaryInfo) LoadBinaryInfo(path string, wg *sync.WaitGroup) error {
 	fi, err := os.Stat(path)
 	if err == nil {
 		bininfo.lastModified = fi.ModTime()
 	}
 
+	bininfo.shared.pcToLineCache.reset()
+
 	switch bininfo.GOOS {
 	case "linux":
 		return bininfo.LoadBinaryInfoElf(path, wg)
@@ -271,13 +307,81 @@ func (bi *BinaryInfo) Types() ([]string, error) {
 }
 
 // PCToLine converts an instruction address to a file/line/function.
+// Results are cached, see ResetPCToLineCache.
 func (bi *BinaryInfo) PCToLine(pc uint64) (string, int, *Function) {
-	fn := bi.PCToFunc(pc)
-	if fn == nil {
-		return "", 0, nil
+	if e, ok := bi.shared.pcToLineCache.get(pc); ok {
+		return e.file, e.line, e.fn
 	}
-	f, ln := fn.cu.lineInfo.PCToLine(fn.Entry, pc)
-	return f, ln, fn
+	e := pcToLineEntry{pc: pc}
+	e.fn = bi.PCToFunc(pc)
+	if e.fn != nil {
+		e.file, e.line = e.fn.cu.lineInfo.PCToLine(e.fn.Entry, pc)
+	}
+	bi.shared.pcToLineCache.add(e)
+	return e.file, e.line, e.fn
+}
+
+// ResetPCToLineCache empties the cache of PCToLine, it must be called
+// when the set of functions known to the BinaryInfo changes, for example
+// if the debug informations of a newly loaded library are added.
+func (bi *BinaryInfo) ResetPCToLineCache() {
+	bi.shared.pcToLineCache.reset()
+}
+
+// pcToLineCacheSize is the maximum number of entries of the PCToLine cache.
+const pcToLineCacheSize = 4096
+
+type pcToLineEntry struct {
+	pc   uint64
+	file string
+	line int
+	fn   *Function
+}
+
+// pcToLineCache is a LRU cache of the results of PCToLine, stepping
+// and unwinding the stacks of many goroutines resolve the same PCs over
+// and over. The zero value is an empty cache.
+type pcToLineCache struct {
+	mu      sync.Mutex
+	entries map[uint64]*list.Element
+	lru     list.List // of pcToLineEntry, most recently used first
+}
+
+func (c *pcToLineCache) get(pc uint64) (pcToLineEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[pc]
+	if !ok {
+		return pcToLineEntry{}, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(pcToLineEntry), true
+}
+
+func (c *pcToLineCache) add(e pcToLineEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[uint64]*list.Element)
+	}
+	if el, ok := c.entries[e.pc]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.pc] = c.lru.PushFront(e)
+	if c.lru.Len() > pcToLineCacheSize {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(pcToLineEntry).pc)
+	}
+}
+
+func (c *pcToLineCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.lru.Init()
 }
 
 // LineToPC converts a file:line into a memory address.
@@ -327,13 +431,13 @@ func (bi *BinaryInfo) Close() error {
 }
 
 func (bi *BinaryInfo) setLoadError(fmtstr string, args ...interface{}) {
-	bi.loadErrMu.Lock()
-	bi.loadErr = fmt.Errorf(fmtstr, args...)
-	bi.loadErrMu.Unlock()
+	bi.shared.loadErrMu.Lock()
+	bi.shared.loadErr = fmt.Errorf(fmtstr, args...)
+	bi.shared.loadErrMu.Unlock()
 }
 
 func (bi *BinaryInfo) LoadError() error {
-	return bi.loadErr
+	return bi.shared.loadErr
 }
 
 type nilCloser struct{}
@@ -454,6 +558,8 @@ func (bi *BinaryInfo) LoadBinaryInfoElf(path string, wg *sync.WaitGroup) error {
 		return err
 	}
 	bi.loclistInit(getDebugLocElf(elfFile))
+	bi.BuildID = ElfBuildID(elfFile)
+	bi.GoVersion = ElfGoVersion(elfFile)
 
 	wg.Add(3)
 	go bi.parseDebugFrameElf(elfFile, wg)
@@ -462,6 +568,90 @@ func (bi *BinaryInfo) LoadBinaryInfoElf(path string, wg *sync.WaitGroup) error {
 	return nil
 }
 
+// ElfBuildID returns the Go build ID stored in the .note.go.buildid note
+// of exe, or the empty string if exe doesn't have one.
+func ElfBuildID(exe *elf.File) string {
+	sec := exe.Section(".note.go.buildid")
+	if sec == nil {
+		return ""
+	}
+	note, err := sec.Data()
+	if err != nil {
+		return ""
+	}
+	const noteHeaderSize = 12 // namesz, descsz, type
+	const goBuildIDNote = 4
+	for len(note) >= noteHeaderSize {
+		namesz := int(exe.ByteOrder.Uint32(note[0:]))
+		descsz := int(exe.ByteOrder.Uint32(note[4:]))
+		typ := exe.ByteOrder.Uint32(note[8:])
+		note = note[noteHeaderSize:]
+		namelen := (namesz + 3) &^ 3
+		desclen := (descsz + 3) &^ 3
+		if namesz < 0 || descsz < 0 || namelen+desclen > len(note) {
+			return ""
+		}
+		if typ == goBuildIDNote && strings.TrimRight(string(note[:namesz]), "\x00") == "Go" {
+			return string(note[namelen : namelen+descsz])
+		}
+		note = note[namelen+desclen:]
+	}
+	return ""
+}
+
+// ElfGoVersion returns the value of runtime.buildVersion read from the
+// data sections of exe, or the empty string if it can't be found.
+func ElfGoVersion(exe *elf.File) string {
+	symbols, err := exe.Symbols()
+	if err != nil {
+		return ""
+	}
+	for _, sym := range symbols {
+		if sym.Name != "runtime.buildVersion" {
+			continue
+		}
+		var ptrSize uint64 = 8
+		if exe.Class == elf.ELFCLASS32 {
+			ptrSize = 4
+		}
+		hdr := elfReadAt(exe, sym.Value, 2*ptrSize)
+		if hdr == nil {
+			return ""
+		}
+		var strptr, strlen uint64
+		if ptrSize == 4 {
+			strptr, strlen = uint64(exe.ByteOrder.Uint32(hdr)), uint64(exe.ByteOrder.Uint32(hdr[4:]))
+		} else {
+			strptr, strlen = exe.ByteOrder.Uint64(hdr), exe.ByteOrder.Uint64(hdr[8:])
+		}
+		if strlen > 64 {
+			return ""
+		}
+		return string(elfReadAt(exe, strptr, strlen))
+	}
+	return ""
+}
+
+// elfReadAt reads n bytes at virtual address addr from the sections of
+// exe that are loaded in memory. Returns nil if the data isn't stored in
+// the file.
+func elfReadAt(exe *elf.File, addr, n uint64) []byte {
+	for _, sec := range exe.Sections {
+		if sec.Flags&elf.SHF_ALLOC == 0 || sec.Type == elf.SHT_NOBITS {
+			continue
+		}
+		if addr < sec.Addr || addr+n > sec.Addr+sec.Size {
+			continue
+		}
+		buf := make([]byte, n)
+		if _, err := sec.ReadAt(buf, int64(addr-sec.Addr)); err != nil {
+			return nil
+		}
+		return buf
+	}
+	return nil
+}
+
 func (bi *BinaryInfo) parseDebugFrameElf(exe *elf.File, wg *sync.WaitGroup) {
 	defer wg.Done()
 
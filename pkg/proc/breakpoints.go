@@ -51,6 +51,13 @@ type Breakpoint struct {
 	DeferReturns []uint64
 	// Cond: if not nil the breakpoint will be triggered only if evaluating Cond returns true
 	Cond ast.Expr
+	// ThreadID: if not zero the breakpoint will be triggered only by the
+	// thread with this ID, it only restricts the user breakpoint, an
+	// overlapping internal breakpoint is triggered by all threads
+	ThreadID int
+	// Disabled: if true the breakpoint is kept, with its hit counts and
+	// condition, but it is never triggered as a user breakpoint
+	Disabled bool
 	// internalCond is the same as Cond but used for the condition of internal breakpoints
 	internalCond ast.Expr
 }
@@ -105,7 +112,7 @@ func (iae InvalidAddressError) Error() string {
 // CheckCondition evaluates bp's condition on thread.
 func (bp *Breakpoint) CheckCondition(thread Thread) BreakpointState {
 	bpstate := BreakpointState{Breakpoint: bp, Active: false, Internal: false, CondError: nil}
-	if bp.Cond == nil && bp.internalCond == nil {
+	if bp.Cond == nil && bp.internalCond == nil && bp.ThreadID == 0 && !bp.Disabled {
 		bpstate.Active = true
 		bpstate.Internal = bp.Kind != UserBreakpoint
 		return bpstate
@@ -136,7 +143,10 @@ func (bp *Breakpoint) CheckCondition(thread Thread) BreakpointState {
 			return bpstate
 		}
 	}
-	if bp.Kind&UserBreakpoint != 0 {
+	if bp.Kind&UserBreakpoint != 0 && !bp.Disabled {
+		if bp.ThreadID != 0 && bp.ThreadID != thread.ThreadID() {
+			return bpstate
+		}
 		// Check normal condition if this is also a user breakpoint
 		bpstate.Active, bpstate.CondError = evalBreakpointCondition(thread, bp.Cond)
 	}
@@ -150,6 +160,13 @@ func (bp *Breakpoint) IsInternal() bool {
 	return bp.Kind != UserBreakpoint
 }
 
+// Installed returns true if bp needs to be written to the target, which is
+// the case unless bp is a disabled user breakpoint that doesn't overlap
+// with an internal breakpoint.
+func (bp *Breakpoint) Installed() bool {
+	return !bp.Disabled || bp.IsInternal()
+}
+
 // IsUser returns true if bp is a user-set breakpoint.
 // User-set breakpoints can overlap with internal breakpoints, in that case
 // both IsUser and IsInternal will be true.
@@ -281,7 +298,9 @@ func (bpmap *BreakpointMap) Clear(addr uint64, clearBreakpoint clearBreakpointFn
 
 	bp.Kind &= ^UserBreakpoint
 	bp.Cond = nil
+	bp.ThreadID = 0
 	if bp.Kind != 0 {
+		bp.Disabled = false
 		return bp, nil
 	}
 
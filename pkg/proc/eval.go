@@ -388,6 +388,8 @@ func (scope *EvalScope) evalBuiltinCall(node *ast.CallExpr) (*Variable, error) {
 		return imagBuiltin(args, node.Args)
 	case "real":
 		return realBuiltin(args, node.Args)
+	case "label":
+		return scope.labelBuiltin(args, node.Args)
 	}
 
 	return nil, fmt.Errorf("function calls are not supported")
@@ -555,6 +557,34 @@ func realBuiltin(args []*Variable, nodeargs []ast.Expr) (*Variable, error) {
 	return newConstant(constant.Real(arg.Value), arg.mem), nil
 }
 
+// labelBuiltin implements label(key), which returns the value of the
+// label key of the current goroutine, or the empty string if the goroutine
+// doesn't have that label.
+func (scope *EvalScope) labelBuiltin(args []*Variable, nodeargs []ast.Expr) (*Variable, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("wrong number of arguments to label: %d", len(args))
+	}
+	arg := args[0]
+	arg.loadValue(loadSingleValue)
+	if arg.Unreadable != nil {
+		return nil, arg.Unreadable
+	}
+	if arg.Kind != reflect.String || arg.Value == nil {
+		return nil, fmt.Errorf("invalid argument %s (type %s) to label", exprToString(nodeargs[0]), arg.TypeString())
+	}
+	if scope.g == nil {
+		if scope.Gvar == nil {
+			return nil, errors.New("label used outside of a goroutine")
+		}
+		g, err := scope.Gvar.parseG()
+		if err != nil {
+			return nil, err
+		}
+		scope.g = g
+	}
+	return newConstant(constant.MakeString(scope.g.Labels()[constant.StringVal(arg.Value)]), scope.Mem), nil
+}
+
 // Evaluates identifier expressions
 func (scope *EvalScope) evalIdent(node *ast.Ident) (*Variable, error) {
 	switch node.Name {
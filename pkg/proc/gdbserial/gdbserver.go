@@ -58,20 +58,37 @@
 // unavailable but the inferior is run in single threaded mode.
 //
 // Therefore the following code will assume lldb-server-like behavior.
+// Stop replies that arrive anyway while we are waiting for the reply to a
+// different command are kept and reported by the next resume, see
+// gdbConn.queueStop.
 
 package gdbserial
 
 import (
 	"bytes"
+	"context"
+	"debug/elf"
 	"debug/macho"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -79,6 +96,8 @@ import (
 
 	"golang.org/x/arch/x86/x86asm"
 
+	"github.com/derekparker/delve/pkg/dwarf/godwarf"
+	"github.com/derekparker/delve/pkg/goversion"
 	"github.com/derekparker/delve/pkg/logflags"
 	"github.com/derekparker/delve/pkg/proc"
 )
@@ -93,6 +112,30 @@ const (
 
 const heartbeatInterval = 10 * time.Second
 
+const defaultHandshakeTimeout = 10 * time.Second
+
+// defaultInterruptPendingTimeout is the default value of
+// Process.interruptPendingTimeout.
+const defaultInterruptPendingTimeout = time.Second
+
+// resyncQuietPeriod is how long the stub must stay silent before
+// gdbConn.resync considers the input drained, resyncReplyTimeout is the
+// maximum amount of time resync waits for the reply to its probe.
+const (
+	resyncQuietPeriod  = 200 * time.Millisecond
+	resyncReplyTimeout = 5 * time.Second
+)
+
+// maxPipelinedCommands is the maximum number of commands
+// gdbConn.execPipelined sends before reading their replies. Sending all of
+// them could deadlock if the stub blocks writing its replies while we are
+// still writing commands.
+const maxPipelinedCommands = 64
+
+// detachStubExitTimeout is how long Detach waits for a stub we started to
+// exit on its own after detaching from the target.
+const detachStubExitTimeout = 5 * time.Second
+
 var ErrDirChange = errors.New("direction change with internal breakpoints")
 
 // Process implements proc.Process using a connection to a debugger stub
@@ -108,20 +151,80 @@ type Process struct {
 	exited bool
 	ctrlC  bool // ctrl-c was sent to stop inferior
 
+	// interruptPending is set when a ctrl-c was sent but the target stopped
+	// for a different reason before receiving it, the stub may answer the
+	// interrupt the next time the target is resumed.
+	// interruptPendingGen is the value of conn.stopGen when it was set, the
+	// flag is discarded if the target is resumed by anything other than the
+	// next continue.
+	// interruptPendingTimeout is how long after the target is resumed a stop
+	// caused by that interrupt is still considered stale.
+	interruptPendingTimeout time.Duration
+	interruptPending        bool
+	interruptPendingGen     uint64
+
 	manualStopRequested bool
+	// manualStops counts the calls to RequestManualStop, a continue uses it
+	// to find out about requests made while the target was stopped
+	// internally between two resumes, see resendManualStop.
+	manualStops uint64
 
-	breakpoints proc.BreakpointMap
+	breakpoints          proc.BreakpointMap
+	breakpointsSuspended bool // breakpoints are removed from the stub, see ContinueWithoutBreakpoints
+
+	noPanicBreakpoint bool // do not set the unrecovered-panic breakpoint
+
+	memcache *memCache // cache of read-only memory, nil if disabled
+
+	passSignals       []int // signals the stub should deliver to the inferior without stopping
+	passSignalsCustom bool  // passSignals was set by the user
+
+	signalPolicy  func(sig uint8) SignalAction // decides whether to stop on a signal, see SetSignalPolicy
+	pendingSignal uint8                        // signal to deliver on the next resume, see SignalPassAndStop
+	threadSignal  *threadSignal                // signal to deliver to a single thread on the next resume, see ContinueThreadWithSignal
+	cont          *continueState               // continue started by StartContinue, nil if the target is stopped
 
 	gcmdok         bool   // true if the stub supports g and G commands
 	threadStopInfo bool   // true if the stub supports qThreadStopInfo
 	tracedir       string // if attached to rr the path to the trace directory
+	execPath       string // path of the executable of the inferior
+	targetSet      bool   // GOOS and GOARCH of the target were set with SetTarget
+
+	loadGInstrAddr uint64 // address of the g loading instruction in memory allocated by the stub, zero if we couldn't allocate it
+
+	inferiors     map[int]bool              // processes managed by the stub, in multiprocess mode
+	inferiorExits []proc.ProcessExitedError // exits of processes other than the selected one, see InferiorExits
+
+	checkpoints map[int]string // rr checkpoints created by us, ID to name
+
+	watchpoints []*Watchpoint // hardware watchpoints set with SetVariableWatchpoint
 
-	loadGInstrAddr uint64 // address of the g loading instruction, zero if we couldn't allocate it
+	libraries      []SharedLibrary          // shared libraries loaded the last time we checked
+	breakpointLibs map[uint64]SharedLibrary // shared library containing each breakpoint, for breakpoints set in shared libraries
 
-	process  *os.Process
-	waitChan chan *os.ProcessState
+	savedBreakpoints []SavedBreakpoint // breakpoints read by LoadBreakpoints, see ReapplyBreakpoints
 
-	allGCache []*proc.G
+	checkThreadsAlive bool // FindThread checks that threads are alive, see SetCheckThreadsAlive
+
+	threadsInfoGen   uint64 // value of conn.stopGen when the thread names and cores were last read
+	threadsInfoValid bool
+
+	// result of SharedLibraries used by describePC, valid if
+	// stopLibsValid is set and stopLibsGen is the current value of
+	// conn.stopGen.
+	stopLibs      []SharedLibrary
+	stopLibsErr   error
+	stopLibsGen   uint64
+	stopLibsValid bool
+
+	numaNodes map[int]int // NUMA node of each CPU core of the local machine, see NUMANode
+
+	process       *os.Process
+	waitChan      chan *os.ProcessState
+	stubTransport StubTransport // transport used to start the stub on a remote host, see LLDBLaunchTransport
+
+	allGCache      []*proc.G
+	goroutineStats *GoroutineStats // cached result of GoroutineStats, reset with allGCache
 }
 
 // Thread is a thread.
@@ -129,9 +232,24 @@ type Thread struct {
 	ID                int
 	strID             string
 	regs              gdbRegisters
+	regsLoaded        bool // regs were read after the target last ran, see loadRegisters
 	CurrentBreakpoint proc.BreakpointState
 	p                 *Process
 	setbp             bool // thread was stopped because of a breakpoint
+	stopKind          StopKind
+	stopSig           uint8
+	stopReasons       stopReasons // all the reasons the thread stopped for, see StopKinds
+	preempted         bool        // thread was stopped by the async preemption signal, see preemptSignal
+	watchpoint        *Watchpoint // watchpoint that stopped the thread
+	name              string
+	core              int // CPU core the thread is running on, -1 if unknown
+
+	// CPU core reported in the stop packet or by qThreadExtraInfo, valid if
+	// stopCoreKnown is set and stopCoreGen is the current value of
+	// conn.stopGen.
+	stopCore      int
+	stopCoreGen   uint64
+	stopCoreKnown bool
 }
 
 // ErrBackendUnavailable is returned when the stub program can not be found.
@@ -142,6 +260,20 @@ func (err *ErrBackendUnavailable) Error() string {
 	return "backend unavailable"
 }
 
+// ErrAlreadyTraced is returned by LLDBAttach when the target process is
+// already being debugged (traced) by another program.
+type ErrAlreadyTraced struct {
+	Pid       int
+	TracerPid int // PID of the program tracing the target, zero if unknown
+}
+
+func (err *ErrAlreadyTraced) Error() string {
+	if err.TracerPid != 0 {
+		return fmt.Sprintf("process %d is already being debugged by PID %d, detach the other debugger and try again", err.Pid, err.TracerPid)
+	}
+	return fmt.Sprintf("process %d is already being debugged, detach the other debugger and try again", err.Pid)
+}
+
 // gdbRegisters represents the current value of the registers of a thread.
 // The storage space for all the registers is allocated as a single memory
 // block in buf, the value field inside an individual gdbRegister will be a
@@ -153,6 +285,8 @@ type gdbRegisters struct {
 	gaddr    uint64
 	hasgaddr bool
 	buf      []byte
+
+	byteOrder binary.ByteOrder // byte order of register values, nil means little endian
 }
 
 type gdbRegister struct {
@@ -161,7 +295,7 @@ type gdbRegister struct {
 }
 
 // New creates a new Process instance.
-// If process is not nil it is the stub's process and will be killed after
+// If process is not nil it is the stub's process and will be stopped by
 // Detach.
 // Use Listen, Dial or Connect to complete connection.
 func New(process *os.Process) *Process {
@@ -170,6 +304,7 @@ func New(process *os.Process) *Process {
 			maxTransmitAttempts: maxTransmitAttempts,
 			inbuf:               make([]byte, 0, initialInputBufferSize),
 			direction:           proc.Forward,
+			handshakeTimeout:    defaultHandshakeTimeout,
 		},
 		threads:        make(map[int]*Thread),
 		bi:             proc.NewBinaryInfo(runtime.GOOS, runtime.GOARCH),
@@ -177,8 +312,12 @@ func New(process *os.Process) *Process {
 		gcmdok:         true,
 		threadStopInfo: true,
 		process:        process,
+
+		interruptPendingTimeout: defaultInterruptPendingTimeout,
 	}
 
+	p.bi.SetStrictUnwind(true)
+
 	if process != nil {
 		p.waitChan = make(chan *os.ProcessState)
 		go func() {
@@ -228,6 +367,269 @@ func (p *Process) Dial(addr string, path string, pid int) error {
 	}
 }
 
+// SetHandshakeTimeout sets the maximum amount of time that Connect will
+// wait for the stub to complete the handshake, a zero duration means no
+// limit. Must be called before Connect.
+func (p *Process) SetHandshakeTimeout(d time.Duration) {
+	p.conn.handshakeTimeout = d
+}
+
+// SetTarget sets the operating system and architecture of the target, using
+// the same names as GOOS and GOARCH. Must be called before Connect.
+// By default Connect determines them from the information returned by the
+// stub (qHostInfo or qProcessInfo), falling back to those of the host if
+// the stub doesn't provide it.
+func (p *Process) SetTarget(goos, goarch string) error {
+	if err := p.setTarget(goos, goarch); err != nil {
+		return err
+	}
+	p.targetSet = true
+	return nil
+}
+
+// setTarget replaces the BinaryInfo of p with one for goos/goarch, if the
+// target is supported.
+func (p *Process) setTarget(goos, goarch string) error {
+	if !supportedTargetOS(goos) {
+		return fmt.Errorf("unsupported target %s/%s: operating system not supported", goos, goarch)
+	}
+	if goarch != "amd64" {
+		return fmt.Errorf("unsupported target %s/%s: architecture not supported", goos, goarch)
+	}
+	p.bi = proc.NewBinaryInfo(goos, goarch)
+	p.bi.SetStrictUnwind(true)
+	return nil
+}
+
+// supportedTargetOS returns true if goos is an operating system supported
+// by setTarget.
+func supportedTargetOS(goos string) bool {
+	switch goos {
+	case "linux", "darwin", "windows":
+		return true
+	}
+	return false
+}
+
+// SetReplyTimeout sets the maximum amount of time to wait for the stub to
+// reply to a command, a zero duration (the default) means no limit. If the
+// stub doesn't reply in time the command fails with ErrStubUnresponsive and
+// all following commands fail with the same error. Resuming the target,
+// restarting an rr recording and rr's qRRCmd commands are not subject to
+// this limit.
+func (p *Process) SetReplyTimeout(d time.Duration) {
+	p.conn.replyTimeout = d
+}
+
+// SetMemoryReadRetry configures memory reads that fail with a transient
+// error to be retried up to retries times, waiting delay between attempts.
+// Reads of addresses that are not mapped are never retried. Retries are
+// disabled by default since they can mask real errors, they are useful
+// with stubs talking to flaky hardware (e.g. over USB or JTAG).
+func (p *Process) SetMemoryReadRetry(retries int, delay time.Duration) {
+	p.conn.memReadRetries = retries
+	p.conn.memReadRetryDelay = delay
+}
+
+// SharedLibrary describes an image mapped in the address space of the
+// inferior.
+type SharedLibrary struct {
+	Name      string
+	LoadAddr  uint64 // load bias (ELF) or address of the mach header (Mach-O), zero if unknown
+	TextStart uint64 // start of the text section in memory, zero if unknown
+	TextEnd   uint64 // end of the text section in memory, zero if unknown
+}
+
+// SharedLibraries returns the list of images loaded by the inferior,
+// starting with its executable, as reported by qXfer:libraries-svr4:read
+// (gdbserver on linux) or jGetLoadedDynamicLibrariesInfos (debugserver).
+// Debugserver only supports the latter, other stubs are asked the former
+// first and the latter if the former isn't supported.
+// If the stub supports neither the list only contains the executable.
+func (p *Process) SharedLibraries() ([]SharedLibrary, error) {
+	exe := SharedLibrary{Name: p.execPath}
+	exe.TextStart, exe.TextEnd = textRange(p.execPath)
+	libs := []SharedLibrary{exe}
+
+	if !p.conn.isDebugserver {
+		svr4libs, err := p.sharedLibrariesSvr4(libs)
+		if err == nil || !isProtocolErrorUnsupported(err) || p.conn.librariesXferSupported {
+			return svr4libs, err
+		}
+	}
+
+	darwinlibs, err := p.sharedLibrariesDarwin(libs)
+	if err != nil && isProtocolErrorUnsupported(err) {
+		return libs, nil
+	}
+	return darwinlibs, err
+}
+
+// sharedLibrariesSvr4 appends to libs the shared libraries reported by
+// qXfer:libraries-svr4:read.
+func (p *Process) sharedLibrariesSvr4(libs []SharedLibrary) ([]SharedLibrary, error) {
+	svr4, err := p.conn.queryLibrariesSvr4()
+	if err != nil {
+		return nil, err
+	}
+	for _, lib := range svr4 {
+		if lib.Name == "" {
+			continue
+		}
+		laddr, _ := strconv.ParseUint(strings.TrimPrefix(lib.LAddr, "0x"), 16, 64)
+		sl := SharedLibrary{Name: lib.Name, LoadAddr: laddr}
+		if start, end := textRange(lib.Name); end != 0 {
+			sl.TextStart, sl.TextEnd = start+laddr, end+laddr
+		}
+		libs = append(libs, sl)
+	}
+	return libs, nil
+}
+
+// sharedLibrariesDarwin appends to libs the images reported by
+// jGetLoadedDynamicLibrariesInfos, the executable image replaces libs[0].
+func (p *Process) sharedLibrariesDarwin(libs []SharedLibrary) ([]SharedLibrary, error) {
+	images, err := p.conn.getLoadedDynamicLibraries()
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		sl := SharedLibrary{Name: image.Pathname, LoadAddr: image.LoadAddress}
+		for _, seg := range image.Segments {
+			if seg.Name == "__TEXT" {
+				sl.TextStart, sl.TextEnd = image.LoadAddress, image.LoadAddress+seg.VMSize
+			}
+		}
+		if image.MachHeader.FileType == macho.TypeExec {
+			libs[0] = sl
+		} else {
+			libs = append(libs, sl)
+		}
+	}
+	return libs, nil
+}
+
+// textRange returns the range of addresses of the text section of the ELF
+// or Mach-O file at path, before relocation.
+func textRange(path string) (start, end uint64) {
+	if f, err := elf.Open(path); err == nil {
+		defer f.Close()
+		if sec := f.Section(".text"); sec != nil {
+			return sec.Addr, sec.Addr + sec.Size
+		}
+		return 0, 0
+	}
+	if f, err := macho.Open(path); err == nil {
+		defer f.Close()
+		if sec := f.Section("__text"); sec != nil {
+			return sec.Addr, sec.Addr + sec.Size
+		}
+	}
+	return 0, 0
+}
+
+// WorkingDir returns the current working directory of the inferior, as
+// reported by the stub.
+func (p *Process) WorkingDir() (string, error) {
+	return p.conn.getWorkingDir()
+}
+
+// SearchMemory searches pattern in the memory range [start, start+length)
+// of the inferior and returns the address of the first match. The search
+// is executed by the stub if it supports qSearch:memory, otherwise memory
+// is read and searched in chunks.
+func (p *Process) SearchMemory(start, length uint64, pattern []byte) (uint64, bool, error) {
+	if p.exited {
+		return 0, false, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if len(pattern) == 0 {
+		return 0, false, errors.New("empty search pattern")
+	}
+	if uint64(len(pattern)) > length {
+		return 0, false, nil
+	}
+	// the escaped pattern could be twice as long
+	if !p.conn.searchMemoryUnsupported && 2*len(pattern)+64 < p.conn.packetSize {
+		addr, found, err := p.conn.searchMemory(start, length, pattern)
+		if !isProtocolErrorUnsupported(err) {
+			return addr, found, err
+		}
+		p.conn.searchMemoryUnsupported = true
+	}
+
+	chunkSize := (p.conn.packetSize - 4) / 2
+	if chunkSize < len(pattern) {
+		chunkSize = len(pattern)
+	}
+	// buf holds the last len(pattern)-1 bytes of the previous chunk followed
+	// by the current chunk, so that matches crossing the boundary between
+	// two chunks are found.
+	buf := make([]byte, 0, len(pattern)-1+chunkSize)
+	bufaddr := start
+	for off := uint64(0); off < length; {
+		sz := uint64(chunkSize)
+		if sz > length-off {
+			sz = length - off
+		}
+		chunk := buf[len(buf) : len(buf)+int(sz)]
+		if err := p.readMemory(chunk, uintptr(start+off)); err != nil {
+			return 0, false, err
+		}
+		buf = buf[:len(buf)+int(sz)]
+		off += sz
+		if idx := bytes.Index(buf, pattern); idx >= 0 {
+			return bufaddr + uint64(idx), true, nil
+		}
+		if keep := len(pattern) - 1; len(buf) > keep {
+			bufaddr += uint64(len(buf) - keep)
+			buf = buf[:copy(buf, buf[len(buf)-keep:])]
+		}
+	}
+	return 0, false, nil
+}
+
+// SetWriteVerification enables or disables verification of memory writes.
+// When enabled every memory write is read back and an error is returned if
+// the memory doesn't contain the written bytes, this is useful with stubs
+// that silently fail to write some memory (for example instruction memory
+// on some JTAG stubs). Disabled by default, since it doubles the cost of
+// writes.
+func (p *Process) SetWriteVerification(enabled bool) {
+	p.conn.verifyWrites = enabled
+}
+
+// StubInfo returns the kind and version of the stub, as determined during
+// the handshake.
+func (p *Process) StubInfo() StubInfo {
+	return p.conn.stubInfo
+}
+
+// StubFeatures describes the optional protocol features supported by the
+// stub.
+type StubFeatures struct {
+	VContActions []string // actions supported by vCont, nil if vCont is not supported
+	ThreadSuffix bool     // thread suffixes for 'g', 'G', 'p' and 'P'
+	Multiprocess bool     // multiprocess extensions
+	Compression  bool     // zlib-deflate compression of responses
+}
+
+// StubFeatures returns the optional protocol features supported by the
+// stub, as determined during the handshake.
+func (p *Process) StubFeatures() StubFeatures {
+	features := StubFeatures{
+		ThreadSuffix: p.conn.threadSuffixSupported,
+		Multiprocess: p.conn.multiprocess,
+		Compression:  p.conn.compressed,
+	}
+	if !p.conn.noVCont {
+		for action := range p.conn.vContActions {
+			features.VContActions = append(features.VContActions, string(action))
+		}
+		sort.Strings(features.VContActions)
+	}
+	return features
+}
+
 // Connect connects to a stub and performs a handshake.
 //
 // Path and pid are, respectively, the path to the executable of the target
@@ -244,16 +646,9 @@ func (p *Process) Connect(conn net.Conn, path string, pid int) error {
 		return err
 	}
 
-	if verbuf, err := p.conn.exec([]byte("$qGDBServerVersion"), "init"); err == nil {
-		for _, v := range strings.Split(string(verbuf), ";") {
-			if strings.HasPrefix(v, "version:") {
-				if v[len("version:"):] == "902" {
-					// Workaround for https://bugs.llvm.org/show_bug.cgi?id=36968, 'g' command crashes a version of debugserver on some systems (?)
-					p.gcmdok = false
-					break
-				}
-			}
-		}
+	if p.conn.stubInfo.Kind == DebugserverStub && p.conn.stubInfo.Version == "902" {
+		// Workaround for https://bugs.llvm.org/show_bug.cgi?id=36968, 'g' command crashes a version of debugserver on some systems (?)
+		p.gcmdok = false
 	}
 
 	if path == "" {
@@ -289,6 +684,19 @@ func (p *Process) Connect(conn net.Conn, path string, pid int) error {
 		}
 	}
 
+	p.execPath = path
+
+	if !p.targetSet {
+		// If the stub reports an operating system we don't know about keep
+		// the default target, the one of the host.
+		if goos, goarch := p.conn.queryTarget(); goos != "" && goarch != "" && supportedTargetOS(goos) {
+			if err := p.setTarget(goos, goarch); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+	}
+
 	var wg sync.WaitGroup
 	err = p.bi.LoadBinaryInfo(path, &wg)
 	wg.Wait()
@@ -300,17 +708,21 @@ func (p *Process) Connect(conn net.Conn, path string, pid int) error {
 		return err
 	}
 
-	// None of the stubs we support returns the value of fs_base or gs_base
-	// along with the registers, therefore we have to resort to executing a MOV
+	// Older stubs do not return the value of fs_base or gs_base along with
+	// the registers, with those we have to resort to executing a MOV
 	// instruction on the inferior to find out where the G struct of a given
 	// thread is located.
 	// Here we try to allocate some memory on the inferior which we will use to
 	// store the MOV instruction.
 	// If the stub doesn't support memory allocation reloadRegisters will
 	// overwrite some existing memory to store the MOV.
-	if addr, err := p.conn.allocMemory(256); err == nil {
-		if _, err := p.conn.writeMemory(uintptr(addr), p.loadGInstr()); err == nil {
-			p.loadGInstrAddr = addr
+	if !p.hasTLSBaseRegister() {
+		if addr, err := p.conn.allocMemory(256); err == nil {
+			if p.writeLoadGInstr(addr) {
+				p.loadGInstrAddr = addr
+			} else {
+				p.conn.deallocMemory(addr)
+			}
 		}
 	}
 
@@ -320,6 +732,7 @@ func (p *Process) Connect(conn net.Conn, path string, pid int) error {
 		p.bi.Close()
 		return err
 	}
+	p.syncCurrentThread()
 
 	if p.conn.pid <= 0 {
 		p.conn.pid, _, err = p.loadProcessInfo(0)
@@ -330,20 +743,259 @@ func (p *Process) Connect(conn net.Conn, path string, pid int) error {
 		}
 	}
 
-	p.selectedGoroutine, _ = proc.GetG(p.CurrentThread())
+	p.loadSelectedGoroutine()
+	p.loadLibraries()
 
-	panicpc, err := proc.FindFunctionLocation(p, "runtime.startpanic", true, 0)
-	if err == nil {
-		bp, err := p.breakpoints.SetWithID(-1, panicpc, p.writeBreakpoint)
-		if err == nil {
-			bp.Name = proc.UnrecoveredPanic
-			bp.Variables = []string{"runtime.curg._panic.arg"}
-		}
+	if !p.passSignalsCustom {
+		p.passSignals = defaultPassSignals(p.bi.GOOS)
+	}
+	p.sendPassSignals()
+
+	if !p.noPanicBreakpoint {
+		p.setUnrecoveredPanicBreakpoint()
 	}
 
 	return nil
 }
 
+// defaultPassSignals returns the list of signals that are routinely
+// received by Go programs and should be delivered to the inferior without
+// stopping it: SIGURG (used for asynchronous preemption), SIGPROF and
+// SIGCHLD.
+func defaultPassSignals(goos string) []int {
+	switch goos {
+	case "linux":
+		return []int{0x17, 0x1b, 0x11} // SIGURG, SIGPROF, SIGCHLD
+	case "darwin":
+		return []int{0x10, 0x1b, 0x14} // SIGURG, SIGPROF, SIGCHLD
+	}
+	return nil
+}
+
+// preemptSignal returns the signal used by the Go runtime for asynchronous
+// preemption (SIGURG) as numbered by the stub for goos. If gdbSignals is
+// set the stub uses gdb's signal numbers, see gdbConn.gdbSignalNumbers,
+// which are the same for every operating system.
+func preemptSignal(goos string, gdbSignals bool) uint8 {
+	if gdbSignals {
+		return 0x10 // GDB_SIGNAL_URG
+	}
+	switch goos {
+	case "linux":
+		return 0x17
+	case "darwin":
+		return 0x10
+	}
+	return 0
+}
+
+// sendPassSignals sends the list of signals that should be passed to the
+// inferior to the stub.
+// Only lldb-server and debugserver, which number signals the same way the
+// target operating system does, are supported: gdbserver uses gdb's own
+// signal numbers and rr doesn't deliver signals during replay. Nothing is
+// sent unless the stub lists QPassSignals in its qSupported reply.
+func (p *Process) sendPassSignals() error {
+	if p.tracedir != "" || !p.conn.threadSuffixSupported || !p.conn.passSignalsSupported {
+		return nil
+	}
+	err := p.conn.passSignals(p.passSignals)
+	if isProtocolErrorUnsupported(err) {
+		return nil
+	}
+	return err
+}
+
+// SetPassSignals sets the list of signals that the stub will deliver to the
+// inferior without stopping it. Signal numbers are those of the target
+// operating system.
+// If it's never called a default list of signals, routinely received by Go
+// programs, will be passed. Users debugging signal handling can remove a
+// signal from the list to stop on it.
+func (p *Process) SetPassSignals(signals []int) error {
+	p.passSignals = signals
+	p.passSignalsCustom = true
+	if p.conn.conn == nil {
+		return nil
+	}
+	return p.sendPassSignals()
+}
+
+// PassSignals returns the list of signals that the stub will deliver to
+// the inferior without stopping it.
+func (p *Process) PassSignals() []int {
+	return p.passSignals
+}
+
+// unrecoveredPanicFunctions is the list of functions of the runtime called
+// when a panic isn't recovered, the function has been renamed in different
+// versions of Go.
+var unrecoveredPanicFunctions = []string{"runtime.startpanic", "runtime.fatalpanic"}
+
+// unrecoveredPanicFunction returns the name of the function of the runtime
+// called when a panic isn't recovered by version ver of Go.
+// Up to Go 1.10 this was runtime.startpanic, since Go 1.11 it is
+// runtime.fatalpanic (runtime.startpanic was renamed to
+// runtime.startpanic_m and is executed on the system stack).
+func unrecoveredPanicFunction(ver goversion.GoVersion) string {
+	if ver.IsDevel() || ver.AfterOrEqual(goversion.GoVersion{Major: 1, Minor: 11, Rev: -1}) {
+		return "runtime.fatalpanic"
+	}
+	return "runtime.startpanic"
+}
+
+// goVersion returns the version of Go used to build the inferior. The
+// version read from the executable when it was loaded is used if
+// available, otherwise runtime.buildVersion is read from memory and, if
+// that fails too, from the executable on the stub's host.
+// The version found is recorded in BinInfo().GoVersion.
+func (p *Process) goVersion() (goversion.GoVersion, bool) {
+	if p.bi.GoVersion == "" {
+		p.bi.GoVersion = p.memoryGoVersion()
+	}
+	if p.bi.GoVersion == "" {
+		p.bi.GoVersion, p.bi.BuildID = p.remoteGoInfo()
+	}
+	if p.bi.GoVersion == "" {
+		return goversion.GoVersion{}, false
+	}
+	return goversion.Parse(p.bi.GoVersion)
+}
+
+// memoryGoVersion reads runtime.buildVersion from the inferior's memory.
+func (p *Process) memoryGoVersion() string {
+	if p.currentThread == nil {
+		return ""
+	}
+	scope, err := proc.ThreadScope(p.currentThread)
+	if err != nil {
+		return ""
+	}
+	v, err := scope.EvalVariable("runtime.buildVersion", proc.LoadConfig{MaxStringLen: 64})
+	if err != nil || v.Unreadable != nil || v.Kind != reflect.String {
+		return ""
+	}
+	return constant.StringVal(v.Value)
+}
+
+// remoteGoInfo returns the Go version and build ID of the executable,
+// reading it from the stub's host with vFile commands.
+func (p *Process) remoteGoInfo() (ver, buildID string) {
+	if p.execPath == "" || p.conn.conn == nil {
+		return "", ""
+	}
+	fd, err := p.conn.vFileOpen(p.execPath)
+	if err != nil {
+		return "", ""
+	}
+	defer p.conn.vFileClose(fd)
+	exe, err := elf.NewFile(&remoteFile{conn: &p.conn, fd: fd})
+	if err != nil {
+		return "", ""
+	}
+	return proc.ElfGoVersion(exe), proc.ElfBuildID(exe)
+}
+
+// remoteFile is an io.ReaderAt for a file opened on the stub's host.
+type remoteFile struct {
+	conn *gdbConn
+	fd   int
+}
+
+func (f *remoteFile) ReadAt(data []byte, off int64) (int, error) {
+	n := 0
+	for n < len(data) {
+		m, err := f.conn.vFilePread(f.fd, data[n:], off+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// readRemoteFile reads the whole file at path on the stub's host with vFile
+// commands. The file is read until the end even if its size is unknown,
+// like for the files in /proc.
+func (p *Process) readRemoteFile(path string) ([]byte, error) {
+	fd, err := p.conn.vFileOpen(path)
+	if err != nil {
+		return nil, err
+	}
+	defer p.conn.vFileClose(fd)
+	f := &remoteFile{conn: &p.conn, fd: fd}
+	var data []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := f.ReadAt(buf, int64(len(data)))
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// setUnrecoveredPanicBreakpoint sets the breakpoint used to stop the
+// inferior when a panic isn't recovered.
+func (p *Process) setUnrecoveredPanicBreakpoint() error {
+	fnnames := unrecoveredPanicFunctions
+	if ver, ok := p.goVersion(); ok {
+		fnnames = append([]string{unrecoveredPanicFunction(ver)}, fnnames...)
+	}
+	var err error
+	for _, fnname := range fnnames {
+		var panicpc uint64
+		panicpc, err = proc.FindFunctionLocation(p, fnname, true, 0)
+		if err != nil {
+			continue
+		}
+		var bp *proc.Breakpoint
+		bp, err = p.breakpoints.SetWithID(-1, panicpc, p.writeBreakpoint)
+		if err != nil {
+			return err
+		}
+		if logflags.GdbWire() {
+			fmt.Fprintf(os.Stderr, "unrecovered-panic breakpoint set on %s\n", fnname)
+		}
+		bp.Name = proc.UnrecoveredPanic
+		bp.Variables = []string{"runtime.curg._panic.arg"}
+		return nil
+	}
+	return err
+}
+
+// ToggleUnrecoveredPanicBreakpoint enables or disables the breakpoint used
+// to stop the inferior when a panic isn't recovered. If called before
+// Connect it determines whether the breakpoint will be set at all.
+func (p *Process) ToggleUnrecoveredPanicBreakpoint(enabled bool) error {
+	p.noPanicBreakpoint = !enabled
+	if p.conn.conn == nil {
+		return nil
+	}
+	for _, bp := range p.breakpoints.M {
+		if bp.Name == proc.UnrecoveredPanic {
+			if enabled {
+				return nil
+			}
+			_, err := p.ClearBreakpoint(bp.Addr)
+			return err
+		}
+	}
+	if !enabled {
+		return nil
+	}
+	if p.exited {
+		return &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	return p.setUnrecoveredPanicBreakpoint()
+}
+
 // unusedPort returns an unused tcp port
 // This is a hack and subject to a race condition with other running
 // programs, but most (all?) OS will cycle through all ephemeral ports
@@ -415,12 +1067,10 @@ func LLDBLaunch(cmd []string, wd string) (*Process, error) {
 			return nil, &ErrBackendUnavailable{}
 		}
 		port = unusedPort()
-		args := make([]string, 0, len(cmd)+3)
-		args = append(args, "gdbserver")
-		args = append(args, port, "--")
-		args = append(args, cmd...)
-
-		proc = exec.Command("lldb-server", args...)
+		// The command line of the inferior is sent with the 'A' packet during
+		// the handshake instead of being passed to lldb-server, which could
+		// mangle it.
+		proc = exec.Command("lldb-server", "gdbserver", port)
 	}
 
 	if logflags.LLDBServerOutput() || logflags.GdbWire() {
@@ -440,6 +1090,10 @@ func LLDBLaunch(cmd []string, wd string) (*Process, error) {
 
 	p := New(proc.Process)
 	p.conn.isDebugserver = isDebugserver
+	if !isDebugserver {
+		p.conn.launchArgs = cmd
+		p.conn.launchWd = wd
+	}
 
 	if listener != nil {
 		err = p.Listen(listener, cmd[0], 0)
@@ -481,15 +1135,28 @@ func LLDBAttach(pid int, path string) (*Process, error) {
 		proc = exec.Command("lldb-server", "gdbserver", "--attach", strconv.Itoa(pid), port)
 	}
 
+	// The error output of the stub is kept to explain why the attach failed,
+	// see attachError.
+	stderr, stderrw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
 	proc.Stdout = os.Stdout
-	proc.Stderr = os.Stderr
+	proc.Stderr = stderrw
 
 	proc.SysProcAttr = backgroundSysProcAttr()
 
-	err := proc.Start()
+	err = proc.Start()
+	stderrw.Close()
 	if err != nil {
+		stderr.Close()
 		return nil, err
 	}
+	output := &stubOutput{}
+	go func() {
+		io.Copy(io.MultiWriter(os.Stderr, output), stderr)
+		stderr.Close()
+	}()
 
 	p := New(proc.Process)
 	p.conn.isDebugserver = isDebugserver
@@ -500,27 +1167,244 @@ func LLDBAttach(pid int, path string) (*Process, error) {
 		err = p.Dial(port, path, pid)
 	}
 	if err != nil {
-		return nil, err
+		return nil, attachError(pid, proc.Process.Pid, err, output.String())
 	}
 	return p, nil
 }
 
-// loadProcessInfo uses qProcessInfo to load the inferior's PID and
-// executable path. This command is not supported by all stubs and not all
-// stubs will report both the PID and executable path.
-func (p *Process) loadProcessInfo(pid int) (int, string, error) {
-	pi, err := p.conn.queryProcessInfo(pid)
+// alreadyTracedMessages are the messages printed or returned by stubs when
+// they fail to attach to a process that is already being debugged.
+var alreadyTracedMessages = []string{
+	"already being debugged", // debugserver
+	"already being traced",
+	"already traced",
+}
+
+// attachError returns an ErrAlreadyTraced error if the failed attempt to
+// attach to pid (err) was caused by another program tracing the process,
+// err otherwise. The process is considered traced if its TracerPid, on
+// linux, is neither zero nor the PID of our stub, or if the stub's error
+// reply or its output contains one of alreadyTracedMessages.
+func attachError(pid, stubPid int, err error, output string) error {
+	if tracer := tracerPid(pid); tracer != 0 && tracer != stubPid {
+		return &ErrAlreadyTraced{Pid: pid, TracerPid: tracer}
+	}
+	msg := output
+	if gdberr, ok := err.(*GdbProtocolError); ok {
+		// debugserver error replies have the format Exx;<hex encoded message>
+		if idx := strings.Index(gdberr.code, ";"); idx >= 0 {
+			if buf, decerr := hex.DecodeString(gdberr.code[idx+1:]); decerr == nil {
+				msg += "\n" + string(buf)
+			}
+		}
+	}
+	msg = strings.ToLower(msg)
+	for _, s := range alreadyTracedMessages {
+		if strings.Contains(msg, s) {
+			return &ErrAlreadyTraced{Pid: pid}
+		}
+	}
+	return err
+}
+
+// tracerPid returns the PID of the program tracing pid, as reported by
+// /proc/<pid>/status, or zero if it isn't traced or it can't be determined.
+func tracerPid(pid int) int {
+	buf, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
 	if err != nil {
-		return 0, "", err
+		return 0
 	}
-	if pid == 0 {
-		n, _ := strconv.ParseUint(pi["pid"], 16, 64)
-		pid = int(n)
+	for _, line := range strings.Split(string(buf), "\n") {
+		if strings.HasPrefix(line, "TracerPid:") {
+			n, _ := strconv.Atoi(strings.TrimSpace(line[len("TracerPid:"):]))
+			return n
+		}
 	}
-	return pid, pi["name"], nil
+	return 0
 }
 
-func (p *Process) BinInfo() *proc.BinaryInfo {
+// stubOutput keeps the last stubOutputSize bytes written by the stub to
+// its standard error.
+type stubOutput struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+const stubOutputSize = 4096
+
+func (w *stubOutput) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, data...)
+	if len(w.buf) > stubOutputSize {
+		w.buf = append(w.buf[:0], w.buf[len(w.buf)-stubOutputSize:]...)
+	}
+	return len(data), nil
+}
+
+func (w *stubOutput) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return string(w.buf)
+}
+
+// loadProcessInfo uses qProcessInfo to load the inferior's PID and
+// executable path. This command is not supported by all stubs and not all
+// stubs will report both the PID and executable path.
+func (p *Process) loadProcessInfo(pid int) (int, string, error) {
+	pi, err := p.conn.queryProcessInfo(pid)
+	if err != nil {
+		return 0, "", err
+	}
+	if pid == 0 {
+		n, _ := strconv.ParseUint(pi["pid"], 16, 64)
+		pid = int(n)
+	}
+	return pid, pi["name"], nil
+}
+
+// ErrProcessInfoUnavailable is returned by CommandLine and Environment
+// when neither the stub nor the local machine can tell us how the target
+// was started.
+var ErrProcessInfoUnavailable = errors.New("command line and environment of the target unavailable")
+
+// CommandLine returns the arguments the target was started with, argv[0]
+// included.
+// On linux they are read from /proc/<pid>/cmdline, with vFile commands or,
+// if the stub doesn't support them and runs on the local machine,
+// directly. On macOS they are read with the kern.procargs2 sysctl, only
+// if the stub runs on the local machine. Otherwise they are taken from the
+// 'args' field of qProcessInfoPID, reported by lldb-server but not by
+// debugserver.
+func (p *Process) CommandLine() ([]string, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	switch p.bi.GOOS {
+	case "linux":
+		if data, err := p.readProcFile("cmdline"); err == nil {
+			return splitNulTerminated(data), nil
+		}
+	case "darwin":
+		if args, _, err := p.localProcArgs(); err == nil {
+			return args, nil
+		}
+	}
+	pi, err := p.conn.queryProcessInfo(p.conn.pid)
+	if err != nil || pi["args"] == "" {
+		return nil, ErrProcessInfoUnavailable
+	}
+	return parseProcessInfoArgs(pi["args"])
+}
+
+// Environment returns the environment the target was started with, as a
+// list of "key=value" strings. Changes made by the target to its own
+// environment (i.e. with os.Setenv) are not visible.
+// The environment is read from /proc/<pid>/environ on linux and with the
+// kern.procargs2 sysctl on macOS, see CommandLine, no query returns it for
+// a remote macOS target or on other systems.
+func (p *Process) Environment() ([]string, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	switch p.bi.GOOS {
+	case "linux":
+		data, err := p.readProcFile("environ")
+		if err != nil {
+			return nil, ErrProcessInfoUnavailable
+		}
+		return splitNulTerminated(data), nil
+	case "darwin":
+		_, env, err := p.localProcArgs()
+		if err != nil {
+			return nil, ErrProcessInfoUnavailable
+		}
+		return env, nil
+	}
+	return nil, ErrProcessInfoUnavailable
+}
+
+// localProcArgs returns the arguments and environment of the target read
+// with the kern.procargs2 sysctl, if the stub runs on the local machine.
+func (p *Process) localProcArgs() (args, env []string, err error) {
+	if p.process == nil || p.stubTransport != nil {
+		return nil, nil, ErrProcessInfoUnavailable
+	}
+	data, err := sysctlProcArgs(p.conn.pid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseProcArgs(data)
+}
+
+// parseProcArgs parses the value of the kern.procargs2 sysctl: argc, as a
+// 32 bit integer, followed by the path of the executable, padding, the
+// arguments and the environment, all NUL terminated strings.
+func parseProcArgs(data []byte) (args, env []string, err error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("malformed process arguments")
+	}
+	argc := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	// skip the executable path and the padding after it
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[i:]
+	}
+	for len(data) > 0 && data[0] == 0 {
+		data = data[1:]
+	}
+	strs := splitNulTerminated(data)
+	if len(strs) < argc {
+		return nil, nil, fmt.Errorf("malformed process arguments")
+	}
+	args, env = strs[:argc], strs[argc:]
+	for i := range env {
+		if env[i] == "" {
+			// the rest is padding or apple specific strings
+			env = env[:i]
+			break
+		}
+	}
+	return args, env, nil
+}
+
+// readProcFile reads the file name of the target's directory in /proc, on
+// the stub's host using vFile commands or, if they fail and the stub runs
+// on the local machine, directly.
+func (p *Process) readProcFile(name string) ([]byte, error) {
+	path := fmt.Sprintf("/proc/%d/%s", p.conn.pid, name)
+	data, err := p.readRemoteFile(path)
+	if err != nil && p.process != nil && p.stubTransport == nil {
+		data, err = ioutil.ReadFile(path)
+	}
+	return data, err
+}
+
+// splitNulTerminated splits data, a list of NUL terminated strings like the
+// contents of /proc/<pid>/cmdline, into its strings.
+func splitNulTerminated(data []byte) []string {
+	if len(data) == 0 {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
+
+// parseProcessInfoArgs parses the 'args' field of qProcessInfoPID: each
+// argument hex encoded, separated by '-'.
+func parseProcessInfoArgs(value string) ([]string, error) {
+	fields := strings.Split(value, "-")
+	args := make([]string, len(fields))
+	for i, field := range fields {
+		arg, err := hex.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("malformed process arguments %q: %v", value, err)
+		}
+		args[i] = string(arg)
+	}
+	return args, nil
+}
+
+func (p *Process) BinInfo() *proc.BinaryInfo {
 	return &p.bi
 }
 
@@ -536,15 +1420,59 @@ func (p *Process) Exited() bool {
 	return p.exited
 }
 
+// ExitStatus returns the exit status of the inferior. If the inferior was
+// terminated by a signal signaled will be true and status will be the
+// number of the signal, otherwise status is the exit code.
+// If the inferior hasn't exited yet exited will be false.
+func (p *Process) ExitStatus() (status int, signaled bool, exited bool) {
+	if !p.exited {
+		return 0, false, false
+	}
+	return p.conn.exitStatus, p.conn.exitSignaled, true
+}
+
 func (p *Process) ResumeNotify(ch chan<- struct{}) {
 	p.conn.resumeChan = ch
 }
 
 func (p *Process) FindThread(threadID int) (proc.Thread, bool) {
 	thread, ok := p.threads[threadID]
+	if ok && p.checkThreadsAlive && p.checkThreadAlive(thread) != nil {
+		return nil, false
+	}
 	return thread, ok
 }
 
+// SetCheckThreadsAlive enables or disables asking the stub whether a
+// thread is still alive, with the 'T' command, every time FindThread
+// returns it. Threads that exited are removed from the thread list.
+// SwitchThread always does this check.
+func (p *Process) SetCheckThreadsAlive(enabled bool) {
+	p.checkThreadsAlive = enabled
+}
+
+// checkThreadAlive asks the stub whether thread is still alive, if it
+// isn't the thread is removed and an error is returned. Stubs that do not
+// support the 'T' command consider all threads alive.
+func (p *Process) checkThreadAlive(thread *Thread) error {
+	if p.conn.threadAliveUnsupported || p.exited {
+		return nil
+	}
+	alive, err := p.conn.threadAlive(thread.strID)
+	if err != nil {
+		if isProtocolErrorUnsupported(err) {
+			p.conn.threadAliveUnsupported = true
+			return nil
+		}
+		return err
+	}
+	if !alive {
+		p.removeThread(thread.ID)
+		return fmt.Errorf("thread %d exited", thread.ID)
+	}
+	return nil
+}
+
 func (p *Process) ThreadList() []proc.Thread {
 	r := make([]proc.Thread, 0, len(p.threads))
 	for _, thread := range p.threads {
@@ -553,10 +1481,245 @@ func (p *Process) ThreadList() []proc.Thread {
 	return r
 }
 
+// ThreadsAtBreakpoint returns the list of threads that were stopped by an
+// active breakpoint during the last stop, sorted by thread ID.
+// When multiple threads hit a breakpoint simultaneously ContinueOnce will
+// only return the thread reported by the stub, this method can be used to
+// retrieve all of them.
+func (p *Process) ThreadsAtBreakpoint() []proc.Thread {
+	r := []proc.Thread{}
+	for _, thread := range p.threads {
+		if thread.CurrentBreakpoint.Breakpoint != nil && thread.CurrentBreakpoint.Active {
+			r = append(r, thread)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ThreadID() < r[j].ThreadID() })
+	return r
+}
+
+// PendingStop is a stop event that the stub reported while the target was
+// supposed to be stopped.
+type PendingStop struct {
+	ThreadID int
+	Signal   int
+	Reason   string // stop reason reported by the stub (i.e. "breakpoint"), can be empty
+}
+
+// DrainPendingStops returns the stop events that the stub reported while
+// the target was supposed to be stopped (delayed events, stray stop
+// replies and stop notifications) and forgets them, so that the next
+// continue resumes the target instead of returning them.
+// Threads that the events report stopped at a breakpoint have their
+// current breakpoint set, so that the state of the process is reconciled
+// with the stub's before the next continue. This is mostly useful with
+// stubs like gdbserver, which can hold breakpoint events and report them
+// on a later packet.
+func (p *Process) DrainPendingStops() ([]PendingStop, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	r := make([]PendingStop, 0, len(p.conn.pendingStops))
+	for len(p.conn.pendingStops) > 0 {
+		sp := p.conn.pendingStops[0]
+		p.conn.pendingStops = p.conn.pendingStops[1:]
+		tid, _ := parseThreadID(sp.threadID)
+		r = append(r, PendingStop{ThreadID: tid, Signal: int(sp.sig), Reason: sp.reason})
+		th, ok := p.threads[tid]
+		if !ok || !sp.atBreakpoint() || th.CurrentBreakpoint.Breakpoint != nil {
+			continue
+		}
+		th.setbp = true
+		if err := th.SetCurrentBreakpoint(); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// CurrentThread returns the current thread, or nil if the process doesn't
+// have any threads (i.e. because it is exiting).
 func (p *Process) CurrentThread() proc.Thread {
+	if p.currentThread == nil {
+		// avoid returning a non-nil interface containing a nil pointer
+		return nil
+	}
 	return p.currentThread
 }
 
+// loadSelectedGoroutine sets the selected goroutine to the goroutine
+// running on the current thread.
+func (p *Process) loadSelectedGoroutine() {
+	p.selectedGoroutine = nil
+	if p.currentThread != nil {
+		p.selectedGoroutine, _ = proc.GetG(p.currentThread)
+	}
+}
+
+// GoroutineStats is a summary of the state of all goroutines, see
+// Process.GoroutineStats.
+type GoroutineStats struct {
+	Total        int            // number of goroutines in runtime.allgs, including dead ones
+	ByStatus     map[string]int // number of goroutines in each status, see goroutineStatusName
+	ByWaitReason map[string]int // number of waiting goroutines for each wait reason
+}
+
+// Live returns the number of goroutines that are neither dead nor idle
+// (just allocated).
+func (stats *GoroutineStats) Live() int {
+	return stats.Total - stats.ByStatus["dead"] - stats.ByStatus["idle"]
+}
+
+// GoroutineStats counts goroutines by status and, for waiting goroutines,
+// by wait reason.
+// Unlike proc.GoroutinesInfo only the status and wait reason of each
+// goroutine are read, and the reads of all goroutines are pipelined (see
+// gdbConn.readMemoryBatch), which makes it fast even with thousands of
+// goroutines. The result is cached until the target is resumed.
+func (p *Process) GoroutineStats() (*GoroutineStats, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if p.goroutineStats != nil {
+		return p.goroutineStats, nil
+	}
+	if p.currentThread == nil {
+		return nil, errors.New("no current thread")
+	}
+	scope, err := proc.ThreadScope(p.currentThread)
+	if err != nil {
+		return nil, err
+	}
+	allgs, err := scope.EvalVariable("runtime.allgs", proc.LoadConfig{})
+	if err != nil {
+		return nil, err
+	}
+	if allgs.Unreadable != nil {
+		return nil, allgs.Unreadable
+	}
+	slicetyp, ok := resolveTypedef(allgs.RealType).(*godwarf.SliceType)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %s for runtime.allgs", allgs.RealType)
+	}
+	ptrtyp, ok := resolveTypedef(slicetyp.ElemType).(*godwarf.PtrType)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %s for runtime.allgs", allgs.RealType)
+	}
+	statusf, err := structField(ptrtyp.Type, "atomicstatus")
+	if err != nil {
+		return nil, err
+	}
+	// Only the part of runtime.g between atomicstatus and waitreason is read.
+	lo, hi := statusf.ByteOffset, statusf.ByteOffset+statusf.Type.Size()
+	waitf, _ := structField(ptrtyp.Type, "waitreason")
+	if waitf != nil {
+		if waitf.ByteOffset < lo {
+			lo = waitf.ByteOffset
+		}
+		if end := waitf.ByteOffset + waitf.Type.Size(); end > hi {
+			hi = end
+		}
+	}
+
+	order, ptrsz := p.order(), p.bi.Arch.PtrSize()
+	ptrs := make([]byte, allgs.Len*int64(ptrsz))
+	if err := p.readMemory(ptrs, allgs.Base); err != nil {
+		return nil, err
+	}
+	var bufs [][]byte
+	var addrs []uint64
+	for i := 0; i < len(ptrs); i += ptrsz {
+		if gaddr := uintAt(order, ptrs[i:i+ptrsz]); gaddr != 0 {
+			bufs = append(bufs, make([]byte, hi-lo))
+			addrs = append(addrs, gaddr+uint64(lo))
+		}
+	}
+
+	stats := &GoroutineStats{ByStatus: make(map[string]int), ByWaitReason: make(map[string]int)}
+	reasonStrings := make(map[uint64]string) // wait reasons before Go 1.11, by address
+	for i, err := range p.conn.readMemoryBatch(bufs, addrs) {
+		if err != nil {
+			return nil, fmt.Errorf("could not read goroutine at %#x: %v", addrs[i]-uint64(lo), err)
+		}
+		buf := bufs[i]
+		status := uintAt(order, buf[statusf.ByteOffset-lo:][:statusf.Type.Size()])
+		stats.Total++
+		stats.ByStatus[goroutineStatusName(status)]++
+		if waitf == nil || status&^gscanStatus != proc.Gwaiting {
+			continue
+		}
+		field := buf[waitf.ByteOffset-lo:][:waitf.Type.Size()]
+		var reason string
+		if _, isstring := resolveTypedef(waitf.Type).(*godwarf.StringType); isstring {
+			// before Go 1.11 g.waitreason is a string
+			ptr, strlen := uintAt(order, field[:ptrsz]), uintAt(order, field[ptrsz:2*ptrsz])
+			var cached bool
+			if reason, cached = reasonStrings[ptr]; !cached {
+				if err := checkStringLen(addrs[i]-uint64(lo)+uint64(waitf.ByteOffset), strlen); err != nil {
+					return nil, err
+				}
+				str := make([]byte, strlen)
+				if err := p.readMemory(str, uintptr(ptr)); err != nil {
+					return nil, err
+				}
+				reason = string(str)
+				reasonStrings[ptr] = reason
+			}
+		} else {
+			reason = p.bi.WaitReasonString(p.currentThread, int64(uintAt(order, field)))
+		}
+		stats.ByWaitReason[reason]++
+	}
+	p.goroutineStats = stats
+	return stats, nil
+}
+
+// gscanStatus is the bit set in g.atomicstatus while the GC scans the stack
+// of the goroutine, _Gscan in src/runtime/runtime2.go.
+const gscanStatus = 0x1000
+
+// goroutineStatusName returns the name of the goroutine status status.
+func goroutineStatusName(status uint64) string {
+	switch status &^ gscanStatus {
+	case proc.Gidle:
+		return "idle"
+	case proc.Grunnable:
+		return "runnable"
+	case proc.Grunning:
+		return "running"
+	case proc.Gsyscall:
+		return "syscall"
+	case proc.Gwaiting:
+		return "waiting"
+	case proc.GmoribundUnused:
+		return "moribund"
+	case proc.Gdead:
+		return "dead"
+	case proc.Genqueue:
+		return "enqueue"
+	case proc.Gcopystack:
+		return "copystack"
+	case 9:
+		// _Gpreempted, since Go 1.14
+		return "preempted"
+	default:
+		return fmt.Sprintf("status %d", status&^gscanStatus)
+	}
+}
+
+// uintAt returns the unsigned integer stored, in byte order order, in buf.
+func uintAt(order binary.ByteOrder, buf []byte) uint64 {
+	switch len(buf) {
+	case 1:
+		return uint64(buf[0])
+	case 2:
+		return uint64(order.Uint16(buf))
+	case 4:
+		return uint64(order.Uint32(buf))
+	default:
+		return order.Uint64(buf)
+	}
+}
+
 func (p *Process) AllGCache() *[]*proc.G {
 	return &p.allGCache
 }
@@ -568,99 +1731,579 @@ func (p *Process) SelectedGoroutine() *proc.G {
 const (
 	interruptSignal  = 0x2
 	breakpointSignal = 0x5
-	childSignal      = 0x11
+	darwinStopSignal = 0x11 // SIGCHLD on linux
 	stopSignal       = 0x13
 )
 
-func (p *Process) ContinueOnce() (proc.Thread, error) {
-	if p.exited {
-		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+// stepOverBreakpoints steps all threads stopped at a breakpoint over it.
+// If the stub supports vCont with per-thread step actions all threads are
+// stepped with a single vCont packet, removing each breakpoint only once,
+// threads that did not complete their step (because the stub reported the
+// stop of another thread first) are then stepped one at a time.
+// The packet continues all the other threads, if one of them stops before
+// the steps complete its stop is queued and returned by the next resume.
+func (p *Process) stepOverBreakpoints() error {
+	var threads []*Thread
+	for _, thread := range p.threads {
+		if thread.CurrentBreakpoint.Breakpoint != nil {
+			threads = append(threads, thread)
+		}
+	}
+	if len(threads) > 1 && p.conn.vContSupports('s') {
+		sort.Slice(threads, func(i, j int) bool { return threads[i].ID < threads[j].ID })
+		var err error
+		threads, err = p.stepThreadsTogether(threads)
+		if err != nil {
+			return err
+		}
+	}
+	for _, thread := range threads {
+		if err := thread.stepInstruction(&threadUpdater{p: p}); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if p.conn.direction == proc.Forward {
-		// step threads stopped at any breakpoint over their breakpoint
-		for _, thread := range p.threads {
-			if thread.CurrentBreakpoint.Breakpoint != nil {
-				if err := thread.stepInstruction(&threadUpdater{p: p}); err != nil {
-					return nil, err
-				}
-			}
+// stepThreadsTogether steps all threads with a single vCont packet, which
+// also continues the other threads, and returns the threads that didn't
+// move.
+func (p *Process) stepThreadsTogether(threads []*Thread) ([]*Thread, error) {
+	pcs := make([]uint64, len(threads))
+	removed := make(map[uint64]bool)
+	defer func() {
+		for addr := range removed {
+			p.installBreakpoint(addr)
+		}
+	}()
+	ids := make([]string, len(threads))
+	for i, thread := range threads {
+		if err := thread.loadRegisters(); err != nil {
+			return nil, err
+		}
+		pcs[i] = thread.regs.PC()
+		ids[i] = thread.strID
+		if removed[pcs[i]] || !p.installedBreakpointAt(pcs[i]) || p.breakpointsSuspended {
+			continue
+		}
+		if err := p.conn.clearBreakpoint(pcs[i]); err != nil {
+			return nil, err
+		}
+		removed[pcs[i]] = true
+	}
+	sp, err := p.conn.stepThreads(ids, &threadUpdater{p: p})
+	if err != nil {
+		if err == threadBlockedError {
+			// let the serial steps deal with the blocked thread
+			return threads, nil
+		}
+		return nil, err
+	}
+	stepped := false
+	for _, id := range ids {
+		if sp.threadID == id {
+			stepped = true
+			break
+		}
+	}
+	if !stepped {
+		// one of the continued threads stopped first, report its stop when
+		// the target is resumed
+		p.conn.pendingStops = append(p.conn.pendingStops, sp)
+	}
+	var r []*Thread
+	for i, thread := range threads {
+		if err := thread.readSomeRegisters(regnamePC); err != nil {
+			return nil, err
+		}
+		if thread.regs.PC() == pcs[i] {
+			r = append(r, thread)
 		}
 	}
+	return r, nil
+}
 
-	p.allGCache = nil
-	for _, th := range p.threads {
-		th.clearBreakpointState()
+// isInterruptSignal returns true if sig is one of the signals used by the
+// stub to report a stop caused by ctrl-c. Only debugserver uses 0x11, on
+// lldb-server/linux it's SIGCHLD.
+func (conn *gdbConn) isInterruptSignal(sig uint8) bool {
+	if conn.isDebugserver {
+		return sig == interruptSignal || sig == darwinStopSignal
 	}
+	return sig == interruptSignal || sig == stopSignal
+}
 
-	p.setCtrlC(false)
+// SignalAction is what ContinueOnce does when the inferior stops because
+// it received a signal.
+type SignalAction uint8
 
-	// resume all threads
-	var threadID string
-	var sig uint8 = 0
-	var tu = threadUpdater{p: p}
-	var err error
-continueLoop:
-	for {
-		tu.Reset()
-		threadID, sig, err = p.conn.resume(sig, &tu)
-		if err != nil {
-			if _, exited := err.(proc.ProcessExitedError); exited {
-				p.exited = true
-			}
-			return nil, err
-		}
+const (
+	// SignalStop stops the inferior, the signal is not delivered.
+	SignalStop SignalAction = iota
+	// SignalPass delivers the signal to the inferior and resumes it.
+	SignalPass
+	// SignalPassAndStop stops the inferior, the signal is delivered when the
+	// inferior is resumed.
+	SignalPassAndStop
+)
 
-		// 0x5 is always a breakpoint, a manual stop either manifests as 0x13
-		// (lldb), 0x11 (debugserver) or 0x2 (gdbserver).
-		// Since 0x2 could also be produced by the user
-		// pressing ^C (in which case it should be passed to the inferior) we need
-		// the ctrlC flag to know that we are the originators.
-		switch sig {
-		case interruptSignal: // interrupt
-			if p.getCtrlC() {
-				break continueLoop
-			}
-		case breakpointSignal: // breakpoint
-			break continueLoop
-		case childSignal: // stop on debugserver but SIGCHLD on lldb-server/linux
-			if p.conn.isDebugserver {
-				break continueLoop
-			}
-		case stopSignal: // stop
-			break continueLoop
-
-		// The following are fake BSD-style signals sent by debugserver
-		// Unfortunately debugserver can not convert them into signals for the
-		// process so we must stop here.
-		case 0x91, 0x92, 0x93, 0x94, 0x95, 0x96: /* TARGET_EXC_BAD_ACCESS */
-			break continueLoop
-		default:
-			// any other signal is always propagated to inferior
+// SetSignalPolicy sets the function used by ContinueOnce to decide what to
+// do when the inferior receives a signal, sig is the signal number as
+// reported by the stub. Breakpoints and the interrupts sent by RequestManualStop
+// always stop the inferior and are not subject to the policy.
+// Signals listed in PassSignals are delivered by the stub without stopping
+// and are never seen by the policy.
+// Passing nil restores the default policy.
+func (p *Process) SetSignalPolicy(policy func(sig uint8) SignalAction) {
+	p.signalPolicy = policy
+}
+
+// defaultSignalPolicy stops on the signals that the stubs use to report a
+// manual stop and on the exceptions reported by debugserver, all other
+// signals are passed to the inferior.
+func (p *Process) defaultSignalPolicy(sig uint8) SignalAction {
+	switch sig {
+	case darwinStopSignal: // stop on debugserver but SIGCHLD on lldb-server/linux
+		if p.conn.isDebugserver {
+			return SignalStop
 		}
+	case stopSignal: // stop
+		return SignalStop
+
+	// The following are fake BSD-style signals sent by debugserver
+	// Unfortunately debugserver can not convert them into signals for the
+	// process so we must stop here.
+	case 0x91, 0x92, 0x93, 0x94, 0x95, 0x96: /* TARGET_EXC_BAD_ACCESS */
+		return SignalStop
 	}
+	// any other signal is propagated to inferior
+	return SignalPass
+}
 
-	if err := p.updateThreadList(&tu); err != nil {
-		return nil, err
+// threadSignal is a signal that must be delivered to a specific thread.
+type threadSignal struct {
+	threadID string
+	sig      uint8
+}
+
+// ContinueThreadWithSignal resumes the target, like ContinueOnce, delivering
+// signal sig to thread tid only (vCont;Csig:tid;c), all other threads are
+// resumed normally.
+// The signal is delivered as if it had been sent with tgkill to that
+// thread: a handler installed for it runs on that thread, if the thread
+// is blocking the signal it stays pending for the thread and is not
+// delivered to any other thread of the process. The signal replaces any
+// signal the thread was stopped by, which is not delivered, and it is not
+// reported as a stop, the target stops again for the usual reasons (a
+// breakpoint, a signal, a manual stop).
+// An error is returned if the stub can only deliver signals to the whole
+// process, when executing backwards and if a signal held by
+// SignalPassAndStop is waiting to be delivered, since delivering both at
+// once isn't possible.
+func (p *Process) ContinueThreadWithSignal(tid int, sig uint8) (proc.Thread, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	th, ok := p.threads[tid]
+	if !ok {
+		return nil, fmt.Errorf("unknown thread %d", tid)
 	}
+	if p.conn.noVCont || !p.conn.vContSupports('C') {
+		return nil, errors.New("the stub does not support delivering signals to a single thread")
+	}
+	if p.conn.direction != proc.Forward {
+		return nil, errors.New("can not deliver a signal while executing backwards")
+	}
+	if p.pendingSignal != 0 {
+		return nil, fmt.Errorf("signal %#x is waiting to be delivered to the target", p.pendingSignal)
+	}
+	p.threadSignal = &threadSignal{threadID: th.strID, sig: sig}
+	defer func() { p.threadSignal = nil }()
+	return p.ContinueOnce()
+}
 
-	if err := p.setCurrentBreakpoints(); err != nil {
+func (p *Process) ContinueOnce() (proc.Thread, error) {
+	if err := p.StartContinue(); err != nil {
 		return nil, err
 	}
+	th, _, err := p.PollStop(-1)
+	return th, err
+}
 
-	for _, thread := range p.threads {
-		if thread.strID == threadID {
-			var err error = nil
-			switch sig {
-			case 0x91:
-				err = errors.New("bad access")
-			case 0x92:
-				err = errors.New("bad instruction")
-			case 0x93:
-				err = errors.New("arithmetic exception")
-			case 0x94:
-				err = errors.New("emulation exception")
-			case 0x95:
+// continueState is the state of a continue started by StartContinue.
+type continueState struct {
+	tu threadUpdater
+
+	// thread range stepped by the stub, see nextRange
+	rangeThread          *Thread
+	rangeStart, rangeEnd uint64
+	rangeStopThread      *Thread // the range stepping thread stopped at a breakpoint
+
+	singleThread     bool          // the target had a single thread, not stopped at a breakpoint
+	sig              uint8         // signal to deliver on the next resume
+	threadSig        *threadSignal // signal to deliver to a single thread on the next resume
+	interruptPending bool          // an interrupt sent during the previous continue could still be reported
+	interruptExpire  time.Time     // stops received after this time are never the answer to that interrupt
+
+	queued *stopPacket // stop received while the target was stopped, see gdbConn.startResume
+
+	manualStops uint64 // value of Process.manualStops when the continue started
+}
+
+// StartContinue resumes the target like ContinueOnce but returns as soon
+// as the resume command is sent, PollStop must then be called to find out
+// when the target stops. This allows integrating the debugger in an event
+// loop without blocking a goroutine while the target is running.
+// Until PollStop reports that the target stopped the only other method
+// that can be called is RequestManualStop.
+func (p *Process) StartContinue() error {
+	if p.exited {
+		return &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if p.cont != nil {
+		return errors.New("the target is already running")
+	}
+	cs := &continueState{tu: threadUpdater{p: p}}
+	p.conn.manualStopMutex.Lock()
+	cs.manualStops = p.manualStops
+	p.conn.manualStopMutex.Unlock()
+
+	// must be computed before stepping threads over their breakpoints, which
+	// doesn't update their registers.
+	cs.rangeThread, cs.rangeStart, cs.rangeEnd = p.nextRange()
+
+	// With a single thread, not stopped at a breakpoint, there is nothing to
+	// step over and, if the thread is still the only one when the target
+	// stops, its stop reason is the one in the stop packet: we don't need to
+	// ask for it with qThreadStopInfo.
+	if th := p.onlyThread(); th != nil {
+		cs.singleThread = th.CurrentBreakpoint.Breakpoint == nil
+	}
+
+	if p.conn.direction == proc.Forward && !cs.singleThread {
+		// step threads stopped at any breakpoint over their breakpoint
+		if err := p.stepOverBreakpoints(); err != nil {
+			return err
+		}
+	}
+
+	p.allGCache = nil
+	p.goroutineStats = nil
+	for _, th := range p.threads {
+		th.clearBreakpointState()
+		th.stopKind, th.stopSig, th.stopReasons = StopNone, 0, 0
+		th.preempted = false
+		th.watchpoint = nil
+	}
+
+	p.setCtrlC(false)
+
+	// resume all threads, delivering the signal held by SignalPassAndStop
+	cs.sig = p.pendingSignal
+	p.pendingSignal = 0
+	cs.threadSig = p.threadSignal
+	p.threadSignal = nil
+	if p.interruptPending && p.interruptPendingGen == p.conn.stopGen {
+		cs.interruptPending = true
+		cs.interruptExpire = time.Now().Add(p.interruptPendingTimeout)
+	}
+	p.interruptPending = false
+	if err := p.startResume(cs); err != nil {
+		return err
+	}
+	p.cont = cs
+	return nil
+}
+
+// startResume sends the command that resumes the target, with the signal
+// and range stepping requested by cs.
+func (p *Process) startResume(cs *continueState) error {
+	cs.tu.Reset()
+	var err error
+	switch {
+	case cs.threadSig != nil:
+		// only for the first resume, the following ones deliver the
+		// signals the target stops with as usual.
+		p.conn.writeResumeThreadWithSignal(cs.threadSig.threadID, cs.threadSig.sig)
+		cs.threadSig = nil
+	case cs.rangeThread != nil && cs.sig == 0:
+		p.conn.writeResumeWithRange(cs.rangeThread.strID, cs.rangeStart, cs.rangeEnd)
+	default:
+		err = p.conn.writeResume(cs.sig)
+	}
+	if err != nil {
+		return err
+	}
+	sp, queued, err := p.conn.startResume()
+	if queued {
+		cs.queued = &sp
+	}
+	return err
+}
+
+// PollStop waits up to timeout for the target resumed by StartContinue to
+// stop and returns the thread that stopped, like ContinueOnce. If the
+// target is still running when timeout expires running is true and
+// PollStop must be called again later. A negative timeout waits until the
+// target stops.
+// Stops that don't concern the user (threads exiting, signals passed to
+// the target, etc.) are handled internally by resuming the target again.
+func (p *Process) PollStop(timeout time.Duration) (th proc.Thread, running bool, err error) {
+	cs := p.cont
+	if cs == nil {
+		return nil, false, errors.New("the target is not running")
+	}
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		var sp stopPacket
+		if cs.queued != nil {
+			sp, cs.queued = *cs.queued, nil
+		} else {
+			wait := time.Duration(-1)
+			if timeout >= 0 {
+				if wait = deadline.Sub(time.Now()); wait < 0 {
+					wait = 0
+				}
+			}
+			sp, running, err = p.conn.waitResume(wait, &cs.tu)
+			if running {
+				return nil, true, nil
+			}
+		}
+		var resume bool
+		resume, err = p.handleStop(cs, sp, err)
+		if err == nil && resume {
+			if err = p.startResume(cs); err == nil {
+				err = p.resendManualStop(cs)
+			}
+			if err == nil {
+				continue
+			}
+		}
+		p.cont = nil
+		if err != nil {
+			return nil, false, err
+		}
+		th, err = p.finishContinue(cs, sp)
+		if err == nil && !p.getCtrlC() && !p.watchpointCondition(th) {
+			if err = p.StartContinue(); err != nil {
+				return nil, false, err
+			}
+			cs = p.cont
+			continue
+		}
+		return th, false, err
+	}
+}
+
+// resendManualStop interrupts the target if RequestManualStop was called
+// while it was stopped between two of the resumes of the continue cs:
+// RequestManualStop only sends the interrupt when the target is running.
+func (p *Process) resendManualStop(cs *continueState) error {
+	p.conn.manualStopMutex.Lock()
+	if p.manualStops == cs.manualStops || p.ctrlC || !p.conn.running {
+		p.conn.manualStopMutex.Unlock()
+		return nil
+	}
+	p.ctrlC = true
+	p.conn.manualStopMutex.Unlock()
+	return p.conn.sendCtrlC()
+}
+
+// handleStop handles the stop sp, or the error err received instead of
+// it, and returns true if the target should be resumed because the user
+// doesn't need to know about the stop.
+func (p *Process) handleStop(cs *continueState, sp stopPacket, err error) (resume bool, _ error) {
+	if err != nil {
+		if exitErr, exited := err.(proc.ProcessExitedError); exited {
+			if exitErr.Pid != p.conn.pid {
+				// one of the other processes managed by the stub exited, or a
+				// process we never knew about, the selected process is still
+				// alive.
+				delete(p.inferiors, exitErr.Pid)
+				p.inferiorExits = append(p.inferiorExits, exitErr)
+				cs.sig = 0
+				return true, nil
+			}
+			p.exited = true
+		}
+		return false, err
+	}
+	threadID, sig := sp.threadID, sp.sig
+	cs.sig = sig
+
+	if pid, _, _ := parseMultiprocessThreadID(threadID); pid > 0 && pid != p.conn.pid {
+		// A thread of another process managed by the stub stopped, the
+		// selected process is only switched by SelectProcess.
+		p.addInferior(pid)
+		cs.sig = 0
+		if sp.threadExited {
+			return true, nil
+		}
+		return false, &ErrInferiorStopped{Pid: pid, ThreadID: threadID, Signal: sig}
+	}
+
+	if cs.interruptPending {
+		cs.interruptPending = false
+		if p.conn.isInterruptSignal(sig) && !p.getCtrlC() && time.Now().Before(cs.interruptExpire) {
+			// This is the answer to a ctrl-c sent during the previous
+			// resume, after the target had already stopped.
+			cs.sig = 0
+			return true, nil
+		}
+	}
+
+	if sp.threadExited {
+		// A thread exited, this isn't something the user needs to know
+		// about, remove it and resume.
+		if tid, err := parseThreadID(threadID); err == nil {
+			p.removeThread(tid)
+		}
+		cs.sig = 0
+		return true, nil
+	}
+
+	if sp.reasons.has(stopReasonThreadCreated) {
+		// A new thread was created, it will be added to the thread list by the
+		// next updateThreadList.
+		cs.sig = 0
+		return true, nil
+	}
+
+	if sp.reasons.has(stopReasonLibrary) {
+		// A shared library was loaded or unloaded, the stub stops the target
+		// only to tell us.
+		if err := p.libraryEvent(); err != nil {
+			return false, err
+		}
+		if sig == breakpointSignal {
+			cs.sig = 0
+			return true, nil
+		}
+	}
+
+	if cs.rangeThread != nil && threadID == cs.rangeThread.strID && sig == breakpointSignal {
+		// The range stepping thread left the range, if it didn't land on a
+		// breakpoint (because of a call or a jump) we just continue and let
+		// the breakpoints set by next deal with it.
+		thread := cs.rangeThread
+		cs.rangeThread = nil
+		if _, exists := p.threads[thread.ID]; exists {
+			if err := thread.readSomeRegisters(regnamePC); err != nil {
+				return false, err
+			}
+			if !p.installedBreakpointAt(thread.regs.PC()) {
+				cs.sig = 0
+				return true, nil
+			}
+			cs.rangeStopThread = thread
+		}
+	}
+
+	if sig != 0 && sig == preemptSignal(p.bi.GOOS, p.conn.gdbSignalNumbers()) {
+		// A thread interrupted by the preemption signal right before
+		// executing a breakpoint is treated as if it hit the breakpoint,
+		// the runtime will send the signal again if it still needs to.
+		hit, err := p.preemptedAtBreakpoint(threadID)
+		if err != nil || hit {
+			return false, err
+		}
+	}
+
+	// 0x5 is always a breakpoint, a manual stop either manifests as 0x13
+	// (lldb), 0x11 (debugserver) or 0x2 (gdbserver).
+	// Since 0x2 could also be produced by the user
+	// pressing ^C (in which case it should be passed to the inferior) we need
+	// the ctrlC flag to know that we are the originators.
+	if sig == breakpointSignal || (sig == interruptSignal && p.getCtrlC()) {
+		return false, nil
+	}
+
+	policy := p.signalPolicy
+	if policy == nil {
+		policy = p.defaultSignalPolicy
+	}
+	switch policy(sig) {
+	case SignalStop:
+		return false, nil
+	case SignalPassAndStop:
+		p.pendingSignal = sig
+		return false, nil
+	}
+	// the signal is delivered to the target when it's resumed
+	return true, nil
+}
+
+// finishContinue updates the state of the threads after the target
+// stopped with sp and returns the thread that stopped.
+func (p *Process) finishContinue(cs *continueState, sp stopPacket) (proc.Thread, error) {
+	threadID, sig := sp.threadID, sp.sig
+
+	if p.getCtrlC() && !p.conn.isInterruptSignal(sig) {
+		// The target stopped for some other reason before the interrupt
+		// reached it, the stub could still report it later.
+		p.interruptPending = true
+		p.interruptPendingGen = p.conn.stopGen
+	}
+
+	if err := p.queryThreadList(&cs.tu); err != nil {
+		return nil, err
+	}
+	if th := p.onlyThread(); cs.singleThread && th != nil && th.strID == threadID {
+		th.setStopInfo(sp)
+	} else if err := p.updateThreadStopInfo(); err != nil {
+		return nil, err
+	}
+	p.invalidateRegisters()
+
+	if len(p.threads) == 0 {
+		// All the threads are gone, the process is exiting but the stub didn't
+		// tell us yet.
+		p.exited = true
+		return nil, proc.ProcessExitedError{Pid: p.conn.pid, Status: p.conn.exitStatus}
+	}
+
+	if sig != 0 && sig == preemptSignal(p.bi.GOOS, p.conn.gdbSignalNumbers()) {
+		for _, thread := range p.threads {
+			if thread.strID == threadID {
+				thread.preempted = true
+			}
+		}
+	}
+
+	if cs.rangeStopThread != nil {
+		// the stub reports the end of a range step as a trace stop
+		cs.rangeStopThread.setbp = true
+	}
+
+	if err := p.setCurrentBreakpoints(); err != nil {
+		return nil, err
+	}
+
+	for _, thread := range p.threads {
+		if thread.CurrentBreakpoint.Breakpoint != nil {
+			thread.stopKind = StopBreakpoint
+		}
+	}
+
+	for _, thread := range p.threads {
+		if thread.strID == threadID {
+			thread.setStopReason(sp)
+			p.pruneWatchpoints()
+			var err error = nil
+			switch sig {
+			case 0x91:
+				err = errors.New("bad access")
+			case 0x92:
+				err = errors.New("bad instruction")
+			case 0x93:
+				err = errors.New("arithmetic exception")
+			case 0x94:
+				err = errors.New("emulation exception")
+			case 0x95:
 				err = errors.New("software exception")
 			case 0x96:
 				err = errors.New("breakpoint exception")
@@ -669,7 +2312,732 @@ continueLoop:
 		}
 	}
 
-	return nil, fmt.Errorf("could not find thread %s", threadID)
+	return nil, fmt.Errorf("could not find thread %s", threadID)
+}
+
+// onlyThread returns the thread of the process if it has exactly one
+// thread, nil otherwise.
+func (p *Process) onlyThread() *Thread {
+	if len(p.threads) != 1 {
+		return nil
+	}
+	for _, th := range p.threads {
+		return th
+	}
+	return nil
+}
+
+// nextRange returns the thread and the range of addresses that the next
+// call to ContinueOnce should range step, if the stub supports it.
+// Range stepping is used while executing a next (i.e. when internal
+// breakpoints are set): the thread running the selected goroutine is
+// stepped by the stub up to the next breakpoint in its function, which is
+// normally the start of the next line, saving the stub the work of
+// handling the breakpoints inside the function.
+func (p *Process) nextRange() (thread *Thread, start, end uint64) {
+	if p.conn.direction != proc.Forward || !p.conn.vContActions['r'] || p.breakpointsSuspended || !p.breakpoints.HasInternalBreakpoints() {
+		return nil, 0, 0
+	}
+	thread = p.currentThread
+	if p.selectedGoroutine != nil {
+		if p.selectedGoroutine.Thread == nil {
+			return nil, 0, 0
+		}
+		thread = p.selectedGoroutine.Thread.(*Thread)
+	}
+	if thread == nil || thread.loadRegisters() != nil {
+		return nil, 0, 0
+	}
+	start = thread.regs.PC()
+	_, _, fn := p.bi.PCToLine(start)
+	if fn == nil {
+		return nil, 0, 0
+	}
+	end = fn.End
+	for addr := range p.breakpoints.M {
+		if addr > start && addr < end {
+			end = addr
+		}
+	}
+	return thread, start, end
+}
+
+// ContinueWithoutBreakpoints is like ContinueOnce but all breakpoints,
+// including internal ones, are removed from the stub for the duration of
+// the continue, so that execution only stops because of a signal or a
+// manual stop request. Breakpoints are reinstalled once the target stops,
+// unless it exited.
+func (p *Process) ContinueWithoutBreakpoints() (proc.Thread, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if err := p.suspendBreakpoints(); err != nil {
+		return nil, err
+	}
+	trapthread, err := p.ContinueOnce()
+	if _, exited := err.(proc.ProcessExitedError); exited {
+		p.breakpointsSuspended = false
+		return nil, err
+	}
+	if err1 := p.restoreBreakpoints(); err == nil {
+		err = err1
+	}
+	return trapthread, err
+}
+
+// terminateTimeout is how long Terminate waits for the target to exit
+// before killing it.
+const terminateTimeout = 10 * time.Second
+
+// Terminate asks the target to exit by delivering signal sig to it, for
+// example SIGTERM, and resumes it until it exits on its own, so that its
+// signal handlers and deferred functions can run. Unlike Detach(true),
+// which kills the target immediately with a 'k' packet, this gives the
+// program a chance to shut down gracefully.
+// The signal is delivered to the current thread, or to the process if there
+// is no current thread. Breakpoints are removed from the stub while the
+// target shuts down and any other stop (a signal, a watchpoint) is ignored
+// by resuming the target again. If the target
+// hasn't exited after terminateTimeout, because it ignores the signal or
+// takes too long to exit, it is stopped and killed and killed is true.
+// The error returned when the target exits is a proc.ProcessExitedError,
+// as for Continue.
+func (p *Process) Terminate(sig uint8) (killed bool, err error) {
+	return p.terminate(sig, terminateTimeout)
+}
+
+func (p *Process) terminate(sig uint8, timeout time.Duration) (killed bool, err error) {
+	if p.exited {
+		return false, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if p.conn.direction != proc.Forward {
+		return false, errors.New("can not deliver a signal while executing backwards")
+	}
+	if p.pendingSignal != 0 {
+		return false, fmt.Errorf("signal %#x is waiting to be delivered to the target", p.pendingSignal)
+	}
+	if !p.breakpointsSuspended {
+		if err := p.suspendBreakpoints(); err != nil {
+			return false, err
+		}
+	}
+	if p.conn.noVCont || !p.conn.vContSupports('C') || p.currentThread == nil {
+		// without vCont the signal is delivered to the current thread anyway
+		p.pendingSignal = sig
+	} else {
+		p.threadSignal = &threadSignal{threadID: p.currentThread.strID, sig: sig}
+	}
+
+	deadline := time.Now().Add(timeout)
+	err = p.StartContinue()
+	for err == nil {
+		wait := deadline.Sub(time.Now())
+		if wait < 0 {
+			wait = 0
+		}
+		var running bool
+		_, running, err = p.PollStop(wait)
+		if running {
+			return true, p.killRunning()
+		}
+		if err == nil {
+			err = p.StartContinue()
+		}
+	}
+	p.pendingSignal = 0
+	p.threadSignal = nil
+	if _, exited := err.(proc.ProcessExitedError); exited {
+		p.breakpointsSuspended = false
+		return false, err
+	}
+	p.restoreBreakpoints()
+	return false, err
+}
+
+// killRunning stops the target resumed by StartContinue and kills it.
+func (p *Process) killRunning() error {
+	if err := p.RequestManualStop(); err != nil {
+		return err
+	}
+	_, _, err := p.PollStop(-1)
+	p.CheckAndClearManualStopRequest()
+	if err == nil {
+		if err = p.conn.kill(); err == nil {
+			err = proc.ProcessExitedError{Pid: p.conn.pid}
+		}
+	}
+	if _, exited := err.(proc.ProcessExitedError); !exited {
+		return err
+	}
+	p.exited = true
+	p.breakpointsSuspended = false
+	return err
+}
+
+// RunToFunction continues the target until a goroutine reaches the first
+// line of function name, using a temporary breakpoint that is removed once
+// Continue returns. The target can stop before reaching the function, for
+// example at a user breakpoint, in which case the temporary breakpoint is
+// removed all the same.
+// It can not be used while a next or step is in progress.
+func (p *Process) RunToFunction(name string) error {
+	if p.exited {
+		return &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if p.breakpoints.HasInternalBreakpoints() {
+		return fmt.Errorf("next while nexting")
+	}
+	addr, err := proc.FindFunctionLocation(p, name, true, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := p.SetBreakpoint(addr, proc.NextBreakpoint, nil); err != nil {
+		return err
+	}
+	err = proc.Continue(p)
+	if !p.exited {
+		if err1 := p.ClearInternalBreakpoints(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// StepOverBreakpointAndContinue steps the current thread past the
+// breakpoint it is stopped at, while all other threads stay stopped, then
+// continues the target. Other threads stopped at a breakpoint are stepped
+// over it by ContinueOnce as usual.
+// If the current thread isn't stopped at a breakpoint this is the same as
+// proc.Continue.
+func (p *Process) StepOverBreakpointAndContinue() error {
+	if p.exited {
+		return &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if th := p.currentThread; th != nil && th.CurrentBreakpoint.Breakpoint != nil {
+		if err := th.stepInstruction(&threadUpdater{p: p}); err != nil {
+			return err
+		}
+		// The thread left the breakpoint, ContinueOnce must not step it again.
+		th.clearBreakpointState()
+		if err := th.reloadRegisters(); err != nil {
+			return err
+		}
+	}
+	return proc.Continue(p)
+}
+
+// RunToMain continues the target until it reaches main.main. This is
+// useful after attaching to a process early in its initialization, if
+// main.main is already running an error is returned instead.
+func (p *Process) RunToMain() error {
+	if p.exited {
+		return &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if g, err := proc.FindGoroutine(p, 1); err == nil && g != nil {
+		frames, _ := g.Stacktrace(50)
+		for _, frame := range frames {
+			if frame.Current.Fn != nil && frame.Current.Fn.Name == "main.main" {
+				return errors.New("main.main is already running")
+			}
+		}
+	}
+	return p.RunToFunction("main.main")
+}
+
+// RunToLine continues the target until a goroutine reaches line of file,
+// and returns the thread that reached it and its goroutine. The same
+// source line can correspond to several address ranges, for example the
+// header of a loop or a function inlined in several places: a temporary
+// breakpoint is set at the start of each of them and all of them are
+// removed once Continue returns, whether the line was reached or not.
+// If the target stops before reaching the line, for example at a user
+// breakpoint or because of a manual stop request, a nil thread is
+// returned; if it exits a ProcessExitedError.
+// It can not be used while a next or step is in progress.
+func (p *Process) RunToLine(file string, line int) (proc.Thread, *proc.G, error) {
+	if p.exited {
+		return nil, nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if p.breakpoints.HasInternalBreakpoints() {
+		return nil, nil, errors.New("can not run to a line while a next or step is in progress")
+	}
+	addrs, err := lineAddrs(p, file, line)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, r := range p.SetBreakpoints(addrs, proc.NextBreakpoint) {
+		if _, exists := r.Err.(proc.BreakpointExistsError); r.Err != nil && !exists {
+			p.ClearInternalBreakpoints()
+			return nil, nil, r.Err
+		}
+	}
+	err = proc.Continue(p)
+	if !p.exited {
+		if err1 := p.ClearInternalBreakpoints(); err == nil {
+			err = err1
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	th := p.currentThread
+	if th == nil {
+		return nil, nil, nil
+	}
+	if err := th.loadRegisters(); err != nil {
+		return nil, nil, err
+	}
+	for _, addr := range addrs {
+		if th.regs.PC() == addr {
+			g, err := proc.GetG(th)
+			return th, g, err
+		}
+	}
+	return nil, nil, nil
+}
+
+// lineAddrs returns the addresses where a breakpoint must be set to stop
+// when a goroutine reaches line of file: the start of every address range
+// of the line, skipping the prologue of functions.
+func lineAddrs(p *Process, file string, line int) ([]uint64, error) {
+	var addrs []uint64
+	seen := make(map[uint64]bool)
+	for _, pc := range p.bi.AllPCsForFileLine(file, line) {
+		fn := p.bi.PCToFunc(pc)
+		if fn == nil {
+			continue
+		}
+		if pc == fn.Entry {
+			if afterPrologue, err := proc.FirstPCAfterPrologue(p, fn, true); err == nil {
+				pc = afterPrologue
+			}
+		}
+		if !seen[pc] {
+			seen[pc] = true
+			addrs = append(addrs, pc)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no code at %s:%d", file, line)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs, nil
+}
+
+// GoroutineCountStop describes the stop of ContinueUntilGoroutineCount
+// caused by the number of goroutines reaching the threshold.
+type GoroutineCountStop struct {
+	// Live is the number of live goroutines before the new one is created,
+	// see GoroutineStats.Live.
+	Live int
+	// Creator is the goroutine that is creating the new goroutine and Stack
+	// its stack, starting with the call to runtime.newproc.
+	Creator *proc.G
+	Stack   []proc.Stackframe
+}
+
+// goroutineCountStackDepth is the maximum depth of GoroutineCountStop.Stack.
+const goroutineCountStackDepth = 50
+
+// ContinueUntilGoroutineCount continues the target until a goroutine is
+// created while there are already n or more live goroutines, that is when
+// the number of live goroutines is about to exceed n. This is useful to
+// find goroutine leaks.
+// Every time a goroutine is created, using an internal breakpoint on
+// runtime.newproc which is removed when ContinueUntilGoroutineCount
+// returns (or by ClearInternalBreakpoints), runtime.allglen is read: it
+// counts all goroutines ever allocated, including dead ones, so live
+// goroutines are only counted with GoroutineStats once it reaches n.
+// The target is stopped at the call to runtime.newproc, with the creating
+// goroutine selected.
+// If the target stops for any other reason, for example a user breakpoint
+// or a manual stop request, which can be used to cancel the operation,
+// ContinueUntilGoroutineCount returns a nil GoroutineCountStop.
+// It can not be used while a next or step is in progress.
+func (p *Process) ContinueUntilGoroutineCount(n int) (stop *GoroutineCountStop, err error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if p.breakpoints.HasInternalBreakpoints() {
+		return nil, errors.New("can not count goroutines while a next or step is in progress")
+	}
+	if p.currentThread == nil {
+		return nil, errors.New("no current thread")
+	}
+	scope, err := proc.ThreadScope(p.currentThread)
+	if err != nil {
+		return nil, err
+	}
+	allglen, err := scope.EvalVariable("runtime.allglen", proc.LoadConfig{})
+	if err != nil {
+		return nil, err
+	}
+	addr, err := proc.FindFunctionLocation(p, "runtime.newproc", true, 0)
+	if err != nil {
+		return nil, err
+	}
+	bp, err := p.SetBreakpoint(addr, proc.NextBreakpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if !p.exited {
+			if err1 := p.ClearInternalBreakpoints(); err == nil {
+				err = err1
+			}
+		}
+	}()
+
+	p.CheckAndClearManualStopRequest()
+	for {
+		trapthread, err := p.ContinueOnce()
+		if err != nil {
+			return nil, err
+		}
+		if p.CheckAndClearManualStopRequest() {
+			return nil, p.SwitchThread(trapthread.ThreadID())
+		}
+
+		var creator *Thread
+		for _, th := range p.threads {
+			if th.CurrentBreakpoint.Breakpoint == nil || !th.CurrentBreakpoint.Active {
+				continue
+			}
+			if th.CurrentBreakpoint.Breakpoint != bp || bp.IsUser() {
+				// stopped at some other breakpoint
+				return nil, p.SwitchThread(th.ID)
+			}
+			creator = th
+		}
+		if creator == nil {
+			return nil, p.SwitchThread(trapthread.ThreadID())
+		}
+
+		if err := p.SwitchThread(creator.ID); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, allglen.RealType.Size())
+		if err := p.readMemory(buf, uintptr(allglen.Addr)); err != nil {
+			return nil, err
+		}
+		if uintAt(p.order(), buf) < uint64(n) {
+			continue
+		}
+		stats, err := p.GoroutineStats()
+		if err != nil {
+			return nil, err
+		}
+		if live := stats.Live(); live >= n {
+			stop = &GoroutineCountStop{Live: live}
+			stop.Creator, err = proc.GetG(creator)
+			if err != nil {
+				return nil, err
+			}
+			stop.Stack, err = stop.Creator.Stacktrace(goroutineCountStackDepth)
+			return stop, err
+		}
+	}
+}
+
+// PanicStop describes a stop at the unrecovered-panic breakpoint, see
+// ContinueToPanic.
+type PanicStop struct {
+	Goroutine *proc.G
+	// Panic is the panic that was not recovered, nil if the goroutine has no
+	// active panic, for example after a fatal error (runtime.throw).
+	Panic *proc.PanicRecord
+	// Origin is the frame of the function that panicked, outside of the
+	// runtime (for example the function that dereferenced a nil pointer
+	// rather than runtime.sigpanic), nil if it could not be found.
+	Origin *proc.Stackframe
+	// Defer is the frame of the deferred function that was running when the
+	// panic started, nil if the panic didn't start inside a deferred call.
+	Defer *proc.Stackframe
+}
+
+// ContinueToPanic continues the target until a panic is not recovered and
+// reports where it originated, instead of just stopping inside the runtime
+// (see setUnrecoveredPanicBreakpoint) after the stack was partially unwound
+// by the execution of deferred calls.
+// Stops at the unrecovered-panic breakpoint of goroutines whose panics
+// were all recovered are skipped. If the target stops for any other reason
+// ContinueToPanic returns a nil PanicStop.
+func (p *Process) ContinueToPanic() (*PanicStop, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if p.noPanicBreakpoint {
+		return nil, errors.New("the unrecovered-panic breakpoint is disabled")
+	}
+	for {
+		if err := proc.Continue(p); err != nil {
+			return nil, err
+		}
+		th := p.currentThread
+		if th == nil || th.CurrentBreakpoint.Breakpoint == nil || th.CurrentBreakpoint.Name != proc.UnrecoveredPanic {
+			return nil, nil
+		}
+		stop, err := p.panicStop(th)
+		if err != nil || stop != nil {
+			return stop, err
+		}
+	}
+}
+
+// panicStop returns the description of the unrecovered panic thread is
+// stopped at, or nil if all active panics of its goroutine were recovered.
+func (p *Process) panicStop(thread *Thread) (*PanicStop, error) {
+	g, err := proc.GetG(thread)
+	if err != nil {
+		return nil, err
+	}
+	stop := &PanicStop{Goroutine: g}
+	panics, err := g.Panics()
+	if err != nil {
+		return nil, err
+	}
+	for i := range panics {
+		if !panics[i].Recovered && !panics[i].Goexit {
+			stop.Panic = &panics[i]
+			break
+		}
+	}
+	if stop.Panic == nil && len(panics) > 0 {
+		return nil, nil
+	}
+
+	frames, err := g.Stacktrace(panicStackDepth)
+	if err != nil {
+		return nil, err
+	}
+	origin, deferred := panicFrames(frames)
+	if origin >= 0 {
+		stop.Origin = &frames[origin]
+	}
+	if deferred >= 0 {
+		stop.Defer = &frames[deferred]
+	}
+	return stop, nil
+}
+
+// panicStackDepth is the maximum depth of the stacktrace read by panicStop.
+const panicStackDepth = 100
+
+// panicFrames returns the index in frames of the function that called
+// runtime.gopanic, skipping runtime functions, and the index of the
+// deferred function that was running when the panic started, which is
+// the frame preceding the runtime functions that called it from an
+// enclosing runtime.gopanic. Both are -1 if not found.
+func panicFrames(frames []proc.Stackframe) (origin, deferred int) {
+	inRuntime := func(i int) bool {
+		fn := frames[i].Current.Fn
+		return fn != nil && strings.HasPrefix(fn.Name, "runtime.")
+	}
+	isGopanic := func(i int) bool {
+		fn := frames[i].Current.Fn
+		return fn != nil && fn.Name == "runtime.gopanic"
+	}
+
+	origin, deferred = -1, -1
+	i := 0
+	for i < len(frames) && !isGopanic(i) {
+		i++
+	}
+	for i < len(frames) && inRuntime(i) {
+		i++
+	}
+	if i >= len(frames) {
+		return -1, -1
+	}
+	origin = i
+
+	for i < len(frames) && !isGopanic(i) {
+		i++
+	}
+	if i >= len(frames) {
+		return origin, -1
+	}
+	for i--; i > origin && inRuntime(i); i-- {
+	}
+	return origin, i
+}
+
+// StopEvent describes a stop of the target delivered by ContinueStream.
+type StopEvent struct {
+	// Thread is the thread that caused the target to stop, it is nil if
+	// the target exited or the continue failed.
+	Thread *Thread
+	// Breakpoint is the breakpoint Thread is stopped at, if any.
+	Breakpoint *proc.Breakpoint
+	// Kind and Signal are the stop reason of Thread, see Thread.StopReason.
+	Kind   StopKind
+	Signal uint8
+	// Err is the error returned by the continue, for example a
+	// proc.ProcessExitedError. An event with a non-nil Err is the last event
+	// delivered on the channel.
+	Err error
+
+	resume chan struct{}
+}
+
+// Resume tells ContinueStream to resume the target after this stop.
+// Calling Resume more than once has no effect.
+func (ev StopEvent) Resume() {
+	select {
+	case ev.resume <- struct{}{}:
+	default:
+	}
+}
+
+// ContinueStream repeatedly continues the target, delivering each stop on
+// the returned channel. After receiving an event the consumer can inspect
+// the state of the target and must call its Resume method to continue
+// again.
+// The channel is closed after the target exits, after an error is
+// delivered or once ctx is canceled. If ctx is canceled while the target
+// is running the target is stopped with a manual stop request before the
+// channel is closed, the stop is not delivered.
+// No other method of p should be called while the target is running.
+func (p *Process) ContinueStream(ctx context.Context) <-chan StopEvent {
+	ch := make(chan StopEvent)
+	go p.continueStream(ctx, ch)
+	return ch
+}
+
+func (p *Process) continueStream(ctx context.Context, ch chan<- StopEvent) {
+	defer close(ch)
+	for ctx.Err() == nil {
+		trapthread, err := p.continueOnce(ctx)
+		if ctx.Err() != nil {
+			// The stop, if any, was caused by the cancellation, drop it along with
+			// the manual stop request.
+			p.CheckAndClearManualStopRequest()
+			return
+		}
+
+		ev := StopEvent{Err: err, resume: make(chan struct{}, 1)}
+		if thread, _ := trapthread.(*Thread); thread != nil {
+			if thread = p.streamStopThread(thread); thread == nil {
+				continue
+			}
+			ev.Thread = thread
+			ev.Breakpoint = thread.CurrentBreakpoint.Breakpoint
+			ev.Kind, ev.Signal = thread.StopReason()
+		}
+		select {
+		case ch <- ev:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		select {
+		case <-ev.resume:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// streamStopThread returns the thread whose stop ContinueStream delivers
+// for a continue that stopped trapthread, or nil if the target should be
+// resumed without delivering anything. Like proc.Continue it skips
+// breakpoints whose condition is false and, since no Next or Step is
+// driving the target, internal breakpoints as well, unless another thread
+// stopped at a user breakpoint at the same time.
+func (p *Process) streamStopThread(trapthread *Thread) *Thread {
+	if bp := trapthread.CurrentBreakpoint; bp.Breakpoint == nil || (bp.Active && !bp.Internal) {
+		return trapthread
+	}
+	for _, th := range p.ThreadsAtBreakpoint() {
+		if !th.Breakpoint().Internal {
+			return th.(*Thread)
+		}
+	}
+	return nil
+}
+
+// continueOnce calls ContinueOnce, stopping the target with a manual stop
+// request if ctx is canceled while it runs. A channel registered with
+// ResumeNotify is still closed when the target is resumed.
+func (p *Process) continueOnce(ctx context.Context) (proc.Thread, error) {
+	notify := p.conn.resumeChan
+	resumed := make(chan struct{})
+	p.ResumeNotify(resumed)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		p.stopOnCancel(ctx, notify, resumed, done)
+		close(stopped)
+	}()
+	trapthread, err := p.ContinueOnce()
+	close(done)
+	<-stopped
+	return trapthread, err
+}
+
+// stopOnCancel forwards the closing of resumed to notify and then sends a
+// manual stop request to the stub if ctx is canceled before done is
+// closed. If the target was never resumed notify is registered again with
+// ResumeNotify.
+// A single request is enough: if the target is stopped internally when it
+// is made, the continue sends it at the next resume (see
+// resendManualStop).
+func (p *Process) stopOnCancel(ctx context.Context, notify chan<- struct{}, resumed, done <-chan struct{}) {
+	select {
+	case <-resumed:
+	case <-done:
+		select {
+		case <-resumed:
+		default:
+			p.conn.resumeChan = notify
+			return
+		}
+	}
+	if notify != nil {
+		close(notify)
+	}
+	select {
+	case <-ctx.Done():
+		p.RequestManualStop()
+	case <-done:
+	}
+}
+
+// suspendBreakpoints removes all breakpoints from the stub, without
+// removing them from p.breakpoints.
+func (p *Process) suspendBreakpoints() error {
+	p.breakpointsSuspended = true
+	for addr, bp := range p.breakpoints.M {
+		if !bp.Installed() {
+			continue
+		}
+		if err := p.conn.clearBreakpoint(addr); err != nil {
+			p.restoreBreakpoints()
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreBreakpoints reinstalls the breakpoints removed by
+// suspendBreakpoints.
+func (p *Process) restoreBreakpoints() error {
+	p.breakpointsSuspended = false
+	var err error
+	for addr, bp := range p.breakpoints.M {
+		if !bp.Installed() {
+			continue
+		}
+		// setting a breakpoint twice is not an error, if we got here after a
+		// failure in suspendBreakpoints some of them were never removed.
+		if err1 := p.installBreakpoint(addr); err == nil {
+			err = err1
+		}
+	}
+	return err
 }
 
 func (p *Process) StepInstruction() error {
@@ -684,7 +3052,8 @@ func (p *Process) StepInstruction() error {
 		thread = p.selectedGoroutine.Thread.(*Thread)
 	}
 	p.allGCache = nil
-	if p.exited {
+	p.goroutineStats = nil
+	if p.exited || thread == nil {
 		return &proc.ProcessExitedError{Pid: p.conn.pid}
 	}
 	thread.clearBreakpointState()
@@ -707,6 +3076,9 @@ func (p *Process) SwitchThread(tid int) error {
 		return proc.ProcessExitedError{Pid: p.conn.pid}
 	}
 	if th, ok := p.threads[tid]; ok {
+		if err := p.checkThreadAlive(th); err != nil {
+			return err
+		}
 		p.currentThread = th
 		p.selectedGoroutine, _ = proc.GetG(p.CurrentThread())
 		return nil
@@ -726,6 +3098,9 @@ func (p *Process) SwitchGoroutine(gid int) error {
 	if g.Thread != nil {
 		return p.SwitchThread(g.Thread.ThreadID())
 	}
+	// The goroutine is parked, its stack is read from the scheduling state
+	// saved in g, see proc.ConvertEvalScope. The current thread is left
+	// unchanged.
 	p.selectedGoroutine = g
 	return nil
 }
@@ -733,6 +3108,7 @@ func (p *Process) SwitchGoroutine(gid int) error {
 func (p *Process) RequestManualStop() error {
 	p.conn.manualStopMutex.Lock()
 	p.manualStopRequested = true
+	p.manualStops++
 	if !p.conn.running {
 		p.conn.manualStopMutex.Unlock()
 		return nil
@@ -762,6 +3138,79 @@ func (p *Process) getCtrlC() bool {
 	return p.ctrlC
 }
 
+// Resync tries to bring the connection with the stub back in a usable
+// state after a command failed because of a malformed or unexpected reply,
+// see gdbConn.resync. If interrupt is set an interrupt is sent first, in
+// case the target was resumed behind our back.
+// If the connection is recovered the registers of all threads are reloaded
+// and the command that failed can be retried.
+func (p *Process) Resync(interrupt bool) error {
+	if p.exited {
+		return &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	p.conn.manualStopMutex.Lock()
+	running := p.conn.running
+	p.conn.manualStopMutex.Unlock()
+	if running {
+		return errors.New("can not resynchronize while the target is running")
+	}
+	if err := p.conn.resync(interrupt); err != nil {
+		return err
+	}
+	if p.memcache != nil {
+		p.memcache.entries = nil
+	}
+	p.allGCache = nil
+	p.goroutineStats = nil
+	return p.updateThreadList(&threadUpdater{p: p})
+}
+
+// RawPacket sends packet to the stub and returns its reply, it's meant for
+// experimentation and for packets that we don't otherwise support.
+// The leading '$' and the checksum are added automatically, characters
+// that can not appear in a packet are escaped.
+// Error replies ('E' followed by a code) and the empty reply for
+// unsupported packets are returned as they are, a non-nil error is only
+// returned if the packet could not be exchanged with the stub.
+// RawPacket refuses to send packets while the target is running, however
+// it does not check the content of packet: sending packets that resume the
+// target, change the current thread or otherwise alter the state of the
+// stub will desync the protocol and the state cached by Process.
+func (p *Process) RawPacket(packet string) (string, error) {
+	if p.exited {
+		return "", &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	p.conn.manualStopMutex.Lock()
+	running := p.conn.running
+	p.conn.manualStopMutex.Unlock()
+	if running {
+		return "", errors.New("can not send packets while the target is running")
+	}
+
+	packet = strings.TrimPrefix(packet, "$")
+	p.conn.outbuf.Reset()
+	p.conn.outbuf.WriteByte('$')
+	writeBinaryBytes(&p.conn.outbuf, []byte(packet))
+	resp, err := p.conn.exec(p.conn.outbuf.Bytes(), "raw packet")
+	if err != nil {
+		if gdberr, ok := err.(*GdbProtocolError); ok {
+			return gdberr.code, nil
+		}
+		return "", err
+	}
+	return string(resp), nil
+}
+
+// Detach disconnects from the stub, killing the target first if kill is
+// set.
+// When kill is false the target is left running if we attached to a stub
+// (Dial, Listen or Connect with a nil process) or if we started a
+// debugserver or lldb-server (LLDBLaunch and LLDBAttach): these stubs exit
+// by themselves after a 'D' packet without touching the target, so instead
+// of killing them we wait for them to exit and only kill them if they don't
+// within detachStubExitTimeout.
+// A recording replayed by rr has nothing that can be left running, the rr
+// process is always killed.
 func (p *Process) Detach(kill bool) error {
 	if kill && !p.exited {
 		err := p.conn.kill()
@@ -773,28 +3222,229 @@ func (p *Process) Detach(kill bool) error {
 		}
 	}
 	if !p.exited {
+		if !kill {
+			// the inferior survives the detach
+			p.freeLoadGInstr()
+		}
 		if err := p.conn.detach(); err != nil {
 			return err
 		}
 	}
 	if p.process != nil {
-		p.process.Kill()
-		<-p.waitChan
+		if kill || p.exited || p.tracedir != "" {
+			p.process.Kill()
+			<-p.waitChan
+		} else {
+			// Killing the stub right after the detach can take the target down
+			// with it, give it a chance to exit on its own.
+			select {
+			case <-p.waitChan:
+			case <-time.After(detachStubExitTimeout):
+				p.process.Kill()
+				<-p.waitChan
+			}
+		}
 		p.process = nil
 	}
+	if p.stubTransport != nil {
+		p.stubTransport.Cleanup()
+		p.stubTransport = nil
+	}
 	return p.bi.Close()
 }
 
+// DetachKeepingBreakpoints detaches from the target leaving it running,
+// like Detach(false), without forgetting the user breakpoints.
+// All breakpoints are removed from the stub before detaching, so that the
+// target is not left with breakpoint instructions in its code, internal
+// breakpoints are deleted, user breakpoints stay in Breakpoints and can be
+// serialized with SaveBreakpoints and installed again in a new session
+// with LoadBreakpoints and ReapplyBreakpoints.
+func (p *Process) DetachKeepingBreakpoints() error {
+	if p.exited {
+		return &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if err := p.ClearInternalBreakpoints(); err != nil {
+		return err
+	}
+	if !p.breakpointsSuspended {
+		if err := p.suspendBreakpoints(); err != nil {
+			return err
+		}
+	}
+	return p.Detach(false)
+}
+
+// SavedBreakpoint is the description of a user breakpoint written by
+// SaveBreakpoints.
+// The address of the breakpoint is saved relative to the entry point of
+// its function, the target can be loaded at a different address when it
+// is restarted (or, for position independent executables, attached
+// again).
+type SavedBreakpoint struct {
+	ID             int
+	Name           string `json:",omitempty"`
+	FunctionName   string
+	FunctionOffset uint64 // distance of the breakpoint from the entry point of FunctionName
+	File           string
+	Line           int
+	Addr           uint64 // address of the breakpoint when it was saved
+
+	Cond       string `json:",omitempty"`
+	Tracepoint bool
+	Goroutine  bool
+	Stacktrace int
+	Variables  []string         `json:",omitempty"`
+	LoadArgs   *proc.LoadConfig `json:",omitempty"`
+	LoadLocals *proc.LoadConfig `json:",omitempty"`
+	Disabled   bool
+}
+
+// SaveBreakpoints returns the user breakpoints, in JSON format, ordered by
+// ID. It can be called after DetachKeepingBreakpoints.
+// Hit counts and the thread restriction of SetThreadBreakpoint are not
+// saved, they are meaningless for a different session.
+func (p *Process) SaveBreakpoints() ([]byte, error) {
+	saved := []SavedBreakpoint{}
+	for _, bp := range p.breakpoints.M {
+		if !bp.IsUser() {
+			continue
+		}
+		sb := SavedBreakpoint{
+			ID:           bp.ID,
+			Name:         bp.Name,
+			FunctionName: bp.FunctionName,
+			File:         bp.File,
+			Line:         bp.Line,
+			Addr:         bp.Addr,
+			Tracepoint:   bp.Tracepoint,
+			Goroutine:    bp.Goroutine,
+			Stacktrace:   bp.Stacktrace,
+			Variables:    bp.Variables,
+			LoadArgs:     bp.LoadArgs,
+			LoadLocals:   bp.LoadLocals,
+			Disabled:     bp.Disabled,
+		}
+		if fn := p.bi.LookupFunc[bp.FunctionName]; fn != nil && bp.Addr >= fn.Entry {
+			sb.FunctionOffset = bp.Addr - fn.Entry
+		}
+		if bp.Cond != nil {
+			var buf bytes.Buffer
+			if err := printer.Fprint(&buf, token.NewFileSet(), bp.Cond); err != nil {
+				return nil, err
+			}
+			sb.Cond = buf.String()
+		}
+		saved = append(saved, sb)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	return json.Marshal(saved)
+}
+
+// LoadBreakpoints reads breakpoints saved by SaveBreakpoints, they are
+// installed by the next call to ReapplyBreakpoints.
+func (p *Process) LoadBreakpoints(data []byte) error {
+	var saved []SavedBreakpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("could not load breakpoints: %v", err)
+	}
+	for i := range saved {
+		if saved[i].Cond == "" {
+			continue
+		}
+		if _, err := parser.ParseExpr(saved[i].Cond); err != nil {
+			return fmt.Errorf("could not load breakpoint %d: wrong condition %q: %v", saved[i].ID, saved[i].Cond, err)
+		}
+	}
+	p.savedBreakpoints = append(p.savedBreakpoints, saved...)
+	return nil
+}
+
+// ReapplyBreakpoints sets the breakpoints read by LoadBreakpoints and
+// returns one result for each of them, in the order they were saved.
+// Breakpoints get new IDs, the address of each breakpoint is computed
+// again from its function, see savedBreakpointAddr. Breakpoints that can
+// not be set are reported in their result and discarded.
+func (p *Process) ReapplyBreakpoints() ([]BreakpointResult, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	saved := p.savedBreakpoints
+	p.savedBreakpoints = nil
+	results := make([]BreakpointResult, len(saved))
+	for i := range saved {
+		sb := &saved[i]
+		r := &results[i]
+		r.Addr, r.Err = savedBreakpointAddr(&p.bi, sb)
+		if r.Err != nil {
+			continue
+		}
+		var cond ast.Expr
+		if sb.Cond != "" {
+			cond, _ = parser.ParseExpr(sb.Cond)
+		}
+		r.Breakpoint, r.Err = p.SetBreakpoint(r.Addr, proc.UserBreakpoint, cond)
+		if r.Err != nil {
+			r.Breakpoint = nil
+			continue
+		}
+		bp := r.Breakpoint
+		bp.Name = sb.Name
+		bp.Tracepoint = sb.Tracepoint
+		bp.Goroutine = sb.Goroutine
+		bp.Stacktrace = sb.Stacktrace
+		bp.Variables = sb.Variables
+		bp.LoadArgs = sb.LoadArgs
+		bp.LoadLocals = sb.LoadLocals
+		if sb.Disabled {
+			if _, err := p.DisableBreakpoint(r.Addr); err != nil {
+				r.Err = err
+			}
+		}
+	}
+	return results, nil
+}
+
+// savedBreakpointAddr returns the address of the saved breakpoint sb in
+// the target described by bi.
+// The address is the entry point of the breakpoint's function plus its
+// saved offset, which is correct even if the target was loaded at a
+// different address. If the function does not exist or is too short the
+// target was rebuilt and the breakpoint is rejected. Breakpoints without a
+// function are only accepted at their original address.
+func savedBreakpointAddr(bi *proc.BinaryInfo, sb *SavedBreakpoint) (uint64, error) {
+	if sb.FunctionName == "" {
+		if bi.PCToFunc(sb.Addr) == nil {
+			return 0, fmt.Errorf("breakpoint %d: no function at %#x", sb.ID, sb.Addr)
+		}
+		return sb.Addr, nil
+	}
+	fn := bi.LookupFunc[sb.FunctionName]
+	if fn == nil {
+		return 0, fmt.Errorf("breakpoint %d: could not find function %s", sb.ID, sb.FunctionName)
+	}
+	addr := fn.Entry + sb.FunctionOffset
+	if addr >= fn.End {
+		return 0, fmt.Errorf("breakpoint %d: offset %#x is outside of function %s", sb.ID, sb.FunctionOffset, sb.FunctionName)
+	}
+	return addr, nil
+}
+
 func (p *Process) Restart(pos string) error {
 	if p.tracedir == "" {
 		return proc.NotRecordedErr
 	}
 
 	p.exited = false
+	p.interruptPending = false
 
 	p.allGCache = nil
+	p.goroutineStats = nil
 	for _, th := range p.threads {
 		th.clearBreakpointState()
+		th.stopKind, th.stopSig, th.stopReasons = StopNone, 0, 0
+		th.preempted = false
+		th.watchpoint = nil
 	}
 
 	p.setCtrlC(false)
@@ -806,7 +3456,7 @@ func (p *Process) Restart(pos string) error {
 
 	// for some reason we have to send a vCont;c after a vRun to make rr behave
 	// properly, because that's what gdb does.
-	_, _, err = p.conn.resume(0, nil)
+	_, err = p.conn.resume(0, nil)
 	if err != nil {
 		return err
 	}
@@ -815,10 +3465,12 @@ func (p *Process) Restart(pos string) error {
 	if err != nil {
 		return err
 	}
-	p.selectedGoroutine, _ = proc.GetG(p.CurrentThread())
+	p.loadSelectedGoroutine()
 
-	for addr := range p.breakpoints.M {
-		p.conn.setBreakpoint(addr)
+	for addr, bp := range p.breakpoints.M {
+		if bp.Installed() {
+			p.installBreakpoint(addr)
+		}
 	}
 
 	return p.setCurrentBreakpoints()
@@ -835,6 +3487,48 @@ func (p *Process) When() (string, error) {
 	return strings.TrimSpace(event), nil
 }
 
+// CurrentEvent returns the event number and tick count of the current
+// position in the rr recording, using rr's "when" and "when-ticks"
+// commands.
+func (p *Process) CurrentEvent() (event, ticks uint64, err error) {
+	if p.tracedir == "" {
+		return 0, 0, proc.NotRecordedErr
+	}
+	resp, err := p.conn.qRRCmd("when")
+	if err != nil {
+		return 0, 0, err
+	}
+	event, err = parseRRNumber(resp)
+	if err != nil {
+		return 0, 0, fmt.Errorf("can not parse event number %q", resp)
+	}
+	resp, err = p.conn.qRRCmd("when-ticks")
+	if err != nil {
+		return 0, 0, err
+	}
+	ticks, err = parseRRNumber(resp)
+	if err != nil {
+		return 0, 0, fmt.Errorf("can not parse tick count %q", resp)
+	}
+	return event, ticks, nil
+}
+
+// parseRRNumber parses the output of rr commands like "when", which is a
+// description followed by a number (i.e. "Current event: 1234"). The
+// description changed across rr versions so we just look for the last
+// number in the output.
+func parseRRNumber(resp string) (uint64, error) {
+	fields := strings.FieldsFunc(resp, func(r rune) bool {
+		return r == ' ' || r == ':' || r == '\n' || r == '\t'
+	})
+	for i := len(fields) - 1; i >= 0; i-- {
+		if n, err := strconv.ParseUint(fields[i], 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	return 0, errors.New("no number found")
+}
+
 const (
 	checkpointPrefix = "Checkpoint "
 )
@@ -863,9 +3557,33 @@ func (p *Process) Checkpoint(where string) (int, error) {
 	if err != nil {
 		return -1, err
 	}
+	if p.checkpoints == nil {
+		p.checkpoints = make(map[int]string)
+	}
+	p.checkpoints[cpid] = where
 	return cpid, nil
 }
 
+// CreateCheckpoint creates an rr checkpoint at the current position in the
+// recording, which can be returned to with RestoreCheckpoint.
+func (p *Process) CreateCheckpoint(name string) (int, error) {
+	return p.Checkpoint(name)
+}
+
+// RestoreCheckpoint moves the current position in the recording to the
+// checkpoint with the specified ID, which must have been created by
+// CreateCheckpoint (or Checkpoint). Like Restart it reloads threads and
+// reinstalls breakpoints.
+func (p *Process) RestoreCheckpoint(id int) error {
+	if p.tracedir == "" {
+		return proc.NotRecordedErr
+	}
+	if _, ok := p.checkpoints[id]; !ok {
+		return fmt.Errorf("checkpoint c%d does not exist", id)
+	}
+	return p.Restart(fmt.Sprintf("c%d", id))
+}
+
 func (p *Process) Checkpoints() ([]proc.Checkpoint, error) {
 	if p.tracedir == "" {
 		return nil, proc.NotRecordedErr
@@ -906,6 +3624,7 @@ func (p *Process) ClearCheckpoint(id int) error {
 	if !strings.HasPrefix(resp, deleteCheckpointPrefix) {
 		return errors.New(resp)
 	}
+	delete(p.checkpoints, id)
 	return nil
 }
 
@@ -930,18 +3649,44 @@ func (p *Process) Breakpoints() *proc.BreakpointMap {
 	return &p.breakpoints
 }
 
+// FindBreakpoint returns the breakpoint hit by a thread stopped at pc.
+// Breakpoints that are not installed in the stub, see
+// DisableBreakpoint, are ignored.
 func (p *Process) FindBreakpoint(pc uint64) (*proc.Breakpoint, bool) {
 	// Check to see if address is past the breakpoint, (i.e. breakpoint was hit).
-	if bp, ok := p.breakpoints.M[pc-uint64(p.bi.Arch.BreakpointSize())]; ok {
+	if bp, ok := p.breakpoints.M[pc-uint64(p.bi.Arch.BreakpointSize())]; ok && bp.Installed() {
 		return bp, true
 	}
 	// Directly use addr to lookup breakpoint.
-	if bp, ok := p.breakpoints.M[pc]; ok {
+	if bp, ok := p.breakpoints.M[pc]; ok && bp.Installed() {
 		return bp, true
 	}
 	return nil, false
 }
 
+// preemptedAtBreakpoint returns true if the thread with the specified ID
+// was stopped by the preemption signal with its PC at an installed
+// breakpoint.
+func (p *Process) preemptedAtBreakpoint(threadID string) (bool, error) {
+	for _, thread := range p.threads {
+		if thread.strID != threadID {
+			continue
+		}
+		if err := thread.readSomeRegisters(regnamePC); err != nil {
+			return false, err
+		}
+		return p.installedBreakpointAt(thread.regs.PC()), nil
+	}
+	return false, nil
+}
+
+// installedBreakpointAt returns true if there is a breakpoint installed in
+// the stub at addr.
+func (p *Process) installedBreakpointAt(addr uint64) bool {
+	bp, ok := p.breakpoints.M[addr]
+	return ok && bp.Installed()
+}
+
 func (p *Process) writeBreakpoint(addr uint64) (string, int, *proc.Function, []byte, error) {
 	f, l, fn := p.bi.PCToLine(uint64(addr))
 	if fn == nil {
@@ -956,19 +3701,376 @@ func (p *Process) writeBreakpoint(addr uint64) (string, int, *proc.Function, []b
 }
 
 func (p *Process) SetBreakpoint(addr uint64, kind proc.BreakpointKind, cond ast.Expr) (*proc.Breakpoint, error) {
-	return p.breakpoints.Set(addr, kind, cond, p.writeBreakpoint)
+	if bp, ok := p.breakpoints.M[addr]; ok && kind != proc.UserBreakpoint && !p.breakpointsSuspended {
+		switch {
+		case !bp.Installed():
+			// internal breakpoint overlapping a disabled user breakpoint, it must
+			// be reinstalled in the stub.
+			if err := p.conn.setBreakpoint(addr); err != nil {
+				return nil, err
+			}
+		case bp.ThreadID != 0 && bp.Kind == proc.UserBreakpoint:
+			// internal breakpoint overlapping a thread breakpoint, the stub must
+			// stop all threads at it.
+			if err := p.conn.clearBreakpoint(addr); err != nil {
+				return nil, err
+			}
+			if err := p.conn.setBreakpoint(addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	bp, err := p.breakpoints.Set(addr, kind, cond, p.writeBreakpoint)
+	if err == nil {
+		p.trackBreakpointLibrary(addr)
+	}
+	return bp, err
+}
+
+// BreakpointResult is the result of setting one of the breakpoints passed
+// to SetBreakpoints.
+type BreakpointResult struct {
+	Addr       uint64
+	Breakpoint *proc.Breakpoint // nil if Err != nil
+	Err        error
+}
+
+// SetBreakpoints sets a breakpoint of the specified kind at each address in
+// addrs and returns one result for each address, in the same order.
+// New breakpoints are sent to the stub in a single batch (see
+// gdbConn.setBreakpoints), which is much faster than calling SetBreakpoint
+// for each address when setting thousands of them, for example at the
+// entry point of every function of a package.
+// A failure setting one breakpoint does not prevent the others from being
+// set.
+func (p *Process) SetBreakpoints(addrs []uint64, kind proc.BreakpointKind) []BreakpointResult {
+	type location struct {
+		file  string
+		line  int
+		fn    *proc.Function
+		first int // index in addrs of the first occurrence of the address
+	}
+	results := make([]BreakpointResult, len(addrs))
+	locs := make(map[uint64]location)
+	var batch []uint64
+	for i, addr := range addrs {
+		results[i].Addr = addr
+		if _, exists := p.breakpoints.M[addr]; exists {
+			continue
+		}
+		if _, queued := locs[addr]; queued {
+			continue
+		}
+		f, l, fn := p.bi.PCToLine(addr)
+		if fn == nil {
+			results[i].Err = proc.InvalidAddressError{Address: addr}
+			continue
+		}
+		locs[addr] = location{f, l, fn, i}
+		batch = append(batch, addr)
+	}
+
+	errs := make(map[uint64]error, len(batch))
+	for i, err := range p.conn.setBreakpoints(batch) {
+		errs[batch[i]] = err
+	}
+
+	for i := range results {
+		r := &results[i]
+		if r.Err != nil {
+			continue
+		}
+		loc, inbatch := locs[r.Addr]
+		if !inbatch {
+			// Already existing breakpoint, SetBreakpoint takes care of
+			// overlapping kinds.
+			r.Breakpoint, r.Err = p.SetBreakpoint(r.Addr, kind, nil)
+			continue
+		}
+		if loc.first != i {
+			// Duplicate of an earlier address.
+			*r = results[loc.first]
+			continue
+		}
+		if err := errs[r.Addr]; err != nil {
+			r.Err = err
+			continue
+		}
+		r.Breakpoint, r.Err = p.breakpoints.Set(r.Addr, kind, nil, func(addr uint64) (string, int, *proc.Function, []byte, error) {
+			return loc.file, loc.line, loc.fn, nil, nil
+		})
+		if r.Err == nil {
+			p.trackBreakpointLibrary(r.Addr)
+		}
+	}
+	return results
+}
+
+// trackBreakpointLibrary records the shared library containing the
+// breakpoint at addr, if any, so that the breakpoint can be removed when
+// the library is unloaded.
+// The list of libraries is the one read when the debugger connected to the
+// target, or at the last library event.
+func (p *Process) trackBreakpointLibrary(addr uint64) {
+	if _, tracked := p.breakpointLibs[addr]; tracked || len(p.libraries) <= 1 {
+		return
+	}
+	for _, lib := range p.libraries[1:] {
+		if addr >= lib.TextStart && addr < lib.TextEnd {
+			if p.breakpointLibs == nil {
+				p.breakpointLibs = make(map[uint64]SharedLibrary)
+			}
+			p.breakpointLibs[addr] = lib
+			return
+		}
+	}
+}
+
+// loadLibraries reads the list of shared libraries currently loaded by the
+// target, so that breakpoints set before the first library event are
+// tracked by trackBreakpointLibrary.
+func (p *Process) loadLibraries() {
+	if libs, err := p.SharedLibraries(); err == nil {
+		p.libraries = libs
+	}
+}
+
+// libraryEvent is called when the stub reports that the list of shared
+// libraries changed. Breakpoints inside libraries that were unloaded are
+// removed from the stub and deleted. Breakpoints that the stub could not
+// remove are kept, and removing them is attempted again at the next
+// library event, the errors are returned.
+func (p *Process) libraryEvent() error {
+	libs, err := p.SharedLibraries()
+	if err != nil {
+		return nil
+	}
+	p.libraries = libs
+	p.bi.ResetPCToLineCache()
+	loaded := make(map[SharedLibrary]bool, len(libs))
+	for _, lib := range libs {
+		loaded[lib] = true
+	}
+	var errs []string
+	for addr, lib := range p.breakpointLibs {
+		bp, ok := p.breakpoints.M[addr]
+		if !ok {
+			delete(p.breakpointLibs, addr)
+			continue
+		}
+		if loaded[lib] {
+			continue
+		}
+		if bp.Installed() {
+			if err := p.conn.clearBreakpoint(addr); err != nil {
+				errs = append(errs, fmt.Sprintf("%#x: %v", addr, err))
+				continue
+			}
+		}
+		delete(p.breakpointLibs, addr)
+		delete(p.breakpoints.M, addr)
+		for _, thread := range p.threads {
+			if thread.CurrentBreakpoint.Breakpoint == bp {
+				thread.clearBreakpointState()
+			}
+		}
+		if logflags.GdbWire() {
+			fmt.Fprintf(os.Stderr, "breakpoint %d at %#x removed, %s was unloaded\n", bp.ID, addr, lib.Name)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("could not remove breakpoint of unloaded library at %s", errs[0])
+	default:
+		sort.Strings(errs)
+		return fmt.Errorf("could not remove %d breakpoints of unloaded libraries: %s", len(errs), strings.Join(errs, ", "))
+	}
+}
+
+// DisableBreakpoint disables the user breakpoint at addr: it is removed
+// from the stub but kept in Breakpoints, with its ID, condition and hit
+// counts, until it is reenabled with EnableBreakpoint or cleared.
+// If an internal breakpoint is set at the same address it stays installed
+// until it is cleared.
+func (p *Process) DisableBreakpoint(addr uint64) (*proc.Breakpoint, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	bp, ok := p.breakpoints.M[addr]
+	if !ok || !bp.IsUser() {
+		return nil, proc.NoBreakpointError{Addr: addr}
+	}
+	if bp.Disabled {
+		return bp, nil
+	}
+	if !bp.IsInternal() && !p.breakpointsSuspended {
+		if err := p.conn.clearBreakpoint(addr); err != nil {
+			return nil, err
+		}
+	}
+	bp.Disabled = true
+	for _, thread := range p.threads {
+		if thread.CurrentBreakpoint.Breakpoint == bp && !thread.CurrentBreakpoint.Internal {
+			thread.clearBreakpointState()
+		}
+	}
+	return bp, nil
+}
+
+// EnableBreakpoint reenables the user breakpoint at addr disabled by
+// DisableBreakpoint.
+func (p *Process) EnableBreakpoint(addr uint64) (*proc.Breakpoint, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	bp, ok := p.breakpoints.M[addr]
+	if !ok || !bp.IsUser() {
+		return nil, proc.NoBreakpointError{Addr: addr}
+	}
+	if !bp.Disabled {
+		return bp, nil
+	}
+	if !bp.Installed() && !p.breakpointsSuspended {
+		if err := p.installBreakpoint(addr); err != nil {
+			return nil, err
+		}
+	}
+	bp.Disabled = false
+	return bp, nil
+}
+
+// SetThreadBreakpoint is like SetBreakpoint but the breakpoint will only
+// be triggered by the thread with the specified ID, only user breakpoints
+// can be restricted to a thread.
+// The restriction is sent to the stub, with the 'thread:tid' suffix of the
+// 'Z' packet, so that other threads don't stop at the breakpoint. Stubs
+// that don't support the suffix stop all threads, Continue then resumes
+// the other threads (see proc.Breakpoint.CheckCondition). The same
+// happens while an internal breakpoint, which must stop all threads,
+// overlaps the thread breakpoint.
+func (p *Process) SetThreadBreakpoint(addr uint64, threadID int, kind proc.BreakpointKind, cond ast.Expr) (*proc.Breakpoint, error) {
+	if kind != proc.UserBreakpoint {
+		return nil, errors.New("only user breakpoints can be restricted to a thread")
+	}
+	th, ok := p.threads[threadID]
+	if !ok {
+		return nil, fmt.Errorf("thread %d does not exist", threadID)
+	}
+	if bp, ok := p.breakpoints.M[addr]; ok {
+		if bp.IsUser() {
+			return bp, proc.BreakpointExistsError{File: bp.File, Line: bp.Line, Addr: bp.Addr}
+		}
+		// the internal breakpoint stays installed for all threads
+		bp.ThreadID = threadID
+		return p.breakpoints.Set(addr, kind, cond, p.writeBreakpoint)
+	}
+	bp, err := p.breakpoints.Set(addr, kind, cond, func(addr uint64) (string, int, *proc.Function, []byte, error) {
+		f, l, fn := p.bi.PCToLine(addr)
+		if fn == nil {
+			return "", 0, nil, nil, proc.InvalidAddressError{Address: addr}
+		}
+		return f, l, fn, nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bp.ThreadID = threadID
+	if !p.breakpointsSuspended {
+		if err := p.conn.setThreadBreakpoint(addr, th.strID); err != nil {
+			delete(p.breakpoints.M, addr)
+			return nil, err
+		}
+	}
+	p.trackBreakpointLibrary(addr)
+	return bp, nil
+}
+
+// installBreakpoint sets the breakpoint at addr in the stub, restricted
+// to its thread if it is a thread breakpoint (see SetThreadBreakpoint).
+func (p *Process) installBreakpoint(addr uint64) error {
+	if bp := p.breakpoints.M[addr]; bp != nil && bp.ThreadID != 0 && bp.Kind == proc.UserBreakpoint {
+		if th := p.threads[bp.ThreadID]; th != nil {
+			return p.conn.setThreadBreakpoint(addr, th.strID)
+		}
+	}
+	return p.conn.setBreakpoint(addr)
 }
 
 func (p *Process) ClearBreakpoint(addr uint64) (*proc.Breakpoint, error) {
 	if p.exited {
 		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
 	}
-	return p.breakpoints.Clear(addr, func(bp *proc.Breakpoint) error {
-		return p.conn.clearBreakpoint(bp.Addr)
-	})
+	return p.breakpoints.Clear(addr, func(bp *proc.Breakpoint) error {
+		if bp.Disabled {
+			return nil
+		}
+		return p.conn.clearBreakpoint(bp.Addr)
+	})
+}
+
+// ClearAllBreakpoints removes all user breakpoints, internal breakpoints
+// are left in place. It does nothing if the process exited.
+// Breakpoints are removed from the stub one at a time, errors do not stop
+// the removal of the remaining breakpoints and are returned together once
+// all of them have been removed. User breakpoints are always deleted from
+// the list of breakpoints, even if the stub could not remove them.
+func (p *Process) ClearAllBreakpoints() error {
+	if p.exited {
+		return nil
+	}
+	var errs []string
+	for addr, bp := range p.breakpoints.M {
+		if !bp.IsUser() {
+			continue
+		}
+		_, err := p.breakpoints.Clear(addr, func(bp *proc.Breakpoint) error {
+			if bp.Disabled {
+				return nil
+			}
+			return p.conn.clearBreakpoint(bp.Addr)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%#x: %v", addr, err))
+			delete(p.breakpoints.M, addr)
+		}
+		if _, ok := p.breakpoints.M[addr]; !ok {
+			delete(p.breakpointLibs, addr)
+			for _, thread := range p.threads {
+				if thread.CurrentBreakpoint.Breakpoint == bp {
+					thread.clearBreakpointState()
+				}
+			}
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("could not clear breakpoint at %s", errs[0])
+	default:
+		sort.Strings(errs)
+		return fmt.Errorf("could not clear %d breakpoints: %s", len(errs), strings.Join(errs, ", "))
+	}
 }
 
 func (p *Process) ClearInternalBreakpoints() error {
+	// disabled user breakpoints overlapping internal breakpoints must be
+	// removed from the stub
+	var uninstall []uint64
+	for addr, bp := range p.breakpoints.M {
+		if bp.Disabled && bp.IsUser() && bp.IsInternal() {
+			uninstall = append(uninstall, addr)
+		}
+	}
+	defer func() {
+		for _, addr := range uninstall {
+			if bp, ok := p.breakpoints.M[addr]; ok && !bp.Installed() && !p.breakpointsSuspended {
+				p.conn.clearBreakpoint(addr)
+			}
+		}
+	}()
 	return p.breakpoints.ClearInternalBreakpoints(func(bp *proc.Breakpoint) error {
 		if err := p.conn.clearBreakpoint(bp.Addr); err != nil {
 			return err
@@ -1001,18 +4103,20 @@ func (tu *threadUpdater) Add(threads []string) error {
 		tu.seen = map[int]bool{}
 	}
 	for _, threadID := range threads {
-		b := threadID
-		if period := strings.Index(b, "."); period >= 0 {
-			b = b[period+1:]
-		}
-		n, err := strconv.ParseUint(b, 16, 32)
+		pid, tid, err := parseMultiprocessThreadID(threadID)
 		if err != nil {
-			return &GdbMalformedThreadIDError{threadID}
+			return err
+		}
+		if pid > 0 {
+			tu.p.addInferior(pid)
+			if tu.p.conn.pid > 0 && pid != tu.p.conn.pid {
+				// thread of a process other than the selected one
+				continue
+			}
 		}
-		tid := int(n)
 		tu.seen[tid] = true
 		if _, found := tu.p.threads[tid]; !found {
-			tu.p.threads[tid] = &Thread{ID: tid, strID: threadID, p: tu.p}
+			tu.p.threads[tid] = &Thread{ID: tid, strID: threadID, p: tu.p, core: -1}
 		}
 	}
 	return nil
@@ -1025,16 +4129,7 @@ func (tu *threadUpdater) Finish() {
 		if threadSeen {
 			continue
 		}
-		delete(tu.p.threads, threadID)
-		if tu.p.currentThread.ID == threadID {
-			tu.p.currentThread = nil
-		}
-	}
-	if tu.p.currentThread != nil {
-		if _, exists := tu.p.threads[tu.p.currentThread.ID]; !exists {
-			// current thread was removed
-			tu.p.currentThread = nil
-		}
+		tu.p.removeThread(threadID)
 	}
 	if tu.p.currentThread == nil {
 		for _, thread := range tu.p.threads {
@@ -1044,6 +4139,201 @@ func (tu *threadUpdater) Finish() {
 	}
 }
 
+// parseThreadID parses a thread ID in the format used by the stub, with or
+// without the process ID (i.e. "p<pid>.<tid>" or "<tid>").
+func parseThreadID(threadID string) (int, error) {
+	_, tid, err := parseMultiprocessThreadID(threadID)
+	return tid, err
+}
+
+// parseMultiprocessThreadID is like parseThreadID but also returns the
+// process ID, which is 0 if threadID doesn't have one.
+func parseMultiprocessThreadID(threadID string) (pid, tid int, err error) {
+	b := threadID
+	if period := strings.Index(b, "."); period >= 0 {
+		if !strings.HasPrefix(b, "p") {
+			return 0, 0, &GdbMalformedThreadIDError{threadID}
+		}
+		n, err := strconv.ParseUint(b[1:period], 16, 32)
+		if err != nil {
+			return 0, 0, &GdbMalformedThreadIDError{threadID}
+		}
+		pid = int(n)
+		b = b[period+1:]
+	}
+	n, err := strconv.ParseUint(b, 16, 32)
+	if err != nil {
+		return 0, 0, &GdbMalformedThreadIDError{threadID}
+	}
+	return pid, int(n), nil
+}
+
+func (p *Process) addInferior(pid int) {
+	if p.inferiors == nil {
+		p.inferiors = make(map[int]bool)
+	}
+	p.inferiors[pid] = true
+}
+
+// Processes returns the PIDs of all the processes managed by the stub.
+// Unless the stub is in multiprocess mode (gdbserver in extended-remote
+// mode) this is only the PID of the target process.
+func (p *Process) Processes() []int {
+	pids := []int{p.conn.pid}
+	for pid := range p.inferiors {
+		if pid != p.conn.pid {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// InferiorExits returns the processes, other than the selected one, that
+// exited while the target was running, in the order the stub reported
+// them, and forgets them.
+func (p *Process) InferiorExits() []proc.ProcessExitedError {
+	exits := p.inferiorExits
+	p.inferiorExits = nil
+	return exits
+}
+
+// ErrInferiorStopped is returned by ContinueOnce when a thread of a
+// process managed by the stub, other than the selected one, stops. The
+// selected process doesn't change: use SelectProcess to examine the
+// process that stopped.
+type ErrInferiorStopped struct {
+	Pid      int    // process that stopped
+	ThreadID string // thread that stopped, as reported by the stub
+	Signal   uint8  // signal the thread stopped with
+}
+
+func (err *ErrInferiorStopped) Error() string {
+	return fmt.Sprintf("process %d stopped on thread %s with signal %#x", err.Pid, err.ThreadID, err.Signal)
+}
+
+// SelectProcess makes pid, which must be one of the processes returned by
+// Processes, the target process: the list of threads, memory reads and
+// writes and new breakpoints will refer to it.
+// Breakpoints already set are not moved to the new process and the binary
+// info is not reloaded, so the new process should be running the same
+// executable (i.e. be a fork of the old one).
+func (p *Process) SelectProcess(pid int) error {
+	if p.exited {
+		return proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if pid == p.conn.pid {
+		return nil
+	}
+	if !p.inferiors[pid] {
+		return fmt.Errorf("process %d is not managed by the stub", pid)
+	}
+	if !p.conn.threadSuffixSupported {
+		// select any thread of the new process so that memory reads and
+		// writes go to it.
+		if err := p.conn.selectThread('g', fmt.Sprintf("p%x.0", pid), "select process"); err != nil {
+			return err
+		}
+	}
+	p.conn.pid = pid
+	p.allGCache = nil
+	p.goroutineStats = nil
+	p.threads = make(map[int]*Thread)
+	p.currentThread = nil
+	if err := p.updateThreadList(&threadUpdater{p: p}); err != nil {
+		return err
+	}
+	p.syncCurrentThread()
+	p.loadSelectedGoroutine()
+	return nil
+}
+
+// syncCurrentThread makes the stub's current thread, as reported by qC,
+// the current thread. Without it the current thread is picked arbitrarily
+// from the thread list, which can disagree with the thread the stub uses
+// for commands that don't select one.
+// This is best effort: the current thread is not changed if the stub
+// doesn't support qC, reports a thread that we don't know about or the
+// query fails.
+func (p *Process) syncCurrentThread() {
+	threadID, err := p.conn.queryCurrentThread()
+	if err != nil {
+		if _, isProtocolError := err.(*GdbProtocolError); !isProtocolError && logflags.GdbWire() {
+			fmt.Fprintf(os.Stderr, "could not read the current thread: %v\n", err)
+		}
+		return
+	}
+	tid, err := parseThreadID(threadID)
+	if err != nil {
+		if logflags.GdbWire() {
+			fmt.Fprintf(os.Stderr, "could not read the current thread: %v\n", err)
+		}
+		return
+	}
+	if th, ok := p.threads[tid]; ok {
+		p.currentThread = th
+	}
+}
+
+// removeThread removes a thread that exited from the list of threads, if
+// it was the current thread a different thread is selected. If the
+// selected goroutine was running on the thread it is deselected, it will
+// be read again from the current thread after the next stop.
+func (p *Process) removeThread(tid int) {
+	delete(p.threads, tid)
+	if p.currentThread != nil && p.currentThread.ID == tid {
+		p.currentThread = nil
+		for _, thread := range p.threads {
+			p.currentThread = thread
+			break
+		}
+	}
+	if g := p.selectedGoroutine; g != nil && g.Thread != nil && g.Thread.ThreadID() == tid {
+		p.selectedGoroutine = nil
+	}
+}
+
+// maxThreadCount is the maximum number of threads we accept from
+// qfThreadInfo/qsThreadInfo, protects us from stubs that never terminate
+// the list.
+const maxThreadCount = 1 << 16
+
+// queryAllThreads reads the full list of threads using qfThreadInfo and
+// qsThreadInfo. The list is only returned if all pages were received and
+// well formed, so that a stub misbehaving in the middle of the list can't
+// cause us to discard threads that still exist.
+func (p *Process) queryAllThreads() ([]string, error) {
+	var threads []string
+	seen := make(map[string]bool)
+	for first := true; ; first = false {
+		page, err := p.conn.queryThreads(first)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			return threads, nil
+		}
+		added := false
+		for _, threadID := range page {
+			if _, _, err := parseMultiprocessThreadID(threadID); err != nil {
+				return nil, err
+			}
+			if seen[threadID] {
+				continue
+			}
+			seen[threadID] = true
+			added = true
+			threads = append(threads, threadID)
+		}
+		if !added {
+			return nil, errors.New("malformed qsThreadInfo response: page contains only threads already listed")
+		}
+		if len(threads) > maxThreadCount {
+			return nil, fmt.Errorf("too many threads listed by qsThreadInfo (more than %d)", maxThreadCount)
+		}
+	}
+}
+
 // updateThreadsList retrieves the list of inferior threads from the stub
 // and passes it to the threadUpdater.
 // Then it reloads the register information for all running threads.
@@ -1052,47 +4342,308 @@ func (tu *threadUpdater) Finish() {
 // thread list and the first step of updateThreadList will be skipped.
 // Registers are always reloaded.
 func (p *Process) updateThreadList(tu *threadUpdater) error {
+	if err := p.queryThreadList(tu); err != nil {
+		return err
+	}
+	if err := p.updateThreadStopInfo(); err != nil {
+		return err
+	}
+	p.invalidateRegisters()
+	return nil
+}
+
+// queryThreadList updates the list of threads, unless tu already received
+// it from the stop packet.
+func (p *Process) queryThreadList(tu *threadUpdater) error {
+	if !tu.done && p.conn.threadsXferSupported {
+		if err := p.updateThreadsInfo(tu); err != nil {
+			return err
+		}
+	}
 	if !tu.done {
-		first := true
-		for {
-			threads, err := p.conn.queryThreads(first)
-			if err != nil {
-				return err
-			}
-			if len(threads) == 0 {
-				break
-			}
-			first = false
-			if err := tu.Add(threads); err != nil {
-				return err
-			}
+		threads, err := p.queryAllThreads()
+		if err != nil {
+			return err
+		}
+		if err := tu.Add(threads); err != nil {
+			return err
 		}
-
 		tu.Finish()
 	}
+	return nil
+}
 
-	if p.threadStopInfo {
-		for _, th := range p.threads {
-			sig, reason, err := p.conn.threadStopInfo(th.strID)
-			if err != nil {
-				if isProtocolErrorUnsupported(err) {
-					p.threadStopInfo = false
-					break
-				}
-				return err
+// updateThreadStopInfo reads the stop reason of all threads using
+// qThreadStopInfo, if the stub supports it. Threads are queried in order of
+// ID.
+func (p *Process) updateThreadStopInfo() error {
+	if !p.threadStopInfo {
+		return nil
+	}
+	threads := make([]*Thread, 0, len(p.threads))
+	for _, th := range p.threads {
+		threads = append(threads, th)
+	}
+	sort.Slice(threads, func(i, j int) bool { return threads[i].ID < threads[j].ID })
+	for _, th := range threads {
+		sp, err := p.conn.threadStopInfo(th.strID)
+		if err != nil {
+			if isProtocolErrorUnsupported(err) {
+				p.threadStopInfo = false
+				return nil
 			}
-			th.setbp = (reason == "breakpoint" || (reason == "" && sig == breakpointSignal))
+			return err
 		}
+		th.setStopInfo(sp)
 	}
+	return nil
+}
 
+// invalidateRegisters discards the registers of all threads after the
+// target ran, each thread reads them again the first time they are used,
+// see Thread.loadRegisters.
+func (p *Process) invalidateRegisters() {
 	for _, thread := range p.threads {
-		if err := thread.reloadRegisters(); err != nil {
+		thread.regsLoaded = false
+	}
+}
+
+// setStopInfo sets the breakpoint and preemption state of the thread, and
+// its stop reasons, from the stop reply sp reported by the stub.
+func (t *Thread) setStopInfo(sp stopPacket) {
+	t.setbp = sp.atBreakpoint()
+	t.preempted = sp.sig != 0 && sp.sig == preemptSignal(t.p.bi.GOOS, t.p.conn.gdbSignalNumbers())
+	t.stopReasons = sp.reasons
+}
+
+// updateThreadsInfo reads the list of threads, their names and the CPU core
+// they are running on using qXfer:threads:read.
+// If tu is not nil the list of threads is also passed to it, otherwise only
+// the name and core of the known threads are updated.
+// If the stub turns out not to support qXfer:threads:read it does nothing.
+func (p *Process) updateThreadsInfo(tu *threadUpdater) error {
+	infos, err := p.conn.queryThreadsXfer()
+	if err != nil {
+		if isProtocolErrorUnsupported(err) {
+			p.conn.threadsXferSupported = false
+			return nil
+		}
+		return err
+	}
+	if tu != nil {
+		threads := make([]string, len(infos))
+		for i := range infos {
+			threads[i] = infos[i].ID
+		}
+		if err := tu.Add(threads); err != nil {
+			return err
+		}
+		tu.Finish()
+	}
+	for _, info := range infos {
+		tid, err := parseThreadID(info.ID)
+		if err != nil {
 			return err
 		}
+		th, ok := p.threads[tid]
+		if !ok {
+			continue
+		}
+		th.name = info.Name
+		th.core = -1
+		if core, err := strconv.Atoi(info.Core); err == nil {
+			th.core = core
+		}
 	}
+	p.threadsInfoGen = p.conn.stopGen
+	p.threadsInfoValid = true
 	return nil
 }
 
+// loadThreadsInfo makes sure the name and core of all threads is up to date
+// for the current stop.
+func (p *Process) loadThreadsInfo() {
+	if !p.conn.threadsXferSupported || p.exited {
+		return
+	}
+	if p.threadsInfoValid && p.threadsInfoGen == p.conn.stopGen {
+		return
+	}
+	p.updateThreadsInfo(nil)
+}
+
+// Name returns the name of the thread, as reported by qXfer:threads:read,
+// or the empty string if the stub doesn't report thread names.
+func (t *Thread) Name() string {
+	t.p.loadThreadsInfo()
+	return t.name
+}
+
+// Core returns the CPU core the thread is running on, as reported by
+// qXfer:threads:read, or -1 if it is unknown.
+func (t *Thread) Core() int {
+	t.p.loadThreadsInfo()
+	return t.core
+}
+
+// CPUCore returns the CPU core the thread is running on. It is read from
+// qXfer:threads:read, from the stop packet (for the thread that stopped)
+// or, failing that, from the description returned by qThreadExtraInfo;
+// the result is cached until the target is resumed.
+// Returns false if the stub doesn't report it.
+func (t *Thread) CPUCore() (int, bool) {
+	if core := t.Core(); core >= 0 {
+		return core, true
+	}
+	if !t.stopCoreKnown || t.stopCoreGen != t.p.conn.stopGen {
+		t.stopCore = -1
+		if !t.p.conn.threadExtraInfoUnsupported && !t.p.exited {
+			info, err := t.p.conn.threadExtraInfo(t.strID)
+			if isProtocolErrorUnsupported(err) {
+				t.p.conn.threadExtraInfoUnsupported = true
+			}
+			if err == nil {
+				t.stopCore = parseThreadExtraInfoCore(info)
+			}
+		}
+		t.stopCoreGen, t.stopCoreKnown = t.p.conn.stopGen, true
+	}
+	return t.stopCore, t.stopCore >= 0
+}
+
+// threadExtraInfoCoreRegexp matches the ways stubs describe the CPU core
+// of a thread in qThreadExtraInfo, for example "Core: 3" or, in QEMU,
+// where each thread is a virtual CPU, "CPU#3 [running]".
+var threadExtraInfoCoreRegexp = regexp.MustCompile(`(?i)\b(?:core|cpu)\s*[:#=]?\s*(\d+)`)
+
+// parseThreadExtraInfoCore returns the CPU core mentioned in info, the
+// description of a thread returned by qThreadExtraInfo, or -1.
+func parseThreadExtraInfoCore(info string) int {
+	m := threadExtraInfoCoreRegexp.FindStringSubmatch(info)
+	if m == nil {
+		return -1
+	}
+	core, err := strconv.Atoi(m[1])
+	if err != nil {
+		return -1
+	}
+	return core
+}
+
+// NUMANode returns the NUMA node of the CPU core the thread is running on,
+// see CPUCore. The topology of the machine is read from sysfs, so this
+// only works for linux targets when the stub was started by us on the
+// local machine; false is returned otherwise.
+func (t *Thread) NUMANode() (int, bool) {
+	core, ok := t.CPUCore()
+	if !ok || t.p.bi.GOOS != "linux" || t.p.process == nil || t.p.stubTransport != nil {
+		return 0, false
+	}
+	if t.p.numaNodes == nil {
+		nodes, err := readNUMANodes(sysfsNodeDir)
+		if err != nil {
+			nodes = map[int]int{}
+		}
+		t.p.numaNodes = nodes
+	}
+	node, ok := t.p.numaNodes[core]
+	return node, ok
+}
+
+// sysfsNodeDir is the directory describing the NUMA nodes of the machine.
+const sysfsNodeDir = "/sys/devices/system/node"
+
+// readNUMANodes reads the NUMA topology from dir, the node directory of
+// sysfs, and returns the NUMA node of each CPU core.
+func readNUMANodes(dir string) (map[int]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "node*", "cpulist"))
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[int]int)
+	for _, path := range paths {
+		node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(filepath.Dir(path)), "node"))
+		if err != nil {
+			continue
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// cpulist is a list of ranges, for example "0-3,8-11"
+		for _, r := range strings.Split(strings.TrimSpace(string(buf)), ",") {
+			if r == "" {
+				continue
+			}
+			lo, hi := r, r
+			if dash := strings.Index(r, "-"); dash >= 0 {
+				lo, hi = r[:dash], r[dash+1:]
+			}
+			first, err1 := strconv.Atoi(lo)
+			last, err2 := strconv.Atoi(hi)
+			if err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("malformed cpulist %q in %s", buf, path)
+			}
+			for core := first; core <= last; core++ {
+				nodes[core] = node
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// StackUsage returns how many bytes of the stack the thread is executing
+// on are in use, the distance between the top of the stack and the stack
+// pointer, and the size of the stack. The bounds of the stack are read
+// from the goroutine the thread is running.
+// A goroutine stack grows when it is full, so the result is only
+// interesting relative to the maximum stack size set by
+// debug.SetMaxStack. When the thread executes on the system stack the
+// usage is the one of the system stack (see proc.ThreadStackBounds),
+// which can not grow: used close to total means that the thread is about
+// to overflow it. If the stack pointer is below the stack used is greater
+// than total, the stack overflowed.
+func (t *Thread) StackUsage() (used, total uint64, err error) {
+	if t.p.exited {
+		return 0, 0, &proc.ProcessExitedError{Pid: t.p.conn.pid}
+	}
+	regs, err := t.Registers(false)
+	if err != nil {
+		return 0, 0, err
+	}
+	lo, hi, _, err := proc.ThreadStackBounds(t)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not read the stack bounds of thread %d: %v", t.ID, err)
+	}
+	return stackUsage(regs.SP(), lo, hi)
+}
+
+// GoroutineStackUsage is like Thread.StackUsage for goroutine g. If g is
+// not running on a thread its usage is computed from the stack pointer
+// saved when it was parked.
+func (p *Process) GoroutineStackUsage(g *proc.G) (used, total uint64, err error) {
+	if th, ok := g.Thread.(*Thread); ok && th != nil {
+		return th.StackUsage()
+	}
+	if g.SP == 0 {
+		return 0, 0, fmt.Errorf("goroutine %d has no saved stack pointer", g.ID)
+	}
+	lo, hi := g.StackBounds()
+	return stackUsage(g.SP, lo, hi)
+}
+
+// stackUsage returns the usage of the stack [lo, hi) when the stack
+// pointer is sp, see Thread.StackUsage.
+func stackUsage(sp, lo, hi uint64) (used, total uint64, err error) {
+	if lo == 0 || hi <= lo {
+		return 0, 0, fmt.Errorf("invalid stack bounds [%#x, %#x)", lo, hi)
+	}
+	if sp > hi {
+		return 0, 0, fmt.Errorf("stack pointer %#x is not in stack [%#x, %#x)", sp, lo, hi)
+	}
+	return hi - sp, hi - lo, nil
+}
+
 func (p *Process) setCurrentBreakpoints() error {
 	if p.threadStopInfo {
 		for _, th := range p.threads {
@@ -1114,18 +4665,142 @@ func (p *Process) setCurrentBreakpoints() error {
 			}
 		}
 	}
-	return nil
+	return nil
+}
+
+// memCache caches the contents of read-only memory for the duration of a
+// stop of the inferior.
+type memCache struct {
+	gen     uint64 // value of conn.stopGen when the cache was filled
+	entries []memCacheEntry
+	regions []memoryRegion
+}
+
+type memCacheEntry struct {
+	addr uint64
+	data []byte
+}
+
+// SetMemoryCache enables or disables caching of memory reads.
+// When enabled, reads of read-only memory (as reported by
+// qMemoryRegionInfo) are served from a cache that is discarded every time
+// the inferior is resumed. Stubs that do not support qMemoryRegionInfo
+// will not benefit from the cache.
+func (p *Process) SetMemoryCache(enabled bool) {
+	if !enabled {
+		p.memcache = nil
+		return
+	}
+	if p.memcache == nil {
+		p.memcache = &memCache{gen: p.conn.stopGen}
+	}
+}
+
+// readOnly returns true if the sz bytes starting at addr are all contained
+// in a memory region that is not writable.
+func (p *Process) readOnly(addr uint64, sz int) bool {
+	for i := range p.memcache.regions {
+		if r := &p.memcache.regions[i]; r.contains(addr, sz) {
+			return r.permissions != "" && !strings.Contains(r.permissions, "w")
+		}
+	}
+	if p.conn.memoryRegionInfoUnsupported {
+		return false
+	}
+	r, err := p.conn.memoryRegionInfo(addr)
+	if err != nil {
+		if isProtocolErrorUnsupported(err) {
+			p.conn.memoryRegionInfoUnsupported = true
+		}
+		return false
+	}
+	p.memcache.regions = append(p.memcache.regions, r)
+	return r.contains(addr, sz) && r.permissions != "" && !strings.Contains(r.permissions, "w")
+}
+
+func (p *Process) readMemory(data []byte, addr uintptr) error {
+	if p.memcache == nil {
+		return p.conn.readMemory(data, addr)
+	}
+	if p.memcache.gen != p.conn.stopGen {
+		*p.memcache = memCache{gen: p.conn.stopGen}
+	}
+	for _, e := range p.memcache.entries {
+		if uint64(addr) >= e.addr && uint64(addr)+uint64(len(data)) <= e.addr+uint64(len(e.data)) {
+			copy(data, e.data[uint64(addr)-e.addr:])
+			return nil
+		}
+	}
+	if !p.readOnly(uint64(addr), len(data)) {
+		return p.conn.readMemory(data, addr)
+	}
+	if err := p.conn.readMemory(data, addr); err != nil {
+		return err
+	}
+	p.memcache.entries = append(p.memcache.entries, memCacheEntry{addr: uint64(addr), data: append([]byte(nil), data...)})
+	return nil
+}
+
+func (t *Thread) ReadMemory(data []byte, addr uintptr) (n int, err error) {
+	err = t.p.readMemory(data, addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// MaxMemReadSize is the largest single read done with a size taken from
+// the target's memory, like the length of a string or the size of a value.
+// It is not a clamp: a larger size is considered corrupt and the read is
+// refused with an error (ReadGoString, GoroutineStats) or done piecemeal
+// (ReadValue).
+const MaxMemReadSize = 1 << 24
+
+// ReadGoString reads the Go string whose header (pointer and length) is
+// stored at headerAddr. If maxLen is not negative the string is truncated
+// to its first maxLen bytes, this only happens after the length in the
+// header was checked against MaxMemReadSize.
+// This takes two round trips with the stub, one for the header and one for
+// the contents, as long as the contents fit into a single packet.
+func (t *Thread) ReadGoString(headerAddr uint64, maxLen int) (string, error) {
+	ptrsz := t.p.bi.Arch.PtrSize()
+	hdr := make([]byte, 2*ptrsz)
+	if _, err := t.ReadMemory(hdr, uintptr(headerAddr)); err != nil {
+		return "", err
+	}
+	order := t.p.order()
+	ptr, strlen := uintAt(order, hdr[:ptrsz]), uintAt(order, hdr[ptrsz:])
+	if err := checkStringLen(headerAddr, strlen); err != nil {
+		return "", err
+	}
+	if maxLen >= 0 && strlen > uint64(maxLen) {
+		strlen = uint64(maxLen)
+	}
+	if strlen == 0 {
+		return "", nil
+	}
+	buf := make([]byte, strlen)
+	if _, err := t.ReadMemory(buf, uintptr(ptr)); err != nil {
+		return "", err
+	}
+	return string(buf), nil
 }
 
-func (t *Thread) ReadMemory(data []byte, addr uintptr) (n int, err error) {
-	err = t.p.conn.readMemory(data, addr)
-	if err != nil {
-		return 0, err
+// checkStringLen returns an error if strlen, the length of the string
+// whose header is at headerAddr, is larger than MaxMemReadSize.
+func checkStringLen(headerAddr, strlen uint64) error {
+	if strlen > MaxMemReadSize {
+		return fmt.Errorf("string at %#x has implausible length %d", headerAddr, strlen)
 	}
-	return len(data), nil
+	return nil
 }
 
 func (t *Thread) WriteMemory(addr uintptr, data []byte) (written int, err error) {
+	if t.p.memcache != nil {
+		// we could be writing to memory that we thought read-only, for example
+		// when patching code.
+		t.p.memcache.entries = nil
+	}
 	return t.p.conn.writeMemory(addr, data)
 }
 
@@ -1136,7 +4811,45 @@ func (t *Thread) Location() (*proc.Location, error) {
 	}
 	pc := regs.PC()
 	f, l, fn := t.p.bi.PCToLine(pc)
-	return &proc.Location{PC: pc, File: f, Line: l, Fn: fn}, nil
+	loc := &proc.Location{PC: pc, File: f, Line: l, Fn: fn}
+	if f == "" && fn == nil {
+		loc.Desc = t.p.describePC(pc)
+	}
+	return loc, nil
+}
+
+// stopSharedLibraries returns the result of SharedLibraries, which is
+// read at most once for every stop of the target.
+func (p *Process) stopSharedLibraries() ([]SharedLibrary, error) {
+	if !p.stopLibsValid || p.stopLibsGen != p.conn.stopGen {
+		p.stopLibs, p.stopLibsErr = p.SharedLibraries()
+		p.stopLibsGen, p.stopLibsValid = p.conn.stopGen, true
+	}
+	return p.stopLibs, p.stopLibsErr
+}
+
+// describePC returns a description of where pc is mapped in the address
+// space of the inferior, for PCs that have no debug info.
+func (p *Process) describePC(pc uint64) string {
+	if libs, err := p.stopSharedLibraries(); err == nil {
+		for _, lib := range libs {
+			if lib.TextEnd != 0 && pc >= lib.TextStart && pc < lib.TextEnd {
+				return fmt.Sprintf("PC %#x in %s (no debug info)", pc, lib.Name)
+			}
+		}
+	}
+	if !p.conn.memoryRegionInfoUnsupported {
+		r, err := p.conn.memoryRegionInfo(pc)
+		switch {
+		case err == nil && (r.permissions == "" || !r.contains(pc, 1)):
+			return fmt.Sprintf("PC %#x not in any mapped region", pc)
+		case err == nil:
+			return fmt.Sprintf("PC %#x in anonymous %s mapping %#x-%#x (no debug info)", pc, r.permissions, r.start, r.start+r.size)
+		case isProtocolErrorUnsupported(err):
+			p.conn.memoryRegionInfoUnsupported = true
+		}
+	}
+	return fmt.Sprintf("PC %#x (no debug info)", pc)
 }
 
 func (t *Thread) Breakpoint() proc.BreakpointState {
@@ -1148,9 +4861,41 @@ func (t *Thread) ThreadID() int {
 }
 
 func (t *Thread) Registers(floatingPoint bool) (proc.Registers, error) {
+	if err := t.loadRegisters(); err != nil {
+		return nil, err
+	}
 	return &t.regs, nil
 }
 
+// RegisterByName returns the value of the register called name by the stub
+// (for example "rax" or "eflags"), registers smaller than 64 bits are zero
+// extended. Returns false if the stub doesn't have a register with that
+// name or if the register is larger than 64 bits.
+func (t *Thread) RegisterByName(name string) (uint64, bool) {
+	if err := t.loadRegisters(); err != nil {
+		return 0, false
+	}
+	return t.regs.value(name)
+}
+
+// SetRegisterByName sets the register called name by the stub to value and
+// writes it to the inferior. Registers larger than 64 bits must be set with
+// SetBytes.
+func (t *Thread) SetRegisterByName(name string, value uint64) error {
+	if err := t.loadRegisters(); err != nil {
+		return err
+	}
+	reg, ok := t.regs.regs[name]
+	if !ok {
+		return fmt.Errorf("unknown register %s", name)
+	}
+	if len(reg.value) > 8 {
+		return fmt.Errorf("register %s is larger than 64 bits", name)
+	}
+	t.regs.setValue(reg, value)
+	return t.writeSomeRegisters(name)
+}
+
 func (t *Thread) Arch() proc.Arch {
 	return t.p.bi.Arch
 }
@@ -1159,26 +4904,392 @@ func (t *Thread) BinInfo() *proc.BinaryInfo {
 	return &t.p.bi
 }
 
+// ErrGUnavailable is returned by ReadG and ReadM when the address of the G
+// struct of a thread can not be determined because the thread is blocked.
+var ErrGUnavailable = errors.New("G address unavailable, thread is blocked")
+
+// ReadG returns the goroutine currently running on the thread. If the
+// thread is executing on the system stack the returned goroutine will be
+// the one that switched to it and its SystemStack field will be set.
+func (t *Thread) ReadG() (*proc.G, error) {
+	if err := t.loadRegisters(); err != nil {
+		return nil, err
+	}
+	if gaddr, hasgaddr := t.regs.GAddr(); hasgaddr && gaddr == 0 {
+		return nil, ErrGUnavailable
+	}
+	return proc.GetG(t)
+}
+
+// ReadM follows the m field of the thread's G and returns the runtime.m
+// struct of the thread, loaded using cfg.
+func (t *Thread) ReadM(cfg proc.LoadConfig) (*proc.Variable, error) {
+	if err := t.loadRegisters(); err != nil {
+		return nil, err
+	}
+	if gaddr, hasgaddr := t.regs.GAddr(); hasgaddr && gaddr == 0 {
+		return nil, ErrGUnavailable
+	}
+	scope, err := proc.GoroutineScope(t)
+	if err != nil {
+		return nil, err
+	}
+	return scope.EvalExpression("*runtime.curg.m", cfg)
+}
+
+// ReadValue reads the value of type typ stored at addr and loads it using
+// cfg. The whole value, typ.Size() bytes, is read at once and its fields
+// or elements are then decoded locally instead of being read one at a
+// time. Values larger than MaxMemReadSize are read piecemeal.
+// Memory referenced by the value (the targets of pointers, the contents
+// of strings, slices, maps, channels and interfaces) is outside of its
+// extent and is read separately, when cfg asks for it to be loaded.
+// Errors reading parts of the value are reported, as usual, by the
+// Unreadable field of the returned variable and of its children.
+func (p *Process) ReadValue(addr uint64, typ godwarf.Type, cfg proc.LoadConfig) (*proc.Variable, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	if p.currentThread == nil {
+		return nil, errors.New("no current thread")
+	}
+	var mem proc.MemoryReadWriter = p.currentThread
+	if sz := typ.Size(); sz > 0 && sz <= MaxMemReadSize {
+		mem = proc.CacheMemory(mem, uintptr(addr), int(sz))
+	}
+	return proc.LoadVariable("", uintptr(addr), typ, &p.bi, mem, cfg), nil
+}
+
+// GoroutineDefers returns the deferred calls pending on g, the most recent
+// first, see proc.G.Defers.
+func (p *Process) GoroutineDefers(g *proc.G) ([]proc.DeferRecord, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	return g.Defers()
+}
+
+// GoroutinePanics returns the active panics of g, the most recent first,
+// see proc.G.Panics.
+func (p *Process) GoroutinePanics(g *proc.G) ([]proc.PanicRecord, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	return g.Panics()
+}
+
 func (t *Thread) stepInstruction(tu *threadUpdater) error {
+	if err := t.loadRegisters(); err != nil {
+		return err
+	}
 	pc := t.regs.PC()
-	if _, atbp := t.p.breakpoints.M[pc]; atbp {
+	if t.p.installedBreakpointAt(pc) && !t.p.breakpointsSuspended {
 		err := t.p.conn.clearBreakpoint(pc)
 		if err != nil {
 			return err
 		}
-		defer t.p.conn.setBreakpoint(pc)
+		defer t.p.installBreakpoint(pc)
 	}
-	_, _, err := t.p.conn.step(t.strID, tu)
+	_, err := t.p.conn.step(t.strID, tu)
 	return err
 }
 
+// StepInstruction executes the next instruction of the thread.
+// Unlike a hardware single step, which executes a single iteration of a
+// string instruction with a REP prefix, the whole repeated operation is
+// executed, see stepOverRep. StepInstructions and StepUntil do not do this.
 func (t *Thread) StepInstruction() error {
-	if err := t.stepInstruction(&threadUpdater{p: t.p}); err != nil {
+	tu := &threadUpdater{p: t.p}
+	stepped, err := t.stepOverRep(tu)
+	if err != nil {
 		return err
 	}
+	if !stepped {
+		if err := t.stepInstruction(tu); err != nil {
+			return err
+		}
+	}
 	return t.reloadRegisters()
 }
 
+// stepOverRep executes the instruction at the thread's PC, if it is a
+// string instruction with a REP prefix, by setting a temporary breakpoint
+// after it and continuing the thread. Only the thread is resumed, the
+// step ends early if it stops for a different reason.
+// Returns false, without executing anything, if the instruction isn't a
+// repeated string instruction or when executing backwards.
+func (t *Thread) stepOverRep(tu *threadUpdater) (bool, error) {
+	if t.p.conn.direction != proc.Forward {
+		return false, nil
+	}
+	if err := t.loadRegisters(); err != nil {
+		return false, err
+	}
+	pc := t.regs.PC()
+	var buf [15]byte // maximum length of an x86 instruction
+	if _, err := t.ReadMemory(buf[:], uintptr(pc)); err != nil {
+		return false, nil
+	}
+	inst, err := x86asm.Decode(buf[:], 64)
+	if err != nil || !isRepStringInst(inst) {
+		return false, nil
+	}
+	next := pc + uint64(inst.Len)
+
+	if !t.p.conn.vContSupports('c') {
+		// without vCont we can't continue a single thread, step each
+		// iteration instead.
+		for t.regs.PC() == pc {
+			if err := t.stepInstruction(tu); err != nil {
+				return true, err
+			}
+			if err := t.readSomeRegisters(regnamePC); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+
+	if t.p.installedBreakpointAt(pc) && !t.p.breakpointsSuspended {
+		if err := t.p.conn.clearBreakpoint(pc); err != nil {
+			return true, err
+		}
+		defer t.p.installBreakpoint(pc)
+	}
+	if !t.p.installedBreakpointAt(next) || t.p.breakpointsSuspended {
+		if err := t.p.conn.setBreakpoint(next); err != nil {
+			return true, err
+		}
+		defer t.p.conn.clearBreakpoint(next)
+	}
+	_, err = t.p.conn.resumeThread(t.strID, tu)
+	return true, err
+}
+
+// isRepStringInst returns true if inst is a string instruction with a REP,
+// REPE or REPNE prefix.
+func isRepStringInst(inst x86asm.Inst) bool {
+	rep := false
+	for _, p := range inst.Prefix {
+		if p == 0 {
+			break
+		}
+		if p&0xff == x86asm.PrefixREP || p&0xff == x86asm.PrefixREPN {
+			rep = true
+		}
+	}
+	if !rep {
+		return false
+	}
+	switch inst.Op {
+	case x86asm.MOVSB, x86asm.MOVSW, x86asm.MOVSD, x86asm.MOVSQ,
+		x86asm.STOSB, x86asm.STOSW, x86asm.STOSD, x86asm.STOSQ,
+		x86asm.LODSB, x86asm.LODSW, x86asm.LODSD, x86asm.LODSQ,
+		x86asm.CMPSB, x86asm.CMPSW, x86asm.CMPSD, x86asm.CMPSQ,
+		x86asm.SCASB, x86asm.SCASW, x86asm.SCASD, x86asm.SCASQ,
+		x86asm.INSB, x86asm.INSW, x86asm.INSD,
+		x86asm.OUTSB, x86asm.OUTSW, x86asm.OUTSD:
+		return true
+	}
+	return false
+}
+
+// StepInstructions executes n instructions on the thread, registers are
+// reloaded only once, after the last instruction. Stepping stops early if
+// the thread reaches a breakpoint, in which case the thread's current
+// breakpoint is set.
+func (t *Thread) StepInstructions(n int) error {
+	if err := t.loadRegisters(); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			if t.p.installedBreakpointAt(t.regs.PC()) {
+				break
+			}
+		}
+		if err := t.stepInstruction(&threadUpdater{p: t.p}); err != nil {
+			return err
+		}
+		// we only need the value of PC to check for breakpoints
+		if err := t.readSomeRegisters(regnamePC); err != nil {
+			return err
+		}
+	}
+	if err := t.reloadRegisters(); err != nil {
+		return err
+	}
+	if t.p.installedBreakpointAt(t.regs.PC()) {
+		return t.SetCurrentBreakpoint()
+	}
+	return nil
+}
+
+// maxStepUntilInstructions is the maximum number of instructions that
+// StepUntil will execute.
+const maxStepUntilInstructions = 100000
+
+// StepUntil single steps the thread until the next instruction to execute
+// satisfies pred, for example:
+//
+//	t.StepUntil(func(inst x86asm.Inst) bool { return inst.Op == x86asm.CALL || inst.Op == x86asm.RET })
+//
+// stops the thread at the next CALL or RET instruction.
+// Like StepInstructions it stops early if the thread reaches a breakpoint
+// and reloads registers only once, at the end. If the instruction isn't
+// found after maxStepUntilInstructions steps an error is returned.
+func (t *Thread) StepUntil(pred func(inst x86asm.Inst) bool) error {
+	if err := t.loadRegisters(); err != nil {
+		return err
+	}
+	var buf [15]byte // maximum length of an x86 instruction
+	found := false
+	for i := 0; i < maxStepUntilInstructions; i++ {
+		if i > 0 {
+			if t.p.installedBreakpointAt(t.regs.PC()) {
+				found = true
+				break
+			}
+		}
+		if err := t.stepInstruction(&threadUpdater{p: t.p}); err != nil {
+			return err
+		}
+		if err := t.readSomeRegisters(regnamePC); err != nil {
+			return err
+		}
+		if _, err := t.ReadMemory(buf[:], uintptr(t.regs.PC())); err != nil {
+			return err
+		}
+		if inst, err := x86asm.Decode(buf[:], 64); err == nil && pred(inst) {
+			found = true
+			break
+		}
+	}
+	if err := t.reloadRegisters(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("instruction not found after %d steps", maxStepUntilInstructions)
+	}
+	if t.p.installedBreakpointAt(t.regs.PC()) {
+		return t.SetCurrentBreakpoint()
+	}
+	return nil
+}
+
+// CurrentInstruction decodes the instruction at the current PC of the
+// thread and returns it along with the current value of each of its
+// arguments, in the same order as inst.Args.
+// Registers are resolved with gdbRegisters.Get, memory arguments to the
+// value stored at their effective address (at most 8 bytes are read),
+// except for LEA where the effective address itself is returned, and
+// relative arguments to the target address. Immediates are returned
+// unchanged. RIP-relative addresses are computed from the address of the
+// next instruction.
+// CurrentInstruction never executes code on the thread: FS and GS relative
+// arguments are only resolved if the stub reports fs_base and gs_base.
+func (t *Thread) CurrentInstruction() (x86asm.Inst, []uint64, error) {
+	if err := t.loadRegisters(); err != nil {
+		return x86asm.Inst{}, nil, err
+	}
+	pc := t.regs.PC()
+	var buf [15]byte // maximum length of an x86 instruction
+	if _, err := t.ReadMemory(buf[:], uintptr(pc)); err != nil {
+		return x86asm.Inst{}, nil, err
+	}
+	inst, err := x86asm.Decode(buf[:], 64)
+	if err != nil {
+		return x86asm.Inst{}, nil, err
+	}
+	next := pc + uint64(inst.Len)
+
+	var vals []uint64
+	for _, arg := range inst.Args {
+		if arg == nil {
+			break
+		}
+		var v uint64
+		switch arg := arg.(type) {
+		case x86asm.Reg:
+			v, err = t.regs.Get(int(arg))
+		case x86asm.Mem:
+			v, err = t.effectiveAddress(inst, arg, next)
+			if err == nil && inst.Op != x86asm.LEA {
+				v, err = t.readOperand(v, inst.MemBytes)
+			}
+		case x86asm.Imm:
+			v = uint64(arg)
+		case x86asm.Rel:
+			v = next + uint64(int64(arg))
+		default:
+			err = fmt.Errorf("unsupported argument %v", arg)
+		}
+		if err != nil {
+			return inst, nil, fmt.Errorf("could not resolve argument %v of %v: %v", arg, inst, err)
+		}
+		vals = append(vals, v)
+	}
+	return inst, vals, nil
+}
+
+// effectiveAddress returns the address of the memory argument mem of
+// inst, which ends at next.
+func (t *Thread) effectiveAddress(inst x86asm.Inst, mem x86asm.Mem, next uint64) (uint64, error) {
+	addr := uint64(mem.Disp)
+	if op := inst.Opcode >> 24; op < 0xa0 || op > 0xa3 {
+		// x86asm zero extends 32 bit displacements, in 64 bit mode they are
+		// sign extended. Only the moffs forms of MOV (0xa0-0xa3) have a 64
+		// bit displacement.
+		addr = uint64(int64(int32(mem.Disp)))
+	}
+	switch mem.Base {
+	case 0:
+	case x86asm.RIP:
+		addr += next
+	default:
+		base, err := t.regs.Get(int(mem.Base))
+		if err != nil {
+			return 0, err
+		}
+		addr += base
+	}
+	if mem.Index != 0 {
+		index, err := t.regs.Get(int(mem.Index))
+		if err != nil {
+			return 0, err
+		}
+		addr += index * uint64(mem.Scale)
+	}
+	switch mem.Segment {
+	case x86asm.FS:
+		base, ok := t.regs.FSBase()
+		if !ok {
+			return 0, fmt.Errorf("%s not reported by the stub", regnameFsBase)
+		}
+		addr += base
+	case x86asm.GS:
+		base, ok := t.regs.GSBase()
+		if !ok {
+			return 0, fmt.Errorf("%s not reported by the stub", regnameGsBase)
+		}
+		addr += base
+	}
+	return addr, nil
+}
+
+// readOperand reads a memory operand of size bytes at addr, operands
+// larger than 8 bytes are truncated to their first 8 bytes.
+func (t *Thread) readOperand(addr uint64, size int) (uint64, error) {
+	if size <= 0 || size > 8 {
+		size = 8
+	}
+	var buf [8]byte
+	if _, err := t.ReadMemory(buf[:size], uintptr(addr)); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
 func (t *Thread) Blocked() bool {
 	regs, err := t.Registers(false)
 	if err != nil {
@@ -1203,6 +5314,39 @@ func (t *Thread) Blocked() bool {
 	return false
 }
 
+// freeLoadGInstr gives back to the inferior the memory allocated for the g
+// loading instruction. This is best effort, the memory is leaked if the stub
+// fails to free it.
+func (p *Process) freeLoadGInstr() {
+	if p.loadGInstrAddr == 0 || p.conn.conn == nil {
+		return
+	}
+	p.conn.deallocMemory(p.loadGInstrAddr)
+	p.loadGInstrAddr = 0
+}
+
+// tlsBaseRegister returns the name of the register containing the base of
+// the segment used by Go for thread local storage on goos.
+func tlsBaseRegister(goos string) string {
+	if goos == "linux" {
+		return regnameFsBase
+	}
+	return regnameGsBase
+}
+
+// hasTLSBaseRegister returns true if the stub reports the value of the
+// register returned by tlsBaseRegister, which lets reloadRegisters find the
+// address of G without executing instructions on the inferior.
+func (p *Process) hasTLSBaseRegister() bool {
+	name := tlsBaseRegister(p.bi.GOOS)
+	for _, reginfo := range p.conn.regsInfo {
+		if reginfo.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // loadGInstr returns the correct MOV instruction for the current
 // OS/architecture that can be executed to load the address of G from an
 // inferior's thread.
@@ -1227,6 +5371,29 @@ func (p *Process) loadGInstr() []byte {
 	return buf.Bytes()
 }
 
+// writeLoadGInstr writes the instruction returned by loadGInstr at addr
+// and reads it back to verify that it was written correctly.
+func (p *Process) writeLoadGInstr(addr uint64) bool {
+	movinstr := p.loadGInstr()
+	if _, err := p.conn.writeMemory(uintptr(addr), movinstr); err != nil {
+		return false
+	}
+	buf := make([]byte, len(movinstr))
+	if err := p.conn.readMemory(buf, uintptr(addr)); err != nil {
+		return false
+	}
+	return bytes.Equal(buf, movinstr)
+}
+
+// loadRegisters reads the registers of the thread, unless they were
+// already read after the target last ran.
+func (t *Thread) loadRegisters() error {
+	if t.regsLoaded {
+		return nil
+	}
+	return t.reloadRegisters()
+}
+
 // reloadRegisters loads the current value of the thread's registers.
 // It will also load the address of the thread's G.
 // Loading the address of G can be done in one of two ways reloadGAlloc, if
@@ -1235,6 +5402,7 @@ func (t *Thread) reloadRegisters() error {
 	if t.regs.regs == nil {
 		t.regs.regs = make(map[string]gdbRegister)
 		t.regs.regsInfo = t.p.conn.regsInfo
+		t.regs.byteOrder = t.p.conn.byteOrder
 
 		regsz := 0
 		for _, reginfo := range t.p.conn.regsInfo {
@@ -1264,15 +5432,17 @@ func (t *Thread) reloadRegisters() error {
 			}
 		}
 	}
-
-	switch t.p.bi.GOOS {
-	case "linux":
-		if reg, hasFsBase := t.regs.regs[regnameFsBase]; hasFsBase {
-			t.regs.gaddr = 0
-			t.regs.tls = binary.LittleEndian.Uint64(reg.value)
-			t.regs.hasgaddr = false
-			return nil
-		}
+	t.regsLoaded = true
+
+	if reg, hasTLSBase := t.regs.regs[tlsBaseRegister(t.p.bi.GOOS)]; hasTLSBase {
+		// The address of G is stored at GStructOffset from the base of the
+		// segment register used for thread local storage, no need to execute
+		// any instruction on the inferior: proc.GetG will read it from
+		// TLS()+GStructOffset() when needed.
+		t.regs.tls = t.regs.order().Uint64(reg.value)
+		t.regs.gaddr = 0
+		t.regs.hasgaddr = false
+		return nil
 	}
 
 	if t.p.loadGInstrAddr > 0 {
@@ -1294,6 +5464,9 @@ func (t *Thread) writeSomeRegisters(regNames ...string) error {
 }
 
 func (t *Thread) readSomeRegisters(regNames ...string) error {
+	if !t.regsLoaded {
+		return t.loadRegisters()
+	}
 	if t.p.gcmdok {
 		return t.p.conn.readRegisters(t.strID, t.regs.buf)
 	}
@@ -1306,12 +5479,9 @@ func (t *Thread) readSomeRegisters(regNames ...string) error {
 	return nil
 }
 
-// reloadGAtPC overwrites the instruction that the thread is stopped at with
-// the MOV instruction used to load current G, executes this single
-// instruction and then puts everything back the way it was.
+// reloadGAtPC executes the MOV instruction used to load current G with
+// execAtPC.
 func (t *Thread) reloadGAtPC() error {
-	movinstr := t.p.loadGInstr()
-
 	if t.Blocked() {
 		t.regs.tls = 0
 		t.regs.gaddr = 0
@@ -1319,7 +5489,31 @@ func (t *Thread) reloadGAtPC() error {
 		return nil
 	}
 
-	cx := t.regs.CX()
+	cx, _, err := t.execAtPC(t.p.loadGInstr())
+	if err != nil {
+		if _, readOnly := err.(*ReadOnlyMemoryError); readOnly || err == threadBlockedError {
+			// we can't determine the G of this thread
+			t.regs.tls = 0
+			t.regs.gaddr = 0
+			t.regs.hasgaddr = true
+			return nil
+		}
+		return err
+	}
+
+	t.regs.gaddr = cx
+	t.regs.hasgaddr = true
+	return nil
+}
+
+// execAtPC overwrites the instruction that the thread is stopped at with
+// instr, executes this single instruction and then puts everything back
+// the way it was. Returns the value of RCX after executing instr and the
+// signal the thread stopped with.
+// Restoring the original instruction is always verified: if it fails the
+// code of the inferior is left corrupted.
+func (t *Thread) execAtPC(instr []byte) (cx uint64, sig uint8, err error) {
+	savedcx := t.regs.CX()
 	pc := t.regs.PC()
 
 	// We are partially replicating the code of GdbserverThread.stepInstruction
@@ -1328,60 +5522,166 @@ func (t *Thread) reloadGAtPC() error {
 	// setting/clearing breakpoints to that same memory which we must work
 	// around by clearing and re-setting the breakpoint in a specific sequence
 	// with the memory writes.
-	// Additionally all breakpoints in [pc, pc+len(movinstr)] need to be removed
-	for addr := range t.p.breakpoints.M {
-		if addr >= pc && addr <= pc+uint64(len(movinstr)) {
-			err := t.p.conn.clearBreakpoint(addr)
-			if err != nil {
-				return err
+	// Additionally all breakpoints in [pc, pc+len(instr)] need to be removed
+	// The other stubs don't need this, but we apply the workaround anyway if
+	// we couldn't determine which stub we are talking to.
+	if kind := t.p.conn.stubInfo.Kind; (kind == LldbServerStub || kind == UnknownStub) && !t.p.breakpointsSuspended {
+		for addr, bp := range t.p.breakpoints.M {
+			if addr >= pc && addr <= pc+uint64(len(instr)) && bp.Installed() {
+				err := t.p.conn.clearBreakpoint(addr)
+				if err != nil {
+					return 0, 0, err
+				}
+				defer t.p.installBreakpoint(addr)
 			}
-			defer t.p.conn.setBreakpoint(addr)
 		}
 	}
 
-	savedcode := make([]byte, len(movinstr))
-	_, err := t.ReadMemory(savedcode, uintptr(pc))
+	savedcode := make([]byte, len(instr))
+	_, err = t.ReadMemory(savedcode, uintptr(pc))
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
-	_, err = t.WriteMemory(uintptr(pc), movinstr)
+	_, err = t.WriteMemory(uintptr(pc), instr)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	defer func() {
 		_, err0 := t.WriteMemory(uintptr(pc), savedcode)
+		if err0 == nil && !t.p.conn.verifyWrites {
+			err0 = t.p.conn.verifyMemory(uintptr(pc), savedcode)
+		}
 		if err == nil {
 			err = err0
 		}
 		t.regs.setPC(pc)
-		t.regs.setCX(cx)
+		t.regs.setCX(savedcx)
 		err1 := t.writeSomeRegisters(regnamePC, regnameCX)
 		if err == nil {
 			err = err1
 		}
-	}()
-
-	_, _, err = t.p.conn.step(t.strID, nil)
-	if err != nil {
-		if err == threadBlockedError {
-			t.regs.tls = 0
-			t.regs.gaddr = 0
-			t.regs.hasgaddr = true
-			return nil
+	}()
+
+	sp, err := t.p.conn.step(t.strID, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := t.readSomeRegisters(regnamePC, regnameCX); err != nil {
+		return 0, 0, err
+	}
+
+	return t.regs.CX(), sp.sig, nil
+}
+
+const (
+	fsSegmentPrefix = 0x64
+	gsSegmentPrefix = 0x65
+
+	// segmentSearchSize is the number of bytes after the first word of a
+	// segment searched by segmentBase for the base of the segment.
+	segmentSearchSize = 0x400
+)
+
+// segmentLoadInstr returns the instruction 'mov rcx, QWORD PTR seg:[off]',
+// seg is the prefix of the segment register (fsSegmentPrefix or
+// gsSegmentPrefix).
+func segmentLoadInstr(seg byte, off uint32) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{seg, 0x48, 0x8b, 0x0c, 0x25})
+	binary.Write(buf, binary.LittleEndian, off)
+	return buf.Bytes()
+}
+
+// FSBase returns the base of the FS segment of the thread.
+// gdbserver, rr and lldb-server on linux report the fs_base register,
+// debugserver doesn't. When the register isn't reported the value is
+// derived by executing MOV instructions relative to the segment on the
+// thread, see segmentBase.
+func (t *Thread) FSBase() (uint64, error) {
+	return t.segmentBase(regnameFsBase, fsSegmentPrefix)
+}
+
+// GSBase returns the base of the GS segment of the thread, see FSBase.
+func (t *Thread) GSBase() (uint64, error) {
+	return t.segmentBase(regnameGsBase, gsSegmentPrefix)
+}
+
+// SetFSBase sets the fs_base register of the thread to v. An error is
+// returned if the stub doesn't report fs_base.
+func (t *Thread) SetFSBase(v uint64) error {
+	return t.setSegmentBase(regnameFsBase, v)
+}
+
+// SetGSBase sets the gs_base register of the thread to v. An error is
+// returned if the stub doesn't report gs_base.
+func (t *Thread) SetGSBase(v uint64) error {
+	return t.setSegmentBase(regnameGsBase, v)
+}
+
+// segmentBase returns the value of regname, if the stub doesn't report it
+// the base is derived from the contents of the segment: the first word of
+// the segment points to the thread control block, which is also the
+// segment base on linux (fs:0), on darwin it is pthread_self and gs_base
+// points to the TSD array inside it whose first slot contains
+// pthread_self.
+// The base is the first word-aligned address in the segmentSearchSize bytes
+// following the first word of the segment whose contents are equal to the
+// first two words of the segment, read with execAtPC.
+func (t *Thread) segmentBase(regname string, seg byte) (uint64, error) {
+	if err := t.loadRegisters(); err != nil {
+		return 0, err
+	}
+	if v, ok := t.regs.value(regname); ok {
+		return v, nil
+	}
+	if t.Blocked() {
+		return 0, fmt.Errorf("can not read %s of thread %d: thread is blocked", regname, t.ID)
+	}
+	var words [2]uint64
+	for i := range words {
+		cx, sig, err := t.execAtPC(segmentLoadInstr(seg, uint32(i*8)))
+		if err != nil {
+			return 0, err
+		}
+		if sig != 0x5 {
+			return 0, fmt.Errorf("can not read %s of thread %d: segment not accessible (signal %d)", regname, t.ID, sig)
 		}
-		return err
+		words[i] = cx
+	}
+	if words[0] == 0 {
+		return 0, fmt.Errorf("can not read %s of thread %d: segment not initialized", regname, t.ID)
+	}
+	buf := make([]byte, segmentSearchSize)
+	if _, err := t.ReadMemory(buf, uintptr(words[0])); err != nil {
+		return 0, err
 	}
+	for off := 0; off+16 <= len(buf); off += 8 {
+		if binary.LittleEndian.Uint64(buf[off:]) == words[0] && binary.LittleEndian.Uint64(buf[off+8:]) == words[1] {
+			return words[0] + uint64(off), nil
+		}
+	}
+	return 0, fmt.Errorf("can not read %s of thread %d: segment base not found", regname, t.ID)
+}
 
-	if err := t.readSomeRegisters(regnamePC, regnameCX); err != nil {
+func (t *Thread) setSegmentBase(regname string, v uint64) error {
+	if err := t.loadRegisters(); err != nil {
 		return err
 	}
-
-	t.regs.gaddr = t.regs.CX()
-	t.regs.hasgaddr = true
-
-	return err
+	reg, ok := t.regs.regs[regname]
+	if !ok || len(reg.value) > 8 {
+		return fmt.Errorf("register %s not exposed by the stub", regname)
+	}
+	t.regs.setValue(reg, v)
+	if err := t.writeSomeRegisters(regname); err != nil {
+		return err
+	}
+	if regname == tlsBaseRegister(t.p.bi.GOOS) {
+		t.regs.tls = v
+	}
+	return nil
 }
 
 // reloadGAlloc makes the specified thread execute one instruction stored at
@@ -1416,7 +5716,7 @@ func (t *Thread) reloadGAlloc() error {
 		}
 	}()
 
-	_, _, err = t.p.conn.step(t.strID, nil)
+	_, err = t.p.conn.step(t.strID, nil)
 	if err != nil {
 		if err == threadBlockedError {
 			t.regs.tls = 0
@@ -1442,6 +5742,470 @@ func (t *Thread) clearBreakpointState() {
 	t.CurrentBreakpoint.Clear()
 }
 
+// WatchKind is the kind of access that triggers a watchpoint.
+type WatchKind uint8
+
+const (
+	WatchWrite  WatchKind = iota // stop when the memory is written
+	WatchRead                    // stop when the memory is read
+	WatchAccess                  // stop when the memory is read or written
+)
+
+// ztype returns the type argument of the 'Z' and 'z' commands for k.
+func (k WatchKind) ztype() int {
+	return int(k) + 2
+}
+
+// Watchpoint is a hardware watchpoint on a Go variable.
+type Watchpoint struct {
+	Expr string // expression used to create the watchpoint
+	Addr uint64
+	Size int
+	Kind WatchKind
+
+	// Cond, if not empty, is a boolean expression evaluated in the scope
+	// used to create the watchpoint every time the watchpoint is triggered,
+	// the target is only stopped if it is true or can not be evaluated.
+	// CondError is the error evaluating Cond the last time.
+	Cond      string
+	CondError error
+
+	scope *proc.EvalScope // scope used to create the watchpoint
+
+	// If the watched variable lives on the stack of a goroutine the
+	// watchpoint follows the variable when the stack is moved and is
+	// removed once the frame that contains it returns.
+	gvar    *proc.Variable // runtime.g of the goroutine, nil if the variable is not on a stack
+	goid    int
+	cfa     uint64 // CFA of the frame containing the variable
+	stackHi uint64 // upper bound of the stack when Addr and cfa were computed
+}
+
+// SetVariableWatchpoint evaluates expr in scope and sets a hardware
+// watchpoint on the memory of the resulting variable. Hardware watchpoints
+// can only watch 1, 2, 4 or 8 bytes, aligned to their size.
+// If the variable lives on the stack of a goroutine the watchpoint is moved
+// along with the variable when the runtime copies the stack and it is
+// automatically removed at the first stop after the frame of scope returns
+// or the goroutine exits. Since the stack is only checked when the target
+// stops, writes made by the runtime while copying the stack are not seen.
+// The watchpoint can be made conditional by setting its Cond field.
+func (p *Process) SetVariableWatchpoint(scope *proc.EvalScope, expr string, kind WatchKind) (*Watchpoint, error) {
+	if p.exited {
+		return nil, &proc.ProcessExitedError{Pid: p.conn.pid}
+	}
+	v, err := scope.EvalVariable(expr, proc.LoadConfig{})
+	if err != nil {
+		return nil, err
+	}
+	if v.Addr == 0 || v.Flags&proc.VariableConstant != 0 || v.RealType == nil {
+		return nil, fmt.Errorf("can not watch %s: expression is not addressable", expr)
+	}
+	wpscope := *scope
+	wp := &Watchpoint{Expr: expr, Addr: uint64(v.Addr), Size: int(v.RealType.Size()), Kind: kind, scope: &wpscope}
+	if err := checkWatchpointSize(wp.Addr, wp.Size); err != nil {
+		return nil, fmt.Errorf("can not watch %s: %v", expr, err)
+	}
+	if scope.Gvar != nil {
+		if gs, err := readGStack(scope.Gvar, scope.Mem, p.order()); err == nil && wp.Addr >= gs.lo && wp.Addr < gs.hi {
+			wp.gvar, wp.goid, wp.stackHi = scope.Gvar, gs.goid, gs.hi
+			wp.cfa = uint64(scope.Regs.CFA)
+		}
+	}
+	if err := p.setWatchpoint(wp); err != nil {
+		return nil, err
+	}
+	return wp, nil
+}
+
+const (
+	// numDebugRegisters is the number of address debug registers (DR0-DR3)
+	// of amd64 CPUs.
+	numDebugRegisters = 4
+	// errnoNoSpace is the error code (ENOSPC) a stub replies with when it
+	// has no debug register left for a watchpoint.
+	errnoNoSpace = "E1c"
+)
+
+// ErrNoHardwareResources is returned when the stub refuses to set a
+// hardware watchpoint because all the debug registers of the CPU are
+// already in use.
+type ErrNoHardwareResources struct {
+	InUse int   // number of hardware watchpoints set, see HardwareSlotsInUse
+	Err   error // error returned by the stub
+}
+
+func (err *ErrNoHardwareResources) Error() string {
+	return fmt.Sprintf("no hardware watchpoint available, %d already in use: remove one first (%v)", err.InUse, err.Err)
+}
+
+// setWatchpoint sets wp on the target and adds it to the list of
+// watchpoints.
+func (p *Process) setWatchpoint(wp *Watchpoint) error {
+	if err := p.conn.setWatchpoint(wp.Kind, wp.Addr, wp.Size); err != nil {
+		// The stub only tells us that it ran out of debug registers if it
+		// replies with ENOSPC, otherwise assume it did when our own
+		// watchpoints already fill all of them.
+		if gdberr, ok := err.(*GdbProtocolError); ok && gdberr.code != "" {
+			if gdberr.code == errnoNoSpace || p.HardwareSlotsInUse() >= numDebugRegisters {
+				return &ErrNoHardwareResources{InUse: p.HardwareSlotsInUse(), Err: err}
+			}
+		}
+		return err
+	}
+	p.watchpoints = append(p.watchpoints, wp)
+	return nil
+}
+
+// HardwareSlotsInUse returns the number of hardware debug registers used
+// by the watchpoints successfully set with SetVariableWatchpoint, each
+// watchpoint uses one. Debug registers used by the stub itself, or by
+// other debuggers, aren't counted.
+func (p *Process) HardwareSlotsInUse() int {
+	return len(p.watchpoints)
+}
+
+// ClearWatchpoint removes a watchpoint created by SetVariableWatchpoint.
+func (p *Process) ClearWatchpoint(wp *Watchpoint) error {
+	for i := range p.watchpoints {
+		if p.watchpoints[i] == wp {
+			if err := p.conn.clearWatchpoint(wp.Kind, wp.Addr, wp.Size); err != nil {
+				return err
+			}
+			p.watchpoints = append(p.watchpoints[:i], p.watchpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no watchpoint on %#x", wp.Addr)
+}
+
+// Watchpoints returns the list of watchpoints currently set.
+func (p *Process) Watchpoints() []*Watchpoint {
+	return p.watchpoints
+}
+
+// Watchpoint returns the watchpoint that stopped the thread, if any.
+func (t *Thread) Watchpoint() *Watchpoint {
+	return t.watchpoint
+}
+
+// checkWatchpointSize returns an error if sz bytes at addr can not be
+// watched by a hardware watchpoint.
+func checkWatchpointSize(addr uint64, sz int) error {
+	switch sz {
+	case 1, 2, 4, 8:
+	default:
+		return fmt.Errorf("size %d not supported by hardware watchpoints (must be 1, 2, 4 or 8 bytes)", sz)
+	}
+	if addr%uint64(sz) != 0 {
+		return fmt.Errorf("address %#x is not aligned to %d bytes", addr, sz)
+	}
+	return nil
+}
+
+// resolveTypedef returns the type typ is a typedef of, if any.
+func resolveTypedef(typ godwarf.Type) godwarf.Type {
+	for {
+		typedef, ok := typ.(*godwarf.TypedefType)
+		if !ok {
+			return typ
+		}
+		typ = typedef.Type
+	}
+}
+
+// structField returns the field called name of the struct type typ.
+func structField(typ godwarf.Type, name string) (*godwarf.StructField, error) {
+	if styp, ok := resolveTypedef(typ).(*godwarf.StructType); ok {
+		for _, f := range styp.Field {
+			if f.Name == name {
+				return f, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("field %s not found in %s", name, typ)
+}
+
+// gStack is the state of the stack of a goroutine, see readGStack.
+type gStack struct {
+	goid   int
+	dead   bool   // the goroutine exited
+	lo, hi uint64 // bounds of the stack
+	sp     uint64 // stack pointer saved the last time the goroutine was descheduled
+}
+
+// readGStack reads the goroutine ID, the status and the stack from gvar, a
+// runtime.g variable, decoding its fields with byte order order.
+func readGStack(gvar *proc.Variable, mem proc.MemoryReadWriter, order binary.ByteOrder) (gStack, error) {
+	field := func(path ...string) (off int64, sz int64, err error) {
+		typ := gvar.RealType
+		for _, name := range path {
+			f, err := structField(typ, name)
+			if err != nil {
+				return 0, 0, err
+			}
+			typ, off = f.Type, off+f.ByteOffset
+		}
+		return off, typ.Size(), nil
+	}
+	read := func(off, sz int64) (uint64, error) {
+		buf := make([]byte, sz)
+		if _, err := mem.ReadMemory(buf, uintptr(gvar.Addr)+uintptr(off)); err != nil {
+			return 0, err
+		}
+		switch sz {
+		case 4:
+			return uint64(order.Uint32(buf)), nil
+		case 8:
+			return order.Uint64(buf), nil
+		}
+		return 0, fmt.Errorf("unexpected field size %d in runtime.g", sz)
+	}
+
+	var gs gStack
+	var offs, szs [3]int64
+	for i, path := range [][]string{{"goid"}, {"stack", "lo"}, {"stack", "hi"}} {
+		off, sz, err := field(path...)
+		if err != nil {
+			return gStack{}, err
+		}
+		offs[i], szs[i] = off, sz
+	}
+	id, err := read(offs[0], szs[0])
+	if err != nil {
+		return gStack{}, err
+	}
+	gs.goid = int(id)
+	if gs.lo, err = read(offs[1], szs[1]); err != nil {
+		return gStack{}, err
+	}
+	if gs.hi, err = read(offs[2], szs[2]); err != nil {
+		return gStack{}, err
+	}
+	if off, sz, err := field("atomicstatus"); err == nil {
+		status, err := read(off, sz)
+		if err != nil {
+			return gStack{}, err
+		}
+		gs.dead = status == proc.Gdead
+	}
+	if off, sz, err := field("sched", "sp"); err == nil {
+		if gs.sp, err = read(off, sz); err != nil {
+			return gStack{}, err
+		}
+	}
+	return gs, nil
+}
+
+// findWatchpoint returns the watchpoint containing addr.
+func (p *Process) findWatchpoint(addr uint64) *Watchpoint {
+	for _, wp := range p.watchpoints {
+		if addr >= wp.Addr && addr < wp.Addr+uint64(wp.Size) {
+			return wp
+		}
+	}
+	return nil
+}
+
+// pruneWatchpoints updates the watchpoints on stack variables: if the
+// runtime moved the stack of the goroutine the watchpoint is moved to the
+// new address of the variable, if the frame containing the variable
+// returned or the goroutine exited the watchpoint is removed.
+func (p *Process) pruneWatchpoints() {
+	live := p.watchpoints[:0]
+	for _, wp := range p.watchpoints {
+		if wp.gvar == nil || p.updateStackWatchpoint(wp) {
+			live = append(live, wp)
+		}
+	}
+	p.watchpoints = live
+}
+
+// updateStackWatchpoint updates wp, a watchpoint on a stack variable, see
+// pruneWatchpoints. Returns false if the watchpoint was removed.
+func (p *Process) updateStackWatchpoint(wp *Watchpoint) bool {
+	if p.currentThread == nil {
+		return true
+	}
+	gs, err := readGStack(wp.gvar, p.currentThread, p.order())
+	inScope := err == nil && !gs.dead && gs.goid == wp.goid
+	if inScope && gs.hi != wp.stackHi {
+		// The stack was copied, variables keep their distance from the top
+		// of the stack.
+		delta := gs.hi - wp.stackHi
+		if err := p.conn.clearWatchpoint(wp.Kind, wp.Addr, wp.Size); err != nil {
+			return true
+		}
+		if err := p.conn.setWatchpoint(wp.Kind, wp.Addr+delta, wp.Size); err != nil {
+			if logflags.GdbWire() {
+				fmt.Fprintf(os.Stderr, "could not move watchpoint on %s from %#x to %#x: %v\n", wp.Expr, wp.Addr, wp.Addr+delta, err)
+			}
+			return false
+		}
+		wp.Addr += delta
+		wp.cfa += delta
+		wp.stackHi = gs.hi
+		wp.scope.Regs.CFA += int64(delta)
+		wp.scope.Regs.FrameBase += int64(delta)
+	}
+	if inScope {
+		// If the goroutine is running one of the threads has its stack
+		// pointer inside the stack of the goroutine.
+		sp := gs.sp
+		for _, th := range p.threads {
+			if th.loadRegisters() != nil {
+				continue
+			}
+			if _, ok := th.regs.regs[regnameSP]; !ok {
+				continue
+			}
+			if thsp := th.regs.SP(); thsp >= gs.lo && thsp < gs.hi {
+				sp = thsp
+				break
+			}
+		}
+		inScope = sp < wp.cfa
+	}
+	if inScope {
+		return true
+	}
+	return p.conn.clearWatchpoint(wp.Kind, wp.Addr, wp.Size) != nil
+}
+
+// watchpointCondition evaluates the condition of the watchpoint that
+// stopped th, if any, and returns false if the target should be resumed
+// because the condition is false.
+func (p *Process) watchpointCondition(th proc.Thread) bool {
+	t, _ := th.(*Thread)
+	if t == nil || t.watchpoint == nil || t.watchpoint.Cond == "" {
+		return true
+	}
+	wp := t.watchpoint
+	scope := *wp.scope
+	scope.Mem = t
+	v, err := scope.EvalExpression(wp.Cond, proc.LoadConfig{})
+	wp.CondError = nil
+	switch {
+	case err != nil:
+		wp.CondError = fmt.Errorf("error evaluating expression: %v", err)
+	case v.Unreadable != nil:
+		wp.CondError = fmt.Errorf("condition expression unreadable: %v", v.Unreadable)
+	case v.Kind != reflect.Bool || v.Value == nil:
+		wp.CondError = errors.New("condition expression not boolean")
+	default:
+		return constant.BoolVal(v.Value)
+	}
+	return true
+}
+
+// StopKind classifies the reason a thread stopped.
+type StopKind uint8
+
+const (
+	// StopNone is the stop kind of threads that didn't cause the inferior to stop.
+	StopNone StopKind = iota
+	// StopBreakpoint means the thread hit a breakpoint managed by us.
+	StopBreakpoint
+	// StopTrap means the thread received a SIGTRAP that doesn't correspond to
+	// any of our breakpoints, for example a breakpoint instruction compiled
+	// into the program.
+	StopTrap
+	// StopHardwareTrap means the stub reported a hardware breakpoint or
+	// watchpoint that doesn't correspond to any of our breakpoints.
+	StopHardwareTrap
+	// StopManual means the inferior was stopped by RequestManualStop.
+	StopManual
+	// StopSignal means the thread received a signal.
+	StopSignal
+	// StopWatchpoint means the thread triggered a watchpoint.
+	StopWatchpoint
+)
+
+func (k StopKind) String() string {
+	switch k {
+	case StopNone:
+		return "none"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopTrap:
+		return "trap"
+	case StopHardwareTrap:
+		return "hardware trap"
+	case StopManual:
+		return "manual stop"
+	case StopSignal:
+		return "signal"
+	case StopWatchpoint:
+		return "watchpoint"
+	default:
+		return fmt.Sprintf("StopKind(%d)", uint8(k))
+	}
+}
+
+// StopReason returns the reason the thread stopped the last time the
+// inferior was resumed and the signal reported by the stub.
+// A thread that stopped with StopTrap was not stopped by one of our
+// breakpoints and should be reported as such to the user.
+func (t *Thread) StopReason() (StopKind, uint8) {
+	return t.stopKind, t.stopSig
+}
+
+// StopKinds returns all the reasons the thread stopped for the last time
+// the inferior was resumed, starting with the one returned by StopReason.
+// A thread can stop for more than one reason at once, for example when a
+// breakpoint and a watchpoint trigger on the same instruction, in that
+// case the thread has both a current breakpoint and a Watchpoint.
+func (t *Thread) StopKinds() []StopKind {
+	if t.stopKind == StopNone {
+		return nil
+	}
+	kinds := []StopKind{t.stopKind}
+	add := func(kind StopKind) {
+		if kind != t.stopKind {
+			kinds = append(kinds, kind)
+		}
+	}
+	if t.CurrentBreakpoint.Breakpoint != nil {
+		add(StopBreakpoint)
+	}
+	if t.stopReasons.has(stopReasonWatchpoint) {
+		add(StopWatchpoint)
+	}
+	if t.stopReasons.has(stopReasonHwBreakpoint) {
+		add(StopHardwareTrap)
+	}
+	return kinds
+}
+
+// setStopReason classifies the stop of the thread that caused the inferior
+// to stop, described by sp, after its current breakpoint has been set.
+func (t *Thread) setStopReason(sp stopPacket) {
+	t.stopSig = sp.sig
+	if sp.hasCore {
+		t.stopCore, t.stopCoreGen, t.stopCoreKnown = sp.core, t.p.conn.stopGen, true
+	}
+	t.stopReasons |= sp.reasons
+	if t.stopReasons.has(stopReasonWatchpoint) {
+		// also when the thread stopped at a breakpoint, a watchpoint can
+		// trigger on the same instruction.
+		t.watchpoint = t.p.findWatchpoint(sp.watchAddr)
+	}
+	switch {
+	case t.CurrentBreakpoint.Breakpoint != nil:
+		t.stopKind = StopBreakpoint
+	case t.stopReasons.has(stopReasonWatchpoint):
+		t.stopKind = StopWatchpoint
+	case t.stopReasons.has(stopReasonHwBreakpoint):
+		t.stopKind = StopHardwareTrap
+	case t.stopReasons.has(stopReasonBreakpoint) || sp.sig == breakpointSignal:
+		t.stopKind = StopTrap
+	case t.p.getCtrlC():
+		t.stopKind = StopManual
+	default:
+		t.stopKind = StopSignal
+	}
+}
+
 func (thread *Thread) SetCurrentBreakpoint() error {
 	thread.clearBreakpointState()
 	regs, err := thread.Registers(false)
@@ -1449,7 +6213,14 @@ func (thread *Thread) SetCurrentBreakpoint() error {
 		return err
 	}
 	pc := regs.PC()
-	if bp, ok := thread.p.FindBreakpoint(pc); ok {
+	bp, ok := thread.p.FindBreakpoint(pc)
+	if thread.preempted {
+		// The thread didn't execute the breakpoint instruction, its PC must
+		// not be moved back.
+		bp, ok = thread.p.breakpoints.M[pc]
+		ok = ok && bp.Installed()
+	}
+	if ok {
 		if thread.regs.PC() != bp.Addr {
 			if err := thread.regs.SetPC(thread, bp.Addr); err != nil {
 				return err
@@ -1466,52 +6237,207 @@ func (thread *Thread) SetCurrentBreakpoint() error {
 	return nil
 }
 
+// order returns the byte order of the target, little endian unless the stub
+// reported otherwise.
+func (p *Process) order() binary.ByteOrder {
+	if p.conn.byteOrder == nil {
+		return binary.LittleEndian
+	}
+	return p.conn.byteOrder
+}
+
+// order returns the byte order of the register values, little endian
+// unless the stub reported otherwise.
+func (regs *gdbRegisters) order() binary.ByteOrder {
+	if regs.byteOrder == nil {
+		return binary.LittleEndian
+	}
+	return regs.byteOrder
+}
+
 func (regs *gdbRegisters) PC() uint64 {
-	return binary.LittleEndian.Uint64(regs.regs[regnamePC].value)
+	return regs.order().Uint64(regs.regs[regnamePC].value)
 }
 
 func (regs *gdbRegisters) setPC(value uint64) {
-	binary.LittleEndian.PutUint64(regs.regs[regnamePC].value, value)
+	regs.order().PutUint64(regs.regs[regnamePC].value, value)
 }
 
 func (regs *gdbRegisters) SP() uint64 {
-	return binary.LittleEndian.Uint64(regs.regs[regnameSP].value)
+	return regs.order().Uint64(regs.regs[regnameSP].value)
 }
 
 func (regs *gdbRegisters) BP() uint64 {
-	return binary.LittleEndian.Uint64(regs.regs[regnameBP].value)
+	return regs.order().Uint64(regs.regs[regnameBP].value)
 }
 
 func (regs *gdbRegisters) CX() uint64 {
-	return binary.LittleEndian.Uint64(regs.regs[regnameCX].value)
+	return regs.order().Uint64(regs.regs[regnameCX].value)
 }
 
 func (regs *gdbRegisters) setCX(value uint64) {
-	binary.LittleEndian.PutUint64(regs.regs[regnameCX].value, value)
+	regs.order().PutUint64(regs.regs[regnameCX].value, value)
 }
 
+// TLS returns the base of the segment used for thread local storage, if
+// the stub reports it, zero otherwise.
 func (regs *gdbRegisters) TLS() uint64 {
 	return regs.tls
 }
 
+// GAddr returns the address of the G struct of the thread, if it is known.
+// When it isn't known it can be read from TLS()+GStructOffset().
 func (regs *gdbRegisters) GAddr() (uint64, bool) {
 	return regs.gaddr, regs.hasgaddr
 }
 
+// value returns the value of the register called name, zero extended to
+// 64 bits. Returns false if the register doesn't exist or is larger than 64
+// bits.
+func (regs *gdbRegisters) value(name string) (uint64, bool) {
+	reg, ok := regs.regs[name]
+	if !ok || len(reg.value) > 8 {
+		return 0, false
+	}
+	var buf [8]byte
+	if regs.order() == binary.BigEndian {
+		copy(buf[8-len(reg.value):], reg.value)
+	} else {
+		copy(buf[:], reg.value)
+	}
+	return regs.order().Uint64(buf[:]), true
+}
+
+// setValue stores v in reg, truncated to the size of the register.
+func (regs *gdbRegisters) setValue(reg gdbRegister, v uint64) {
+	var buf [8]byte
+	regs.order().PutUint64(buf[:], v)
+	if regs.order() == binary.BigEndian {
+		copy(reg.value, buf[8-len(reg.value):])
+	} else {
+		copy(reg.value, buf[:])
+	}
+}
+
+// AMD64Registers is a snapshot of the general purpose registers of an
+// amd64 thread.
+type AMD64Registers struct {
+	Rax, Rbx, Rcx, Rdx, Rsi, Rdi, Rbp, Rsp uint64
+	R8, R9, R10, R11, R12, R13, R14, R15   uint64
+	Rip, Rflags                            uint64
+	Cs, Ss, Ds, Es, Fs, Gs                 uint64 // zero if the stub doesn't report them
+	FsBase, GsBase                         uint64 // zero if the stub doesn't report them
+}
+
+// AMD64 returns the general purpose registers as an AMD64Registers struct.
+// An error is returned if the stub didn't report one of the registers
+// needed to fill the struct, except for the segment registers.
+func (regs *gdbRegisters) AMD64() (AMD64Registers, error) {
+	var r AMD64Registers
+	required := []struct {
+		name string
+		dst  *uint64
+	}{
+		{"rax", &r.Rax}, {"rbx", &r.Rbx}, {"rcx", &r.Rcx}, {"rdx", &r.Rdx},
+		{"rsi", &r.Rsi}, {"rdi", &r.Rdi}, {"rbp", &r.Rbp}, {"rsp", &r.Rsp},
+		{"r8", &r.R8}, {"r9", &r.R9}, {"r10", &r.R10}, {"r11", &r.R11},
+		{"r12", &r.R12}, {"r13", &r.R13}, {"r14", &r.R14}, {"r15", &r.R15},
+		{"rip", &r.Rip}, {"eflags", &r.Rflags},
+	}
+	for _, reg := range required {
+		v, ok := regs.value(reg.name)
+		if !ok {
+			return AMD64Registers{}, fmt.Errorf("register %s not available", reg.name)
+		}
+		*reg.dst = v
+	}
+	r.Cs, _ = regs.value("cs")
+	r.Ss, _ = regs.value("ss")
+	r.Ds, _ = regs.value("ds")
+	r.Es, _ = regs.value("es")
+	r.Fs, _ = regs.value("fs")
+	r.Gs, _ = regs.value("gs")
+	r.FsBase, _ = regs.value(regnameFsBase)
+	r.GsBase, _ = regs.value(regnameGsBase)
+	return r, nil
+}
+
+// FSBase returns the value of the fs_base register, false if the stub
+// doesn't report it. gdbserver, rr and lldb-server on linux report fs_base
+// and gs_base, debugserver reports neither. Thread.FSBase can also
+// determine the value when the stub doesn't report it.
+func (regs *gdbRegisters) FSBase() (uint64, bool) {
+	return regs.value(regnameFsBase)
+}
+
+// GSBase returns the value of the gs_base register, false if the stub
+// doesn't report it, see FSBase.
+func (regs *gdbRegisters) GSBase() (uint64, bool) {
+	return regs.value(regnameGsBase)
+}
+
+// debugReg returns the register for the x86 debug register DRn.
+func (regs *gdbRegisters) debugReg(n int) (gdbRegister, error) {
+	if n < 0 || n > 7 {
+		return gdbRegister{}, fmt.Errorf("invalid debug register dr%d", n)
+	}
+	reg, ok := regs.regs[fmt.Sprintf("dr%d", n)]
+	if !ok || len(reg.value) > 8 {
+		return gdbRegister{}, fmt.Errorf("debug register dr%d not exposed by the stub", n)
+	}
+	return reg, nil
+}
+
+// DebugReg returns the value of the x86 debug register DRn (0 <= n <= 7)
+// of the thread. The register is always read from the stub with a 'p'
+// packet: the debug registers are usually left out of the 'g' packet and
+// they can be changed by the stub, for example to set watchpoints, so the
+// cached value may be stale.
+// An error is returned if the stub doesn't expose the debug registers.
+func (t *Thread) DebugReg(n int) (uint64, error) {
+	if err := t.loadRegisters(); err != nil {
+		return 0, err
+	}
+	reg, err := t.regs.debugReg(n)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.p.conn.readRegister(t.strID, reg.regnum, reg.value); err != nil {
+		return 0, err
+	}
+	v, _ := t.regs.value(fmt.Sprintf("dr%d", n))
+	return v, nil
+}
+
+// SetDebugReg sets the x86 debug register DRn (0 <= n <= 7) of the thread
+// to v. The register is always written with a 'P' packet since stubs
+// usually leave the debug registers out of the 'g' packet.
+func (t *Thread) SetDebugReg(n int, v uint64) error {
+	if err := t.loadRegisters(); err != nil {
+		return err
+	}
+	reg, err := t.regs.debugReg(n)
+	if err != nil {
+		return err
+	}
+	t.regs.setValue(reg, v)
+	return t.p.conn.writeRegister(t.strID, reg.regnum, reg.value)
+}
+
 func (regs *gdbRegisters) byName(name string) uint64 {
 	reg, ok := regs.regs[name]
 	if !ok {
 		return 0
 	}
-	return binary.LittleEndian.Uint64(reg.value)
+	return regs.order().Uint64(reg.value)
 }
 
 func (regs *gdbRegisters) Get(n int) (uint64, error) {
 	reg := x86asm.Reg(n)
 	const (
-		mask8  = 0x000f
-		mask16 = 0x00ff
-		mask32 = 0xffff
+		mask8  = 0xff
+		mask16 = 0xffff
+		mask32 = 0xffffffff
 	)
 
 	switch reg {
@@ -1660,9 +6586,47 @@ func (regs *gdbRegisters) Get(n int) (uint64, error) {
 		return regs.byName("r15"), nil
 	}
 
+	if reg >= x86asm.X0 && reg <= x86asm.X15 {
+		value := regs.sseRegister(int(reg - x86asm.X0))
+		if len(value) < 8 {
+			return 0, proc.UnknownRegisterError
+		}
+		return regs.order().Uint64(value), nil
+	}
+
 	return 0, proc.UnknownRegisterError
 }
 
+// sseRegister returns the value of the i-th SSE register, if the stub
+// reports the AVX registers the full 256 bit value of ymm<i> is returned.
+func (regs *gdbRegisters) sseRegister(i int) []byte {
+	if reg, ok := regs.regs[fmt.Sprintf("ymm%d", i)]; ok {
+		return reg.value
+	}
+	if reg, ok := regs.regs[fmt.Sprintf("xmm%d", i)]; ok {
+		return reg.value
+	}
+	return nil
+}
+
+// GetWide returns the full value of the SSE register n, numbered like in
+// Get (x86asm.X0 through x86asm.X15).
+// The returned slice is 32 bytes long if the stub reports the AVX registers
+// and 16 bytes long otherwise.
+func (regs *gdbRegisters) GetWide(n int) ([]byte, error) {
+	reg := x86asm.Reg(n)
+	if reg < x86asm.X0 || reg > x86asm.X15 {
+		return nil, proc.UnknownRegisterError
+	}
+	value := regs.sseRegister(int(reg - x86asm.X0))
+	if value == nil {
+		return nil, proc.UnknownRegisterError
+	}
+	r := make([]byte, len(value))
+	copy(r, value)
+	return r, nil
+}
+
 func (regs *gdbRegisters) SetPC(thread proc.Thread, pc uint64) error {
 	regs.setPC(pc)
 	t := thread.(*Thread)
@@ -1673,20 +6637,84 @@ func (regs *gdbRegisters) SetPC(thread proc.Thread, pc uint64) error {
 	return t.p.conn.writeRegister(t.strID, reg.regnum, reg.value)
 }
 
+// SetBytes sets the value of the register with the specified name (as
+// reported by the stub, i.e. "xmm0", "ymm0", "st0") and writes it to the
+// thread. The length of value must match the size of the register, 80 bit
+// x87 registers are specified in the layout used by the stub, see
+// x87Value: with a little endian target the 64 bit mantissa followed by the
+// 16 bit sign and exponent.
+// If the stub only reports AVX registers the xmm registers can still be set
+// by name, the upper half of the corresponding ymm register is preserved.
+func (regs *gdbRegisters) SetBytes(thread proc.Thread, name string, value []byte) error {
+	t := thread.(*Thread)
+	reg, ok := regs.regs[name]
+	dst := reg.value
+	if !ok && strings.HasPrefix(name, "xmm") {
+		reg, ok = regs.regs["y"+name[1:]]
+		if ok {
+			dst = reg.value[:16]
+		}
+	}
+	if !ok {
+		return fmt.Errorf("unknown register %s", name)
+	}
+	if len(value) != len(dst) {
+		return fmt.Errorf("wrong size for register %s: %d bytes (expected %d)", name, len(value), len(dst))
+	}
+	copy(dst, value)
+	if t.p.gcmdok {
+		return t.p.conn.writeRegisters(t.strID, regs.buf)
+	}
+	return t.p.conn.writeRegister(t.strID, reg.regnum, reg.value)
+}
+
+// x87Value splits value, an 80 bit x87 register in the byte order of the
+// stub, into its sign and exponent and its mantissa. In little endian the
+// mantissa comes first, in big endian the sign and exponent do.
+func (regs *gdbRegisters) x87Value(value []byte) (exponent uint16, mantissa uint64) {
+	if regs.order() == binary.BigEndian {
+		return binary.BigEndian.Uint16(value[:2]), binary.BigEndian.Uint64(value[2:])
+	}
+	return binary.LittleEndian.Uint16(value[8:]), binary.LittleEndian.Uint64(value[:8])
+}
+
+// Slice returns the list of registers reported by the stub. The x87
+// registers are reported by the stubs in the order of the FPU stack, as
+// they are stored by FXSAVE (st0 is ST(0)), the TOP field of the status
+// word is used to map the tag word, which describes the physical
+// registers, to them.
 func (regs *gdbRegisters) Slice() []proc.Register {
+	top := -1
+	if fstat, ok := regs.value("fstat"); ok {
+		top = proc.X87Top(uint16(fstat))
+	}
 	r := make([]proc.Register, 0, len(regs.regsInfo))
 	for _, reginfo := range regs.regsInfo {
 		switch {
+		case reginfo.Name == "fstat":
+			fstat, _ := regs.value(reginfo.Name)
+			r = proc.AppendX87StatusReg(r, reginfo.Name, uint16(fstat))
+		case reginfo.Name == "fctrl":
+			fctrl, _ := regs.value(reginfo.Name)
+			r = proc.AppendX87ControlReg(r, reginfo.Name, uint16(fctrl))
+		case reginfo.Name == "ftag":
+			// some stubs report the abridged tag word saved by FXSAVE
+			// (8 bits), others the full tag word.
+			ftag, _ := regs.value(reginfo.Name)
+			r = proc.AppendX87TagReg(r, reginfo.Name, uint16(ftag), reginfo.Bitsize == 8, top)
+		case reginfo.Name == "fop":
+			fop, _ := regs.value(reginfo.Name)
+			r = proc.AppendWordReg(r, reginfo.Name, uint16(fop))
 		case reginfo.Name == "eflags":
-			r = proc.AppendEflagReg(r, reginfo.Name, uint64(binary.LittleEndian.Uint32(regs.regs[reginfo.Name].value)))
+			r = proc.AppendEflagReg(r, reginfo.Name, uint64(regs.order().Uint32(regs.regs[reginfo.Name].value)))
 		case reginfo.Name == "mxcsr":
-			r = proc.AppendMxcsrReg(r, reginfo.Name, uint64(binary.LittleEndian.Uint32(regs.regs[reginfo.Name].value)))
+			r = proc.AppendMxcsrReg(r, reginfo.Name, uint64(regs.order().Uint32(regs.regs[reginfo.Name].value)))
 		case reginfo.Bitsize == 16:
-			r = proc.AppendWordReg(r, reginfo.Name, binary.LittleEndian.Uint16(regs.regs[reginfo.Name].value))
+			r = proc.AppendWordReg(r, reginfo.Name, regs.order().Uint16(regs.regs[reginfo.Name].value))
 		case reginfo.Bitsize == 32:
-			r = proc.AppendDwordReg(r, reginfo.Name, binary.LittleEndian.Uint32(regs.regs[reginfo.Name].value))
+			r = proc.AppendDwordReg(r, reginfo.Name, regs.order().Uint32(regs.regs[reginfo.Name].value))
 		case reginfo.Bitsize == 64:
-			r = proc.AppendQwordReg(r, reginfo.Name, binary.LittleEndian.Uint64(regs.regs[reginfo.Name].value))
+			r = proc.AppendQwordReg(r, reginfo.Name, regs.order().Uint64(regs.regs[reginfo.Name].value))
 		case reginfo.Bitsize == 80:
 			idx := 0
 			for _, stprefix := range []string{"stmm", "st"} {
@@ -1695,8 +6723,8 @@ func (regs *gdbRegisters) Slice() []proc.Register {
 					break
 				}
 			}
-			value := regs.regs[reginfo.Name].value
-			r = proc.AppendX87Reg(r, idx, binary.LittleEndian.Uint16(value[8:]), binary.LittleEndian.Uint64(value[:8]))
+			exponent, mantissa := regs.x87Value(regs.regs[reginfo.Name].value)
+			r = proc.AppendX87Reg(r, idx, exponent, mantissa)
 
 		case reginfo.Bitsize == 128:
 			r = proc.AppendSSEReg(r, strings.ToUpper(reginfo.Name), regs.regs[reginfo.Name].value)
@@ -3,7 +3,10 @@ package gdbserial
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"debug/macho"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -11,6 +14,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,6 +39,7 @@ type gdbConn struct {
 
 	packetSize int               // maximum packet size supported by stub
 	regsInfo   []gdbRegisterInfo // list of registers
+	byteOrder  binary.ByteOrder  // byte order of the target, as reported by the stub
 
 	pid int // cache process id
 
@@ -43,6 +48,47 @@ type gdbConn struct {
 	maxTransmitAttempts   int  // maximum number of transmit or receive attempts when bad checksums are read
 	threadSuffixSupported bool // thread suffix supported by stub
 	isDebugserver         bool // true if the stub is debugserver
+
+	stubInfo StubInfo // kind and version of the stub, determined during the handshake
+
+	// replies to qHostInfo and qProcessInfo, read once during the handshake,
+	// nil if the stub doesn't support them.
+	hostInfo    map[string]string
+	processInfo map[string]string
+
+	stopGen uint64 // incremented every time the inferior is resumed
+
+	supportedCompressions []string // compression algorithms supported by the stub
+	compressed            bool     // zlib-deflate compression of responses was enabled with QEnableCompression
+
+	memoryRegionInfoUnsupported bool // qMemoryRegionInfo is not supported by the stub
+	searchMemoryUnsupported     bool // qSearch:memory is not supported by the stub
+	threadsXferSupported        bool // qXfer:threads:read is supported by the stub
+	librariesXferSupported      bool // qXfer:libraries-svr4:read is supported by the stub
+	passSignalsSupported        bool // QPassSignals is supported by the stub
+	threadAliveUnsupported      bool // the T command is not supported by the stub
+	threadExtraInfoUnsupported  bool // qThreadExtraInfo is not supported by the stub
+	threadBreakpointUnsupported bool // the stub rejects the thread suffix of Z packets, see setThreadBreakpoint
+
+	pendingStops []stopPacket // stop events received while the target was stopped, see queueStop and Process.DrainPendingStops
+
+	vContActions map[byte]bool // actions supported by vCont, as reported by vCont?, nil if unknown
+	noVCont      bool          // the stub doesn't support vCont, use c, C and s instead
+
+	handshakeTimeout time.Duration // maximum duration of the handshake, zero for no limit
+	replyTimeout     time.Duration // maximum time to wait for the reply to a command, zero for no limit
+	dead             error         // if not nil the connection is unusable and every command fails with this error
+
+	launchArgs []string // if not nil the stub is asked to launch this command line during the handshake
+	launchWd   string   // working directory of the inferior launched during the handshake
+
+	verifyWrites bool // read back memory after writing it, see Process.SetWriteVerification
+
+	memReadRetries    int           // number of times a memory read failing with a transient error is retried
+	memReadRetryDelay time.Duration // delay between retries of a failed memory read
+
+	exitStatus   int  // exit code or terminating signal of the inferior, valid after it exited
+	exitSignaled bool // true if the inferior was terminated by a signal ('X' stop reply)
 }
 
 const (
@@ -56,6 +102,18 @@ const (
 
 var ErrTooManyAttempts = errors.New("too many transmit attempts")
 
+// ErrStubUnresponsive is returned when the stub doesn't reply to a command
+// within the timeout set by Process.SetReplyTimeout. The connection can
+// not be used after this error is returned.
+var ErrStubUnresponsive = errors.New("stub is not responding")
+
+// ErrProtocolDesync is returned when the reply to a command doesn't have
+// the shape expected for that command, which means that requests and
+// replies are out of step (for example a reply was read as the response to
+// the wrong command). The connection can not be used after this error is
+// returned.
+var ErrProtocolDesync = errors.New("protocol desynchronized")
+
 // GdbProtocolError is an error response (Exx) of Gdb Remote Serial Protocol
 // or an "unsupported command" response (empty packet).
 type GdbProtocolError struct {
@@ -99,7 +157,28 @@ const (
 	qSupportedMultiprocess = "$qSupported:multiprocess+;swbreak+;hwbreak+;no-resumed+;xmlRegisters=i386"
 )
 
+// handshake configures the connection with the stub. If the stub doesn't
+// complete the handshake within conn.handshakeTimeout an error is returned.
 func (conn *gdbConn) handshake() error {
+	// the handshake has its own deadline
+	replyTimeout := conn.replyTimeout
+	conn.replyTimeout = 0
+	defer func() { conn.replyTimeout = replyTimeout }()
+	if conn.handshakeTimeout > 0 {
+		conn.conn.SetReadDeadline(time.Now().Add(conn.handshakeTimeout))
+		defer conn.conn.SetReadDeadline(time.Time{})
+	}
+	err := conn.handshakeInternal()
+	if err == nil {
+		return nil
+	}
+	if neterr, isneterr := err.(net.Error); (isneterr && neterr.Timeout()) || err == io.EOF || err == ErrTooManyAttempts {
+		return fmt.Errorf("%s does not appear to be a gdb remote stub: %v", conn.conn.RemoteAddr(), err)
+	}
+	return err
+}
+
+func (conn *gdbConn) handshakeInternal() error {
 	conn.ack = true
 	conn.packetSize = 256
 	conn.rdr = bufio.NewReader(conn.conn)
@@ -120,8 +199,10 @@ func (conn *gdbConn) handshake() error {
 		conn.threadSuffixSupported = true
 	}
 
+	var features map[string]bool
 	if !conn.threadSuffixSupported {
-		features, err := conn.qSupported(true)
+		var err error
+		features, err = conn.qSupported(true)
 		if err != nil {
 			return err
 		}
@@ -138,7 +219,28 @@ func (conn *gdbConn) handshake() error {
 		// execute qSupported with the multiprocess feature disabled (the
 		// interaction of thread suffixes and multiprocess is not documented), we
 		// only need this call to configure conn.packetSize.
-		if _, err := conn.qSupported(false); err != nil {
+		var err error
+		features, err = conn.qSupported(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn.threadsXferSupported = features["qXfer:threads:read"]
+	conn.librariesXferSupported = features["qXfer:libraries-svr4:read"]
+	conn.passSignalsSupported = features["QPassSignals"]
+	conn.hostInfo = conn.queryInfo("$qHostInfo")
+	conn.stubInfo = conn.queryStubInfo(features)
+
+	if conn.launchArgs != nil {
+		if conn.launchWd != "" {
+			// If the stub doesn't support QSetWorkingDir the inferior will inherit
+			// the working directory of the stub.
+			if err := conn.setWorkingDir(conn.launchWd); err != nil && !isProtocolErrorUnsupported(err) {
+				return err
+			}
+		}
+		if err := conn.launch(conn.launchArgs); err != nil {
 			return err
 		}
 	}
@@ -155,10 +257,20 @@ func (conn *gdbConn) handshake() error {
 		}
 	}
 
+	if err := validateRegisterInfo(conn.regsInfo); err != nil {
+		return err
+	}
+
+	conn.processInfo = conn.queryInfo("$qProcessInfo")
+	conn.byteOrder = conn.queryByteOrder()
+
 	// We either need:
 	//  * QListThreadsInStopReply + qThreadStopInfo (i.e. lldb-server/debugserver),
 	//  * or a stub that runs the inferior in single threaded mode (i.e. rr).
 	// Otherwise we'll have problems handling breakpoints in multithreaded programs.
+	// When QListThreadsInStopReply is enabled the stub will include the list
+	// of threads in every stop packet, saving us a round of qfThreadInfo and
+	// qsThreadInfo after every stop.
 	if _, err := conn.exec([]byte("$QListThreadsInStopReply"), "init"); err != nil {
 		gdberr, ok := err.(*GdbProtocolError)
 		if !ok {
@@ -169,9 +281,264 @@ func (conn *gdbConn) handshake() error {
 		}
 	}
 
+	// Ask the stub to report thread exits with 'w' stop replies, they are
+	// handled by Process.ContinueOnce without stopping.
+	if features["QThreadEvents"] {
+		if err := conn.enableThreadEvents(); err != nil && !isProtocolErrorUnsupported(err) {
+			return err
+		}
+	}
+
+	conn.queryVCont()
+
+	conn.enableCompression()
+
 	return nil
 }
 
+// enableThreadEvents executes a 'QThreadEvents:1' command, after it the
+// stub reports thread creation and exit events.
+func (conn *gdbConn) enableThreadEvents() error {
+	_, err := conn.exec([]byte("$QThreadEvents:1"), "init")
+	return err
+}
+
+// queryVCont uses 'vCont?' to find out which vCont actions are supported by
+// the stub.
+func (conn *gdbConn) queryVCont() {
+	resp, err := conn.exec([]byte("$vCont?"), "init")
+	if err != nil || !bytes.HasPrefix(resp, []byte("vCont")) {
+		conn.noVCont = true
+		return
+	}
+	conn.vContActions = make(map[byte]bool)
+	for _, action := range strings.Split(string(resp[len("vCont"):]), ";") {
+		if len(action) > 0 {
+			conn.vContActions[action[0]] = true
+		}
+	}
+}
+
+// vContSupports returns true if vCont can be used with the specified
+// action. If vCont? wasn't executed we assume that all actions are supported.
+func (conn *gdbConn) vContSupports(action byte) bool {
+	if conn.noVCont {
+		return false
+	}
+	return conn.vContActions == nil || conn.vContActions[action]
+}
+
+// StubKind is the kind of remote stub we are connected to.
+type StubKind uint8
+
+const (
+	UnknownStub StubKind = iota
+	GdbserverStub
+	LldbServerStub
+	DebugserverStub
+	RRStub
+)
+
+func (kind StubKind) String() string {
+	switch kind {
+	case GdbserverStub:
+		return "gdbserver"
+	case LldbServerStub:
+		return "lldb-server"
+	case DebugserverStub:
+		return "debugserver"
+	case RRStub:
+		return "rr"
+	default:
+		return "unknown stub"
+	}
+}
+
+// gdbSignalNumbers returns true if the stub reports signals with gdb's own
+// numbers (see gdb/signals.def) instead of the ones of the target
+// operating system: gdbserver and rr translate signals, lldb-server and
+// debugserver don't.
+func (conn *gdbConn) gdbSignalNumbers() bool {
+	return conn.stubInfo.Kind == GdbserverStub || conn.stubInfo.Kind == RRStub
+}
+
+// StubInfo describes the remote stub.
+type StubInfo struct {
+	Kind    StubKind
+	Version string // version reported by the stub, empty if it didn't report one
+}
+
+func (info StubInfo) String() string {
+	if info.Version == "" {
+		return info.Kind.String()
+	}
+	return info.Kind.String() + " " + info.Version
+}
+
+// queryStubInfo determines the kind and version of the stub using
+// qGDBServerVersion, which is supported by lldb-server and debugserver.
+// For the other stubs we fall back to the reply to qHostInfo (also an lldb
+// extension) and to the features reported by qSupported: rr is the only stub
+// supporting reverse execution, otherwise we assume gdbserver.
+func (conn *gdbConn) queryStubInfo(features map[string]bool) StubInfo {
+	var info StubInfo
+	if resp, err := conn.exec([]byte("$qGDBServerVersion"), "init"); err == nil {
+		for _, kv := range strings.Split(string(resp), ";") {
+			colon := strings.Index(kv, ":")
+			if colon < 0 {
+				continue
+			}
+			switch kv[:colon] {
+			case "name":
+				switch kv[colon+1:] {
+				case "lldb", "lldb-server":
+					info.Kind = LldbServerStub
+				case "debugserver":
+					info.Kind = DebugserverStub
+				}
+			case "version":
+				info.Version = kv[colon+1:]
+			}
+		}
+		if info.Kind != UnknownStub {
+			return info
+		}
+	}
+	if ostype, ok := conn.hostInfo["ostype"]; ok {
+		switch ostype {
+		case "macosx", "ios", "tvos", "watchos":
+			info.Kind = DebugserverStub
+		default:
+			info.Kind = LldbServerStub
+		}
+		return info
+	}
+	switch {
+	case features["ReverseContinue"] || features["ReverseStep"]:
+		info.Kind = RRStub
+	case features != nil:
+		info.Kind = GdbserverStub
+	}
+	return info
+}
+
+// queryInfo executes cmd, qHostInfo or qProcessInfo, and returns its reply
+// as a map of keys to values. Returns nil if the stub doesn't support cmd.
+func (conn *gdbConn) queryInfo(cmd string) map[string]string {
+	resp, err := conn.exec([]byte(cmd), "init")
+	if err != nil {
+		return nil
+	}
+	return parseInfo(string(resp))
+}
+
+// parseInfo parses the reply to qHostInfo or qProcessInfo, a list of
+// key:value pairs separated by semicolons.
+func parseInfo(resp string) map[string]string {
+	info := make(map[string]string)
+	for _, kv := range strings.Split(resp, ";") {
+		if colon := strings.Index(kv, ":"); colon >= 0 {
+			info[kv[:colon]] = kv[colon+1:]
+		}
+	}
+	return info
+}
+
+// queryByteOrder determines the byte order of the target using the
+// 'endian' field of qHostInfo or qProcessInfo, read during the handshake,
+// defaulting to little endian when neither reported it.
+func (conn *gdbConn) queryByteOrder() binary.ByteOrder {
+	for _, info := range []map[string]string{conn.hostInfo, conn.processInfo} {
+		switch info["endian"] {
+		case "big":
+			return binary.BigEndian
+		case "little":
+			return binary.LittleEndian
+		}
+	}
+	return binary.LittleEndian
+}
+
+// queryTarget determines the operating system and architecture of the
+// target, as GOOS and GOARCH, using the 'ostype' and 'triple' fields of
+// the replies to qHostInfo and qProcessInfo read during the handshake.
+// Either value is empty if it couldn't be determined.
+func (conn *gdbConn) queryTarget() (goos, goarch string) {
+	for _, info := range []map[string]string{conn.hostInfo, conn.processInfo} {
+		if ostype, ok := info["ostype"]; ok && goos == "" {
+			goos = ostypeToGOOS(ostype)
+		}
+		if value, ok := info["triple"]; ok {
+			triple, err := hex.DecodeString(value)
+			if err != nil {
+				triple = []byte(value)
+			}
+			if goarch == "" {
+				goarch = tripleToGOARCH(string(triple))
+			}
+			if goos == "" {
+				if fields := strings.Split(string(triple), "-"); len(fields) >= 3 {
+					goos = ostypeToGOOS(fields[2])
+				}
+			}
+		}
+		if goos != "" && goarch != "" {
+			return goos, goarch
+		}
+	}
+	return goos, goarch
+}
+
+// ostypeToGOOS converts an operating system name used by lldb to GOOS.
+func ostypeToGOOS(ostype string) string {
+	switch ostype {
+	case "macosx", "darwin", "ios", "tvos", "watchos":
+		return "darwin"
+	case "windows", "win32":
+		return "windows"
+	}
+	return ostype
+}
+
+// tripleToGOARCH converts the architecture of a target triple (for example
+// "x86_64-pc-linux-gnu") to GOARCH.
+func tripleToGOARCH(triple string) string {
+	arch := triple
+	if dash := strings.Index(triple, "-"); dash >= 0 {
+		arch = triple[:dash]
+	}
+	switch arch {
+	case "x86_64", "amd64":
+		return "amd64"
+	case "i386", "i486", "i586", "i686":
+		return "386"
+	case "aarch64", "arm64":
+		return "arm64"
+	case "":
+		return ""
+	}
+	if strings.HasPrefix(arch, "arm") {
+		return "arm"
+	}
+	return arch
+}
+
+// enableCompression enables compression of the packets sent by the stub,
+// if the stub supports it (only debugserver does). Compression is a big
+// win for large memory reads, where most of the memory is zeroed.
+// Of the algorithms supported by debugserver we only implement
+// zlib-deflate, if it isn't available packets will be sent uncompressed.
+func (conn *gdbConn) enableCompression() {
+	for _, compression := range conn.supportedCompressions {
+		if compression == "zlib-deflate" {
+			if _, err := conn.exec([]byte("$QEnableCompression:type:zlib-deflate;"), "init"); err == nil {
+				conn.compressed = true
+			}
+			return
+		}
+	}
+}
+
 // qSupported interprets qSupported responses.
 func (conn *gdbConn) qSupported(multiprocess bool) (features map[string]bool, err error) {
 	q := qSupportedSimple
@@ -188,10 +555,13 @@ func (conn *gdbConn) qSupported(multiprocess bool) (features map[string]bool, er
 		if len(stubfeature) <= 0 {
 			continue
 		} else if equal := strings.Index(stubfeature, "="); equal >= 0 {
-			if stubfeature[:equal] == "PacketSize" {
+			switch stubfeature[:equal] {
+			case "PacketSize":
 				if n, err := strconv.ParseInt(stubfeature[equal+1:], 16, 64); err == nil {
 					conn.packetSize = int(n)
 				}
+			case "SupportedCompressions":
+				conn.supportedCompressions = strings.Split(stubfeature[equal+1:], ",")
 			}
 		} else if stubfeature[len(stubfeature)-1] == '+' {
 			features[stubfeature[:len(stubfeature)-1]] = true
@@ -268,6 +638,34 @@ func (conn *gdbConn) readTargetXml() (err error) {
 	return nil
 }
 
+// validateRegisterInfo checks that the register layout described by the
+// stub makes sense: every register must have a size that is a whole number
+// of bytes and registers must not overlap. Gaps between registers are
+// allowed, but logged, since they usually mean that we failed to parse
+// part of the description.
+func validateRegisterInfo(regsInfo []gdbRegisterInfo) error {
+	sorted := make([]gdbRegisterInfo, len(regsInfo))
+	copy(sorted, regsInfo)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	for i, reg := range sorted {
+		if reg.Bitsize <= 0 || reg.Bitsize%8 != 0 || reg.Offset < 0 {
+			return fmt.Errorf("invalid register description: register %s has offset %d and size %d bits", reg.Name, reg.Offset, reg.Bitsize)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := sorted[i-1]
+		prevEnd := prev.Offset + prev.Bitsize/8
+		if reg.Offset < prevEnd {
+			return fmt.Errorf("invalid register description: register %s (offset %d) overlaps register %s (offset %d, size %d bits)", reg.Name, reg.Offset, prev.Name, prev.Offset, prev.Bitsize)
+		}
+		if reg.Offset > prevEnd && logflags.GdbWire() {
+			fmt.Printf("%d byte gap in register description between %s and %s\n", reg.Offset-prevEnd, prev.Name, reg.Name)
+		}
+	}
+	return nil
+}
+
 // readRegisterInfo uses qRegisterInfo to read register information (used
 // when qXfer:feature:read is not supported).
 func (conn *gdbConn) readRegisterInfo() (err error) {
@@ -406,6 +804,27 @@ func (conn *gdbConn) setBreakpoint(addr uint64) error {
 	return err
 }
 
+// setThreadBreakpoint executes a 'Z' (insert breakpoint) command of type
+// '0' and kind '1' with a 'thread:tid' suffix, which asks the stub to only
+// stop threadID at the breakpoint. Stubs that don't support the suffix
+// reject the packet, the breakpoint is then set for all threads, with a
+// plain 'Z' packet, and the suffix is not sent again.
+func (conn *gdbConn) setThreadBreakpoint(addr uint64, threadID string) error {
+	if conn.threadBreakpointUnsupported {
+		return conn.setBreakpoint(addr)
+	}
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$Z0,%x,1;thread:%s", addr, threadID)
+	if _, err := conn.exec(conn.outbuf.Bytes(), "set thread breakpoint"); err == nil {
+		return nil
+	}
+	if err := conn.setBreakpoint(addr); err != nil {
+		return err
+	}
+	conn.threadBreakpointUnsupported = true
+	return nil
+}
+
 // clearBreakpoint executes a 'z' (remove breakpoint) command of type '0' and kind '1'
 func (conn *gdbConn) clearBreakpoint(addr uint64) error {
 	conn.outbuf.Reset()
@@ -414,6 +833,122 @@ func (conn *gdbConn) clearBreakpoint(addr uint64) error {
 	return err
 }
 
+// setBreakpoints executes a 'Z' (insert breakpoint) command of type '0' and
+// kind '1' for each address in addrs and returns the result of each one,
+// see execPipelined.
+func (conn *gdbConn) setBreakpoints(addrs []uint64) []error {
+	cmds := make([][]byte, len(addrs))
+	for i, addr := range addrs {
+		cmds[i] = []byte(fmt.Sprintf("$Z0,%x,1", addr))
+	}
+	_, errs := conn.execPipelined(cmds, "set breakpoint")
+	return errs
+}
+
+// readMemoryBatch reads len(bufs[i]) bytes at addrs[i] into bufs[i], for
+// each i, and returns the result of each read. Reads that fit in a single
+// packet are executed with execPipelined, the others with readMemory.
+func (conn *gdbConn) readMemoryBatch(bufs [][]byte, addrs []uint64) []error {
+	errs := make([]error, len(bufs))
+	var cmds [][]byte
+	var idx []int
+	for i := range bufs {
+		if len(bufs[i]) > (conn.packetSize-4)/2 {
+			errs[i] = conn.readMemory(bufs[i], uintptr(addrs[i]))
+			continue
+		}
+		cmds = append(cmds, []byte(fmt.Sprintf("$m%x,%x", addrs[i], len(bufs[i]))))
+		idx = append(idx, i)
+	}
+
+	resps, cmderrs := conn.execPipelined(cmds, "memory read")
+	for j, i := range idx {
+		if cmderrs[j] != nil {
+			errs[i] = cmderrs[j]
+			continue
+		}
+		if len(resps[j]) != 2*len(bufs[i]) {
+			errs[i] = fmt.Errorf("short memory read at %#x: %d bytes instead of %d", addrs[i], len(resps[j])/2, len(bufs[i]))
+			continue
+		}
+		if _, err := hex.Decode(bufs[i], resps[j]); err != nil {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// execPipelined executes each command in cmds and returns the reply and
+// the error of each one. If acknowledgments are disabled the commands are
+// pipelined, up to maxPipelinedCommands commands are sent before reading
+// their replies, otherwise they are executed one at a time like exec.
+// Replies are copied, unlike the ones returned by exec they remain valid
+// after the next command.
+func (conn *gdbConn) execPipelined(cmds [][]byte, context string) ([][]byte, []error) {
+	resps := make([][]byte, len(cmds))
+	errs := make([]error, len(cmds))
+	if conn.ack {
+		for i, cmd := range cmds {
+			resp, err := conn.exec(cmd, context)
+			resps[i], errs[i] = append([]byte(nil), resp...), err
+		}
+		return resps, errs
+	}
+
+	for start := 0; start < len(cmds); start += maxPipelinedCommands {
+		end := start + maxPipelinedCommands
+		if end > len(cmds) {
+			end = len(cmds)
+		}
+
+		sent := start
+		var senderr error
+		for ; sent < end; sent++ {
+			if senderr = conn.send(cmds[sent]); senderr != nil {
+				break
+			}
+		}
+
+		for i := start; i < sent; i++ {
+			resp, err := conn.recv(cmds[i], context, false)
+			if err == nil && !plausibleReply(cmds[i], resp) {
+				conn.dead = ErrProtocolDesync
+				err = ErrProtocolDesync
+			}
+			if err == nil {
+				resps[i] = append([]byte(nil), resp...)
+			}
+			errs[i] = err
+		}
+
+		if senderr != nil {
+			for i := sent; i < len(cmds); i++ {
+				errs[i] = senderr
+			}
+			break
+		}
+	}
+	return resps, errs
+}
+
+// setWatchpoint executes a 'Z' (insert breakpoint) command of type '2'
+// (write watchpoint), '3' (read watchpoint) or '4' (access watchpoint).
+func (conn *gdbConn) setWatchpoint(kind WatchKind, addr uint64, sz int) error {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$Z%d,%x,%x", kind.ztype(), addr, sz)
+	_, err := conn.exec(conn.outbuf.Bytes(), "set watchpoint")
+	return err
+}
+
+// clearWatchpoint executes a 'z' (remove breakpoint) command of type '2',
+// '3' or '4'.
+func (conn *gdbConn) clearWatchpoint(kind WatchKind, addr uint64, sz int) error {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$z%d,%x,%x", kind.ztype(), addr, sz)
+	_, err := conn.exec(conn.outbuf.Bytes(), "clear watchpoint")
+	return err
+}
+
 // kill executes a 'k' (kill) command.
 func (conn *gdbConn) kill() error {
 	resp, err := conn.exec([]byte{'$', 'k'}, "kill")
@@ -458,6 +993,10 @@ func (conn *gdbConn) readRegisters(threadID string, data []byte) error {
 		return err
 	}
 
+	if len(resp)/2 > len(data) {
+		return fmt.Errorf("invalid register description: 'g' packet contains %d bytes, but registers only take %d bytes", len(resp)/2, len(data))
+	}
+
 	for i := 0; i < len(resp); i += 2 {
 		n, _ := strconv.ParseUint(string(resp[i:i+2]), 16, 8)
 		data[i/2] = uint8(n)
@@ -526,61 +1065,234 @@ func (conn *gdbConn) writeRegister(threadID string, regnum int, data []byte) err
 
 // resume executes a 'vCont' command on all threads with action 'c' if sig
 // is 0 or 'C' if it isn't.
-func (conn *gdbConn) resume(sig uint8, tu *threadUpdater) (string, uint8, error) {
+func (conn *gdbConn) resume(sig uint8, tu *threadUpdater) (stopPacket, error) {
+	if err := conn.writeResume(sig); err != nil {
+		return stopPacket{}, err
+	}
+	return conn.sendResume(tu)
+}
+
+// writeResume writes to conn.outbuf the command executed by resume.
+func (conn *gdbConn) writeResume(sig uint8) error {
 	if conn.direction == proc.Forward {
 		conn.outbuf.Reset()
-		if sig == 0 {
+		switch {
+		case sig == 0 && conn.vContSupports('c'):
 			fmt.Fprint(&conn.outbuf, "$vCont;c")
-		} else {
+		case sig == 0:
+			fmt.Fprint(&conn.outbuf, "$c")
+		case conn.vContSupports('C'):
 			fmt.Fprintf(&conn.outbuf, "$vCont;C%02x", sig)
+		default:
+			fmt.Fprintf(&conn.outbuf, "$C%02x", sig)
 		}
 	} else {
 		if err := conn.selectThread('c', "p-1.-1", "resume"); err != nil {
-			return "", 0, err
+			return err
 		}
 		conn.outbuf.Reset()
 		fmt.Fprint(&conn.outbuf, "$bc")
 	}
+	return nil
+}
+
+// resumeThread executes a 'vCont' command that continues only the
+// specified thread, all other threads stay stopped. The stub must support
+// the 'c' action of vCont.
+func (conn *gdbConn) resumeThread(threadID string, tu *threadUpdater) (stopPacket, error) {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$vCont;c:%s", threadID)
+	return conn.sendResume(tu)
+}
+
+// resumeThreadWithSignal executes a 'vCont' command that continues the
+// specified thread delivering signal sig to it and continues all other
+// threads without a signal. The stub must support the 'C' action.
+func (conn *gdbConn) resumeThreadWithSignal(threadID string, sig uint8, tu *threadUpdater) (stopPacket, error) {
+	conn.writeResumeThreadWithSignal(threadID, sig)
+	return conn.sendResume(tu)
+}
+
+// writeResumeThreadWithSignal writes to conn.outbuf the command executed
+// by resumeThreadWithSignal.
+func (conn *gdbConn) writeResumeThreadWithSignal(threadID string, sig uint8) {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$vCont;C%02x:%s;c", sig, threadID)
+}
+
+// resumeWithRange executes a 'vCont' command that range steps the
+// specified thread while its PC is in [start, end) and continues all other
+// threads. The stub must support the 'r' action.
+func (conn *gdbConn) resumeWithRange(threadID string, start, end uint64, tu *threadUpdater) (stopPacket, error) {
+	conn.writeResumeWithRange(threadID, start, end)
+	return conn.sendResume(tu)
+}
+
+// writeResumeWithRange writes to conn.outbuf the command executed by
+// resumeWithRange.
+func (conn *gdbConn) writeResumeWithRange(threadID string, start, end uint64) {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$vCont;r%x,%x:%s;c", start, end, threadID)
+}
+
+// sendResume sends the resume command in conn.outbuf and waits for the
+// target to stop, see startResume and waitResume.
+func (conn *gdbConn) sendResume(tu *threadUpdater) (stopPacket, error) {
+	sp, queued, err := conn.startResume()
+	if queued || err != nil {
+		return sp, err
+	}
+	sp, _, err = conn.waitResume(-1, tu)
+	return sp, err
+}
+
+// startResume sends the resume command in conn.outbuf, without waiting
+// for the target to stop.
+// If a stop was received while the target was supposed to be stopped (see
+// queueStop) and the command continues all threads the target isn't
+// resumed and that stop is returned instead, with queued set to true.
+// Steps and range steps are always sent to the stub: they must stop after
+// the requested thread moves, the queued stops are kept for the next
+// continue. So are resumes delivering a signal, which would otherwise be
+// lost.
+func (conn *gdbConn) startResume() (sp stopPacket, queued bool, err error) {
+	if len(conn.pendingStops) > 0 && continuesAll(conn.outbuf.Bytes()) {
+		sp := conn.pendingStops[0]
+		conn.pendingStops = conn.pendingStops[1:]
+		conn.stopGen++
+		if conn.resumeChan != nil {
+			close(conn.resumeChan)
+			conn.resumeChan = nil
+		}
+		return sp, true, nil
+	}
 	conn.manualStopMutex.Lock()
+	conn.stopGen++
 	if err := conn.send(conn.outbuf.Bytes()); err != nil {
 		conn.manualStopMutex.Unlock()
-		return "", 0, err
+		return stopPacket{}, false, err
 	}
 	conn.running = true
 	conn.manualStopMutex.Unlock()
-	defer func() {
-		conn.manualStopMutex.Lock()
-		conn.running = false
-		conn.manualStopMutex.Unlock()
-	}()
 	if conn.resumeChan != nil {
 		close(conn.resumeChan)
 		conn.resumeChan = nil
 	}
-	return conn.waitForvContStop("resume", "-1", tu)
+	return stopPacket{}, false, nil
+}
+
+// continuesAll returns true if cmd is a resume command that continues all
+// threads, without stepping any of them or delivering a signal.
+func continuesAll(cmd []byte) bool {
+	cmd = bytes.TrimPrefix(cmd, []byte{'$'})
+	if !bytes.HasPrefix(cmd, []byte("vCont;")) {
+		return len(cmd) > 0 && cmd[0] == 'c'
+	}
+	all := false
+	for _, action := range bytes.Split(cmd[len("vCont;"):], []byte{';'}) {
+		if len(action) == 0 || action[0] != 'c' {
+			return false
+		}
+		if bytes.IndexByte(action, ':') < 0 {
+			all = true
+		}
+	}
+	return all
+}
+
+// waitResume waits for the target resumed by startResume to stop. If
+// timeout isn't negative and no stop is received from the stub before it
+// expires running is true, console output ('O' packets) received in the
+// meantime is consumed.
+func (conn *gdbConn) waitResume(timeout time.Duration, tu *threadUpdater) (sp stopPacket, running bool, err error) {
+	defer func() {
+		if !running {
+			conn.manualStopMutex.Lock()
+			conn.running = false
+			conn.manualStopMutex.Unlock()
+		}
+	}()
+	if timeout < 0 {
+		sp, err = conn.waitForvContStop("resume", "-1", tu)
+		return sp, false, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		// Only wait for the first byte of a packet: once the stub starts
+		// sending it the rest of the packet follows immediately, a deadline
+		// expiring in the middle of a packet would lose the part read.
+		conn.conn.SetReadDeadline(deadline)
+		_, err := conn.rdr.Peek(1)
+		conn.conn.SetReadDeadline(time.Time{})
+		if neterr, isneterr := err.(net.Error); isneterr && neterr.Timeout() {
+			return stopPacket{}, true, nil
+		}
+		// any other error is returned by recv
+		resp, err := conn.recv(nil, "resume", false)
+		if err != nil {
+			return stopPacket{}, false, err
+		}
+		repeat, sp, err := conn.parseStopPacket(resp, "-1", tu)
+		if !repeat {
+			return sp, false, err
+		}
+	}
 }
 
-// step executes a 'vCont' command on the specified thread with 's' action.
-func (conn *gdbConn) step(threadID string, tu *threadUpdater) (string, uint8, error) {
+// step executes a 'vCont' command on the specified thread with 's' action,
+// or a 's' command if the stub doesn't support it.
+func (conn *gdbConn) step(threadID string, tu *threadUpdater) (stopPacket, error) {
 	if conn.direction == proc.Forward {
-		conn.outbuf.Reset()
-		fmt.Fprintf(&conn.outbuf, "$vCont;s:%s", threadID)
+		if conn.vContSupports('s') {
+			conn.outbuf.Reset()
+			fmt.Fprintf(&conn.outbuf, "$vCont;s:%s", threadID)
+		} else {
+			// the thread suffix does not apply to 's', the thread to step
+			// must always be selected with Hc.
+			if err := conn.selectThread('c', threadID, "step"); err != nil {
+				return stopPacket{}, err
+			}
+			conn.outbuf.Reset()
+			fmt.Fprint(&conn.outbuf, "$s")
+		}
 	} else {
 		if err := conn.selectThread('c', threadID, "step"); err != nil {
-			return "", 0, err
+			return stopPacket{}, err
 		}
 		conn.outbuf.Reset()
 		fmt.Fprint(&conn.outbuf, "$bs")
 	}
+	conn.stopGen++
 	if err := conn.send(conn.outbuf.Bytes()); err != nil {
-		return "", 0, err
+		return stopPacket{}, err
 	}
 	return conn.waitForvContStop("singlestep", threadID, tu)
 }
 
+// stepThreads executes a 'vCont' command stepping all the specified threads
+// at the same time, the default action continues the other threads.
+// If the stub doesn't support the 's' action only the first thread is
+// stepped, see step.
+func (conn *gdbConn) stepThreads(threadIDs []string, tu *threadUpdater) (stopPacket, error) {
+	if !conn.vContSupports('s') {
+		return conn.step(threadIDs[0], tu)
+	}
+	conn.outbuf.Reset()
+	fmt.Fprint(&conn.outbuf, "$vCont")
+	for _, threadID := range threadIDs {
+		fmt.Fprintf(&conn.outbuf, ";s:%s", threadID)
+	}
+	fmt.Fprint(&conn.outbuf, ";c")
+	conn.stopGen++
+	if err := conn.send(conn.outbuf.Bytes()); err != nil {
+		return stopPacket{}, err
+	}
+	return conn.waitForvContStop("singlestep", threadIDs[0], tu)
+}
+
 var threadBlockedError = errors.New("thread blocked")
 
-func (conn *gdbConn) waitForvContStop(context string, threadID string, tu *threadUpdater) (string, uint8, error) {
+func (conn *gdbConn) waitForvContStop(context string, threadID string, tu *threadUpdater) (stopPacket, error) {
 	count := 0
 	failed := false
 	for {
@@ -601,22 +1313,68 @@ func (conn *gdbConn) waitForvContStop(context string, threadID string, tu *threa
 			}
 			count++
 		} else if failed {
-			return "", 0, threadBlockedError
+			return stopPacket{}, threadBlockedError
 		} else if err != nil {
-			return "", 0, err
+			return stopPacket{}, err
 		} else {
 			repeat, sp, err := conn.parseStopPacket(resp, threadID, tu)
 			if !repeat {
-				return sp.threadID, sp.sig, err
+				return sp, err
 			}
 		}
 	}
 }
 
 type stopPacket struct {
-	threadID string
-	sig      uint8
-	reason   string
+	threadID     string
+	sig          uint8
+	reason       string      // value of the 'reason' keys, separated by commas if there is more than one
+	reasons      stopReasons // all the stop reasons reported by the stub
+	threadExited bool        // the thread exited ('w' stop reply)
+	watchAddr    uint64      // address that triggered the watchpoint
+	core         int         // CPU core the thread stopped on, if hasCore is set
+	hasCore      bool        // the stub reported the CPU core ('core' key)
+}
+
+// stopReasons is the set of reasons a thread stopped for.
+// A thread can stop for more than one reason at once, for example when a
+// breakpoint and a watchpoint trigger on the same instruction: stubs
+// report this with more than one stop reason key in the stop packet
+// ('swbreak', 'watch', etc.) or, for lldb's stubs, more than one 'reason'
+// key.
+type stopReasons uint16
+
+const (
+	stopReasonBreakpoint   stopReasons = 1 << iota // software breakpoint ('swbreak' or 'reason:breakpoint')
+	stopReasonHwBreakpoint                         // hardware breakpoint ('hwbreak')
+	stopReasonWatchpoint                           // watchpoint ('watch', 'rwatch', 'awatch' or 'reason:watchpoint')
+	stopReasonTrace                                // single step ('reason:trace')
+	stopReasonSignal                               // signal ('reason:signal')
+	stopReasonException                            // exception ('reason:exception')
+	stopReasonLibrary                              // the list of shared libraries changed ('library')
+	stopReasonThreadCreated                        // the thread was just created ('create'), see QThreadEvents
+)
+
+// lldbStopReasons maps the values of the 'reason' key sent by lldb's
+// stubs to stop reasons, unknown values are only kept in
+// stopPacket.reason.
+var lldbStopReasons = map[string]stopReasons{
+	"breakpoint": stopReasonBreakpoint,
+	"watchpoint": stopReasonWatchpoint,
+	"trace":      stopReasonTrace,
+	"signal":     stopReasonSignal,
+	"exception":  stopReasonException,
+}
+
+func (r stopReasons) has(reason stopReasons) bool {
+	return r&reason != 0
+}
+
+// atBreakpoint returns true if the thread that stopped with sp could be
+// stopped at one of our breakpoints: the stub said so or, if it didn't
+// give any reason, the thread received the breakpoint signal.
+func (sp *stopPacket) atBreakpoint() bool {
+	return sp.reasons.has(stopReasonBreakpoint) || (sp.reasons == 0 && sp.reason == "" && sp.sig == breakpointSignal)
 }
 
 // executes 'vCont' (continue/step) command
@@ -637,6 +1395,7 @@ func (conn *gdbConn) parseStopPacket(resp []byte, threadID string, tu *threadUpd
 			fmt.Fprintf(os.Stderr, "full stop packet: %s\n", string(resp))
 		}
 
+		var description []byte
 		buf := resp[3:]
 		for buf != nil {
 			colon := bytes.Index(buf, []byte{':'})
@@ -661,18 +1420,46 @@ func (conn *gdbConn) parseStopPacket(resp []byte, threadID string, tu *threadUpd
 				sp.threadID = string(value)
 			case "threads":
 				if tu != nil {
-					tu.Add(strings.Split(string(value), ","))
+					if err := tu.Add(strings.Split(string(value), ",")); err != nil {
+						return false, stopPacket{}, err
+					}
 					tu.Finish()
 				}
 			case "reason":
-				sp.reason = string(value)
+				if sp.reason != "" {
+					sp.reason += ","
+				}
+				sp.reason += string(value)
+				sp.reasons |= lldbStopReasons[string(value)]
+			case "description":
+				description = value
+			case "swbreak":
+				sp.reasons |= stopReasonBreakpoint
+			case "hwbreak":
+				sp.reasons |= stopReasonHwBreakpoint
+			case "watch", "rwatch", "awatch":
+				sp.watchAddr, _ = strconv.ParseUint(string(value), 16, 64)
+				sp.reasons |= stopReasonWatchpoint
+			case "library":
+				sp.reasons |= stopReasonLibrary
+			case "create":
+				sp.reasons |= stopReasonThreadCreated
+			case "core":
+				if core, err := strconv.ParseUint(string(value), 16, 32); err == nil {
+					sp.core, sp.hasCore = int(core), true
+				}
 			}
 		}
 
+		if sp.watchAddr == 0 && sp.reasons.has(stopReasonWatchpoint) && description != nil {
+			sp.watchAddr = parseWatchpointDescription(description)
+		}
+
 		return false, sp, nil
 
 	case 'W', 'X':
-		// process exited, next two character are exit code
+		// process exited, next two character are exit code ('W') or the signal
+		// that terminated the process ('X')
 
 		semicolon := bytes.Index(resp, []byte{';'})
 
@@ -680,9 +1467,34 @@ func (conn *gdbConn) parseStopPacket(resp []byte, threadID string, tu *threadUpd
 			semicolon = len(resp)
 		}
 		status, _ := strconv.ParseUint(string(resp[1:semicolon]), 16, 8)
+		pid := conn.pid
+		if conn.multiprocess && semicolon < len(resp) && bytes.HasPrefix(resp[semicolon+1:], []byte("process:")) {
+			// in multiprocess mode the exit packet specifies which process
+			// exited
+			if n, err := strconv.ParseUint(string(resp[semicolon+1+len("process:"):]), 16, 32); err == nil {
+				pid = int(n)
+			}
+		}
+		if pid != conn.pid {
+			return false, stopPacket{}, proc.ProcessExitedError{Pid: pid, Status: int(status)}
+		}
+		conn.exitStatus = int(status)
+		conn.exitSignaled = resp[0] == 'X'
 		return false, stopPacket{}, proc.ProcessExitedError{Pid: conn.pid, Status: int(status)}
 
-	case 'N':
+	case 'w':
+		// a thread exited, the exit status is followed by the thread ID
+		semicolon := bytes.Index(resp, []byte{';'})
+		if semicolon < 0 {
+			return false, stopPacket{}, fmt.Errorf("malformed thread exit packet: %s", string(resp))
+		}
+		status, _ := strconv.ParseUint(string(resp[1:semicolon]), 16, 8)
+		sp.sig = uint8(status)
+		sp.threadID = string(resp[semicolon+1:])
+		sp.threadExited = true
+		return false, sp, nil
+
+	case 'N':
 		// we were singlestepping the thread and the thread exited
 		sp.threadID = threadID
 		return false, sp, nil
@@ -701,6 +1513,77 @@ func (conn *gdbConn) parseStopPacket(resp []byte, threadID string, tu *threadUpd
 	}
 }
 
+// parseWatchpointDescription returns the address of the watchpoint
+// described by the hex encoded description of a 'reason:watchpoint' stop,
+// sent by lldb's stubs instead of a 'watch' key. The description starts
+// with the address of the watchpoint, in decimal, followed by other fields
+// separated by spaces. Returns zero if the address can't be parsed.
+func parseWatchpointDescription(description []byte) uint64 {
+	buf, err := hex.DecodeString(string(description))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) == 0 {
+		return 0
+	}
+	addr, _ := strconv.ParseUint(fields[0], 10, 64)
+	return addr
+}
+
+// stopReplyCommands are the prefixes of the commands that are answered
+// with a stop reply.
+var stopReplyCommands = []string{"$?", "$qThreadStopInfo", "$vAttach", "$vRun", "$vCont;", "$c", "$C", "$s", "$S", "$bc", "$bs"}
+
+// isStrayStopReply returns true if resp is a stop reply ('T' or 'S'
+// packet) and cmd is not a command that is answered with a stop reply.
+func isStrayStopReply(cmd, resp []byte) bool {
+	if len(resp) < 3 || !isHexDigit(resp[1]) || !isHexDigit(resp[2]) {
+		return false
+	}
+	switch resp[0] {
+	case 'T':
+	case 'S':
+		if len(resp) != 3 {
+			return false
+		}
+	default:
+		return false
+	}
+	for _, prefix := range stopReplyCommands {
+		if bytes.HasPrefix(cmd, []byte(prefix)) {
+			return false
+		}
+	}
+	return true
+}
+
+func isHexDigit(ch byte) bool {
+	return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+// queueStop saves a stop reply received while the target was supposed to
+// be stopped, it will be returned by the next resume instead of resuming
+// the target. This happens with stubs that report delayed events on any
+// packet, see the comment at the top of gdbserver.go.
+func (conn *gdbConn) queueStop(resp []byte) {
+	var sp stopPacket
+	if resp[0] == 'S' {
+		sig, err := strconv.ParseUint(string(resp[1:3]), 16, 8)
+		if err != nil {
+			return
+		}
+		sp.sig = uint8(sig)
+	} else {
+		var err error
+		_, sp, err = conn.parseStopPacket(resp, "", nil)
+		if err != nil {
+			return
+		}
+	}
+	conn.pendingStops = append(conn.pendingStops, sp)
+}
+
 const ctrlC = 0x03 // the ASCII character for ^C
 
 // executes a ctrl-C on the line
@@ -759,6 +1642,92 @@ func (conn *gdbConn) queryProcessInfo(pid int) (map[string]string, error) {
 	return pi, nil
 }
 
+// gdbLibrariesSvr4 is used to parse the document returned by
+// qXfer:libraries-svr4:read, described by:
+//  https://github.com/bminor/binutils-gdb/blob/61baf725eca99af2569262d10aca03dcde2698f6/gdb/features/library-list-svr4.dtd
+type gdbLibrariesSvr4 struct {
+	Libraries []gdbLibrarySvr4 `xml:"library"`
+}
+
+type gdbLibrarySvr4 struct {
+	Name  string `xml:"name,attr"`
+	LAddr string `xml:"l_addr,attr"`
+}
+
+// queryLibrariesSvr4 reads the list of shared libraries loaded by the
+// dynamic linker using qXfer:libraries-svr4:read.
+func (conn *gdbConn) queryLibrariesSvr4() ([]gdbLibrarySvr4, error) {
+	buf, err := conn.qXfer("libraries-svr4", "")
+	if err != nil {
+		return nil, err
+	}
+	var libs gdbLibrariesSvr4
+	if err := xml.Unmarshal(buf, &libs); err != nil {
+		return nil, fmt.Errorf("malformed qXfer:libraries-svr4:read response: %v", err)
+	}
+	return libs.Libraries, nil
+}
+
+// gdbThreadsInfo is used to parse the document returned by
+// qXfer:threads:read, described by:
+//  https://github.com/bminor/binutils-gdb/blob/61baf725eca99af2569262d10aca03dcde2698f6/gdb/features/threads.dtd
+type gdbThreadsInfo struct {
+	Threads []gdbThreadInfo `xml:"thread"`
+}
+
+type gdbThreadInfo struct {
+	ID   string `xml:"id,attr"`
+	Core string `xml:"core,attr"`
+	Name string `xml:"name,attr"`
+}
+
+// queryThreadsXfer reads the list of threads using qXfer:threads:read.
+func (conn *gdbConn) queryThreadsXfer() ([]gdbThreadInfo, error) {
+	buf, err := conn.qXfer("threads", "")
+	if err != nil {
+		return nil, err
+	}
+	var info gdbThreadsInfo
+	if err := xml.Unmarshal(buf, &info); err != nil {
+		return nil, fmt.Errorf("malformed qXfer:threads:read response: %v", err)
+	}
+	return info.Threads, nil
+}
+
+// queryCurrentThread executes a 'qC' command and returns the ID of the
+// stub's current thread, the thread used by commands that don't specify
+// one.
+func (conn *gdbConn) queryCurrentThread() (string, error) {
+	resp, err := conn.exec([]byte("$qC"), "current thread")
+	if err != nil {
+		return "", err
+	}
+	if len(resp) < 3 || resp[0] != 'Q' || resp[1] != 'C' {
+		return "", fmt.Errorf("malformed qC response %q", resp)
+	}
+	threadID := string(resp[2:])
+	if _, _, err := parseMultiprocessThreadID(threadID); err != nil {
+		return "", err
+	}
+	return threadID, nil
+}
+
+// threadExtraInfo executes a 'qThreadExtraInfo' command and returns the
+// description of the thread, a free form string.
+func (conn *gdbConn) threadExtraInfo(threadID string) (string, error) {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$qThreadExtraInfo,%s", threadID)
+	resp, err := conn.exec(conn.outbuf.Bytes(), "thread extra info")
+	if err != nil {
+		return "", err
+	}
+	info := make([]byte, len(resp)/2)
+	if _, err := hex.Decode(info, resp); err != nil {
+		return "", fmt.Errorf("malformed qThreadExtraInfo response %q: %v", resp, err)
+	}
+	return string(info), nil
+}
+
 // executes qfThreadInfo/qsThreadInfo commands
 func (conn *gdbConn) queryThreads(first bool) (threads []string, err error) {
 	// https://sourceware.org/gdb/onlinedocs/gdb/General-Query-Packets.html
@@ -792,10 +1761,7 @@ func (conn *gdbConn) queryThreads(first bool) (threads []string, err error) {
 			tidbuf = tidbuf[:comma]
 		}
 		if conn.multiprocess && pid == 0 {
-			dot := bytes.Index(tidbuf, []byte{'.'})
-			if dot >= 0 {
-				pid, _ = strconv.Atoi(string(tidbuf[1:dot]))
-			}
+			pid, _, _ = parseMultiprocessThreadID(string(tidbuf))
 		}
 		threads = append(threads, string(tidbuf))
 		if comma < 0 {
@@ -804,14 +1770,17 @@ func (conn *gdbConn) queryThreads(first bool) (threads []string, err error) {
 		resp = resp[comma+1:]
 	}
 
-	if conn.multiprocess && pid > 0 {
+	if conn.multiprocess && pid > 0 && conn.pid <= 0 {
 		conn.pid = pid
 	}
 	return threads, nil
 }
 
+// selectThread sends a 'H' packet selecting threadID for the commands of
+// the given kind. The thread suffix replaces Hg but not Hc, which is still
+// needed by 's' and 'c'.
 func (conn *gdbConn) selectThread(kind byte, threadID string, context string) error {
-	if conn.threadSuffixSupported {
+	if conn.threadSuffixSupported && kind != 'c' {
 		panic("selectThread when thread suffix is supported")
 	}
 	conn.outbuf.Reset()
@@ -833,8 +1802,6 @@ func (conn *gdbConn) readMemory(data []byte, addr uintptr) error {
 	data = data[:0]
 
 	for size > 0 {
-		conn.outbuf.Reset()
-
 		// gdbserver will crash if we ask too many bytes... not return an error, actually crash
 		sz := size
 		if dataSize := (conn.packetSize - 4) / 2; sz > dataSize {
@@ -842,10 +1809,22 @@ func (conn *gdbConn) readMemory(data []byte, addr uintptr) error {
 		}
 		size = size - sz
 
-		fmt.Fprintf(&conn.outbuf, "$m%x,%x", addr+uintptr(len(data)), sz)
-		resp, err := conn.exec(conn.outbuf.Bytes(), "memory read")
-		if err != nil {
-			return err
+		var resp []byte
+		for attempt := 0; ; attempt++ {
+			conn.outbuf.Reset()
+			fmt.Fprintf(&conn.outbuf, "$m%x,%x", addr+uintptr(len(data)), sz)
+			var err error
+			resp, err = conn.exec(conn.outbuf.Bytes(), "memory read")
+			if err == nil {
+				break
+			}
+			if attempt >= conn.memReadRetries || !conn.transientMemoryError(err, addr+uintptr(len(data))) {
+				return err
+			}
+			if logflags.GdbWire() {
+				fmt.Fprintf(os.Stderr, "memory read at %#x failed with %v, retrying (%d/%d)\n", addr+uintptr(len(data)), err, attempt+1, conn.memReadRetries)
+			}
+			time.Sleep(conn.memReadRetryDelay)
 		}
 
 		for i := 0; i < len(resp); i += 2 {
@@ -856,12 +1835,79 @@ func (conn *gdbConn) readMemory(data []byte, addr uintptr) error {
 	return nil
 }
 
+// errnoEFAULT is the error code returned by stubs that report errno values
+// when reading an address that isn't mapped.
+const errnoEFAULT = 0x0e
+
+// transientMemoryError returns true if err, returned by a memory read at
+// addr, could succeed if the read is retried. Error responses for addresses
+// that aren't mapped in the inferior are never transient.
+func (conn *gdbConn) transientMemoryError(err error, addr uintptr) bool {
+	gdberr, ok := err.(*GdbProtocolError)
+	if !ok || gdberr.code == "" {
+		return false
+	}
+	if !conn.memoryRegionInfoUnsupported {
+		r, err := conn.memoryRegionInfo(uint64(addr))
+		if err == nil {
+			return r.permissions != ""
+		}
+		if isProtocolErrorUnsupported(err) {
+			conn.memoryRegionInfoUnsupported = true
+		}
+	}
+	if len(gdberr.code) > 1 && gdberr.code[0] == 'E' {
+		if n, err := strconv.ParseUint(gdberr.code[1:], 16, 8); err == nil && n == errnoEFAULT {
+			return false
+		}
+	}
+	return true
+}
+
 func writeAsciiBytes(w io.Writer, data []byte) {
 	for _, b := range data {
 		fmt.Fprintf(w, "%02x", b)
 	}
 }
 
+// writeBinaryBytes writes data to w escaping the characters that can not
+// appear in the binary data of a packet.
+func writeBinaryBytes(w *bytes.Buffer, data []byte) {
+	for _, b := range data {
+		switch b {
+		case '#', '$', '}', '*':
+			w.WriteByte('}')
+			w.WriteByte(b ^ escapeXor)
+		default:
+			w.WriteByte(b)
+		}
+	}
+}
+
+// searchMemory executes a 'qSearch:memory' command, searching pattern in
+// the memory range [start, start+length).
+func (conn *gdbConn) searchMemory(start, length uint64, pattern []byte) (addr uint64, found bool, err error) {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$qSearch:memory:%x;%x;", start, length)
+	writeBinaryBytes(&conn.outbuf, pattern)
+	resp, err := conn.exec(conn.outbuf.Bytes(), "search memory")
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case string(resp) == "0":
+		return 0, false, nil
+	case bytes.HasPrefix(resp, []byte("1,")):
+		addr, err = strconv.ParseUint(string(resp[2:]), 16, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("malformed qSearch:memory response %q", resp)
+		}
+		return addr, true, nil
+	default:
+		return 0, false, fmt.Errorf("malformed qSearch:memory response %q", resp)
+	}
+}
+
 // executes 'M' (write memory) command
 func (conn *gdbConn) writeMemory(addr uintptr, data []byte) (written int, err error) {
 	conn.outbuf.Reset()
@@ -872,11 +1918,75 @@ func (conn *gdbConn) writeMemory(addr uintptr, data []byte) (written int, err er
 
 	_, err = conn.exec(conn.outbuf.Bytes(), "memory write")
 	if err != nil {
+		if _, isProtocolErr := err.(*GdbProtocolError); isProtocolErr && conn.readOnlyRegion(addr, len(data)) {
+			return 0, &ReadOnlyMemoryError{Addr: addr}
+		}
 		return 0, err
 	}
+	if conn.verifyWrites {
+		if err := conn.verifyMemory(addr, data); err != nil {
+			return 0, err
+		}
+	}
 	return len(data), nil
 }
 
+// ReadOnlyMemoryError is returned when the stub refuses to write memory
+// that belongs to a region that is not writable.
+// gdbserver and lldb-server write memory through ptrace or /proc/pid/mem,
+// which ignore page protections, and debugserver makes the page writable
+// for the duration of the write, so this error is only seen with stubs
+// that honor page protections. None of the stubs provide a way to change
+// the protection of a page explicitly.
+type ReadOnlyMemoryError struct {
+	Addr uintptr
+}
+
+func (err *ReadOnlyMemoryError) Error() string {
+	return fmt.Sprintf("cannot write to read-only region at %#x", err.Addr)
+}
+
+// readOnlyRegion returns true if the stub reports that the sz bytes
+// starting at addr are in a memory region that isn't writable. Returns
+// false if the stub doesn't support qMemoryRegionInfo.
+func (conn *gdbConn) readOnlyRegion(addr uintptr, sz int) bool {
+	if conn.memoryRegionInfoUnsupported {
+		return false
+	}
+	r, err := conn.memoryRegionInfo(uint64(addr))
+	if err != nil {
+		if isProtocolErrorUnsupported(err) {
+			conn.memoryRegionInfoUnsupported = true
+		}
+		return false
+	}
+	return r.contains(uint64(addr), sz) && r.permissions != "" && !strings.Contains(r.permissions, "w")
+}
+
+// MemoryWriteError is returned when reading back the memory after a write
+// shows that the write did not take effect.
+type MemoryWriteError struct {
+	Addr     uintptr
+	Written  []byte
+	ReadBack []byte
+}
+
+func (err *MemoryWriteError) Error() string {
+	return fmt.Sprintf("memory write at %#x did not take effect: wrote %x, read back %x", err.Addr, err.Written, err.ReadBack)
+}
+
+// verifyMemory reads the memory at addr and checks that it contains data.
+func (conn *gdbConn) verifyMemory(addr uintptr, data []byte) error {
+	buf := make([]byte, len(data))
+	if err := conn.readMemory(buf, addr); err != nil {
+		return fmt.Errorf("could not verify memory write at %#x: %v", addr, err)
+	}
+	if !bytes.Equal(buf, data) {
+		return &MemoryWriteError{Addr: addr, Written: data, ReadBack: buf}
+	}
+	return nil
+}
+
 func (conn *gdbConn) allocMemory(sz uint64) (uint64, error) {
 	conn.outbuf.Reset()
 	fmt.Fprintf(&conn.outbuf, "$_M%x,rwx", sz)
@@ -887,20 +1997,230 @@ func (conn *gdbConn) allocMemory(sz uint64) (uint64, error) {
 	return strconv.ParseUint(string(resp), 16, 64)
 }
 
-// threadStopInfo executes a 'qThreadStopInfo' and returns the reason the
-// thread stopped.
-func (conn *gdbConn) threadStopInfo(threadID string) (sig uint8, reason string, err error) {
+// deallocMemory executes a '_m' command, freeing memory allocated with
+// allocMemory.
+func (conn *gdbConn) deallocMemory(addr uint64) error {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$_m%x", addr)
+	_, err := conn.exec(conn.outbuf.Bytes(), "memory deallocation")
+	return err
+}
+
+// passSignals executes a 'QPassSignals' command, signals in the list will
+// be delivered to the inferior by the stub without stopping.
+func (conn *gdbConn) passSignals(signals []int) error {
+	conn.outbuf.Reset()
+	fmt.Fprint(&conn.outbuf, "$QPassSignals:")
+	for i, sig := range signals {
+		if i > 0 {
+			fmt.Fprint(&conn.outbuf, ";")
+		}
+		fmt.Fprintf(&conn.outbuf, "%02x", sig)
+	}
+	_, err := conn.exec(conn.outbuf.Bytes(), "pass signals")
+	return err
+}
+
+// memoryRegion describes a region of the inferior's address space.
+type memoryRegion struct {
+	start, size uint64
+	permissions string // a combination of 'r', 'w' and 'x', empty if unmapped
+}
+
+// contains returns true if the region contains the sz bytes starting at addr.
+func (r *memoryRegion) contains(addr uint64, sz int) bool {
+	return addr >= r.start && addr+uint64(sz) <= r.start+r.size
+}
+
+// memoryRegionInfo executes a 'qMemoryRegionInfo' command and returns the
+// memory region containing addr.
+func (conn *gdbConn) memoryRegionInfo(addr uint64) (memoryRegion, error) {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$qMemoryRegionInfo:%x", addr)
+	resp, err := conn.exec(conn.outbuf.Bytes(), "memory region info")
+	if err != nil {
+		return memoryRegion{}, err
+	}
+
+	var r memoryRegion
+	for _, keyval := range strings.Split(string(resp), ";") {
+		colon := strings.Index(keyval, ":")
+		if colon < 0 {
+			continue
+		}
+		value := keyval[colon+1:]
+		switch keyval[:colon] {
+		case "start":
+			r.start, _ = strconv.ParseUint(value, 16, 64)
+		case "size":
+			r.size, _ = strconv.ParseUint(value, 16, 64)
+		case "permissions":
+			r.permissions = value
+		}
+	}
+	return r, nil
+}
+
+// threadAlive executes a 'T' command and returns true if the thread is
+// still alive.
+func (conn *gdbConn) threadAlive(threadID string) (bool, error) {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$T%s", threadID)
+	_, err := conn.exec(conn.outbuf.Bytes(), "thread alive")
+	if err != nil {
+		if gdberr, ok := err.(*GdbProtocolError); ok && gdberr.code != "" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// threadStopInfo executes a 'qThreadStopInfo' and returns the stop reply
+// describing why the thread stopped.
+func (conn *gdbConn) threadStopInfo(threadID string) (stopPacket, error) {
 	conn.outbuf.Reset()
 	fmt.Fprintf(&conn.outbuf, "$qThreadStopInfo%s", threadID)
 	resp, err := conn.exec(conn.outbuf.Bytes(), "thread stop info")
 	if err != nil {
-		return 0, "", err
+		return stopPacket{}, err
 	}
 	_, sp, err := conn.parseStopPacket(resp, "", nil)
 	if err != nil {
-		return 0, "", err
+		return stopPacket{}, err
+	}
+	return sp, nil
+}
+
+// launch executes an 'A' command, setting the command line of the inferior
+// and launching it, then uses 'qLaunchSuccess' to check that the launch
+// succeeded. Each argument is sent hex encoded, prefixed by its length and
+// position, so that arguments containing spaces, quotes or non-ASCII
+// characters are passed to the inferior unchanged.
+func (conn *gdbConn) launch(args []string) error {
+	conn.outbuf.Reset()
+	fmt.Fprint(&conn.outbuf, "$A")
+	for i, arg := range args {
+		if i > 0 {
+			conn.outbuf.WriteString(",")
+		}
+		fmt.Fprintf(&conn.outbuf, "%d,%d,", len(arg)*2, i)
+		writeAsciiBytes(&conn.outbuf, []byte(arg))
+	}
+	if _, err := conn.exec(conn.outbuf.Bytes(), "launch"); err != nil {
+		return err
+	}
+	resp, err := conn.exec([]byte("$qLaunchSuccess"), "launch")
+	if err != nil {
+		return err
+	}
+	if string(resp) != "OK" {
+		return fmt.Errorf("could not launch %s: %s", args[0], resp)
+	}
+	return nil
+}
+
+// setWorkingDir executes a 'QSetWorkingDir' command, setting the working
+// directory of the inferior launched by the next 'A' command.
+func (conn *gdbConn) setWorkingDir(wd string) error {
+	conn.outbuf.Reset()
+	fmt.Fprint(&conn.outbuf, "$QSetWorkingDir:")
+	writeAsciiBytes(&conn.outbuf, []byte(wd))
+	_, err := conn.exec(conn.outbuf.Bytes(), "set working directory")
+	return err
+}
+
+// getWorkingDir executes a 'qGetWorkingDir' command and returns the
+// working directory of the inferior.
+func (conn *gdbConn) getWorkingDir() (string, error) {
+	resp, err := conn.exec([]byte("$qGetWorkingDir"), "get working directory")
+	if err != nil {
+		return "", err
+	}
+	wd, err := hex.DecodeString(string(resp))
+	if err != nil {
+		return "", fmt.Errorf("malformed qGetWorkingDir response %q: %v", resp, err)
+	}
+	return string(wd), nil
+}
+
+// vFileOpen opens path on the stub's host for reading with a
+// 'vFile:open' command and returns the file descriptor.
+func (conn *gdbConn) vFileOpen(path string) (int, error) {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$vFile:open:%s,0,0", hex.EncodeToString([]byte(path)))
+	resp, err := conn.exec(conn.outbuf.Bytes(), "open remote file")
+	if err != nil {
+		return -1, err
 	}
-	return sp.sig, sp.reason, nil
+	fd, _, err := parseFileIOResponse(resp)
+	return int(fd), err
+}
+
+// vFilePread reads len(data) bytes at offset off of the remote file fd
+// with a 'vFile:pread' command, returns the number of bytes read.
+func (conn *gdbConn) vFilePread(fd int, data []byte, off int64) (int, error) {
+	sz := len(data)
+	if maxsz := conn.packetSize - 16; sz > maxsz {
+		sz = maxsz
+	}
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$vFile:pread:%x,%x,%x", fd, sz, off)
+	if err := conn.send(conn.outbuf.Bytes()); err != nil {
+		return 0, err
+	}
+	resp, err := conn.recv(conn.outbuf.Bytes(), "read remote file", true)
+	if err != nil {
+		return 0, err
+	}
+	n, attachment, err := parseFileIOResponse(resp)
+	if err != nil {
+		return 0, err
+	}
+	if int(n) != len(attachment) || int(n) > sz {
+		return 0, fmt.Errorf("malformed vFile:pread response %q", resp)
+	}
+	return copy(data, attachment), nil
+}
+
+// vFileClose closes the remote file fd.
+func (conn *gdbConn) vFileClose(fd int) error {
+	conn.outbuf.Reset()
+	fmt.Fprintf(&conn.outbuf, "$vFile:close:%x", fd)
+	resp, err := conn.exec(conn.outbuf.Bytes(), "close remote file")
+	if err != nil {
+		return err
+	}
+	_, _, err = parseFileIOResponse(resp)
+	return err
+}
+
+// parseFileIOResponse parses the response to a 'vFile' command, which has
+// the form:
+//  F<result>[,<errno>][;<attachment>]
+// where result and errno are hexadecimal numbers.
+func parseFileIOResponse(resp []byte) (result int64, attachment []byte, err error) {
+	if len(resp) == 0 || resp[0] != 'F' {
+		return 0, nil, fmt.Errorf("malformed vFile response %q", resp)
+	}
+	resp = resp[1:]
+	if semicolon := bytes.IndexByte(resp, ';'); semicolon >= 0 {
+		attachment = resp[semicolon+1:]
+		resp = resp[:semicolon]
+	}
+	fields := strings.SplitN(string(resp), ",", 2)
+	result, err = strconv.ParseInt(fields[0], 16, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed vFile response %q", resp)
+	}
+	if result < 0 {
+		errno := "unknown"
+		if len(fields) > 1 {
+			errno = fields[1]
+		}
+		return 0, nil, fmt.Errorf("remote file operation failed, errno %s", errno)
+	}
+	return result, attachment, nil
 }
 
 // restart executes a 'vRun' command.
@@ -943,8 +2263,16 @@ type imageList struct {
 }
 
 type imageDescription struct {
-	Pathname   string     `json:"pathname"`
-	MachHeader machHeader `json:"mach_header"`
+	Pathname    string         `json:"pathname"`
+	LoadAddress uint64         `json:"load_address"`
+	MachHeader  machHeader     `json:"mach_header"`
+	Segments    []imageSegment `json:"segments"`
+}
+
+type imageSegment struct {
+	Name   string `json:"name"`
+	VMAddr uint64 `json:"vmaddr"`
+	VMSize uint64 `json:"vmsize"`
 }
 
 type machHeader struct {
@@ -952,9 +2280,14 @@ type machHeader struct {
 }
 
 // getLoadedDynamicLibraries executes jGetLoadedDynamicLibrariesInfos which
-// returns the list of loaded dynamic libraries
+// returns the list of loaded dynamic libraries.
+// Both the JSON argument and the JSON reply use the binary framing of the
+// 'X' packet, the closing brace in particular must be escaped.
 func (conn *gdbConn) getLoadedDynamicLibraries() ([]imageDescription, error) {
-	cmd := []byte("$jGetLoadedDynamicLibrariesInfos:{\"fetch_all_solibs\":true}")
+	conn.outbuf.Reset()
+	conn.outbuf.WriteString("$jGetLoadedDynamicLibrariesInfos:")
+	writeBinaryBytes(&conn.outbuf, []byte(`{"fetch_all_solibs":true}`))
+	cmd := conn.outbuf.Bytes()
 	if err := conn.send(cmd); err != nil {
 		return nil, err
 	}
@@ -974,7 +2307,142 @@ func (conn *gdbConn) exec(cmd []byte, context string) ([]byte, error) {
 	if err := conn.send(cmd); err != nil {
 		return nil, err
 	}
-	return conn.recv(cmd, context, false)
+	resp, err := conn.recv(cmd, context, false)
+	if err != nil {
+		return nil, err
+	}
+	if !plausibleReply(cmd, resp) {
+		if logflags.GdbWire() {
+			fmt.Printf("reply %q is not valid for packet %q during %s\n", resp, cmd, context)
+		}
+		conn.dead = ErrProtocolDesync
+		return nil, ErrProtocolDesync
+	}
+	return resp, nil
+}
+
+// resync drains the input, discarding everything that was sent by the stub
+// until it stays silent for resyncQuietPeriod, then sends a probe command
+// (qC) and checks that its reply is the next packet received.
+// Stop replies found in the drained input are not discarded, they are kept
+// for the next resume like the ones received by recv (see queueStop), with
+// the exception of the one caused by our interrupt, if interrupt is set.
+// If the probe succeeds the connection is usable again, even if it was
+// marked dead by a previous ErrProtocolDesync.
+func (conn *gdbConn) resync(interrupt bool) error {
+	if conn.dead == ErrProtocolDesync {
+		conn.dead = nil
+	}
+	if conn.dead != nil {
+		return conn.dead
+	}
+	if interrupt {
+		if err := conn.sendCtrlC(); err != nil {
+			return err
+		}
+	}
+
+	var drained []byte
+	buf := make([]byte, 1024)
+	for {
+		conn.conn.SetReadDeadline(time.Now().Add(resyncQuietPeriod))
+		n, err := conn.rdr.Read(buf)
+		drained = append(drained, buf[:n]...)
+		if err != nil {
+			conn.conn.SetReadDeadline(time.Time{})
+			if neterr, isneterr := err.(net.Error); isneterr && neterr.Timeout() {
+				break
+			}
+			return err
+		}
+	}
+	if logflags.GdbWire() {
+		fmt.Printf("resync: drained %q\n", drained)
+	}
+
+	for {
+		start := bytes.IndexAny(drained, "$%")
+		if start < 0 {
+			break
+		}
+		drained = drained[start:]
+		end := bytes.IndexByte(drained, '#')
+		if end < 0 || end+3 > len(drained) {
+			break
+		}
+		if i := bytes.LastIndexAny(drained[1:end], "$%"); i >= 0 {
+			// truncated packet
+			drained = drained[i+1:]
+			continue
+		}
+		packet, sum := drained[:end+1], drained[end+1:end+3]
+		drained = drained[end+3:]
+		if tgt, err := strconv.ParseUint(string(sum), 16, 8); err != nil || checksum(packet) != uint8(tgt) {
+			continue
+		}
+		_, msg := wiredecode(packet, nil)
+		if packet[0] == '%' {
+			if !bytes.HasPrefix(msg, []byte("Stop:")) {
+				continue
+			}
+			msg = msg[len("Stop:"):]
+		} else if conn.ack {
+			conn.sendack('+')
+		}
+		if !isStrayStopReply(nil, msg) {
+			// not a stop reply
+			continue
+		}
+		if sig, _ := strconv.ParseUint(string(msg[1:3]), 16, 8); interrupt && conn.isInterruptSignal(uint8(sig)) {
+			continue
+		}
+		conn.queueStop(msg)
+	}
+
+	replyTimeout := conn.replyTimeout
+	if replyTimeout <= 0 || replyTimeout > resyncReplyTimeout {
+		conn.replyTimeout = resyncReplyTimeout
+	}
+	defer func() { conn.replyTimeout = replyTimeout }()
+	resp, err := conn.exec([]byte("$qC"), "resync")
+	if err != nil {
+		if _, isProtocolError := err.(*GdbProtocolError); !isProtocolError {
+			return err
+		}
+	} else if len(resp) < 2 || resp[0] != 'Q' || resp[1] != 'C' {
+		conn.dead = ErrProtocolDesync
+		return ErrProtocolDesync
+	}
+	return nil
+}
+
+// plausibleReply returns false if resp can not be the reply to cmd.
+// Only commands with a well defined reply are checked: 'g', 'm' and 'p'
+// must be answered with hex data, 'G', 'M', 'P', 'X', 'Z', 'z', 'H' and
+// 'T' with OK. Errors and empty replies were already handled by recv.
+func plausibleReply(cmd, resp []byte) bool {
+	if len(cmd) < 2 {
+		return true
+	}
+	switch cmd[1] {
+	case 'g', 'm', 'p':
+		if len(resp)%2 != 0 {
+			return false
+		}
+		for _, ch := range resp {
+			switch {
+			case ch >= '0' && ch <= '9', ch >= 'a' && ch <= 'f', ch >= 'A' && ch <= 'F':
+			case ch == 'x': // unavailable register
+			default:
+				return false
+			}
+		}
+		return true
+	case 'G', 'M', 'P', 'X', 'Z', 'z', 'H', 'T':
+		return string(resp) == "OK"
+	default:
+		return true
+	}
 }
 
 var hexdigit = []byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f'}
@@ -983,6 +2451,9 @@ func (conn *gdbConn) send(cmd []byte) error {
 	if len(cmd) == 0 || cmd[0] != '$' {
 		panic("gdb protocol error: command doesn't start with '$'")
 	}
+	if conn.dead != nil {
+		return conn.dead
+	}
 
 	// append checksum to packet
 	cmd = append(cmd, '#')
@@ -1019,7 +2490,54 @@ func (conn *gdbConn) send(cmd []byte) error {
 	return nil
 }
 
+// untimedCommands are the commands whose reply can take any amount of
+// time and are never subject to conn.replyTimeout: restarting a recording
+// with rr replays it up to the requested event, and so do some of the
+// qRRCmd commands.
+var untimedCommands = []string{"$vRun", "$qRRCmd"}
+
+func isUntimedCommand(cmd []byte) bool {
+	for _, prefix := range untimedCommands {
+		if bytes.HasPrefix(cmd, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// recv reads the reply to cmd. If cmd is not nil and conn.replyTimeout is
+// set the stub must reply within conn.replyTimeout, otherwise the
+// connection is marked dead and ErrStubUnresponsive is returned. A nil cmd
+// is used while waiting for the target to stop after a resume, which can
+// take any amount of time, as can the reply to untimedCommands.
 func (conn *gdbConn) recv(cmd []byte, context string, binary bool) (resp []byte, err error) {
+	if conn.dead != nil {
+		return nil, conn.dead
+	}
+	if cmd != nil && conn.replyTimeout > 0 && !isUntimedCommand(cmd) {
+		conn.conn.SetReadDeadline(time.Now().Add(conn.replyTimeout))
+		defer conn.conn.SetReadDeadline(time.Time{})
+		defer func() {
+			if neterr, isneterr := err.(net.Error); isneterr && neterr.Timeout() {
+				conn.dead = ErrStubUnresponsive
+				err = ErrStubUnresponsive
+			}
+		}()
+	}
+	for {
+		resp, err = conn.readPacket(cmd, context, binary)
+		if err != nil || cmd == nil || !isStrayStopReply(cmd, resp) {
+			return resp, err
+		}
+		// The target stopped while we thought it was already stopped (or the
+		// stub is reporting a delayed event), keep the stop for the next resume
+		// and read the actual reply.
+		conn.queueStop(resp)
+	}
+}
+
+// readPacket reads one packet sent by the stub, see recv.
+func (conn *gdbConn) readPacket(cmd []byte, context string, binary bool) (resp []byte, err error) {
 	attempt := 0
 	for {
 		var err error
@@ -1051,18 +2569,22 @@ func (conn *gdbConn) recv(cmd []byte, context string, binary bool) (resp []byte,
 			}
 		}
 
-		if !conn.ack {
-			break
-		}
-
 		if resp[0] == '%' {
 			// If the first character is a % (instead of $) the stub sent us a
 			// notification packet, this is weird since we specifically claimed that
-			// we don't support notifications of any kind, but it should be safe to
-			// ignore regardless.
+			// we don't support notifications of any kind. Stop notifications are
+			// kept for the next resume, everything else is ignored.
+			// Notifications are not acknowledged.
+			if _, msg := wiredecode(resp, nil); bytes.HasPrefix(msg, []byte("Stop:")) && len(msg) > len("Stop:") {
+				conn.queueStop(msg[len("Stop:"):])
+			}
 			continue
 		}
 
+		if !conn.ack {
+			break
+		}
+
 		if checksumok(resp, conn.inbuf[:2]) {
 			conn.sendack('+')
 			break
@@ -1075,10 +2597,27 @@ func (conn *gdbConn) recv(cmd []byte, context string, binary bool) (resp []byte,
 		conn.sendack('-')
 	}
 
-	if binary {
-		conn.inbuf, resp = binarywiredecode(resp, conn.inbuf)
-	} else {
-		conn.inbuf, resp = wiredecode(resp, conn.inbuf)
+	compressed := false
+	if conn.compressed && len(resp) > 1 {
+		switch resp[1] {
+		case 'N':
+			// packet wasn't compressed, remove the marker
+			resp = append(resp[:1], resp[2:]...)
+		case 'C':
+			conn.inbuf, resp, err = decompress(resp, conn.inbuf)
+			if err != nil {
+				return nil, err
+			}
+			compressed = true
+		}
+	}
+
+	if !compressed {
+		if binary {
+			conn.inbuf, resp = binarywiredecode(resp, conn.inbuf)
+		} else {
+			conn.inbuf, resp = wiredecode(resp, conn.inbuf)
+		}
 	}
 
 	if len(resp) == 0 || resp[0] == 'E' {
@@ -1197,6 +2736,30 @@ func binarywiredecode(in, buf []byte) (newbuf, msg []byte) {
 	return buf, buf[start:]
 }
 
+// decompress decodes a packet compressed with zlib-deflate. The format of
+// compressed packets is:
+//  $C<uncompressed size>:<compressed data>#
+// where the compressed data is escaped like the contents of binary packets.
+// The scratch buffer buf is used to unescape the compressed data and is
+// returned as newbuf.
+func decompress(in, buf []byte) (newbuf, msg []byte, err error) {
+	colon := bytes.Index(in, []byte{':'})
+	if colon < 0 {
+		return buf, nil, fmt.Errorf("malformed compressed packet")
+	}
+	sz, err := strconv.Atoi(string(in[2:colon]))
+	if err != nil {
+		return buf, nil, fmt.Errorf("malformed compressed packet: %v", err)
+	}
+	var data []byte
+	buf, data = binarywiredecode(in[colon:], buf)
+	msg = make([]byte, sz)
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(data)), msg); err != nil {
+		return buf, nil, fmt.Errorf("could not decompress packet: %v", err)
+	}
+	return buf, msg, nil
+}
+
 // Checksumok checks that checksum is a valid checksum for packet.
 func checksumok(packet, checksumBuf []byte) bool {
 	if packet[0] != '$' {
@@ -0,0 +1,1138 @@
+package gdbserial
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derekparker/delve/pkg/proc"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+func TestParseExitStopPacket(t *testing.T) {
+	for _, tc := range []struct {
+		resp     string
+		status   int
+		signaled bool
+	}{
+		{"W00", 0, false},
+		{"W02;process:1a2b", 2, false},
+		{"X09", 9, true},
+		{"X0f;process:1a2b", 15, true},
+	} {
+		conn := &gdbConn{pid: 10}
+		_, _, err := conn.parseStopPacket([]byte(tc.resp), "", nil)
+		exitErr, isexited := err.(proc.ProcessExitedError)
+		if !isexited {
+			t.Fatalf("%s: expected ProcessExitedError, got %v", tc.resp, err)
+		}
+		if exitErr.Status != tc.status {
+			t.Errorf("%s: wrong status in error %d (expected %d)", tc.resp, exitErr.Status, tc.status)
+		}
+		if conn.exitStatus != tc.status || conn.exitSignaled != tc.signaled {
+			t.Errorf("%s: wrong exit status %d %v (expected %d %v)", tc.resp, conn.exitStatus, conn.exitSignaled, tc.status, tc.signaled)
+		}
+	}
+}
+
+// fakeStub answers every packet it receives on conn with the next
+// response in resps.
+func fakeStub(conn net.Conn, resps []string) {
+	rdr := bufio.NewReader(conn)
+	for _, resp := range resps {
+		if _, err := rdr.ReadBytes('#'); err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2)) // checksum
+		buf := []byte("$" + resp + "#")
+		sum := checksum(buf)
+		buf = append(buf, hexdigit[sum>>4], hexdigit[sum&0xf])
+		conn.Write(buf)
+	}
+	conn.Close()
+}
+
+// newFakeStubConn starts a fakeStub answering with resps and returns a
+// connection to it, the packets exchanged on the connection are recorded
+// in the returned buffer.
+func newFakeStubConn(resps []string) (net.Conn, *bytes.Buffer) {
+	client, server := net.Pipe()
+	go fakeStub(server, resps)
+	log := new(bytes.Buffer)
+	return NewRecordingConn(log, client), log
+}
+
+// multiReplyStub is like fakeStub but sends all the packets in resps[i]
+// as the reply to the i-th command.
+func multiReplyStub(conn net.Conn, resps [][]string) {
+	rdr := bufio.NewReader(conn)
+	for _, packets := range resps {
+		if _, err := rdr.ReadBytes('#'); err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2)) // checksum
+		for _, resp := range packets {
+			buf := []byte("$" + resp + "#")
+			sum := checksum(buf)
+			conn.Write(append(buf, hexdigit[sum>>4], hexdigit[sum&0xf]))
+		}
+	}
+	conn.Close()
+}
+
+// fakePipelinedStub is like fakeStub but it reads all commands before
+// sending the first reply, the commands must be pipelined.
+func fakePipelinedStub(conn net.Conn, resps []string) {
+	rdr := bufio.NewReader(conn)
+	for range resps {
+		if _, err := rdr.ReadBytes('#'); err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2)) // checksum
+	}
+	for _, resp := range resps {
+		buf := []byte("$" + resp + "#")
+		sum := checksum(buf)
+		buf = append(buf, hexdigit[sum>>4], hexdigit[sum&0xf])
+		conn.Write(buf)
+	}
+}
+
+func newTestConn(c net.Conn) *gdbConn {
+	return &gdbConn{
+		conn:                c,
+		rdr:                 bufio.NewReader(c),
+		inbuf:               make([]byte, 0, initialInputBufferSize),
+		maxTransmitAttempts: maxTransmitAttempts,
+		packetSize:          256,
+	}
+}
+
+func TestRecordReplayConn(t *testing.T) {
+	cmds := []string{"$qC", "$m1000,4", "$vCont;c"}
+	resps := []string{"QC1a2b", "deadbeef", "W00"}
+
+	client, server := net.Pipe()
+	go fakeStub(server, resps)
+
+	var log bytes.Buffer
+	conn := newTestConn(NewRecordingConn(&log, client))
+
+	exec := func(conn *gdbConn) {
+		for i, cmd := range cmds {
+			resp, err := conn.exec([]byte(cmd), "test")
+			if err != nil {
+				t.Fatalf("exec %s: %v", cmd, err)
+			}
+			if string(resp) != resps[i] {
+				t.Fatalf("exec %s: got %q expected %q", cmd, resp, resps[i])
+			}
+		}
+	}
+
+	exec(conn)
+	client.Close()
+
+	recorded := log.String()
+	t.Logf("recorded:\n%s", recorded)
+
+	replay, err := NewReplayConn(bytes.NewBufferString(recorded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec(newTestConn(replay))
+
+	replay, err = NewReplayConn(bytes.NewBufferString(recorded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newTestConn(replay).exec([]byte("$qOffsets"), "test")
+	if _, ismismatch := err.(*ReplayMismatchError); !ismismatch {
+		t.Fatalf("expected mismatch error, got %v", err)
+	}
+}
+
+func TestEnableThreadEvents(t *testing.T) {
+	c, log := newFakeStubConn([]string{"OK", ""})
+	conn := newTestConn(c)
+	if err := conn.enableThreadEvents(); err != nil {
+		t.Fatal(err)
+	}
+	if sent := log.String(); !strings.Contains(sent, "$QThreadEvents:1#") {
+		t.Errorf("QThreadEvents not sent: %q", sent)
+	}
+	if err := conn.enableThreadEvents(); !isProtocolErrorUnsupported(err) {
+		t.Errorf("expected unsupported error, got %v", err)
+	}
+}
+
+// rleEncode encodes data using the run-length encoding of the protocol.
+func rleEncode(data []byte) []byte {
+	var out []byte
+	for i := 0; i < len(data); {
+		c := data[i]
+		out = append(out, c)
+		i++
+		n := 0
+		for i+n < len(data) && data[i+n] == c && n < 97 {
+			n++
+		}
+		if n == 6 || n == 7 {
+			// would produce '#' or '$'
+			n = 5
+		}
+		if n > 3 {
+			out = append(out, '*', byte(n+29))
+			i += n
+		}
+	}
+	return out
+}
+
+// compressEncode encodes data as a zlib-deflate compressed packet.
+func compressEncode(data []byte) []byte {
+	var zbuf bytes.Buffer
+	w, _ := flate.NewWriter(&zbuf, flate.BestCompression)
+	w.Write(data)
+	w.Close()
+	out := []byte(fmt.Sprintf("C%d:", len(data)))
+	for _, b := range zbuf.Bytes() {
+		switch b {
+		case '#', '$', '}', '*':
+			out = append(out, '}', b^escapeXor)
+		default:
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func recvPacket(conn *gdbConn, payload []byte) ([]byte, error) {
+	pkt := append([]byte{'$'}, payload...)
+	pkt = append(pkt, '#', '0', '0')
+	conn.rdr = bufio.NewReader(bytes.NewReader(pkt))
+	return conn.recv(nil, "test", false)
+}
+
+func sparseMemoryReply() []byte {
+	return []byte(strings.Repeat("0", 8000) + "deadbeef" + strings.Repeat("0", 8000))
+}
+
+func TestRecvCompressed(t *testing.T) {
+	expected := sparseMemoryReply()
+	conn := newTestConn(nil)
+
+	for _, tc := range []struct {
+		name       string
+		compressed bool
+		payload    []byte
+	}{
+		{"plain", false, expected},
+		{"rle", false, rleEncode(expected)},
+		{"uncompressed-marker", true, append([]byte{'N'}, rleEncode(expected)...)},
+		{"zlib-deflate", true, compressEncode(expected)},
+	} {
+		conn.compressed = tc.compressed
+		resp, err := recvPacket(conn, tc.payload)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(resp, expected) {
+			t.Fatalf("%s: wrong packet contents", tc.name)
+		}
+	}
+}
+
+func BenchmarkRecvSparseMemory(b *testing.B) {
+	data := sparseMemoryReply()
+	for _, bc := range []struct {
+		name       string
+		compressed bool
+		payload    []byte
+	}{
+		{"plain", false, data},
+		{"rle", false, rleEncode(data)},
+		{"zlib-deflate", true, compressEncode(data)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			conn := newTestConn(nil)
+			conn.compressed = bc.compressed
+			b.SetBytes(int64(len(bc.payload)))
+			for i := 0; i < b.N; i++ {
+				if _, err := recvPacket(conn, bc.payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReplyTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		rdr := bufio.NewReader(server)
+		// answer the first command after a delay, as if the target ran for a
+		// while after a resume
+		if _, err := rdr.ReadBytes('#'); err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2))
+		time.Sleep(200 * time.Millisecond)
+		server.Write([]byte("$T05thread:1;#d7"))
+		// hang on the second command
+		for {
+			if _, err := rdr.ReadByte(); err != nil {
+				return
+			}
+		}
+	}()
+	defer server.Close()
+
+	conn := newTestConn(client)
+	conn.replyTimeout = 50 * time.Millisecond
+	if err := conn.send([]byte("$c")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := conn.recv(nil, "resume", false); err != nil || string(resp) != "T05thread:1;" {
+		t.Fatalf("resume: %q %v", resp, err)
+	}
+
+	if _, err := conn.exec([]byte("$qC"), "test"); err != ErrStubUnresponsive {
+		t.Fatalf("expected ErrStubUnresponsive, got %v", err)
+	}
+	if _, err := conn.exec([]byte("$qC"), "test"); err != ErrStubUnresponsive {
+		t.Fatalf("connection not marked dead, got %v", err)
+	}
+}
+
+func TestReplyTimeoutUntimedCommands(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		// rr replays the recording before answering
+		rdr := bufio.NewReader(server)
+		for _, reply := range []string{"T05thread:1;", "6e6f6e65"} {
+			if _, err := rdr.ReadBytes('#'); err != nil {
+				return
+			}
+			rdr.Read(make([]byte, 2))
+			time.Sleep(200 * time.Millisecond)
+			buf := []byte("$" + reply + "#")
+			sum := checksum(buf)
+			server.Write(append(buf, hexdigit[sum>>4], hexdigit[sum&0xf]))
+		}
+	}()
+	defer server.Close()
+
+	conn := newTestConn(client)
+	conn.replyTimeout = 50 * time.Millisecond
+	if err := conn.restart(""); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	if resp, err := conn.qRRCmd("when"); err != nil || resp != "none" {
+		t.Fatalf("qRRCmd: %q %v", resp, err)
+	}
+}
+
+func TestProtocolDesync(t *testing.T) {
+	client, server := net.Pipe()
+	// the stop reply is read as the reply to 'g'
+	go multiReplyStub(server, [][]string{{"OK"}, {"0011xxxx"}, {"T05thread:1;", "OK"}})
+
+	conn := newTestConn(client)
+	if _, err := conn.exec([]byte("$Z0,1000,1"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.exec([]byte("$g"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.exec([]byte("$g"), "test"); err != ErrProtocolDesync {
+		t.Fatalf("expected ErrProtocolDesync, got %v", err)
+	}
+	if _, err := conn.exec([]byte("$z0,1000,1"), "test"); err != ErrProtocolDesync {
+		t.Fatalf("connection not marked unusable, got %v", err)
+	}
+	if len(conn.pendingStops) != 1 || conn.pendingStops[0].threadID != "1" {
+		t.Errorf("stop reply not queued %#v", conn.pendingStops)
+	}
+
+	for _, tc := range []struct {
+		cmd, resp string
+		ok        bool
+	}{
+		{"$m1000,2", "abcd", true},
+		{"$m1000,2", "abc", false},
+		{"$p10", "OK", false},
+		{"$P10=00", "OK", true},
+		{"$Z0,1000,1", "0000", false},
+		{"$Hg1", "QC1", false},
+		{"$qC", "QC1", true},
+	} {
+		if ok := plausibleReply([]byte(tc.cmd), []byte(tc.resp)); ok != tc.ok {
+			t.Errorf("%s %s: expected %v got %v", tc.cmd, tc.resp, tc.ok, ok)
+		}
+	}
+}
+
+func TestProtocolDesyncReply(t *testing.T) {
+	client, server := net.Pipe()
+	// the reply to a 'Z' is read as the reply to 'g'
+	go fakeStub(server, []string{"OK", "0011xxxx", "OK", "OK"})
+
+	conn := newTestConn(client)
+	if _, err := conn.exec([]byte("$Z0,1000,1"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.exec([]byte("$g"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.exec([]byte("$g"), "test"); err != ErrProtocolDesync {
+		t.Fatalf("expected ErrProtocolDesync, got %v", err)
+	}
+	if len(conn.pendingStops) != 0 {
+		t.Errorf("unexpected queued stops %#v", conn.pendingStops)
+	}
+}
+
+func TestGetSSERegisters(t *testing.T) {
+	xmm1 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	regs := &gdbRegisters{regs: map[string]gdbRegister{
+		"rax":  {value: []byte{0x2a, 0, 0, 0, 0, 0, 0, 0}},
+		"xmm1": {value: xmm1},
+	}}
+
+	if v, err := regs.Get(int(x86asm.RAX)); err != nil || v != 0x2a {
+		t.Errorf("Get(RAX) = %#x, %v", v, err)
+	}
+	if v, err := regs.Get(int(x86asm.X1)); err != nil || v != 0x0807060504030201 {
+		t.Errorf("Get(X1) = %#x, %v", v, err)
+	}
+	if _, err := regs.Get(int(x86asm.X2)); err != proc.UnknownRegisterError {
+		t.Errorf("Get(X2) returned %v", err)
+	}
+	if v, err := regs.GetWide(int(x86asm.X1)); err != nil || !bytes.Equal(v, xmm1) {
+		t.Errorf("GetWide(X1) = %x, %v", v, err)
+	}
+	if _, err := regs.GetWide(int(x86asm.RAX)); err != proc.UnknownRegisterError {
+		t.Errorf("GetWide(RAX) returned %v", err)
+	}
+}
+
+func TestQueryStubInfo(t *testing.T) {
+	for _, tc := range []struct {
+		resps    []string
+		hostInfo string // reply to qHostInfo, empty if not supported
+		features map[string]bool
+		expected string
+	}{
+		{[]string{"name:lldb;version:14.0.0;"}, "", nil, "lldb-server 14.0.0"},
+		{[]string{"name:debugserver;version:902;"}, "", nil, "debugserver 902"},
+		{[]string{""}, "triple:7838365f36342d70632d6c696e75782d676e75;ostype:linux;", nil, "lldb-server"},
+		{[]string{""}, "", map[string]bool{"ReverseContinue": true, "ReverseStep": true}, "rr"},
+		{[]string{""}, "", map[string]bool{"qXfer:features:read": true}, "gdbserver"},
+	} {
+		client, server := net.Pipe()
+		go fakeStub(server, append([]string{tc.hostInfo}, tc.resps...))
+		conn := newTestConn(client)
+		conn.hostInfo = conn.queryInfo("$qHostInfo")
+		info := conn.queryStubInfo(tc.features)
+		client.Close()
+		if info.String() != tc.expected {
+			t.Errorf("%q: got %q expected %q", tc.resps, info, tc.expected)
+		}
+	}
+}
+
+func TestParseRRNumber(t *testing.T) {
+	for _, tc := range []struct {
+		resp     string
+		expected uint64
+	}{
+		{"Current event: 1234\n", 1234},
+		{"Completed event: 1234\n", 1234},
+		{"Current tick: 56789\n", 56789},
+		{"56789", 56789},
+	} {
+		n, err := parseRRNumber(tc.resp)
+		if err != nil || n != tc.expected {
+			t.Errorf("%q: got %d %v expected %d", tc.resp, n, err, tc.expected)
+		}
+	}
+	if _, err := parseRRNumber("unknown command"); err == nil {
+		t.Errorf("no error for response without a number")
+	}
+}
+
+func TestVContFallback(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"vCont;c;C;t", "T05thread:1;", "OK", "T05thread:1;", "OK", "T05thread:2;", "T05thread:1;"})
+
+	var log bytes.Buffer
+	conn := newTestConn(NewRecordingConn(&log, client))
+	conn.threadSuffixSupported = true
+	conn.queryVCont()
+	if conn.noVCont || !conn.vContSupports('c') || conn.vContSupports('s') {
+		t.Fatalf("wrong vCont actions %v", conn.vContActions)
+	}
+	if _, err := conn.resume(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.step("1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.stepThreads([]string{"2", "3"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.noVCont = true
+	if _, err := conn.resume(0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := []string{}
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+			sent = append(sent, strings.SplitN(line[len(replaySendPrefix)+2:], "#", 2)[0])
+		}
+	}
+	expected := []string{"vCont?", "vCont;c", "Hc1", "s", "Hc2", "s", "c"}
+	if fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Errorf("sent %q expected %q", sent, expected)
+	}
+}
+
+func TestResumeWithRange(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"T05thread:2;"})
+
+	var log bytes.Buffer
+	conn := newTestConn(NewRecordingConn(&log, client))
+	sp, err := conn.resumeWithRange("2", 0x401000, 0x401020, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.threadID != "2" || sp.sig != breakpointSignal {
+		t.Errorf("wrong stop packet %#v", sp)
+	}
+	if !strings.Contains(log.String(), "$vCont;r401000,401020:2;c#") {
+		t.Errorf("wrong resume packet:\n%s", log.String())
+	}
+}
+
+func TestValidateRegisterInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		regs  []gdbRegisterInfo
+		valid bool
+	}{
+		{"ok", []gdbRegisterInfo{{Name: "rax", Bitsize: 64, Offset: 0}, {Name: "rip", Bitsize: 64, Offset: 8}}, true},
+		{"gap", []gdbRegisterInfo{{Name: "rax", Bitsize: 64, Offset: 0}, {Name: "rip", Bitsize: 64, Offset: 16}}, true},
+		{"overlap", []gdbRegisterInfo{{Name: "rax", Bitsize: 64, Offset: 0}, {Name: "rip", Bitsize: 64, Offset: 4}}, false},
+		{"unsorted overlap", []gdbRegisterInfo{{Name: "rip", Bitsize: 64, Offset: 4}, {Name: "rax", Bitsize: 64, Offset: 0}}, false},
+		{"bad size", []gdbRegisterInfo{{Name: "rax", Bitsize: 12, Offset: 0}}, false},
+	} {
+		err := validateRegisterInfo(tc.regs)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: unexpected result %v", tc.name, err)
+		}
+	}
+}
+
+func TestReadRegistersTooLong(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{strings.Repeat("00", 16)})
+	conn := newTestConn(client)
+	conn.threadSuffixSupported = true
+	if err := conn.readRegisters("1", make([]byte, 8)); err == nil {
+		t.Errorf("no error for 'g' packet longer than the register description")
+	}
+}
+
+func TestMemoryReadRetry(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"E01", "start:1000;size:1000;permissions:rw;", "deadbeef",
+		"E01", "start:0;size:1000;",
+		"E0e",
+	})
+
+	var log bytes.Buffer
+	conn := newTestConn(NewRecordingConn(&log, client))
+	conn.memReadRetries = 2
+
+	buf := make([]byte, 4)
+	if err := conn.readMemory(buf, 0x1000); err != nil {
+		t.Fatalf("transient error not retried: %v", err)
+	}
+	if !bytes.Equal(buf, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("wrong data %x", buf)
+	}
+	if err := conn.readMemory(buf, 0x10); err == nil {
+		t.Errorf("read of unmapped memory succeeded")
+	}
+
+	// Without retries the first error is returned.
+	conn.memReadRetries = 0
+	if err := conn.readMemory(buf, 0x1000); err == nil {
+		t.Errorf("read succeeded")
+	}
+
+	if n := strings.Count(log.String(), "$m"); n != 4 {
+		t.Errorf("expected 4 memory reads, got %d:\n%s", n, log.String())
+	}
+}
+
+func TestLaunchArgs(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "OK", "OK", "Efailed"})
+
+	var log bytes.Buffer
+	conn := newTestConn(NewRecordingConn(&log, client))
+
+	if err := conn.launch([]string{"/bin/prog", "a b", "\"é\""}); err != nil {
+		t.Fatal(err)
+	}
+	const expected = "$A18,0,2f62696e2f70726f67,6,1,612062,8,2,22c3a922#"
+	if !strings.Contains(log.String(), expected) {
+		t.Errorf("A packet not found in:\n%s", log.String())
+	}
+	if err := conn.launch([]string{"/bin/prog"}); err == nil {
+		t.Errorf("launch failure not reported")
+	}
+}
+
+func TestLaunchWorkingDir(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "2f746d702f77c3a9"})
+
+	var log bytes.Buffer
+	conn := newTestConn(NewRecordingConn(&log, client))
+
+	if err := conn.setWorkingDir("/tmp/wé"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "$QSetWorkingDir:2f746d702f77c3a9#") {
+		t.Errorf("QSetWorkingDir packet not found in:\n%s", log.String())
+	}
+	if wd, err := conn.getWorkingDir(); err != nil || wd != "/tmp/wé" {
+		t.Errorf("got %q %v", wd, err)
+	}
+}
+
+func TestWriteMemoryVerify(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "OK", "cafe", "OK", "beef"})
+
+	conn := newTestConn(client)
+	if _, err := conn.writeMemory(0x1000, []byte{0xca, 0xfe}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.verifyWrites = true
+	if _, err := conn.writeMemory(0x1000, []byte{0xca, 0xfe}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := conn.writeMemory(0x1000, []byte{0xca, 0xfe})
+	if _, ismismatch := err.(*MemoryWriteError); !ismismatch {
+		t.Fatalf("expected MemoryWriteError got %v", err)
+	}
+	t.Logf("%v", err)
+}
+
+func TestBigEndianRegisters(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"", "pid:1;endian:big;ptrsize:8;"})
+	conn := newTestConn(client)
+	conn.hostInfo = conn.queryInfo("$qHostInfo")
+	conn.processInfo = conn.queryInfo("$qProcessInfo")
+	if conn.hostInfo != nil || conn.processInfo["ptrsize"] != "8" {
+		t.Errorf("wrong info %v %v", conn.hostInfo, conn.processInfo)
+	}
+	if order := conn.queryByteOrder(); order != binary.BigEndian {
+		t.Fatalf("wrong byte order %v", order)
+	}
+
+	buf := make([]byte, 16)
+	regs := gdbRegisters{regs: map[string]gdbRegister{
+		regnamePC: {regnum: 0, value: buf[0:8]},
+		regnameSP: {regnum: 1, value: buf[8:16]},
+	}, buf: buf, byteOrder: binary.BigEndian}
+	buf[15] = 0x10
+	regs.setPC(0x401000)
+	if !bytes.Equal(buf[:8], []byte{0, 0, 0, 0, 0, 0x40, 0x10, 0}) {
+		t.Errorf("wrong PC encoding %x", buf[:8])
+	}
+	if pc, sp := regs.PC(), regs.SP(); pc != 0x401000 || sp != 0x10 {
+		t.Errorf("wrong PC %#x or SP %#x", pc, sp)
+	}
+
+	// little endian is the default
+	regs.byteOrder = nil
+	if sp := regs.SP(); sp != 0x1000000000000000 {
+		t.Errorf("wrong SP %#x", sp)
+	}
+
+	// registers narrower than 64 bits are zero extended
+	eflags := make([]byte, 4)
+	regs.byteOrder = binary.BigEndian
+	regs.regs["eflags"] = gdbRegister{regnum: 2, value: eflags}
+	regs.setValue(regs.regs["eflags"], 0x246)
+	if !bytes.Equal(eflags, []byte{0, 0, 0x2, 0x46}) {
+		t.Errorf("wrong eflags encoding %x", eflags)
+	}
+	if v, ok := regs.value("eflags"); !ok || v != 0x246 {
+		t.Errorf("wrong eflags %#x %v", v, ok)
+	}
+
+	// 80 bit x87 registers: sign and exponent first in big endian
+	st0 := []byte{0x40, 0x00, 0x80, 0, 0, 0, 0, 0, 0, 0} // 2.0
+	regs.byteOrder = binary.BigEndian
+	if exponent, mantissa := regs.x87Value(st0); exponent != 0x4000 || mantissa != 0x8000000000000000 {
+		t.Errorf("wrong big endian x87 value %#x %#x", exponent, mantissa)
+	}
+	regs.byteOrder = binary.LittleEndian
+	st0 = []byte{0, 0, 0, 0, 0, 0, 0, 0x80, 0x00, 0x40}
+	if exponent, mantissa := regs.x87Value(st0); exponent != 0x4000 || mantissa != 0x8000000000000000 {
+		t.Errorf("wrong little endian x87 value %#x %#x", exponent, mantissa)
+	}
+}
+
+func TestIsInterruptSignal(t *testing.T) {
+	for _, tc := range []struct {
+		debugserver bool
+		sig         uint8
+		tgt         bool
+	}{
+		{false, 0x2, true},
+		{false, 0x13, true},
+		{false, 0x11, false}, // SIGCHLD on linux
+		{true, 0x2, true},
+		{true, 0x11, true},
+		{true, 0x13, false},
+	} {
+		conn := &gdbConn{isDebugserver: tc.debugserver}
+		if out := conn.isInterruptSignal(tc.sig); out != tc.tgt {
+			t.Errorf("debugserver=%v sig=%#x: got %v expected %v", tc.debugserver, tc.sig, out, tc.tgt)
+		}
+	}
+}
+
+func TestAMD64Registers(t *testing.T) {
+	names := []string{"rax", "rbx", "rcx", "rdx", "rsi", "rdi", "rbp", "rsp", "r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15", "rip"}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		buf := make([]byte, 8*len(names)+4+4)
+		regs := gdbRegisters{regs: map[string]gdbRegister{}, buf: buf, byteOrder: order}
+		for i, name := range names {
+			regs.regs[name] = gdbRegister{regnum: i, value: buf[i*8 : i*8+8]}
+			order.PutUint64(buf[i*8:], uint64(i+1))
+		}
+		off := 8 * len(names)
+		regs.regs["eflags"] = gdbRegister{regnum: len(names), value: buf[off : off+4]}
+		order.PutUint32(buf[off:], 0x246)
+		regs.regs["cs"] = gdbRegister{regnum: len(names) + 1, value: buf[off+4 : off+8]}
+		order.PutUint32(buf[off+4:], 0x33)
+
+		r, err := regs.AMD64()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rax != 1 || r.Rsp != 8 || r.R15 != 16 || r.Rip != 17 || r.Rflags != 0x246 || r.Cs != 0x33 || r.Gs != 0 {
+			t.Errorf("%v: wrong registers %#v", order, r)
+		}
+
+		delete(regs.regs, "r12")
+		if _, err := regs.AMD64(); err == nil {
+			t.Errorf("%v: no error for missing register", order)
+		}
+	}
+}
+
+func TestWriteReadOnlyMemory(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"E0e", "start:1000;size:1000;permissions:rx;", // read-only region
+		"E0e", "start:3000;size:1000;permissions:rw;", // writable region, other error
+		"E0e", "", // qMemoryRegionInfo not supported
+		"E0e",
+	})
+	conn := newTestConn(client)
+
+	_, err := conn.writeMemory(0x1800, []byte{0xcc})
+	if roerr, ok := err.(*ReadOnlyMemoryError); !ok || roerr.Addr != 0x1800 {
+		t.Errorf("wrong error for read-only region: %v", err)
+	}
+	for _, addr := range []uintptr{0x3800, 0x4800, 0x5800} {
+		if _, err := conn.writeMemory(addr, []byte{0xcc}); err == nil {
+			t.Errorf("%#x: no error", addr)
+		} else if _, ok := err.(*ReadOnlyMemoryError); ok {
+			t.Errorf("%#x: wrong error %v", addr, err)
+		}
+	}
+	if !conn.memoryRegionInfoUnsupported {
+		t.Errorf("qMemoryRegionInfo not marked unsupported")
+	}
+}
+
+func TestSSHTransport(t *testing.T) {
+	tr := &SSHTransport{Target: "user@host", Options: []string{"-p", "2222"}}
+	cmd := tr.Command(1234, []string{"lldb-server", "gdbserver", "it's"})
+	expected := []string{"ssh", "-p", "2222", "-o", "BatchMode=yes", "-o", "ExitOnForwardFailure=yes", "-R", "127.0.0.1:1234:127.0.0.1:1234", "--", "user@host", `echo $$; exec 'lldb-server' 'gdbserver' 'it'\''s'`}
+	if fmt.Sprintf("%q", cmd.Args) != fmt.Sprintf("%q", expected) {
+		t.Errorf("wrong command line %q (expected %q)", cmd.Args, expected)
+	}
+
+	var out bytes.Buffer
+	tr.pid.out = &out
+	cmd.Stdout.Write([]byte("12"))
+	cmd.Stdout.Write([]byte("3\nstub "))
+	cmd.Stdout.Write([]byte("output\n"))
+	if pid := tr.pid.get(); pid != 123 {
+		t.Errorf("wrong remote pid %d", pid)
+	}
+	if out.String() != "stub output\n" {
+		t.Errorf("wrong output %q", out.String())
+	}
+
+	if _, err := LLDBLaunchRemote("-oProxyCommand=false", []string{"prog"}, ""); err == nil {
+		t.Errorf("no error for a destination starting with '-'")
+	}
+	if _, err := LLDBLaunchRemote("user@host", nil, ""); err == nil {
+		t.Errorf("no error for an empty command line")
+	}
+}
+
+func TestQueuedStopOnlyForContinue(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"T05thread:1;", "T05thread:1;"})
+
+	var log bytes.Buffer
+	conn := newTestConn(NewRecordingConn(&log, client))
+	conn.queueStop([]byte("T13thread:2;"))
+
+	// steps and range steps are sent to the stub, the stop stays queued
+	for _, cmd := range []string{"$vCont;r1000,1010:1;c", "$vCont;C02:1;s:2"} {
+		conn.outbuf.Reset()
+		conn.outbuf.WriteString(cmd)
+		sp, err := conn.sendResume(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sp.threadID != "1" || sp.sig != 0x5 {
+			t.Errorf("%s: wrong stop %#v", cmd, sp)
+		}
+		if !strings.Contains(log.String(), replaySendPrefix+`"`+cmd+"#") {
+			t.Errorf("%s: not sent:\n%s", cmd, log.String())
+		}
+		if len(conn.pendingStops) != 1 {
+			t.Errorf("%s: queued stop consumed", cmd)
+		}
+	}
+
+	log.Reset()
+	conn.outbuf.Reset()
+	conn.outbuf.WriteString("$vCont;c")
+	sp, err := conn.sendResume(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.threadID != "2" || sp.sig != 0x13 || len(conn.pendingStops) != 0 {
+		t.Errorf("wrong stop %#v", sp)
+	}
+	if log.Len() != 0 {
+		t.Errorf("target resumed:\n%s", log.String())
+	}
+
+	for cmd, expected := range map[string]bool{
+		"$c":                    true,
+		"$C02":                  false,
+		"$vCont;c":              true,
+		"$vCont;C02:1;c":        false,
+		"$vCont;c:1":            false,
+		"$s":                    false,
+		"$bc":                   false,
+		"$vCont;s:1":            false,
+		"$vCont;r1000,1010:1;c": false,
+		"$vCont;c:1;s:2":        false,
+	} {
+		if got := continuesAll([]byte(cmd)); got != expected {
+			t.Errorf("continuesAll(%q) = %v, expected %v", cmd, got, expected)
+		}
+	}
+}
+
+func TestStrayStopReply(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		frame := func(start byte, payload string) []byte {
+			buf := append([]byte{start}, payload...)
+			buf = append(buf, '#')
+			sum := checksum(buf)
+			return append(buf, hexdigit[sum>>4], hexdigit[sum&0xf])
+		}
+		rdr := bufio.NewReader(server)
+		if _, err := rdr.ReadBytes('#'); err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2))
+		server.Write(frame('$', "T05thread:2;reason:breakpoint;"))
+		server.Write(frame('%', "Stop:T13thread:3;"))
+		server.Write(frame('$', "S0b"))
+		server.Write(frame('$', "00100000"))
+		server.Close()
+	}()
+
+	var log bytes.Buffer
+	conn := newTestConn(NewRecordingConn(&log, client))
+	resp, err := conn.exec([]byte("$p10"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "00100000" {
+		t.Errorf("wrong reply %q", resp)
+	}
+
+	for _, tc := range []struct {
+		threadID string
+		sig      uint8
+		reason   string
+	}{
+		{"2", 0x5, "breakpoint"},
+		{"3", 0x13, ""},
+		{"", 0xb, ""},
+	} {
+		conn.outbuf.Reset()
+		conn.outbuf.WriteString("$vCont;c")
+		sp, err := conn.sendResume(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sp.threadID != tc.threadID || sp.sig != tc.sig || sp.reason != tc.reason {
+			t.Errorf("wrong stop %#v (expected %v)", sp, tc)
+		}
+	}
+	if conn.stopGen != 3 {
+		t.Errorf("wrong stopGen %d", conn.stopGen)
+	}
+	if strings.Contains(log.String(), "vCont") {
+		t.Errorf("target resumed:\n%s", log.String())
+	}
+
+	for _, tc := range []struct {
+		cmd, resp string
+		stray     bool
+	}{
+		{"$g", "T05thread:1;", true},
+		{"$m1000,2", "S05", true},
+		{"$?", "T05thread:1;", false},
+		{"$qThreadStopInfo1", "T05thread:1;", false},
+		{"$vCont;s:1", "T05thread:1;", false},
+		{"$qC", "QC1", false},
+		{"$m1000,2", "S0501", false},
+	} {
+		if stray := isStrayStopReply([]byte(tc.cmd), []byte(tc.resp)); stray != tc.stray {
+			t.Errorf("%s %s: expected %v got %v", tc.cmd, tc.resp, tc.stray, stray)
+		}
+	}
+}
+
+func TestResync(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		frame := func(start byte, payload string) []byte {
+			buf := append([]byte{start}, payload...)
+			buf = append(buf, '#')
+			sum := checksum(buf)
+			return append(buf, hexdigit[sum>>4], hexdigit[sum&0xf])
+		}
+		rdr := bufio.NewReader(server)
+		if ch, _ := rdr.ReadByte(); ch != ctrlC {
+			return
+		}
+		// garbage left over from the command that desynchronized the
+		// connection, followed by a stop reply, a truncated packet and the
+		// reply to our interrupt.
+		server.Write([]byte("0000#a3"))
+		server.Write(frame('$', "T05thread:2;"))
+		server.Write([]byte("$0011"))
+		server.Write(frame('$', "T13thread:1;"))
+		if _, err := rdr.ReadBytes('#'); err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2))
+		server.Write(frame('$', "QC1"))
+		server.Close()
+	}()
+
+	conn := newTestConn(client)
+	conn.dead = ErrProtocolDesync
+	if err := conn.resync(true); err != nil {
+		t.Fatal(err)
+	}
+	if conn.dead != nil {
+		t.Errorf("connection still marked dead: %v", conn.dead)
+	}
+	if len(conn.pendingStops) != 1 || conn.pendingStops[0].threadID != "2" || conn.pendingStops[0].sig != 0x5 {
+		t.Errorf("wrong pending stops %#v", conn.pendingStops)
+	}
+
+	conn.dead = ErrStubUnresponsive
+	if err := conn.resync(false); err != ErrStubUnresponsive {
+		t.Errorf("expected ErrStubUnresponsive, got %v", err)
+	}
+}
+
+func TestRegistersGetSubRegisters(t *testing.T) {
+	u64 := func(v uint64) []byte {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], v)
+		return buf[:]
+	}
+	regs := gdbRegisters{regs: map[string]gdbRegister{
+		"rax": {value: u64(0x1122334455667788)},
+		"r8":  {value: u64(0x8877665544332211)},
+	}}
+	for _, tc := range []struct {
+		reg x86asm.Reg
+		val uint64
+	}{
+		{x86asm.AL, 0x88},
+		{x86asm.AH, 0x77},
+		{x86asm.AX, 0x7788},
+		{x86asm.EAX, 0x55667788},
+		{x86asm.RAX, 0x1122334455667788},
+		{x86asm.R8B, 0x11},
+		{x86asm.R8W, 0x2211},
+		{x86asm.R8L, 0x44332211},
+		{x86asm.R8, 0x8877665544332211},
+	} {
+		if v, err := regs.Get(int(tc.reg)); err != nil || v != tc.val {
+			t.Errorf("Get(%v) = %#x, %v (expected %#x)", tc.reg, v, err, tc.val)
+		}
+	}
+}
+
+func TestAttachError(t *testing.T) {
+	const pid = 1 << 30 // does not exist
+	other := errors.New("stub exited while waiting for connection: exit status 1")
+
+	gdberr := &GdbProtocolError{"attach", "$vAttach;40000000", "E96;" + hex.EncodeToString([]byte("tried to attach to process already being debugged"))}
+	if err, ok := attachError(pid, 0, gdberr, "").(*ErrAlreadyTraced); !ok || err.Pid != pid {
+		t.Errorf("wrong error for debugserver reply: %v", err)
+	}
+	if err, ok := attachError(pid, 0, other, "error: process 1073741824 is already traced\n").(*ErrAlreadyTraced); !ok || err.Pid != pid {
+		t.Errorf("wrong error for stub output: %v", err)
+	}
+	if err := attachError(pid, 0, other, "error: no such process\n"); err != other {
+		t.Errorf("unrelated error changed: %v", err)
+	}
+	if err := attachError(pid, 0, &GdbProtocolError{"attach", "$vAttach;40000000", "E01"}, ""); !strings.Contains(err.Error(), "E01") {
+		t.Errorf("unrelated error changed: %v", err)
+	}
+	if tracer := tracerPid(pid); tracer != 0 {
+		t.Errorf("wrong tracer %d for nonexistent process", tracer)
+	}
+
+	msg := (&ErrAlreadyTraced{Pid: 10, TracerPid: 20}).Error()
+	if !strings.Contains(msg, "process 10 is already being debugged by PID 20") {
+		t.Errorf("wrong message %q", msg)
+	}
+}
+
+func TestReadMemoryBatch(t *testing.T) {
+	client, server := net.Pipe()
+	go fakePipelinedStub(server, []string{"04000000", "E0e", "0200"})
+
+	var log bytes.Buffer
+	conn := newTestConn(NewRecordingConn(&log, client))
+
+	bufs := [][]byte{make([]byte, 4), make([]byte, 4), make([]byte, 4)}
+	errs := conn.readMemoryBatch(bufs, []uint64{0xc000000090, 0xc000000190, 0xc000000290})
+	if errs[0] != nil || binary.LittleEndian.Uint32(bufs[0]) != 4 {
+		t.Errorf("wrong first read %x %v", bufs[0], errs[0])
+	}
+	if _, isprotoerr := errs[1].(*GdbProtocolError); !isprotoerr {
+		t.Errorf("expected protocol error, got %v", errs[1])
+	}
+	if errs[2] == nil {
+		t.Errorf("short read not reported")
+	}
+
+	var packets []string
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+			packets = append(packets, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+		}
+	}
+	if want := []string{"$mc000000090,4", "$mc000000190,4", "$mc000000290,4"}; fmt.Sprint(packets) != fmt.Sprint(want) {
+		t.Errorf("wrong packets sent %q, expected %q", packets, want)
+	}
+}
+
+func TestX87ControlRegisters(t *testing.T) {
+	slice := func(regsInfo []gdbRegisterInfo, values map[string]uint64) map[string]string {
+		regs := gdbRegisters{regs: map[string]gdbRegister{}, regsInfo: regsInfo, buf: make([]byte, 64)}
+		for _, reginfo := range regsInfo {
+			value := regs.buf[reginfo.Offset : reginfo.Offset+reginfo.Bitsize/8]
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], values[reginfo.Name])
+			copy(value, buf[:])
+			regs.regs[reginfo.Name] = gdbRegister{regnum: reginfo.Regnum, value: value}
+		}
+		found := map[string]string{}
+		for _, reg := range regs.Slice() {
+			found[reg.Name] = reg.Value
+		}
+		return found
+	}
+
+	// gdbserver reports the environment as 32 bit registers and the full
+	// tag word: ST(0) is R6 and valid, ST(1) is R7 and zero.
+	found := slice([]gdbRegisterInfo{
+		{Name: "fctrl", Bitsize: 32, Offset: 0},
+		{Name: "fstat", Bitsize: 32, Offset: 4},
+		{Name: "ftag", Bitsize: 32, Offset: 8},
+		{Name: "fop", Bitsize: 32, Offset: 12},
+		{Name: "fioff", Bitsize: 32, Offset: 16},
+	}, map[string]uint64{"fctrl": 0x37f, "fstat": 0x3000, "ftag": 0x4fff, "fop": 0x5d9, "fioff": 0x401000})
+	for name, expected := range map[string]string{
+		"fctrl": "0x037f\t[RC=0 PC=3 PM UM OM ZM DM IM]",
+		"fstat": "[TOP=6]",
+		"ftag":  "0x4fff\t[ST(0)=valid ST(1)=zero ST(2)=empty ST(3)=empty ST(4)=empty ST(5)=empty ST(6)=empty ST(7)=empty]",
+		"fop":   "0x05d9",
+		"fioff": "0x00401000",
+	} {
+		if !strings.HasSuffix(found[name], expected) {
+			t.Errorf("wrong value for %s: %q, expected %q", name, found[name], expected)
+		}
+	}
+
+	// abridged tag word, without the status word the physical registers
+	// are described.
+	found = slice([]gdbRegisterInfo{{Name: "ftag", Bitsize: 8, Offset: 0}}, map[string]uint64{"ftag": 0xc0})
+	if expected := "0xc0\t[R0=empty R1=empty R2=empty R3=empty R4=empty R5=empty R6=valid R7=valid]"; found["ftag"] != expected {
+		t.Errorf("wrong value for ftag: %q, expected %q", found["ftag"], expected)
+	}
+}
+
+func TestParseProcArgs(t *testing.T) {
+	data := []byte("\x02\x00\x00\x00/usr/local/bin/server\x00\x00\x00\x00./server\x00-v\x00A=1\x00PATH=/bin\x00\x00executable_path=/usr/local/bin/server\x00\x00\x00")
+	args, env, err := parseProcArgs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%q", args) != `["./server" "-v"]` {
+		t.Errorf("wrong command line %q", args)
+	}
+	if fmt.Sprintf("%q", env) != `["A=1" "PATH=/bin"]` {
+		t.Errorf("wrong environment %q", env)
+	}
+	if _, _, err := parseProcArgs([]byte("\x05\x00\x00\x00/bin/server\x00./server\x00")); err == nil {
+		t.Errorf("no error for truncated arguments")
+	}
+}
@@ -0,0 +1,9 @@
+package gdbserial
+
+import "golang.org/x/sys/unix"
+
+// sysctlProcArgs returns the value of the kern.procargs2 sysctl for the
+// local process pid, see parseProcArgs.
+func sysctlProcArgs(pid int) ([]byte, error) {
+	return unix.SysctlRaw("kern.procargs2", pid)
+}
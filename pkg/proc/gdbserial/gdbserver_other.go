@@ -0,0 +1,8 @@
+// +build !darwin
+
+package gdbserial
+
+// sysctlProcArgs is only implemented on macOS.
+func sysctlProcArgs(pid int) ([]byte, error) {
+	return nil, ErrProcessInfoUnavailable
+}
@@ -0,0 +1,211 @@
+package gdbserial
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The connections in this file wrap the transport used by gdbConn so that a
+// conversation with a stub can be recorded to a log and later replayed
+// without the stub.
+//
+// The log is a text file with one entry per line, each entry is either:
+//   <- "data"
+// for data sent by us to the stub or:
+//   -> "data"
+// for data received from the stub, data is quoted using Go syntax.
+
+const (
+	replaySendPrefix = "<- "
+	replayRecvPrefix = "-> "
+)
+
+// recordingConn is a net.Conn that logs all data sent and received through
+// the underlying connection.
+type recordingConn struct {
+	net.Conn
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewRecordingConn returns a net.Conn that forwards everything to
+// underlying and records every packet sent and received to w.
+// The resulting log can be used with NewReplayConn.
+func NewRecordingConn(w io.Writer, underlying net.Conn) net.Conn {
+	return &recordingConn{Conn: underlying, w: w}
+}
+
+func (conn *recordingConn) log(prefix string, data []byte) {
+	conn.mu.Lock()
+	fmt.Fprintf(conn.w, "%s%s\n", prefix, strconv.Quote(string(data)))
+	conn.mu.Unlock()
+}
+
+func (conn *recordingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.log(replayRecvPrefix, b[:n])
+	}
+	return n, err
+}
+
+func (conn *recordingConn) Write(b []byte) (int, error) {
+	conn.log(replaySendPrefix, b)
+	return conn.Conn.Write(b)
+}
+
+// ReplayMismatchError is returned by a replay connection when the data sent
+// to it doesn't match the recorded log.
+type ReplayMismatchError struct {
+	Expected, Got string
+}
+
+func (err *ReplayMismatchError) Error() string {
+	if err.Expected == "" {
+		return fmt.Sprintf("replay: unexpected send %q after end of log", err.Got)
+	}
+	return fmt.Sprintf("replay: expected send %q got %q", err.Expected, err.Got)
+}
+
+type replayEntry struct {
+	send bool
+	data []byte
+}
+
+// replayConn is a net.Conn that serves the responses contained in a log
+// written by a recordingConn.
+type replayConn struct {
+	mu      sync.Mutex
+	entries []replayEntry
+	inbuf   bytes.Buffer
+}
+
+// NewReplayConn returns a net.Conn that replays the log read from r, which
+// must have been produced by NewRecordingConn.
+// Every write to the connection is checked against the log, the data
+// received after it in the log is then served to subsequent reads.
+func NewReplayConn(r io.Reader) (net.Conn, error) {
+	conn := &replayConn{}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 4096), 1<<24)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		var e replayEntry
+		switch {
+		case len(line) >= 3 && line[:3] == replaySendPrefix:
+			e.send = true
+		case len(line) >= 3 && line[:3] == replayRecvPrefix:
+			e.send = false
+		default:
+			return nil, fmt.Errorf("replay: malformed line %d: %q", lineno, line)
+		}
+		data, err := strconv.Unquote(line[3:])
+		if err != nil {
+			return nil, fmt.Errorf("replay: malformed line %d: %v", lineno, err)
+		}
+		e.data = []byte(data)
+		conn.entries = append(conn.entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	conn.fill()
+	return conn, nil
+}
+
+// fill moves all the receive entries at the start of the log to the input
+// buffer.
+func (conn *replayConn) fill() {
+	for len(conn.entries) > 0 && !conn.entries[0].send {
+		conn.inbuf.Write(conn.entries[0].data)
+		conn.entries = conn.entries[1:]
+	}
+}
+
+func (conn *replayConn) Read(b []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.inbuf.Len() > 0 {
+		return conn.inbuf.Read(b)
+	}
+	if len(conn.entries) == 0 {
+		return 0, io.EOF
+	}
+	// The log says that the next thing that happened was a send, which means
+	// that the recorded read timed out.
+	return 0, replayTimeoutError{}
+}
+
+func (conn *replayConn) Write(b []byte) (int, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	// A single recorded write could be split into multiple writes during
+	// replay, or vice versa, only the sequence of bytes matters.
+	written := 0
+	for written < len(b) {
+		if len(conn.entries) == 0 {
+			return written, &ReplayMismatchError{Got: string(b[written:])}
+		}
+		e := &conn.entries[0]
+		n := len(b) - written
+		if n > len(e.data) {
+			n = len(e.data)
+		}
+		if !bytes.Equal(e.data[:n], b[written:written+n]) {
+			return written, &ReplayMismatchError{Expected: string(e.data), Got: string(b[written:])}
+		}
+		written += n
+		e.data = e.data[n:]
+		if len(e.data) == 0 {
+			conn.entries = conn.entries[1:]
+			conn.fill()
+		}
+	}
+	return written, nil
+}
+
+func (conn *replayConn) Close() error {
+	return nil
+}
+
+func (conn *replayConn) LocalAddr() net.Addr {
+	return replayAddr{}
+}
+
+func (conn *replayConn) RemoteAddr() net.Addr {
+	return replayAddr{}
+}
+
+func (conn *replayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *replayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *replayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+type replayTimeoutError struct{}
+
+func (replayTimeoutError) Error() string   { return "replay: read timeout" }
+func (replayTimeoutError) Timeout() bool   { return true }
+func (replayTimeoutError) Temporary() bool { return true }
@@ -0,0 +1,4245 @@
+package gdbserial
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/dwarf"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"go/parser"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/derekparker/delve/pkg/dwarf/dwarfbuilder"
+	"github.com/derekparker/delve/pkg/dwarf/godwarf"
+	"github.com/derekparker/delve/pkg/dwarf/op"
+	"github.com/derekparker/delve/pkg/goversion"
+	"github.com/derekparker/delve/pkg/proc"
+	protest "github.com/derekparker/delve/pkg/proc/test"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// newFakeStubProcess returns a Process connected to a fakeStub answering
+// with resps, see newFakeStubConn.
+func newFakeStubProcess(resps []string) (*Process, *bytes.Buffer) {
+	conn, log := newFakeStubConn(resps)
+	p := New(nil)
+	p.conn = *newTestConn(conn)
+	return p, log
+}
+
+func TestThreadExitDuringContinue(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"w00;p10.2", "T05thread:p10.3;create:;", "W00"})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	p.conn.pid = 0x10
+	for _, tid := range []int{1, 2} {
+		p.threads[tid] = &Thread{ID: tid, strID: fmt.Sprintf("p10.%x", tid), p: p}
+	}
+	p.currentThread = p.threads[2]
+
+	_, err := p.ContinueOnce()
+	if _, isexited := err.(proc.ProcessExitedError); !isexited {
+		t.Fatalf("expected process to exit, got %v", err)
+	}
+	if _, found := p.threads[2]; found {
+		t.Errorf("exited thread still in the thread list")
+	}
+	if p.currentThread == nil || p.currentThread.ID != 1 {
+		t.Errorf("wrong current thread %v", p.currentThread)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"start:1000;size:1000;permissions:rx;",
+		"deadbeef",
+		"start:2000;size:1000;permissions:rw;",
+		"01020304",
+		"01020304",
+		"start:1000;size:1000;permissions:rx;",
+		"deadbeef",
+	})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	p.SetMemoryCache(true)
+	thread := &Thread{ID: 1, strID: "1", p: p}
+
+	read := func(addr uintptr, expected string) {
+		buf := make([]byte, 4)
+		if _, err := thread.ReadMemory(buf, addr); err != nil {
+			t.Fatalf("ReadMemory(%#x): %v", addr, err)
+		}
+		if fmt.Sprintf("%x", buf) != expected {
+			t.Fatalf("ReadMemory(%#x): got %x expected %s", addr, buf, expected)
+		}
+	}
+
+	read(0x1000, "deadbeef")
+	read(0x1000, "deadbeef") // read-only memory, served from the cache
+	read(0x2000, "01020304")
+	read(0x2000, "01020304") // writable memory, read again
+	p.conn.stopGen++
+	read(0x1000, "deadbeef") // cache discarded after resume
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		// not a stub: read everything and never answer
+		buf := make([]byte, 100)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	defer server.Close()
+
+	p := New(nil)
+	p.SetHandshakeTimeout(100 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		done <- p.Connect(client, "", 0)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "does not appear to be a gdb remote stub") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake did not time out")
+	}
+}
+
+func TestThreadsInStopReply(t *testing.T) {
+	p := New(nil)
+	p.threads[4] = &Thread{ID: 4, strID: "4", p: p}
+	p.currentThread = p.threads[4]
+	tu := &threadUpdater{p: p}
+	_, sp, err := p.conn.parseStopPacket([]byte("T05thread:2;threads:1,2,3;reason:breakpoint;"), "", tu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.threadID != "2" || sp.reason != "breakpoint" {
+		t.Errorf("wrong stop packet %#v", sp)
+	}
+	if !tu.done {
+		t.Fatal("thread list in stop packet did not complete the thread update")
+	}
+	if len(p.threads) != 3 {
+		t.Errorf("wrong number of threads %d", len(p.threads))
+	}
+	for _, tid := range []int{1, 2, 3} {
+		if _, found := p.threads[tid]; !found {
+			t.Errorf("thread %d not found", tid)
+		}
+	}
+	if p.currentThread == nil || p.currentThread.ID == 4 {
+		t.Errorf("current thread not updated")
+	}
+
+	_, _, err = p.conn.parseStopPacket([]byte("T05thread:2;threads:1,zz;"), "", &threadUpdater{p: p})
+	if _, ismalformed := err.(*GdbMalformedThreadIDError); !ismalformed {
+		t.Errorf("expected malformed thread ID error, got %v", err)
+	}
+}
+
+func TestThreadsXfer(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		`l<?xml version="1.0"?><threads><thread id="p10.1" core="2" name="main"/><thread id="p10.2" core="10"/></threads>`,
+	})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	p.conn.threadsXferSupported = true
+	if err := p.updateThreadsInfo(&threadUpdater{p: p}); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.threads) != 2 {
+		t.Fatalf("wrong number of threads %d", len(p.threads))
+	}
+	for _, tc := range []struct {
+		tid  int
+		name string
+		core int
+	}{
+		{1, "main", 2},
+		{2, "", 10},
+	} {
+		th := p.threads[tc.tid]
+		if th == nil {
+			t.Fatalf("thread %d not found", tc.tid)
+		}
+		if th.Name() != tc.name || th.Core() != tc.core {
+			t.Errorf("thread %d: got %q %d expected %q %d", tc.tid, th.Name(), th.Core(), tc.name, tc.core)
+		}
+	}
+}
+
+func TestReadGoString(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"0020000000000000" + "0500000000000000",
+		"68656c6c6f",
+		"0020000000000000" + "0500000000000000",
+		"6865",
+		"0020000000000000" + "ffffffffffffff7f",
+	})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	thread := &Thread{ID: 1, strID: "1", p: p}
+
+	if s, err := thread.ReadGoString(0x1000, -1); err != nil || s != "hello" {
+		t.Errorf("got %q %v", s, err)
+	}
+	if s, err := thread.ReadGoString(0x1000, 2); err != nil || s != "he" {
+		t.Errorf("got %q %v", s, err)
+	}
+	if _, err := thread.ReadGoString(0x1000, -1); err == nil {
+		t.Errorf("no error for corrupt string header")
+	}
+
+	// the header is decoded with the byte order of the target
+	p, _ = newFakeStubProcess([]string{"0000000000002000" + "0000000000000005", "68656c6c6f"})
+	p.conn.byteOrder = binary.BigEndian
+	thread = &Thread{ID: 1, strID: "1", p: p}
+	if s, err := thread.ReadGoString(0x1000, -1); err != nil || s != "hello" {
+		t.Errorf("got %q %v", s, err)
+	}
+}
+
+func TestMultiprocessThreads(t *testing.T) {
+	p := New(nil)
+	p.conn.pid = 0x10
+	p.conn.multiprocess = true
+	tu := &threadUpdater{p: p}
+	if err := tu.Add([]string{"p10.1", "p20.2", "p10.3"}); err != nil {
+		t.Fatal(err)
+	}
+	tu.Finish()
+	if len(p.threads) != 2 || p.threads[1] == nil || p.threads[3] == nil {
+		t.Errorf("wrong threads %v", p.threads)
+	}
+	if pids := p.Processes(); len(pids) != 2 || pids[0] != 0x10 || pids[1] != 0x20 {
+		t.Errorf("wrong processes %v", pids)
+	}
+	if err := p.SelectProcess(0x30); err == nil {
+		t.Errorf("selected a process not managed by the stub")
+	}
+
+	_, _, err := p.conn.parseStopPacket([]byte("W00;process:20"), "", nil)
+	if exitErr, isexited := err.(proc.ProcessExitedError); !isexited || exitErr.Pid != 0x20 {
+		t.Errorf("wrong exit error %v", err)
+	}
+}
+
+func TestMultiprocessStops(t *testing.T) {
+	conn, log := newFakeStubConn([]string{"W00;process:20", "W00;process:40", "T05thread:p30.2;", "W00;process:10"})
+	p := newSingleThreadTestProcess(conn)
+	p.conn.pid = 0x10
+	p.conn.multiprocess = true
+	p.threads[1].strID = "p10.1"
+	p.addInferior(0x20)
+
+	// exits of other processes, known or not, don't end the continue
+	_, err := p.ContinueOnce()
+	if stopErr, ok := err.(*ErrInferiorStopped); !ok || stopErr.Pid != 0x30 || stopErr.ThreadID != "p30.2" || stopErr.Signal != 0x5 {
+		t.Fatalf("wrong error %v", err)
+	}
+	if p.conn.pid != 0x10 || p.exited {
+		t.Errorf("selected process changed: pid %#x exited %v", p.conn.pid, p.exited)
+	}
+	if pids := p.Processes(); len(pids) != 2 || pids[0] != 0x10 || pids[1] != 0x30 {
+		t.Errorf("wrong processes %v", pids)
+	}
+	exits := p.InferiorExits()
+	if len(exits) != 2 || exits[0].Pid != 0x20 || exits[1].Pid != 0x40 {
+		t.Errorf("wrong exits %v", exits)
+	}
+	if exits := p.InferiorExits(); len(exits) != 0 {
+		t.Errorf("exits not cleared %v", exits)
+	}
+	if n := strings.Count(log.String(), "$vCont;c#"); n != 3 {
+		t.Errorf("target resumed %d times, expected 3:\n%s", n, log.String())
+	}
+
+	_, err = p.ContinueOnce()
+	if exitErr, isexited := err.(proc.ProcessExitedError); !isexited || exitErr.Pid != 0x10 || !p.exited {
+		t.Errorf("wrong exit error %v", err)
+	}
+}
+
+func TestNoThreadsAfterStop(t *testing.T) {
+	client, server := net.Pipe()
+	// the process stops but by the time we ask for the list of threads they
+	// are all gone.
+	go fakeStub(server, []string{"T05thread:1;", "l"})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	p.threadStopInfo = false
+	p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+	p.currentThread = p.threads[1]
+
+	_, err := p.ContinueOnce()
+	if _, isexited := err.(proc.ProcessExitedError); !isexited {
+		t.Fatalf("expected process to exit, got %v", err)
+	}
+	if p.CurrentThread() != nil {
+		t.Errorf("current thread is not nil: %v", p.CurrentThread())
+	}
+	if err := p.StepInstruction(); err == nil {
+		t.Errorf("StepInstruction succeeded without threads")
+	}
+}
+
+func TestContinueWithoutBreakpoints(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "T13thread:1;threads:1;", strings.Repeat("00", 16), "OK"})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.GOOS = "linux"
+	p.threadStopInfo = false
+	p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+	p.currentThread = p.threads[1]
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000}
+
+	if _, err := p.ContinueWithoutBreakpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if p.breakpointsSuspended {
+		t.Errorf("breakpoints still suspended")
+	}
+	if _, ok := p.breakpoints.M[0x1000]; !ok {
+		t.Errorf("breakpoint removed from the breakpoint map")
+	}
+
+	sent := log.String()
+	clear, resume, set := strings.Index(sent, "$z0,1000,1"), strings.Index(sent, "$vCont;c"), strings.Index(sent, "$Z0,1000,1")
+	if clear < 0 || resume < 0 || set < 0 || !(clear < resume && resume < set) {
+		t.Errorf("wrong packet sequence:\n%s", sent)
+	}
+}
+
+func TestSetRegisterBytes(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "OK", "OK"})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.gcmdok = false
+	thread := &Thread{ID: 1, strID: "1", p: p}
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: "st0", Bitsize: 80, Offset: 0, Regnum: 0x10},
+		{Name: "ymm1", Bitsize: 256, Offset: 10, Regnum: 0x20},
+	}
+	buf := make([]byte, 42)
+	thread.regsLoaded = true
+	thread.regs = gdbRegisters{regs: map[string]gdbRegister{}, regsInfo: p.conn.regsInfo, buf: buf}
+	for _, reginfo := range p.conn.regsInfo {
+		thread.regs.regs[reginfo.Name] = gdbRegister{regnum: reginfo.Regnum, value: buf[reginfo.Offset : reginfo.Offset+reginfo.Bitsize/8]}
+	}
+
+	// 1.0 in x87 extended precision
+	st0 := []byte{0, 0, 0, 0, 0, 0, 0, 0x80, 0xff, 0x3f}
+	if err := thread.regs.SetBytes(thread, "st0", st0); err != nil {
+		t.Fatal(err)
+	}
+	xmm1 := bytes.Repeat([]byte{0xab}, 16)
+	if err := thread.regs.SetBytes(thread, "xmm1", xmm1); err != nil {
+		t.Fatal(err)
+	}
+	ymm1 := bytes.Repeat([]byte{0xcd}, 32)
+	if err := thread.regs.SetBytes(thread, "ymm1", ymm1[:16]); err == nil {
+		t.Errorf("no error for wrong register size")
+	}
+	if err := thread.regs.SetBytes(thread, "ymm1", ymm1); err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]string{}
+	for _, reg := range thread.regs.Slice() {
+		found[reg.Name] = fmt.Sprintf("%x", reg.Bytes)
+	}
+	if !bytes.Equal(thread.regs.regs["st0"].value, st0) {
+		t.Errorf("wrong value for st0: %x", thread.regs.regs["st0"].value)
+	}
+	if found["XMM1"] != fmt.Sprintf("%x", ymm1[:16]) {
+		t.Errorf("wrong value for XMM1: %s", found["XMM1"])
+	}
+	if !strings.Contains(log.String(), "$P10=0000000000000080ff3f;thread:1;") {
+		t.Errorf("st0 not written:\n%s", log.String())
+	}
+	if !strings.Contains(log.String(), "$P20="+strings.Repeat("ab", 16)+strings.Repeat("00", 16)) {
+		t.Errorf("xmm1 not written:\n%s", log.String())
+	}
+}
+
+func TestDrainPendingStops(t *testing.T) {
+	client, server := net.Pipe()
+	// thread 2 stops at a breakpoint while we think the target is stopped
+	go multiReplyStub(server, [][]string{{"T05thread:2;reason:breakpoint;", "OK"}})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	p.conn.threadSuffixSupported = true
+	p.gcmdok = false
+	for _, tid := range []int{1, 2} {
+		th := &Thread{ID: tid, strID: fmt.Sprintf("%x", tid), p: p}
+		th.regsLoaded = true
+		th.regs = gdbRegisters{regs: map[string]gdbRegister{regnamePC: {value: []byte{0, 0x10, 0, 0, 0, 0, 0, 0}}}}
+		p.threads[tid] = th
+	}
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000, Kind: proc.UserBreakpoint, HitCount: map[int]uint64{}}
+
+	if _, err := p.conn.exec([]byte("$Z0,2000,1"), "test"); err != nil {
+		t.Fatal(err)
+	}
+	p.conn.queueStop([]byte("T13thread:1;"))
+
+	stops, err := p.DrainPendingStops()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stops) != 2 || stops[0].ThreadID != 2 || stops[0].Signal != breakpointSignal || stops[0].Reason != "breakpoint" || stops[1].ThreadID != 1 || stops[1].Signal != 0x13 {
+		t.Errorf("wrong pending stops %#v", stops)
+	}
+	if p.threads[2].CurrentBreakpoint.Breakpoint == nil {
+		t.Errorf("current breakpoint of thread 2 not set")
+	}
+	if p.threads[1].CurrentBreakpoint.Breakpoint != nil {
+		t.Errorf("current breakpoint of thread 1 set")
+	}
+	if len(p.conn.pendingStops) != 0 {
+		t.Errorf("pending stops not drained %#v", p.conn.pendingStops)
+	}
+	if stops, err := p.DrainPendingStops(); err != nil || len(stops) != 0 {
+		t.Errorf("stops drained twice %#v %v", stops, err)
+	}
+}
+
+func TestSignalPolicy(t *testing.T) {
+	const sigpipe = 0xd
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"T0dthread:1;threads:1;", strings.Repeat("00", 16),
+		"T13thread:1;threads:1;", strings.Repeat("00", 16),
+	})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.GOOS = "linux"
+	p.threadStopInfo = false
+	p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+	p.currentThread = p.threads[1]
+
+	if p.defaultSignalPolicy(sigpipe) != SignalPass || p.defaultSignalPolicy(stopSignal) != SignalStop {
+		t.Errorf("wrong default policy")
+	}
+
+	p.SetSignalPolicy(func(sig uint8) SignalAction {
+		if sig == sigpipe {
+			return SignalPassAndStop
+		}
+		return p.defaultSignalPolicy(sig)
+	})
+
+	if _, err := p.ContinueOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ContinueOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := log.String()
+	first, second := strings.Index(sent, "$vCont;c#"), strings.Index(sent, "$vCont;C0d#")
+	if first < 0 || second < 0 || first > second {
+		t.Errorf("signal not delivered on resume:\n%s", sent)
+	}
+}
+
+func TestStopReason(t *testing.T) {
+	pc := func(addr uint64) string {
+		var buf [16]byte
+		binary.LittleEndian.PutUint64(buf[:], addr)
+		return hex.EncodeToString(buf[:])
+	}
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"T05thread:1;threads:1;swbreak:;", pc(0x2000),
+		"T05thread:1;threads:1;swbreak:;", pc(0x1000), "0000000000000000",
+		"T05thread:1;threads:1;hwbreak:;", pc(0x3000),
+		"T0bthread:1;threads:1;", pc(0x3000),
+	})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	p.conn.threadSuffixSupported = true
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.GOOS = "linux"
+	p.threadStopInfo = false
+	p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+	p.currentThread = p.threads[1]
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000}
+	p.SetSignalPolicy(func(sig uint8) SignalAction { return SignalStop })
+
+	for _, expected := range []StopKind{StopTrap, StopBreakpoint, StopHardwareTrap, StopSignal} {
+		p.threads[1].CurrentBreakpoint.Clear()
+		th, err := p.ContinueOnce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind, _ := th.(*Thread).StopReason(); kind != expected {
+			t.Errorf("expected %v got %v", expected, kind)
+		}
+	}
+}
+
+func TestTLSBaseRegister(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"0010000000000000" + "0070000000000000"})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	p.conn.threadSuffixSupported = true
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameGsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.GOOS = "darwin"
+	if !p.hasTLSBaseRegister() {
+		t.Fatalf("gs_base not found")
+	}
+	thread := &Thread{ID: 1, strID: "1", p: p}
+
+	// the G address must be found without executing instructions on the
+	// inferior, the stub only answers the 'g' packet.
+	if err := thread.reloadRegisters(); err != nil {
+		t.Fatal(err)
+	}
+	if tls := thread.regs.TLS(); tls != 0x7000 {
+		t.Errorf("wrong TLS %#x", tls)
+	}
+	if _, hasgaddr := thread.regs.GAddr(); hasgaddr {
+		t.Errorf("unexpected G address")
+	}
+
+	p.bi.GOOS = "linux"
+	if p.hasTLSBaseRegister() {
+		t.Errorf("fs_base found")
+	}
+}
+
+func TestQueryThreadsPagination(t *testing.T) {
+	const pages = 50
+	resps := []string{}
+	for i := 0; i < pages; i++ {
+		resps = append(resps, fmt.Sprintf("m%x,%x", 2*i+1, 2*i+2))
+	}
+	resps = append(resps, "l")
+
+	client, server := net.Pipe()
+	go fakeStub(server, resps)
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	threads, err := p.queryAllThreads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 2*pages {
+		t.Errorf("expected %d threads got %d", 2*pages, len(threads))
+	}
+
+	for _, resps := range [][]string{
+		{"m1,2", "m3,zz"},     // malformed thread ID
+		{"m1,2", "E01"},       // error in the middle of the list
+		{"m1,2", "m1,2", "l"}, // the stub starts over
+	} {
+		client, server := net.Pipe()
+		go fakeStub(server, resps)
+		p := New(nil)
+		p.conn = *newTestConn(client)
+		p.threadStopInfo = false
+		p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+		p.threads[7] = &Thread{ID: 7, strID: "7", p: p}
+		if err := p.updateThreadList(&threadUpdater{p: p}); err == nil {
+			t.Errorf("%v: no error", resps)
+		}
+		if len(p.threads) != 2 || p.threads[7] == nil {
+			t.Errorf("%v: thread list changed: %v", resps, p.threads)
+		}
+	}
+}
+
+func TestRegisterByName(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "OK"})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	buf := make([]byte, 28)
+	thread := &Thread{ID: 1, strID: "1", p: p}
+	thread.regsLoaded = true
+	thread.regs = gdbRegisters{regs: map[string]gdbRegister{
+		"rax":    {regnum: 0, value: buf[0:8]},
+		"eflags": {regnum: 1, value: buf[8:12]},
+		"xmm0":   {regnum: 2, value: buf[12:28]},
+	}, buf: buf}
+	buf[8] = 0x46
+
+	if v, ok := thread.RegisterByName("eflags"); !ok || v != 0x46 {
+		t.Errorf("eflags: %#x %v", v, ok)
+	}
+	if _, ok := thread.RegisterByName("xmm0"); ok {
+		t.Errorf("xmm0 read as 64 bit register")
+	}
+	if _, ok := thread.RegisterByName("nonexistent"); ok {
+		t.Errorf("nonexistent register found")
+	}
+
+	// with 'G'
+	if err := thread.SetRegisterByName("rax", 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := thread.RegisterByName("rax"); v != 0x1234 {
+		t.Errorf("rax: %#x", v)
+	}
+	// with 'P'
+	p.gcmdok = false
+	if err := thread.SetRegisterByName("eflags", 0x202); err != nil {
+		t.Fatal(err)
+	}
+	if err := thread.SetRegisterByName("xmm0", 0); err == nil {
+		t.Errorf("xmm0 set as 64 bit register")
+	}
+
+	sent := log.String()
+	if !strings.Contains(sent, "$G3412") || !strings.Contains(sent, "$P1=02020000;thread:1;") {
+		t.Errorf("wrong packets:\n%s", sent)
+	}
+}
+
+func TestSharedLibraries(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		`l<library-list-svr4 version="1.0" main-lm="0x7f0000001000">` +
+			`<library name="linux-vdso.so.1" lm="0x7f0000002000" l_addr="0x7ffd00000000" l_ld="0x7ffd00000300"/>` +
+			`<library name="/nonexistent/libc.so.6" lm="0x7f0000003000" l_addr="0x7f1000000000" l_ld="0x7f1000200000"/>` +
+			`</library-list-svr4>`,
+		"",
+		"",
+	})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	p.execPath = os.Args[0]
+
+	libs, err := p.SharedLibraries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(libs) != 3 {
+		t.Fatalf("wrong number of libraries %v", libs)
+	}
+	if libs[0].Name != os.Args[0] || (runtime.GOOS == "linux" && libs[0].TextStart >= libs[0].TextEnd) {
+		t.Errorf("wrong executable %#v", libs[0])
+	}
+	if libs[2].Name != "/nonexistent/libc.so.6" || libs[2].LoadAddr != 0x7f1000000000 || libs[2].TextEnd != 0 {
+		t.Errorf("wrong library %#v", libs[2])
+	}
+
+	// neither qXfer:libraries-svr4:read nor jGetLoadedDynamicLibrariesInfos
+	// are supported.
+	libs, err = p.SharedLibraries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(libs) != 1 || libs[0].Name != os.Args[0] {
+		t.Errorf("wrong libraries %v", libs)
+	}
+}
+
+func TestSharedLibrariesDebugserver(t *testing.T) {
+	const images = `{"images":[` +
+		`{"load_address":4294967296,"pathname":"/tmp/a.out","mach_header":{"filetype":2},` +
+		`"segments":[{"name":"__PAGEZERO","vmaddr":0,"vmsize":4294967296},{"name":"__TEXT","vmaddr":4294967296,"vmsize":16384}]},` +
+		`{"load_address":140703128616960,"pathname":"/usr/lib/libSystem.B.dylib","mach_header":{"filetype":6},` +
+		`"segments":[{"name":"__TEXT","vmaddr":140703128616960,"vmsize":8192}]}]}`
+
+	// The reply uses the binary framing, the stub escapes '}'.
+	var reply bytes.Buffer
+	writeBinaryBytes(&reply, []byte(images))
+
+	client, server := net.Pipe()
+	go fakeStub(server, []string{reply.String()})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.isDebugserver = true
+	p.execPath = "/tmp/a.out"
+
+	libs, err := p.SharedLibraries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SharedLibrary{
+		{Name: "/tmp/a.out", LoadAddr: 0x100000000, TextStart: 0x100000000, TextEnd: 0x100004000},
+		{Name: "/usr/lib/libSystem.B.dylib", LoadAddr: 0x7ff800000000, TextStart: 0x7ff800000000, TextEnd: 0x7ff800002000},
+	}
+	if fmt.Sprint(libs) != fmt.Sprint(want) {
+		t.Errorf("wrong libraries %#v, expected %#v", libs, want)
+	}
+
+	// qXfer:libraries-svr4:read must not be tried and the closing brace of
+	// the argument must be escaped.
+	var packets []string
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+			packets = append(packets, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+		}
+	}
+	if len(packets) != 1 || packets[0] != `$jGetLoadedDynamicLibrariesInfos:{\"fetch_all_solibs\":true}]` {
+		t.Errorf("wrong packets sent %q", packets)
+	}
+}
+
+func TestFreeLoadGInstr(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK"})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.loadGInstrAddr = 0x7000
+
+	p.freeLoadGInstr()
+	if p.loadGInstrAddr != 0 {
+		t.Errorf("loadGInstrAddr not cleared")
+	}
+	p.freeLoadGInstr()
+	if n := strings.Count(log.String(), "$_m7000#"); n != 1 {
+		t.Errorf("memory freed %d times:\n%s", n, log.String())
+	}
+}
+
+func TestWatchpoints(t *testing.T) {
+	for _, tc := range []struct {
+		addr uint64
+		sz   int
+		ok   bool
+	}{
+		{0x1000, 8, true},
+		{0x1002, 2, true},
+		{0x1003, 1, true},
+		{0x1004, 8, false},
+		{0x1000, 16, false},
+		{0x1000, 3, false},
+	} {
+		if err := checkWatchpointSize(tc.addr, tc.sz); (err == nil) != tc.ok {
+			t.Errorf("%#x %d: %v", tc.addr, tc.sz, err)
+		}
+	}
+
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "T05thread:1;threads:1;watch:1004;", strings.Repeat("00", 16), "OK"})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.GOOS = "linux"
+	p.threadStopInfo = false
+	p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+	p.currentThread = p.threads[1]
+
+	wp := &Watchpoint{Expr: "x", Addr: 0x1000, Size: 8, Kind: WatchAccess}
+	if err := p.conn.setWatchpoint(wp.Kind, wp.Addr, wp.Size); err != nil {
+		t.Fatal(err)
+	}
+	p.watchpoints = append(p.watchpoints, wp)
+
+	th, err := p.ContinueOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, _ := th.(*Thread).StopReason(); kind != StopWatchpoint || th.(*Thread).Watchpoint() != wp {
+		t.Errorf("wrong stop reason %v %v", kind, th.(*Thread).Watchpoint())
+	}
+
+	if err := p.ClearWatchpoint(wp); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Watchpoints()) != 0 {
+		t.Errorf("watchpoint not removed")
+	}
+	if sent := log.String(); !strings.Contains(sent, "$Z4,1000,8#") || !strings.Contains(sent, "$z4,1000,8#") {
+		t.Errorf("wrong packets:\n%s", sent)
+	}
+}
+
+func TestVariableWatchpoint(t *testing.T) {
+	const (
+		gaddr  = 0xc000000100
+		stklo  = 0xc000100000
+		stkhi  = 0xc000108000
+		cfa    = stkhi - 0x100
+		xaddr  = cfa - 0x10
+		moved  = 0xc000300000 - stkhi // distance the stack is moved by
+		memlen = 0x200
+	)
+
+	dwb := dwarfbuilder.New()
+	int64off := dwb.AddBaseType("int64", dwarfbuilder.DW_ATE_signed, 8)
+	dwb.AddSubprogram("main.main", 0x40100, 0x41000)
+	dwb.Attr(dwarf.AttrFrameBase, dwarfbuilder.LocationBlock(op.DW_OP_call_frame_cfa))
+	dwb.AddVariable("x", int64off, dwarfbuilder.LocationBlock(op.DW_OP_fbreg, int(xaddr-cfa)))
+	dwb.TagClose()
+	abbrev, aranges, frame, info, line, pubnames, ranges, str, loc, err := dwb.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dwdata, err := dwarf.New(abbrev, aranges, frame, info, line, pubnames, ranges, str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi := proc.NewBinaryInfo("linux", "amd64")
+	bi.LoadFromData(dwdata, frame, line, loc)
+
+	uint64Type := &godwarf.UintType{BasicType: godwarf.BasicType{CommonType: godwarf.CommonType{ByteSize: 8, Name: "uint64"}, BitSize: 64}}
+	uint32Type := &godwarf.UintType{BasicType: godwarf.BasicType{CommonType: godwarf.CommonType{ByteSize: 4, Name: "uint32"}, BitSize: 32}}
+	gType := &godwarf.StructType{
+		CommonType: godwarf.CommonType{ByteSize: 40, Name: "runtime.g"},
+		StructName: "runtime.g",
+		Kind:       "struct",
+		Field: []*godwarf.StructField{
+			{Name: "stack", ByteOffset: 0, Type: &godwarf.StructType{
+				CommonType: godwarf.CommonType{ByteSize: 16, Name: "runtime.stack"},
+				StructName: "runtime.stack",
+				Kind:       "struct",
+				Field: []*godwarf.StructField{
+					{Name: "lo", Type: uint64Type, ByteOffset: 0},
+					{Name: "hi", Type: uint64Type, ByteOffset: 8},
+				},
+			}},
+			{Name: "sched", ByteOffset: 16, Type: &godwarf.StructType{
+				CommonType: godwarf.CommonType{ByteSize: 8, Name: "runtime.gobuf"},
+				StructName: "runtime.gobuf",
+				Kind:       "struct",
+				Field:      []*godwarf.StructField{{Name: "sp", Type: uint64Type, ByteOffset: 0}},
+			}},
+			{Name: "atomicstatus", Type: uint32Type, ByteOffset: 24},
+			{Name: "goid", Type: uint64Type, ByteOffset: 32},
+		},
+	}
+	g := make([]byte, 40)
+	setG := func(lo, hi, sp uint64, status uint32) {
+		binary.LittleEndian.PutUint64(g[0:], lo)
+		binary.LittleEndian.PutUint64(g[8:], hi)
+		binary.LittleEndian.PutUint64(g[16:], sp)
+		binary.LittleEndian.PutUint32(g[24:], status)
+		binary.LittleEndian.PutUint64(g[32:], 7)
+	}
+	setG(stklo, stkhi, cfa-0x40, 0)
+	stack := make([]byte, memlen)
+	movedStack := make([]byte, memlen)
+	binary.LittleEndian.PutUint64(stack[xaddr-(stkhi-memlen):], 3)
+
+	stops := []string{}
+	client, server := net.Pipe()
+	go memoryStub(server, map[uint64][]byte{gaddr: g, stkhi - memlen: stack, stkhi + moved - memlen: movedStack}, func(req string) string {
+		switch {
+		case strings.HasPrefix(req, "Z") || strings.HasPrefix(req, "z"):
+			return "OK"
+		case strings.HasPrefix(req, "vCont;c"):
+			stop := stops[0]
+			stops = stops[1:]
+			return stop
+		case strings.HasPrefix(req, "g"):
+			return strings.Repeat("00", 16)
+		}
+		return ""
+	})
+
+	var log bytes.Buffer
+	p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+	p.threadStopInfo = false
+	gvar := proc.LoadVariable("", gaddr, gType, &bi, p.currentThread, proc.LoadConfig{})
+	scope := &proc.EvalScope{
+		Location: proc.Location{PC: 0x40100, Fn: bi.LookupFunc["main.main"]},
+		Regs:     op.DwarfRegisters{CFA: cfa, FrameBase: cfa},
+		Mem:      p.currentThread,
+		Gvar:     gvar,
+		BinInfo:  &bi,
+	}
+
+	wp, err := p.SetVariableWatchpoint(scope, "x", WatchWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wp.Addr != xaddr || wp.Size != 8 || wp.goid != 7 {
+		t.Fatalf("wrong watchpoint %#x %d %d", wp.Addr, wp.Size, wp.goid)
+	}
+	if !strings.Contains(log.String(), fmt.Sprintf("$Z2,%x,8#", uint64(xaddr))) {
+		t.Errorf("watchpoint not set:\n%s", log.String())
+	}
+
+	// the stack is copied to a new location
+	copy(movedStack, stack)
+	setG(stklo+moved, stkhi+moved, cfa+moved-0x40, 0)
+	p.pruneWatchpoints()
+	if len(p.watchpoints) != 1 || wp.Addr != xaddr+moved {
+		t.Fatalf("watchpoint not moved: %#x", wp.Addr)
+	}
+	if sent := log.String(); !strings.Contains(sent, fmt.Sprintf("$z2,%x,8#", uint64(xaddr))) || !strings.Contains(sent, fmt.Sprintf("$Z2,%x,8#", uint64(xaddr+moved))) {
+		t.Errorf("wrong packets moving the watchpoint:\n%s", sent)
+	}
+
+	// the condition is evaluated in the scope of the watchpoint, at the new
+	// address of the variable
+	wp.Cond = "x == 5"
+	watchStop := fmt.Sprintf("T05thread:1;threads:1;watch:%x;", uint64(xaddr+moved))
+	stops = []string{watchStop, "T13thread:1;threads:1;"}
+	th, err := p.ContinueOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, _ := th.(*Thread).StopReason(); kind != StopSignal || wp.CondError != nil {
+		t.Errorf("watchpoint with false condition stopped the target: %v %v", kind, wp.CondError)
+	}
+	binary.LittleEndian.PutUint64(movedStack[xaddr-(stkhi-memlen):], 5)
+	stops = []string{watchStop}
+	th, err = p.ContinueOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, _ := th.(*Thread).StopReason(); kind != StopWatchpoint || th.(*Thread).Watchpoint() != wp {
+		t.Errorf("watchpoint with true condition did not stop the target: %v", kind)
+	}
+
+	// the frame returns
+	setG(stklo+moved, stkhi+moved, cfa+moved+8, 0)
+	p.pruneWatchpoints()
+	if len(p.watchpoints) != 0 {
+		t.Errorf("watchpoint not removed after the frame returned")
+	}
+	if !strings.Contains(log.String(), fmt.Sprintf("$z2,%x,8#", uint64(xaddr+moved))) {
+		t.Errorf("watchpoint not cleared:\n%s", log.String())
+	}
+
+	// the goroutine exits
+	setG(stklo+moved, stkhi+moved, cfa+moved-0x40, 0)
+	movedScope := *scope
+	movedScope.Regs = op.DwarfRegisters{CFA: cfa + moved, FrameBase: cfa + moved}
+	if wp, err = p.SetVariableWatchpoint(&movedScope, "x", WatchWrite); err != nil || wp.goid != 7 {
+		t.Fatalf("could not set watchpoint: %v", err)
+	}
+	setG(stklo+moved, stkhi+moved, cfa+moved-0x40, uint32(proc.Gdead))
+	p.pruneWatchpoints()
+	if len(p.watchpoints) != 0 {
+		t.Errorf("watchpoint not removed after the goroutine exited")
+	}
+}
+
+func TestContinueStream(t *testing.T) {
+	newProcess := func(resps []string) *Process {
+		client, server := net.Pipe()
+		go fakeStub(server, resps)
+		p := New(nil)
+		p.conn = *newTestConn(client)
+		p.conn.threadSuffixSupported = true
+		p.conn.regsInfo = []gdbRegisterInfo{
+			{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+			{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+		}
+		p.bi.GOOS = "linux"
+		p.threadStopInfo = false
+		p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+		p.currentThread = p.threads[1]
+		return p
+	}
+	regs := strings.Repeat("00", 16)
+
+	p := newProcess([]string{"T05thread:1;threads:1;", regs, "T0athread:1;threads:1;", regs, "W00"})
+	p.SetSignalPolicy(func(sig uint8) SignalAction { return SignalStop })
+	var kinds []StopKind
+	var lastErr error
+	for ev := range p.ContinueStream(context.Background()) {
+		if ev.Err != nil {
+			lastErr = ev.Err
+			continue
+		}
+		if ev.Thread != p.threads[1] {
+			t.Errorf("wrong thread %v", ev.Thread)
+		}
+		kinds = append(kinds, ev.Kind)
+		ev.Resume()
+	}
+	if len(kinds) != 2 || kinds[0] != StopTrap || kinds[1] != StopSignal {
+		t.Errorf("wrong stops %v", kinds)
+	}
+	if _, exited := lastErr.(proc.ProcessExitedError); !exited {
+		t.Errorf("expected exit, got %v", lastErr)
+	}
+
+	// canceling the context while the consumer holds a stop closes the
+	// channel without resuming the target.
+	p = newProcess([]string{"T05thread:1;threads:1;", regs})
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := p.ContinueStream(ctx)
+	if ev := <-ch; ev.Err != nil || ev.Kind != StopTrap {
+		t.Fatalf("wrong first stop %v %v", ev.Kind, ev.Err)
+	}
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("channel not closed after cancel")
+	}
+
+	// stops at a breakpoint whose condition is false and at internal
+	// breakpoints are not delivered, a channel registered with ResumeNotify
+	// is closed when the target is first resumed.
+	pcRegs := func(pc uint64) string {
+		var regs [16]byte
+		binary.LittleEndian.PutUint64(regs[:], pc)
+		return hex.EncodeToString(regs[:])
+	}
+	p = newProcess([]string{
+		"T05thread:1;threads:1;", pcRegs(0x1000),
+		"OK", "T05thread:1;threads:1;", "OK", // step over the breakpoint
+		"T05thread:1;threads:1;", pcRegs(0x2000), "0000000000000000", // g
+		"OK", "T05thread:1;threads:1;", "OK",
+		"T05thread:1;threads:1;", pcRegs(0x3000),
+	})
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000, Kind: proc.UserBreakpoint, ThreadID: 2, HitCount: map[int]uint64{}}
+	p.breakpoints.M[0x2000] = &proc.Breakpoint{Addr: 0x2000, Kind: proc.NextBreakpoint, HitCount: map[int]uint64{}}
+	notify := make(chan struct{})
+	p.ResumeNotify(notify)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	ev := <-p.ContinueStream(ctx)
+	if ev.Err != nil || ev.Breakpoint != nil || ev.Thread == nil {
+		t.Fatalf("wrong stop %#v", ev)
+	}
+	if pc := ev.Thread.regs.PC(); pc != 0x3000 {
+		t.Errorf("wrong stop pc %#x", pc)
+	}
+	select {
+	case <-notify:
+	default:
+		t.Errorf("ResumeNotify channel not closed")
+	}
+}
+
+func TestContinueStreamCancel(t *testing.T) {
+	client, server := net.Pipe()
+	interrupts := make(chan int)
+	go func() {
+		// the target runs until it is interrupted, then counts the
+		// interrupts sent after that.
+		rdr := bufio.NewReader(server)
+		rdr.ReadBytes('#')
+		rdr.Read(make([]byte, 2))
+		if b, _ := rdr.ReadByte(); b != ctrlC {
+			t.Errorf("expected interrupt, got %#x", b)
+		}
+		reply := func(resp string) {
+			buf := []byte("$" + resp + "#")
+			sum := checksum(buf)
+			server.Write(append(buf, hexdigit[sum>>4], hexdigit[sum&0xf]))
+		}
+		reply("T02thread:1;threads:1;")
+		n := 0
+		for {
+			b, err := rdr.ReadByte()
+			if err != nil {
+				break
+			}
+			switch b {
+			case ctrlC:
+				n++
+			case '#':
+				rdr.Read(make([]byte, 2))
+				reply(strings.Repeat("00", 16))
+			}
+		}
+		interrupts <- n
+	}()
+
+	p := newSingleThreadTestProcess(client)
+	p.threadStopInfo = false
+	resumed := make(chan struct{})
+	p.ResumeNotify(resumed)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := p.ContinueStream(ctx)
+	<-resumed
+	cancel()
+	if ev, ok := <-ch; ok {
+		t.Errorf("stop delivered after cancel %#v", ev)
+	}
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	if n := <-interrupts; n != 0 {
+		t.Errorf("%d more interrupts sent after the target stopped", n)
+	}
+	if p.CheckAndClearManualStopRequest() {
+		t.Errorf("manual stop request not cleared")
+	}
+}
+
+func TestResendManualStop(t *testing.T) {
+	client, server := net.Pipe()
+	received := make(chan byte, 10)
+	go func() {
+		var b [1]byte
+		for {
+			if _, err := server.Read(b[:]); err != nil {
+				close(received)
+				return
+			}
+			received <- b[0]
+		}
+	}()
+	p := newSingleThreadTestProcess(client)
+	cs := &continueState{}
+
+	// the target is stopped between two resumes of the continue cs
+	p.RequestManualStop()
+	if p.getCtrlC() {
+		t.Fatal("interrupt sent to a stopped target")
+	}
+	p.conn.running = true
+	if err := p.resendManualStop(cs); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.resendManualStop(cs); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	var sent []byte
+	for b := range received {
+		sent = append(sent, b)
+	}
+	if string(sent) != string([]byte{ctrlC}) || !p.getCtrlC() {
+		t.Errorf("wrong interrupts %q %v", sent, p.getCtrlC())
+	}
+}
+
+func TestManualStopRace(t *testing.T) {
+	client, server := net.Pipe()
+	regs := strings.Repeat("00", 16)
+	resumed := make(chan struct{})
+	go func() {
+		// The target hits a breakpoint while the interrupt is in flight, the
+		// stub answers the interrupt at the next resume.
+		rdr := bufio.NewReader(server)
+		rdr.ReadBytes('#')
+		rdr.Read(make([]byte, 2))
+		close(resumed)
+		if b, _ := rdr.ReadByte(); b != ctrlC {
+			t.Errorf("expected interrupt, got %#x", b)
+		}
+		buf := []byte("$T05thread:1;threads:1;#")
+		sum := checksum(buf)
+		server.Write(append(buf, hexdigit[sum>>4], hexdigit[sum&0xf]))
+		fakeStub(&bufferedConn{server, rdr}, []string{regs, "T02thread:1;threads:1;", "T05thread:1;threads:1;", regs})
+	}()
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.GOOS = "linux"
+	p.threadStopInfo = false
+	p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+	p.currentThread = p.threads[1]
+
+	errc := make(chan error)
+	go func() {
+		_, err := p.ContinueOnce()
+		errc <- err
+	}()
+	<-resumed
+	if err := p.RequestManualStop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if !p.interruptPending {
+		t.Errorf("interrupt not recorded as pending")
+	}
+	p.CheckAndClearManualStopRequest()
+
+	// the target is stopped, no interrupt should be sent
+	if err := p.RequestManualStop(); err != nil {
+		t.Fatal(err)
+	}
+	p.CheckAndClearManualStopRequest()
+
+	th, err := p.ContinueOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.(*Thread).stopSig != breakpointSignal {
+		t.Errorf("stale interrupt not swallowed, stopped with %#x", th.(*Thread).stopSig)
+	}
+	if p.interruptPending {
+		t.Errorf("interrupt still pending")
+	}
+	if n := strings.Count(log.String(), replaySendPrefix+strconv.Quote(string([]byte{ctrlC}))); n != 1 {
+		t.Errorf("%d interrupts sent, expected 1", n)
+	}
+}
+
+func TestInterruptPendingExpires(t *testing.T) {
+	const regs = "0010000000000000" + "0000000000000000"
+	continueOnce := func(stop string, setup func(p *Process)) uint8 {
+		t.Helper()
+		client, server := net.Pipe()
+		go fakeStub(server, []string{stop, regs})
+		p := newSingleThreadTestProcess(client)
+		p.threadStopInfo = false
+		p.SetSignalPolicy(func(sig uint8) SignalAction { return SignalStop })
+		p.interruptPending = true
+		p.interruptPendingGen = p.conn.stopGen
+		setup(p)
+		th, err := p.ContinueOnce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.interruptPending {
+			t.Errorf("interrupt still pending")
+		}
+		return th.(*Thread).stopSig
+	}
+
+	// SIGCHLD is not the answer to an interrupt on lldb-server
+	if sig := continueOnce("T11thread:1;threads:1;", func(p *Process) {}); sig != 0x11 {
+		t.Errorf("SIGCHLD swallowed, stopped with %#x", sig)
+	}
+
+	// the target was resumed (for example stepped) after the interrupt was
+	// recorded, the stale reply would have been received then
+	if sig := continueOnce("T02thread:1;threads:1;", func(p *Process) { p.conn.stopGen++ }); sig != interruptSignal {
+		t.Errorf("interrupt swallowed after another resume, stopped with %#x", sig)
+	}
+
+	// the stub did not answer the interrupt promptly
+	if sig := continueOnce("T02thread:1;threads:1;", func(p *Process) { p.interruptPendingTimeout = -time.Second }); sig != interruptSignal {
+		t.Errorf("interrupt swallowed after the timeout, stopped with %#x", sig)
+	}
+}
+
+// bufferedConn is a net.Conn that reads through rdr.
+type bufferedConn struct {
+	net.Conn
+	rdr *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.rdr.Read(b)
+}
+
+// memoryStub serves 'm' requests from mem, which maps addresses to the
+// contents of the memory starting there, other requests are answered by
+// handle or, if it is nil, with an error.
+// Replies are sent by a separate goroutine so that requests can be
+// pipelined.
+func memoryStub(conn net.Conn, mem map[uint64][]byte, handle func(req string) string) {
+	replies := make(chan []byte, 1024)
+	defer close(replies)
+	go func() {
+		defer conn.Close()
+		for reply := range replies {
+			conn.Write(reply)
+		}
+	}()
+	rdr := bufio.NewReader(conn)
+	for {
+		req, err := rdr.ReadBytes('#')
+		if err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2)) // checksum
+		req = req[1 : len(req)-1]
+		resp := "E01"
+		var addr, sz uint64
+		if n, _ := fmt.Sscanf(string(req), "m%x,%x", &addr, &sz); n == 2 {
+			for start, data := range mem {
+				if addr >= start && addr+sz <= start+uint64(len(data)) {
+					resp = hex.EncodeToString(data[addr-start : addr-start+sz])
+				}
+			}
+		} else if handle != nil {
+			resp = handle(string(req))
+		}
+		buf := []byte("$" + resp + "#")
+		sum := checksum(buf)
+		replies <- append(buf, hexdigit[sum>>4], hexdigit[sum&0xf])
+	}
+}
+
+// Layout of the minimal Go runtime described by loadFakeRuntime.
+const (
+	fakeMainAddr    = 0x40100 // main.main, 0x100 bytes
+	fakeNewprocAddr = 0x40200 // runtime.newproc, 0x100 bytes
+	fakePanicAddr   = 0x40300 // runtime.startpanic, 0x100 bytes
+	fakeTextEnd     = 0x40400
+
+	fakeAllgsAddr       = 0x50000 // runtime.allgs
+	fakeAllglenAddr     = 0x50018 // runtime.allglen
+	fakeWaitReasonsAddr = 0x50020 // runtime.waitReasonStrings, [2]string
+
+	// offsets of the fields of runtime.g
+	fakeGSchedSP      = 0x00
+	fakeGSchedPC      = 0x08
+	fakeGGoid         = 0x10
+	fakeGGopc         = 0x18
+	fakeGAtomicstatus = 0x20
+	fakeGM            = 0x28
+	fakeGWaitreason   = 0x30 // uint8, or string if stringWaitReason is set
+	fakeGSize         = 0x40
+)
+
+// loadFakeRuntime loads into bi the debug info of a minimal Go runtime:
+// the functions main.main, runtime.newproc and runtime.startpanic, the
+// type runtime.g (whose m is always nil) and the variables runtime.allgs, runtime.allglen and
+// runtime.waitReasonStrings. If stringWaitReason is set g.waitreason is a
+// string, like before Go 1.11.
+func loadFakeRuntime(t *testing.T, bi *proc.BinaryInfo, stringWaitReason bool) {
+	addr := func(a uint64) []byte {
+		loc := []byte{byte(op.DW_OP_addr), 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(loc[1:], a)
+		return loc
+	}
+	member := func(off uint) []byte {
+		return dwarfbuilder.LocationBlock(op.DW_OP_plus_uconst, off)
+	}
+
+	dwb := dwarfbuilder.New()
+	uint8off := dwb.AddBaseType("uint8", dwarfbuilder.DW_ATE_unsigned, 1)
+	uint32off := dwb.AddBaseType("uint32", dwarfbuilder.DW_ATE_unsigned, 4)
+	uint64off := dwb.AddBaseType("uint64", dwarfbuilder.DW_ATE_unsigned, 8)
+	int64off := dwb.AddBaseType("int64", dwarfbuilder.DW_ATE_signed, 8)
+	uintptroff := dwb.AddBaseType("uintptr", dwarfbuilder.DW_ATE_unsigned, 8)
+
+	byteptroff := dwb.TagOpen(dwarf.TagPointerType, "*uint8")
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.Ptr))
+	dwb.Attr(dwarf.AttrType, uint8off)
+	dwb.TagClose()
+
+	stringoff := dwb.AddStructType("string", 16)
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.String))
+	dwb.AddMember("str", byteptroff, member(0))
+	dwb.AddMember("len", int64off, member(8))
+	dwb.TagClose()
+
+	gobufoff := dwb.AddStructType("runtime.gobuf", 16)
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.Struct))
+	dwb.AddMember("sp", uintptroff, member(fakeGSchedSP))
+	dwb.AddMember("pc", uintptroff, member(fakeGSchedPC))
+	dwb.TagClose()
+
+	moff := dwb.AddStructType("runtime.m", 8)
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.Struct))
+	dwb.AddMember("procid", uint64off, member(0))
+	dwb.TagClose()
+
+	mptroff := dwb.TagOpen(dwarf.TagPointerType, "*runtime.m")
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.Ptr))
+	dwb.Attr(dwarf.AttrType, moff)
+	dwb.TagClose()
+
+	goff := dwb.AddStructType("runtime.g", fakeGSize)
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.Struct))
+	dwb.AddMember("sched", gobufoff, member(0))
+	dwb.AddMember("goid", int64off, member(fakeGGoid))
+	dwb.AddMember("gopc", uintptroff, member(fakeGGopc))
+	dwb.AddMember("atomicstatus", uint32off, member(fakeGAtomicstatus))
+	dwb.AddMember("m", mptroff, member(fakeGM))
+	if stringWaitReason {
+		dwb.AddMember("waitreason", stringoff, member(fakeGWaitreason))
+	} else {
+		dwb.AddMember("waitreason", uint8off, member(fakeGWaitreason))
+	}
+	dwb.TagClose()
+
+	gptroff := dwb.TagOpen(dwarf.TagPointerType, "*runtime.g")
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.Ptr))
+	dwb.Attr(dwarf.AttrType, goff)
+	dwb.TagClose()
+
+	gptrptroff := dwb.TagOpen(dwarf.TagPointerType, "**runtime.g")
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.Ptr))
+	dwb.Attr(dwarf.AttrType, gptroff)
+	dwb.TagClose()
+
+	allgsoff := dwb.AddStructType("[]*runtime.g", 24)
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.Slice))
+	dwb.Attr(godwarf.AttrGoElem, gptroff)
+	dwb.AddMember("array", gptrptroff, member(0))
+	dwb.AddMember("len", int64off, member(8))
+	dwb.AddMember("cap", int64off, member(16))
+	dwb.TagClose()
+
+	reasonsoff := dwb.TagOpen(dwarf.TagArrayType, "[2]string")
+	dwb.Attr(godwarf.AttrGoKind, uint8(reflect.Array))
+	dwb.Attr(dwarf.AttrByteSize, uint8(32))
+	dwb.Attr(dwarf.AttrType, stringoff)
+	dwb.TagOpen(dwarf.TagSubrangeType, "")
+	dwb.Attr(dwarf.AttrCount, uint8(2))
+	dwb.TagClose()
+	dwb.TagClose()
+
+	dwb.AddSubprogram("main.main", fakeMainAddr, fakeNewprocAddr)
+	dwb.TagClose()
+	dwb.AddSubprogram("runtime.newproc", fakeNewprocAddr, fakePanicAddr)
+	dwb.TagClose()
+	dwb.AddSubprogram("runtime.startpanic", fakePanicAddr, fakeTextEnd)
+	dwb.TagClose()
+
+	dwb.AddVariable("runtime.allgs", allgsoff, addr(fakeAllgsAddr))
+	dwb.AddVariable("runtime.allglen", uint64off, addr(fakeAllglenAddr))
+	dwb.AddVariable("runtime.waitReasonStrings", reasonsoff, addr(fakeWaitReasonsAddr))
+
+	abbrev, aranges, frame, info, _, pubnames, ranges, str, loc, err := dwb.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := fakeLineTable()
+	dwdata, err := dwarf.New(abbrev, aranges, frame, info, line, pubnames, ranges, str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi.LoadFromData(dwdata, frame, line, loc)
+}
+
+// fakeMainFile is the source file of main.main in the line table returned
+// by fakeLineTable.
+const fakeMainFile = "/tmp/main.go"
+
+// fakeLineTable returns a debug_line section for main.main, its body is a
+// loop whose header, line 10, starts at two addresses:
+//  0x40100 line 9
+//  0x40110 line 10
+//  0x40120 line 11
+//  0x40130 line 10
+//  0x40140 line 12
+func fakeLineTable() []byte {
+	const (
+		lineBase   = -5
+		lineRange  = 14
+		opcodeBase = 10
+	)
+	var hdr bytes.Buffer
+	// min_inst_length, default_is_stmt, line_base, line_range, opcode_base
+	hdr.Write([]byte{1, 1, byte(lineBase & 0xff), lineRange, opcodeBase})
+	// standard_opcode_lengths
+	hdr.Write([]byte{0, 1, 1, 1, 1, 0, 0, 0, 1})
+	// no include directories, a single file
+	hdr.WriteByte(0)
+	hdr.WriteString(fakeMainFile + "\x00")
+	hdr.Write([]byte{0, 0, 0, 0})
+
+	var prog bytes.Buffer
+	prog.Write([]byte{0, 9, 2}) // DW_LNE_set_address
+	binary.Write(&prog, binary.LittleEndian, uint64(fakeMainAddr))
+	prog.Write([]byte{3, 8, 1}) // DW_LNS_advance_line to line 9, DW_LNS_copy
+	for _, delta := range []int{1, 1, -1, 2} {
+		// special opcode advancing the address by 0x10 and the line by delta
+		prog.WriteByte(byte(delta - lineBase + lineRange*0x10 + opcodeBase))
+	}
+	prog.Write([]byte{2, 0xc0, 1}) // DW_LNS_advance_pc to the end of main.main
+	prog.Write([]byte{0, 1, 1})    // DW_LNE_end_sequence
+
+	var line bytes.Buffer
+	binary.Write(&line, binary.LittleEndian, uint32(2+4+hdr.Len()+prog.Len()))
+	binary.Write(&line, binary.LittleEndian, uint16(2))
+	binary.Write(&line, binary.LittleEndian, uint32(hdr.Len()))
+	line.Write(hdr.Bytes())
+	line.Write(prog.Bytes())
+	return line.Bytes()
+}
+
+// newFakeRuntimeTestProcess returns a process, like
+// newSingleThreadTestProcess, running the runtime described by
+// loadFakeRuntime. The registers of the thread are rip, rsp, rbp and
+// fs_base, in this order (see fakeRuntimeRegs), and are read immediately.
+func newFakeRuntimeTestProcess(t *testing.T, conn net.Conn, stringWaitReason bool) *Process {
+	p := newSingleThreadTestProcess(conn)
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameSP, Bitsize: 64, Offset: 8, Regnum: 1},
+		{Name: regnameBP, Bitsize: 64, Offset: 16, Regnum: 2},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 24, Regnum: 3},
+	}
+	p.bi = proc.NewBinaryInfo("linux", "amd64")
+	loadFakeRuntime(t, &p.bi, stringWaitReason)
+	p.threadStopInfo = false
+	if err := p.threads[1].reloadRegisters(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// fakeRuntimeRegs returns the reply to a 'g' packet for the registers of
+// a thread of newFakeRuntimeTestProcess.
+func fakeRuntimeRegs(pc, sp, fsbase uint64) string {
+	var regs [32]byte
+	binary.LittleEndian.PutUint64(regs[:], pc)
+	binary.LittleEndian.PutUint64(regs[8:], sp)
+	binary.LittleEndian.PutUint64(regs[24:], fsbase)
+	return hex.EncodeToString(regs[:])
+}
+
+// fakeG returns the contents of a runtime.g, as described by
+// loadFakeRuntime, with a numeric wait reason.
+func fakeG(goid int64, status uint64, waitreason uint8) []byte {
+	g := make([]byte, fakeGSize)
+	binary.LittleEndian.PutUint64(g[fakeGSchedPC:], fakeMainAddr)
+	binary.LittleEndian.PutUint64(g[fakeGGoid:], uint64(goid))
+	binary.LittleEndian.PutUint32(g[fakeGAtomicstatus:], uint32(status))
+	g[fakeGWaitreason] = waitreason
+	return g
+}
+
+// fakeAllgs returns the contents of runtime.allgs and runtime.allglen for
+// the Gs at gaddrs, the array of the slice is stored at arrayAddr.
+func fakeAllgs(arrayAddr uint64, gaddrs []uint64) (header, array []byte) {
+	header = make([]byte, 32)
+	binary.LittleEndian.PutUint64(header, arrayAddr)
+	binary.LittleEndian.PutUint64(header[8:], uint64(len(gaddrs)))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(gaddrs)))
+	binary.LittleEndian.PutUint64(header[24:], uint64(len(gaddrs))) // allglen
+	array = make([]byte, 8*len(gaddrs))
+	for i, gaddr := range gaddrs {
+		binary.LittleEndian.PutUint64(array[8*i:], gaddr)
+	}
+	return header, array
+}
+
+// fileStub serves vFile requests for the file at path.
+func fileStub(t *testing.T, conn net.Conn, path string) {
+	defer conn.Close()
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reply := func(resp []byte) {
+		var out []byte
+		out = append(out, '$')
+		for _, ch := range resp {
+			switch ch {
+			case '#', '$', '}', '*':
+				out = append(out, '}', ch^escapeXor)
+			default:
+				out = append(out, ch)
+			}
+		}
+		out = append(out, '#')
+		sum := checksum(out)
+		out = append(out, hexdigit[sum>>4], hexdigit[sum&0xf])
+		conn.Write(out)
+	}
+	rdr := bufio.NewReader(conn)
+	for {
+		req, err := rdr.ReadBytes('#')
+		if err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2)) // checksum
+		req = req[1 : len(req)-1]
+		switch {
+		case bytes.HasPrefix(req, []byte("vFile:open:")):
+			if args := strings.Split(string(req[len("vFile:open:"):]), ","); args[0] != hex.EncodeToString([]byte(path)) {
+				reply([]byte("F-1,2"))
+			} else {
+				reply([]byte("F5"))
+			}
+		case bytes.HasPrefix(req, []byte("vFile:pread:")):
+			var fd, sz, off int
+			fmt.Sscanf(string(req), "vFile:pread:%x,%x,%x", &fd, &sz, &off)
+			if off > len(buf) {
+				off = len(buf)
+			}
+			if off+sz > len(buf) {
+				sz = len(buf) - off
+			}
+			reply(append([]byte(fmt.Sprintf("F%x;", sz)), buf[off:off+sz]...))
+		case bytes.HasPrefix(req, []byte("vFile:close:")):
+			reply([]byte("F0"))
+		default:
+			reply(nil)
+		}
+	}
+}
+
+func TestRemoteGoInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fixture isn't an ELF file")
+	}
+	exe := protest.BuildFixture("increment", 0).Path
+
+	client, server := net.Pipe()
+	go fileStub(t, server, exe)
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	p.conn.packetSize = 1 << 16
+	p.execPath = exe
+
+	ver, ok := p.goVersion()
+	if !ok || p.bi.GoVersion != runtime.Version() {
+		t.Errorf("wrong Go version %q (%v), expected %q", p.bi.GoVersion, ok, runtime.Version())
+	}
+	if p.bi.BuildID == "" {
+		t.Errorf("build ID not found")
+	}
+	if want, _ := goversion.Parse(runtime.Version()); ver != want {
+		t.Errorf("wrong parsed Go version %v, expected %v", ver, want)
+	}
+
+	p.execPath = "/does/not/exist"
+	p.bi.GoVersion = ""
+	if _, ok := p.goVersion(); ok {
+		t.Errorf("Go version found for a missing file")
+	}
+}
+
+func TestEnableDisableBreakpoint(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "OK", "OK", "OK", "OK"})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.bi.Arch = proc.AMD64Arch("linux")
+
+	bp := &proc.Breakpoint{Addr: 0x1000, ID: 1, Kind: proc.UserBreakpoint, HitCount: map[int]uint64{1: 3}, TotalHitCount: 3}
+	p.breakpoints.M[bp.Addr] = bp
+
+	if _, err := p.DisableBreakpoint(0x1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := p.FindBreakpoint(0x1001); found {
+		t.Errorf("disabled breakpoint found")
+	}
+	if _, err := p.EnableBreakpoint(0x1000); err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := p.FindBreakpoint(0x1001); !ok || found != bp || bp.TotalHitCount != 3 || bp.HitCount[1] != 3 {
+		t.Errorf("breakpoint not restored: %v", found)
+	}
+
+	// an internal breakpoint overlapping a disabled breakpoint is installed
+	// until it is cleared
+	if _, err := p.DisableBreakpoint(0x1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.SetBreakpoint(0x1000, proc.NextBreakpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ClearInternalBreakpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if p.breakpoints.M[0x1000] != bp || !bp.Disabled {
+		t.Errorf("disabled breakpoint lost")
+	}
+
+	if _, err := p.DisableBreakpoint(0x2000); err == nil {
+		t.Errorf("no error disabling a missing breakpoint")
+	}
+
+	var packets []string
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+			packets = append(packets, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+		}
+	}
+	expected := []string{"$z0,1000,1", "$Z0,1000,1", "$z0,1000,1", "$Z0,1000,1", "$z0,1000,1"}
+	if strings.Join(packets, " ") != strings.Join(expected, " ") {
+		t.Errorf("wrong packets %q, expected %q", packets, expected)
+	}
+}
+
+func TestSetThreadBreakpoint(t *testing.T) {
+	newProcess := func(resps []string) (*Process, *bytes.Buffer) {
+		p, log := newFakeStubProcess(resps)
+		p.bi = proc.NewBinaryInfo("linux", "amd64")
+		loadFakeRuntime(t, &p.bi, false)
+		for _, tid := range []int{1, 2} {
+			p.threads[tid] = &Thread{ID: tid, strID: fmt.Sprintf("%x", tid), p: p}
+		}
+		return p, log
+	}
+	sentPackets := func(log *bytes.Buffer) string {
+		var packets []string
+		for _, line := range strings.Split(log.String(), "\n") {
+			if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+				packets = append(packets, strings.SplitN(line[len(replaySendPrefix)+2:], "#", 2)[0])
+			}
+		}
+		return strings.Join(packets, " ")
+	}
+
+	// the restriction is sent to the stub, an internal breakpoint
+	// overlapping the thread breakpoint is set for all threads
+	p, log := newProcess([]string{"OK", "OK", "OK"})
+	bp, err := p.SetThreadBreakpoint(fakeMainAddr, 2, proc.UserBreakpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp.ThreadID != 2 || bp.FunctionName != "main.main" {
+		t.Errorf("wrong breakpoint %#v", bp)
+	}
+	if _, err := p.SetThreadBreakpoint(fakeNewprocAddr, 2, proc.NextBreakpoint, nil); err == nil {
+		t.Errorf("internal breakpoint restricted to a thread")
+	}
+	if _, err := p.SetThreadBreakpoint(fakeNewprocAddr, 3, proc.UserBreakpoint, nil); err == nil {
+		t.Errorf("breakpoint restricted to a missing thread")
+	}
+	if bp.CheckCondition(p.threads[1]).Active || !bp.CheckCondition(p.threads[2]).Active {
+		t.Errorf("wrong threads for the thread breakpoint")
+	}
+	if _, err := p.SetBreakpoint(fakeMainAddr, proc.NextBreakpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	if packets := sentPackets(log); packets != "Z0,40100,1;thread:2 z0,40100,1 Z0,40100,1" {
+		t.Errorf("wrong packets %q", packets)
+	}
+
+	// stubs that reject the suffix get a plain Z packet
+	p, log = newProcess([]string{"", "OK", "OK"})
+	for _, addr := range []uint64{fakeMainAddr, fakeNewprocAddr} {
+		if _, err := p.SetThreadBreakpoint(addr, 1, proc.UserBreakpoint, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if packets := sentPackets(log); packets != "Z0,40100,1;thread:1 Z0,40100,1 Z0,40200,1" {
+		t.Errorf("wrong packets %q", packets)
+	}
+}
+
+func TestStepOverRep(t *testing.T) {
+	for _, tc := range []struct {
+		code []byte
+		rep  bool
+	}{
+		{[]byte{0xf3, 0xa4}, true},       // rep movsb
+		{[]byte{0xf3, 0x48, 0xab}, true}, // rep stosq
+		{[]byte{0xf2, 0xae}, true},       // repne scasb
+		{[]byte{0xa4}, false},            // movsb
+		{[]byte{0xf3, 0xc3}, false},      // rep ret
+		{[]byte{0xf3, 0x90}, false},      // pause
+	} {
+		inst, err := x86asm.Decode(tc.code, 64)
+		if err != nil {
+			t.Fatalf("%x: %v", tc.code, err)
+		}
+		if isRepStringInst(inst) != tc.rep {
+			t.Errorf("%x (%v): expected %v", tc.code, inst, tc.rep)
+		}
+	}
+
+	code := append([]byte{0xf3, 0xa4}, make([]byte, 13)...)
+	pcregs := "0010000000000000" + strings.Repeat("00", 8)
+	afterregs := "0210000000000000" + strings.Repeat("00", 8)
+	client, server := net.Pipe()
+	go fakeStub(server, []string{pcregs, hex.EncodeToString(code), "OK", "T05thread:1;", "OK", afterregs})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.GOOS = "linux"
+	th := &Thread{ID: 1, strID: "1", p: p}
+	p.threads[1] = th
+	p.currentThread = th
+	if err := th.reloadRegisters(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := th.StepInstruction(); err != nil {
+		t.Fatal(err)
+	}
+	if pc := th.regs.PC(); pc != 0x1002 {
+		t.Errorf("wrong PC after step %#x", pc)
+	}
+	sent := log.String()
+	set, resume, clear := strings.Index(sent, "$Z0,1002,1#"), strings.Index(sent, "$vCont;c:1#"), strings.Index(sent, "$z0,1002,1#")
+	if set < 0 || resume < set || clear < resume {
+		t.Errorf("wrong packet sequence:\n%s", sent)
+	}
+}
+
+func TestSearchMemory(t *testing.T) {
+	mem := []byte("0123456xyz789abcdefghijk")
+	chunk := func(off int) string { return hex.EncodeToString(mem[off : off+8]) }
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"1,1020",                    // stub side search
+		"", hex.EncodeToString(mem), // qSearch:memory unsupported
+		chunk(0), chunk(8), // match across the chunk boundary
+		chunk(0), chunk(8), chunk(16), // no match
+	})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.packetSize = 100
+
+	addr, found, err := p.SearchMemory(0x1000, 0x100, []byte("a#b"))
+	if err != nil || !found || addr != 0x1020 {
+		t.Fatalf("stub search: %#x %v %v", addr, found, err)
+	}
+	if !strings.Contains(log.String(), `$qSearch:memory:1000;100;a}\x03b#`) {
+		t.Errorf("wrong qSearch packet:\n%s", log.String())
+	}
+
+	addr, found, err = p.SearchMemory(0x1000, uint64(len(mem)), []byte("xyz"))
+	if err != nil || !found || addr != 0x1007 {
+		t.Fatalf("client side search: %#x %v %v", addr, found, err)
+	}
+	if !p.conn.searchMemoryUnsupported {
+		t.Errorf("qSearch:memory not marked unsupported")
+	}
+
+	p.conn.packetSize = 20 // chunks of 8 bytes
+	addr, found, err = p.SearchMemory(0x1000, uint64(len(mem)), []byte("xyz"))
+	if err != nil || !found || addr != 0x1007 {
+		t.Fatalf("search across chunks: %#x %v %v", addr, found, err)
+	}
+	if _, found, err := p.SearchMemory(0x1000, uint64(len(mem)), []byte("zz")); err != nil || found {
+		t.Errorf("unexpected match %v %v", found, err)
+	}
+}
+
+func TestRunToFunctionErrors(t *testing.T) {
+	p := New(nil)
+	if err := p.RunToFunction("main.doesnotexist"); err == nil {
+		t.Errorf("no error for missing function")
+	}
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000, Kind: proc.NextBreakpoint}
+	if err := p.RunToFunction("main.main"); err == nil || err.Error() != "next while nexting" {
+		t.Errorf("wrong error while nexting: %v", err)
+	}
+	p.exited = true
+	if _, isexited := p.RunToMain().(*proc.ProcessExitedError); !isexited {
+		t.Errorf("expected ProcessExitedError")
+	}
+}
+
+func TestLibraryUnloadBreakpoints(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"T05thread:1;threads:1;library:;",
+		`l<library-list-svr4 version="1.0" main-lm="0x7f0000001000">` +
+			`<library name="linux-vdso.so.1" lm="0x7f0000002000" l_addr="0x7ffd00000000" l_ld="0x7ffd00000300"/>` +
+			`</library-list-svr4>`,
+		"OK",
+		"T05thread:1;threads:1;",
+		strings.Repeat("00", 16),
+	})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.GOOS = "linux"
+	p.threadStopInfo = false
+	p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+	p.currentThread = p.threads[1]
+
+	libfoo := SharedLibrary{Name: "/nonexistent/libfoo.so", LoadAddr: 0x7f1000000000, TextStart: 0x7f1000001000, TextEnd: 0x7f1000002000}
+	p.libraries = []SharedLibrary{{}, libfoo}
+	for _, addr := range []uint64{0x401000, 0x7f1000001500} {
+		p.breakpoints.M[addr] = &proc.Breakpoint{Addr: addr, Kind: proc.UserBreakpoint}
+		p.trackBreakpointLibrary(addr)
+	}
+	if lib := p.breakpointLibs[0x7f1000001500]; lib != libfoo {
+		t.Errorf("breakpoint library not tracked: %v", p.breakpointLibs)
+	}
+
+	if _, err := p.ContinueOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.breakpoints.M[0x7f1000001500]; ok {
+		t.Errorf("breakpoint in unloaded library not removed")
+	}
+	if _, ok := p.breakpoints.M[0x401000]; !ok {
+		t.Errorf("breakpoint in executable removed")
+	}
+	if n := strings.Count(log.String(), "$z0,"); n != 1 || !strings.Contains(log.String(), "$z0,7f1000001500,1#") {
+		t.Errorf("breakpoint in unloaded library not removed from the stub:\n%s", log.String())
+	}
+	if n := strings.Count(log.String(), "$vCont;c#"); n != 2 {
+		t.Errorf("library event not resumed transparently:\n%s", log.String())
+	}
+
+	// a breakpoint that the stub can not remove is kept and the error is
+	// returned
+	p, _ = newFakeStubProcess([]string{
+		"T05thread:1;threads:1;library:;",
+		`l<library-list-svr4 version="1.0" main-lm="0x7f0000001000"></library-list-svr4>`,
+		"E01",
+	})
+	p.threadStopInfo = false
+	p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+	p.currentThread = p.threads[1]
+	p.libraries = []SharedLibrary{{}, libfoo}
+	p.breakpoints.M[0x7f1000001500] = &proc.Breakpoint{Addr: 0x7f1000001500, Kind: proc.UserBreakpoint}
+	p.trackBreakpointLibrary(0x7f1000001500)
+	if _, err := p.ContinueOnce(); err == nil || !strings.Contains(err.Error(), "0x7f1000001500") {
+		t.Errorf("wrong error %v", err)
+	}
+	if _, ok := p.breakpoints.M[0x7f1000001500]; !ok {
+		t.Errorf("breakpoint still in the stub forgotten")
+	}
+	if _, ok := p.breakpointLibs[0x7f1000001500]; !ok {
+		t.Errorf("breakpoint library forgotten")
+	}
+}
+
+func TestLibrariesLoadedAtConnect(t *testing.T) {
+	// any ELF file with a text section will do as the shared library
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	start, end := textRange(exe)
+	if end == 0 {
+		t.Skip("test executable has no text section")
+	}
+	const laddr = 0x7f1000000000
+
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		`l<library-list-svr4 version="1.0" main-lm="0x7f0000001000">` +
+			fmt.Sprintf(`<library name="%s" lm="0x7f0000002000" l_addr="%#x" l_ld="0x7f0000000300"/>`, exe, laddr) +
+			`</library-list-svr4>`,
+	})
+	p := newSingleThreadTestProcess(client)
+
+	// the libraries are read when connecting, before any library event
+	p.loadLibraries()
+	if len(p.libraries) != 2 || p.libraries[1].Name != exe {
+		t.Fatalf("wrong libraries %v", p.libraries)
+	}
+	addr := start + laddr + (end-start)/2
+	p.breakpoints.M[addr] = &proc.Breakpoint{Addr: addr, Kind: proc.UserBreakpoint}
+	p.trackBreakpointLibrary(addr)
+	if lib, ok := p.breakpointLibs[addr]; !ok || lib.TextStart != start+laddr || lib.TextEnd != end+laddr {
+		t.Errorf("breakpoint library not tracked: %v", p.breakpointLibs)
+	}
+}
+
+func TestLocationNoDebugInfo(t *testing.T) {
+	for _, tc := range []struct {
+		resps []string
+		desc  string
+	}{
+		{[]string{"", "", "start:0;size:400000;"}, "PC 0x1000 not in any mapped region"},
+		{[]string{"", "", "start:1000;size:1000;permissions:rx;"}, "PC 0x1000 in anonymous rx mapping 0x1000-0x2000 (no debug info)"},
+		{[]string{"", "", ""}, "PC 0x1000 (no debug info)"},
+	} {
+		client, server := net.Pipe()
+		go fakeStub(server, tc.resps)
+		p := New(nil)
+		p.conn = *newTestConn(client)
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, 0x1000)
+		th := &Thread{ID: 1, strID: "1", p: p}
+		th.regsLoaded = true
+		th.regs = gdbRegisters{regs: map[string]gdbRegister{regnamePC: {value: buf}}, buf: buf, byteOrder: binary.LittleEndian}
+		loc, err := th.Location()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.PC != 0x1000 || loc.Desc != tc.desc {
+			t.Errorf("wrong location %#x %q, expected %q", loc.PC, loc.Desc, tc.desc)
+		}
+		client.Close()
+	}
+}
+
+func TestLocationNoDebugInfoCache(t *testing.T) {
+	client, server := net.Pipe()
+	region := "start:1000;size:1000;permissions:rx;"
+	go fakeStub(server, []string{"", "", region, region, "", "", region})
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, 0x1000)
+	th := &Thread{ID: 1, strID: "1", p: p}
+	th.regsLoaded = true
+	th.regs = gdbRegisters{regs: map[string]gdbRegister{regnamePC: {value: buf}}, buf: buf, byteOrder: binary.LittleEndian}
+
+	libraryQueries := func() int {
+		return strings.Count(log.String(), replaySendPrefix+`"$qXfer:libraries-svr4:read`)
+	}
+	for i, expected := range []int{1, 1, 2} {
+		if i == 2 {
+			p.conn.stopGen++
+		}
+		loc, err := th.Location()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.Desc != "PC 0x1000 in anonymous rx mapping 0x1000-0x2000 (no debug info)" {
+			t.Errorf("%d: wrong description %q", i, loc.Desc)
+		}
+		if n := libraryQueries(); n != expected {
+			t.Errorf("%d: shared libraries read %d times, expected %d", i, n, expected)
+		}
+	}
+	client.Close()
+}
+
+func TestStepOverBreakpointAndContinue(t *testing.T) {
+	client, server := net.Pipe()
+	regs := "0010000000000000" + strings.Repeat("00", 8)
+	go fakeStub(server, []string{"OK", "T05thread:1;", "OK", regs, "OK", "T05thread:2;", "OK", "W00"})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.Arch = proc.AMD64Arch("linux")
+	p.bi.GOOS = "linux"
+	p.threadStopInfo = false
+
+	bp := &proc.Breakpoint{Addr: 0x1000, ID: 1, Kind: proc.UserBreakpoint, HitCount: map[int]uint64{}}
+	p.breakpoints.M[bp.Addr] = bp
+	for _, id := range []int{1, 2} {
+		th := &Thread{ID: id, strID: fmt.Sprintf("%d", id), p: p}
+		buf := make([]byte, 16)
+		binary.LittleEndian.PutUint64(buf, 0x1000)
+		th.regsLoaded = true
+		th.regs = gdbRegisters{regs: map[string]gdbRegister{regnamePC: {value: buf[:8]}}, buf: buf, byteOrder: binary.LittleEndian}
+		th.CurrentBreakpoint.Breakpoint = bp
+		p.threads[id] = th
+	}
+	p.currentThread = p.threads[1]
+
+	err := p.StepOverBreakpointAndContinue()
+	if _, exited := err.(proc.ProcessExitedError); !exited {
+		t.Fatalf("expected exit, got %v", err)
+	}
+
+	var steps []string
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$vCont;s`) {
+			steps = append(steps, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+		}
+	}
+	if len(steps) != 2 || steps[0] != "$vCont;s:1" || steps[1] != "$vCont;s:2" {
+		t.Errorf("wrong steps %q\n%s", steps, log.String())
+	}
+}
+
+func TestDebugRegisters(t *testing.T) {
+	client, server := net.Pipe()
+	// dr7 is read twice, the stub changed it in between
+	go fakeStub(server, []string{"0004000000000000", "0104000000000000", "OK", "00100000c0000000"})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.gcmdok = true
+	th := &Thread{ID: 1, strID: "1", p: p}
+	buf := make([]byte, 16)
+	th.regsLoaded = true
+	th.regs = gdbRegisters{regs: map[string]gdbRegister{
+		"dr0": {regnum: 0x40, value: buf[:8]},
+		"dr7": {regnum: 0x47, value: buf[8:]},
+	}, buf: buf}
+
+	if v, err := th.DebugReg(7); err != nil || v != 0x400 {
+		t.Errorf("wrong dr7 %#x %v", v, err)
+	}
+	if v, err := th.DebugReg(7); err != nil || v != 0x401 {
+		t.Errorf("wrong dr7 on second read %#x %v", v, err)
+	}
+	if _, err := th.DebugReg(3); err == nil {
+		t.Errorf("no error for missing debug register")
+	}
+	if _, err := th.DebugReg(8); err == nil {
+		t.Errorf("no error for invalid debug register")
+	}
+	if err := th.SetDebugReg(0, 0xc000001000); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := th.DebugReg(0); v != 0xc000001000 {
+		t.Errorf("wrong dr0 after set %#x", v)
+	}
+	sent := log.String()
+	if !strings.Contains(sent, replaySendPrefix+`"$P40=00100000c0000000;thread:1;`) {
+		t.Errorf("dr0 not written:\n%s", sent)
+	}
+	if n := strings.Count(sent, replaySendPrefix+`"$p47;thread:1;`); n != 2 {
+		t.Errorf("dr7 read %d times with 'p', expected 2:\n%s", n, sent)
+	}
+}
+
+func TestClearAllBreakpoints(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"E01", "E01"})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.bi.Arch = proc.AMD64Arch("linux")
+
+	for _, bp := range []*proc.Breakpoint{
+		{Addr: 0x1000, ID: 1, Kind: proc.UserBreakpoint},
+		{Addr: 0x2000, ID: 2, Kind: proc.UserBreakpoint},
+		{Addr: 0x3000, ID: 3, Kind: proc.UserBreakpoint, Disabled: true},
+		{Addr: 0x4000, Kind: proc.NextBreakpoint},
+		{Addr: 0x5000, ID: 4, Kind: proc.UserBreakpoint | proc.StepBreakpoint},
+	} {
+		p.breakpoints.M[bp.Addr] = bp
+	}
+
+	err := p.ClearAllBreakpoints()
+	if err == nil || !strings.Contains(err.Error(), "could not clear 2 breakpoints") {
+		t.Errorf("wrong error %v", err)
+	}
+	if len(p.breakpoints.M) != 2 || p.breakpoints.M[0x4000] == nil || p.breakpoints.M[0x5000] == nil {
+		t.Errorf("wrong breakpoints left %v", p.breakpoints.M)
+	}
+	if p.breakpoints.M[0x5000].IsUser() {
+		t.Errorf("user breakpoint overlapping an internal breakpoint not cleared")
+	}
+	if n := strings.Count(log.String(), replaySendPrefix+`"$z0,`); n != 2 {
+		t.Errorf("%d breakpoints removed from the stub, expected 2:\n%s", n, log.String())
+	}
+
+	p.exited = true
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000, ID: 1, Kind: proc.UserBreakpoint}
+	if err := p.ClearAllBreakpoints(); err != nil {
+		t.Errorf("error after exit: %v", err)
+	}
+}
+
+func TestPreemptedAtBreakpoint(t *testing.T) {
+	for _, tc := range []struct {
+		kind StubKind
+		sig  string // SIGURG as numbered by the stub
+	}{
+		{LldbServerStub, "17"},
+		{GdbserverStub, "10"},
+		{RRStub, "10"},
+	} {
+		t.Run(tc.kind.String(), func(t *testing.T) {
+			testPreemptedAtBreakpoint(t, tc.kind, tc.sig)
+		})
+	}
+}
+
+func testPreemptedAtBreakpoint(t *testing.T, kind StubKind, sig string) {
+	newProcess := func(resps []string) (*Process, *bytes.Buffer) {
+		client, server := net.Pipe()
+		go fakeStub(server, resps)
+		var log bytes.Buffer
+		p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+		p.conn.stubInfo.Kind = kind
+		p.bi.Arch = proc.AMD64Arch("linux")
+		p.threadStopInfo = false
+		p.threads[1].reloadRegisters()
+		p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000, ID: 1, Kind: proc.UserBreakpoint, HitCount: map[int]uint64{}}
+		return p, &log
+	}
+	pad := strings.Repeat("00", 8)
+
+	// preempted right before executing the breakpoint: the breakpoint is hit
+	// and the signal is not delivered.
+	p, _ := newProcess([]string{pad + pad, "T" + sig + "thread:1;threads:1;", "0010000000000000" + pad, "0010000000000000" + pad})
+	th, err := p.ContinueOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, _ := th.(*Thread).StopReason(); kind != StopBreakpoint || th.(*Thread).CurrentBreakpoint.Breakpoint == nil {
+		t.Errorf("breakpoint not hit, stop reason %v", kind)
+	}
+	if pc := th.(*Thread).regs.PC(); pc != 0x1000 {
+		t.Errorf("wrong PC %#x", pc)
+	}
+
+	// preempted right after the instruction at the breakpoint address was
+	// stepped over: the PC must not be moved back.
+	p, log := newProcess([]string{pad + pad, "T" + sig + "thread:1;threads:1;", "0110000000000000" + pad, "0110000000000000" + pad})
+	p.SetSignalPolicy(func(sig uint8) SignalAction { return SignalStop })
+	th, err = p.ContinueOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind, stopSig := th.(*Thread).StopReason(); kind != StopSignal || fmt.Sprintf("%02x", stopSig) != sig {
+		t.Errorf("wrong stop reason %v %#x", kind, stopSig)
+	}
+	if pc := th.(*Thread).regs.PC(); pc != 0x1001 {
+		t.Errorf("PC moved to %#x", pc)
+	}
+	if strings.Contains(log.String(), replaySendPrefix+`"$G`) || strings.Contains(log.String(), replaySendPrefix+`"$P`) {
+		t.Errorf("registers written:\n%s", log.String())
+	}
+}
+
+func TestPreemptSignal(t *testing.T) {
+	for _, tc := range []struct {
+		goos       string
+		gdbSignals bool
+		sig        uint8
+	}{
+		{"linux", false, 0x17},
+		{"darwin", false, 0x10},
+		{"linux", true, 0x10},
+		{"darwin", true, 0x10},
+	} {
+		if sig := preemptSignal(tc.goos, tc.gdbSignals); sig != tc.sig {
+			t.Errorf("preemptSignal(%q, %v) = %#x, expected %#x", tc.goos, tc.gdbSignals, sig, tc.sig)
+		}
+	}
+
+	// SIGIO, in gdb's numbers, is not a preemption
+	p := newSingleThreadTestProcess(nil)
+	th := p.threads[1]
+	p.conn.stubInfo.Kind = GdbserverStub
+	if th.setStopInfo(stopPacket{sig: 0x17}); th.preempted {
+		t.Errorf("SIGIO taken for preemption by gdbserver")
+	}
+	if th.setStopInfo(stopPacket{sig: 0x10}); !th.preempted {
+		t.Errorf("SIGURG not taken for preemption by gdbserver")
+	}
+	p.conn.stubInfo.Kind = LldbServerStub
+	if th.setStopInfo(stopPacket{sig: 0x17}); !th.preempted {
+		t.Errorf("SIGURG not taken for preemption by lldb-server")
+	}
+}
+
+func TestQueryTarget(t *testing.T) {
+	hexTriple := func(triple string) string { return hex.EncodeToString([]byte(triple)) }
+	for _, tc := range []struct {
+		resps        []string
+		goos, goarch string
+		unsupported  bool
+	}{
+		{[]string{"triple:" + hexTriple("aarch64-unknown-linux-gnu") + ";ostype:linux;endian:little;"}, "linux", "arm64", true},
+		{[]string{"", "pid:1;triple:" + hexTriple("x86_64-apple-macosx") + ";"}, "darwin", "amd64", false},
+		{[]string{"", ""}, "", "", true},
+		{[]string{"ostype:freebsd;triple:" + hexTriple("x86_64-unknown-freebsd") + ";"}, "freebsd", "amd64", true},
+	} {
+		// replies to qHostInfo and qProcessInfo
+		client, server := net.Pipe()
+		go fakeStub(server, append(tc.resps, "", ""))
+		conn := newTestConn(client)
+		conn.hostInfo = conn.queryInfo("$qHostInfo")
+		conn.processInfo = conn.queryInfo("$qProcessInfo")
+		client.Close()
+		goos, goarch := conn.queryTarget()
+		if goos != tc.goos || goarch != tc.goarch {
+			t.Errorf("%q: got %s/%s expected %s/%s", tc.resps, goos, goarch, tc.goos, tc.goarch)
+		}
+		if goos != "" && supportedTargetOS(goos) == (goos == "freebsd") {
+			t.Errorf("%s: wrong supportedTargetOS", goos)
+		}
+
+		p := New(nil)
+		err := p.SetTarget(goos, goarch)
+		if (err != nil) != tc.unsupported {
+			t.Errorf("%s/%s: wrong error %v", goos, goarch, err)
+		}
+		if err == nil && (p.bi.GOOS != goos || p.bi.Arch == nil || !p.targetSet) {
+			t.Errorf("%s/%s: target not set", goos, goarch)
+		}
+	}
+}
+
+func TestThreadAlive(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"E01", "OK", "E01", "E10", ""})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	for _, id := range []int{1, 2, 3, 4} {
+		p.threads[id] = &Thread{ID: id, strID: fmt.Sprintf("%x", id), p: p, regsLoaded: true}
+	}
+	p.currentThread = p.threads[1]
+
+	if err := p.SwitchThread(2); err == nil || p.currentThread.ID != 1 {
+		t.Errorf("switched to dead thread: %v", err)
+	}
+	if _, ok := p.threads[2]; ok {
+		t.Errorf("dead thread not removed")
+	}
+	if err := p.SwitchThread(3); err != nil || p.currentThread.ID != 3 {
+		t.Errorf("could not switch to thread 3: %v", err)
+	}
+
+	p.SetCheckThreadsAlive(true)
+	if _, ok := p.FindThread(4); ok {
+		t.Errorf("dead thread found")
+	}
+	// the stub doesn't support T
+	if th, ok := p.FindThread(1); !ok || th.ThreadID() != 1 || !p.conn.threadAliveUnsupported {
+		t.Errorf("thread 1 not found")
+	}
+
+	expected := []string{"$T2", "$T3", "$m0,8", "$T4", "$T1"} // m reads the G of thread 3
+	var packets []string
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+			packets = append(packets, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+		}
+	}
+	if fmt.Sprint(packets) != fmt.Sprint(expected) {
+		t.Errorf("wrong packets %q, expected %q", packets, expected)
+	}
+}
+
+func TestRemoveCurrentThread(t *testing.T) {
+	p, _ := newFakeStubProcess(nil)
+	for _, id := range []int{1, 2} {
+		p.threads[id] = &Thread{ID: id, strID: fmt.Sprintf("%x", id), p: p}
+	}
+	p.currentThread = p.threads[2]
+	p.selectedGoroutine = &proc.G{ID: 1, Thread: p.threads[2]}
+
+	// thread 2 is missing from the new thread list
+	tu := &threadUpdater{p: p}
+	if err := tu.Add([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	tu.Finish()
+	if p.currentThread == nil || p.currentThread.ID != 1 {
+		t.Errorf("wrong current thread %v", p.currentThread)
+	}
+	if p.selectedGoroutine != nil {
+		t.Errorf("selected goroutine still on the removed thread")
+	}
+
+	p.removeThread(1)
+	if p.currentThread != nil {
+		t.Errorf("current thread not reset: %v", p.currentThread)
+	}
+}
+
+func TestStepOverBreakpointsTogether(t *testing.T) {
+	client, server := net.Pipe()
+	pad := strings.Repeat("00", 8)
+	go fakeStub(server, []string{
+		// threads 1 and 2 are stepped together with thread 3, which doesn't
+		// move and is stepped again by itself
+		"OK", "OK",
+		"T05thread:1;",
+		"0110000000000000" + pad, "0110000000000000" + pad, "0020000000000000" + pad,
+		"OK", "OK",
+		"OK", "T05thread:3;", "OK",
+		"W00",
+	})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.bi.Arch = proc.AMD64Arch("linux")
+	p.bi.GOOS = "linux"
+	p.threadStopInfo = false
+
+	for _, addr := range []uint64{0x1000, 0x2000} {
+		p.breakpoints.M[addr] = &proc.Breakpoint{Addr: addr, Kind: proc.UserBreakpoint, HitCount: map[int]uint64{}}
+	}
+	for id, pc := range map[int]uint64{1: 0x1000, 2: 0x1000, 3: 0x2000} {
+		th := &Thread{ID: id, strID: fmt.Sprintf("%d", id), p: p}
+		buf := make([]byte, 16)
+		binary.LittleEndian.PutUint64(buf, pc)
+		th.regsLoaded = true
+		th.regs = gdbRegisters{regs: map[string]gdbRegister{regnamePC: {value: buf[:8]}}, buf: buf, byteOrder: binary.LittleEndian}
+		th.CurrentBreakpoint.Breakpoint = p.breakpoints.M[pc]
+		p.threads[id] = th
+	}
+	p.currentThread = p.threads[1]
+
+	if _, err := p.ContinueOnce(); err == nil {
+		t.Fatalf("expected exit")
+	}
+
+	var packets []string
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+			packets = append(packets, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+		}
+	}
+	if len(packets) == 12 {
+		// breakpoints are set back in no particular order
+		sort.Strings(packets[6:8])
+	}
+	expected := []string{
+		"$z0,1000,1", "$z0,2000,1", "$vCont;s:1;s:2;s:3;c",
+		"$g;thread:1;", "$g;thread:2;", "$g;thread:3;",
+		"$Z0,1000,1", "$Z0,2000,1",
+		"$z0,2000,1", "$vCont;s:3", "$Z0,2000,1",
+		"$vCont;c",
+	}
+	if fmt.Sprint(packets) != fmt.Sprint(expected) {
+		t.Errorf("wrong packets:\n%q\nexpected:\n%q", packets, expected)
+	}
+}
+
+func TestStepOverBreakpointsQueuesStop(t *testing.T) {
+	// thread 3, continued while threads 1 and 2 are stepped, stops first
+	pc := "0010000000000000" + strings.Repeat("00", 8)
+	conn, log := newFakeStubConn([]string{
+		"OK", "T05thread:3;", pc, pc, "OK",
+		"OK", "T05thread:1;", "OK",
+		"OK", "T05thread:2;", "OK",
+	})
+	p := newSingleThreadTestProcess(conn)
+	p.bi.Arch = proc.AMD64Arch("linux")
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000, Kind: proc.UserBreakpoint, HitCount: map[int]uint64{}}
+	for id := 1; id <= 3; id++ {
+		th := &Thread{ID: id, strID: fmt.Sprintf("%d", id), p: p}
+		buf := make([]byte, 16)
+		binary.LittleEndian.PutUint64(buf, 0x1000)
+		th.regsLoaded = true
+		th.regs = gdbRegisters{regs: map[string]gdbRegister{regnamePC: {value: buf[:8]}}, buf: buf, byteOrder: binary.LittleEndian}
+		p.threads[id] = th
+	}
+	p.threads[1].CurrentBreakpoint.Breakpoint = p.breakpoints.M[0x1000]
+	p.threads[2].CurrentBreakpoint.Breakpoint = p.breakpoints.M[0x1000]
+	p.currentThread = p.threads[1]
+
+	if err := p.stepOverBreakpoints(); err != nil {
+		t.Fatal(err)
+	}
+	if sent := log.String(); !strings.Contains(sent, "$vCont;s:1;s:2;c#") || !strings.Contains(sent, "$vCont;s:1#") || !strings.Contains(sent, "$vCont;s:2#") {
+		t.Errorf("wrong packets sent %q", sent)
+	}
+	if len(p.conn.pendingStops) != 1 || p.conn.pendingStops[0].threadID != "3" {
+		t.Errorf("stop of thread 3 not queued: %v", p.conn.pendingStops)
+	}
+}
+
+func TestRawPacket(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"1234", "E22", ""})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+
+	for _, tc := range []struct {
+		packet, resp string
+	}{
+		{"$qSomething", "1234"},
+		{"X1000,1:#", "E22"},
+		{"qUnsupported", ""},
+	} {
+		resp, err := p.RawPacket(tc.packet)
+		if err != nil {
+			t.Fatalf("%q: %v", tc.packet, err)
+		}
+		if resp != tc.resp {
+			t.Errorf("%q: wrong response %q (expected %q)", tc.packet, resp, tc.resp)
+		}
+	}
+
+	var packets []string
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+			packets = append(packets, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+		}
+	}
+	expected := []string{"$qSomething", `$X1000,1:}\x03`, "$qUnsupported"}
+	if strings.Join(packets, " ") != strings.Join(expected, " ") {
+		t.Errorf("wrong packets sent %q (expected %q)", packets, expected)
+	}
+
+	p.conn.running = true
+	if _, err := p.RawPacket("qSomething"); err == nil {
+		t.Errorf("no error sending a packet while running")
+	}
+}
+
+func TestSegmentBase(t *testing.T) {
+	for _, tc := range []struct {
+		seg byte
+		reg x86asm.Reg
+	}{
+		{fsSegmentPrefix, x86asm.FS},
+		{gsSegmentPrefix, x86asm.GS},
+	} {
+		instr := segmentLoadInstr(tc.seg, 8)
+		inst, err := x86asm.Decode(instr, 64)
+		if err != nil || inst.Op != x86asm.MOV || inst.Args[0] != x86asm.RCX || inst.Len != len(instr) {
+			t.Errorf("wrong instruction %v %v", inst, err)
+			continue
+		}
+		if mem, ok := inst.Args[1].(x86asm.Mem); !ok || mem.Segment != tc.reg || mem.Base != 0 || mem.Disp != 8 {
+			t.Errorf("wrong operand %v", inst.Args[1])
+		}
+	}
+
+	// rip = 0x1000, rcx = 0x7fffffffe000, fs_base = 0
+	regs := "001000000000000000e0ffffff7f00000000000000000000"
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"OK",                 // G, SetFSBase
+		"909090909090909090", // m, save code
+		"OK",                 // M, write mov
+		"T05thread:1;",       // vCont;s
+		regs,                 // g
+		"OK",                 // M, restore code
+		"909090909090909090", // m, verify
+		"OK",                 // G, restore registers
+	})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.threadSuffixSupported = true
+	p.conn.vContActions = map[byte]bool{'s': true}
+	p.bi.GOOS = "linux"
+	th := &Thread{ID: 1, strID: "1", p: p}
+	buf := make([]byte, 24)
+	th.regsLoaded = true
+	th.regs = gdbRegisters{regs: map[string]gdbRegister{
+		regnamePC:     {regnum: 0, value: buf[:8]},
+		regnameCX:     {regnum: 1, value: buf[8:16]},
+		regnameFsBase: {regnum: 2, value: buf[16:]},
+	}, buf: buf}
+	th.regs.setPC(0x1000)
+	th.regs.setCX(0x7f00)
+
+	if err := th.SetFSBase(0xc000010000); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := th.FSBase(); err != nil || v != 0xc000010000 {
+		t.Errorf("wrong fs_base %#x %v", v, err)
+	}
+	if th.regs.TLS() != 0xc000010000 {
+		t.Errorf("TLS not updated %#x", th.regs.TLS())
+	}
+	if _, ok := th.regs.GSBase(); ok {
+		t.Errorf("gs_base reported")
+	}
+	if err := th.SetGSBase(0); err == nil {
+		t.Errorf("no error setting missing gs_base")
+	}
+
+	gs, sig, err := th.execAtPC(segmentLoadInstr(gsSegmentPrefix, 0))
+	if err != nil || sig != 5 || gs != 0x7fffffffe000 {
+		t.Errorf("wrong gs:0 %#x %d %v", gs, sig, err)
+	}
+	if pc := th.regs.PC(); pc != 0x1000 {
+		t.Errorf("pc not restored %#x", pc)
+	}
+	if cx := th.regs.CX(); cx != 0x7f00 {
+		t.Errorf("rcx not restored %#x", cx)
+	}
+	if !strings.Contains(log.String(), replaySendPrefix+`"$M1000,9:65488b0c2500000000`) {
+		t.Errorf("mov not written:\n%s", log.String())
+	}
+}
+
+func TestSegmentBaseFallback(t *testing.T) {
+	const (
+		tcb      = 0x7f0000001000
+		codeAddr = 0x40100
+	)
+
+	// Thread.Blocked considers threads stopped outside of any function as
+	// blocked.
+	dwb := dwarfbuilder.New()
+	dwb.AddSubprogram("main.main", 0x40100, 0x41000)
+	dwb.TagClose()
+	abbrev, aranges, frame, info, line, pubnames, ranges, str, loc, err := dwb.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dwdata, err := dwarf.New(abbrev, aranges, frame, info, line, pubnames, ranges, str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		goos    string
+		seg     byte
+		tsdOff  uint64 // offset of the segment base from the first word of the segment
+		fsbase  bool
+		decoyAt uint64
+	}{
+		// the first word of the segment on linux is the TCB, which is fs_base
+		{"linux", fsSegmentPrefix, 0, true, 0},
+		// gs_base on darwin points to the TSD array inside pthread_self, the
+		// first word is also found earlier in the struct.
+		{"darwin", gsSegmentPrefix, 0xe0, false, 0x40},
+	} {
+		segment := make([]byte, segmentSearchSize)
+		binary.LittleEndian.PutUint64(segment[tc.tsdOff:], tcb)
+		binary.LittleEndian.PutUint64(segment[tc.tsdOff+8:], 0xc000000000)
+		if tc.decoyAt != 0 {
+			binary.LittleEndian.PutUint64(segment[tc.decoyAt:], tcb)
+			binary.LittleEndian.PutUint64(segment[tc.decoyAt+8:], 0x1234)
+		}
+		code := bytes.Repeat([]byte{0x90}, 9)
+		mem := map[uint64][]byte{codeAddr: code, tcb: segment}
+
+		var movs []string
+		var cx uint64
+		handle := func(req string) string {
+			switch {
+			case strings.HasPrefix(req, "M"):
+				instr, _ := hex.DecodeString(req[strings.Index(req, ":")+1:])
+				if instr[0] != 0x90 {
+					movs = append(movs, req)
+					if instr[0] != tc.seg {
+						return "E01"
+					}
+					disp := binary.LittleEndian.Uint32(instr[5:])
+					cx = binary.LittleEndian.Uint64(segment[tc.tsdOff+uint64(disp):])
+				}
+				return "OK"
+			case strings.HasPrefix(req, "vCont;s"):
+				return "T05thread:1;"
+			case strings.HasPrefix(req, "g"):
+				var buf [16]byte
+				binary.LittleEndian.PutUint64(buf[:], codeAddr)
+				binary.LittleEndian.PutUint64(buf[8:], cx)
+				return hex.EncodeToString(buf[:])
+			}
+			return "OK"
+		}
+		client, server := net.Pipe()
+		go memoryStub(server, mem, handle)
+
+		p := New(nil)
+		p.conn = *newTestConn(client)
+		p.conn.threadSuffixSupported = true
+		p.conn.vContActions = map[byte]bool{'s': true}
+		p.bi = proc.NewBinaryInfo(tc.goos, "amd64")
+		p.bi.LoadFromData(dwdata, frame, line, loc)
+		th := &Thread{ID: 1, strID: "1", p: p}
+		buf := make([]byte, 16)
+		th.regsLoaded = true
+		th.regs = gdbRegisters{regs: map[string]gdbRegister{
+			regnamePC: {regnum: 0, value: buf[:8]},
+			regnameCX: {regnum: 1, value: buf[8:16]},
+		}, buf: buf}
+		th.regs.setPC(codeAddr)
+		th.regs.setCX(0x7f00)
+
+		var base uint64
+		if tc.fsbase {
+			base, err = th.FSBase()
+		} else {
+			base, err = th.GSBase()
+		}
+		if err != nil || base != tcb+tc.tsdOff {
+			t.Errorf("%s: wrong segment base %#x %v", tc.goos, base, err)
+		}
+		if len(movs) != 2 {
+			t.Errorf("%s: wrong instructions executed %q", tc.goos, movs)
+		}
+		if pc, cx := th.regs.PC(), th.regs.CX(); pc != codeAddr || cx != 0x7f00 {
+			t.Errorf("%s: registers not restored %#x %#x", tc.goos, pc, cx)
+		}
+		if err := th.SetFSBase(0); err == nil {
+			t.Errorf("%s: no error setting missing fs_base", tc.goos)
+		}
+		client.Close()
+	}
+}
+
+func newSingleThreadTestProcess(conn net.Conn) *Process {
+	p := New(nil)
+	p.conn = *newTestConn(conn)
+	p.conn.threadSuffixSupported = true
+	p.conn.vContActions = map[byte]bool{'c': true, 's': true}
+	p.conn.regsInfo = []gdbRegisterInfo{
+		{Name: regnamePC, Bitsize: 64, Offset: 0, Regnum: 0},
+		{Name: regnameFsBase, Bitsize: 64, Offset: 8, Regnum: 1},
+	}
+	p.bi.GOOS = "linux"
+	p.threads[1] = &Thread{ID: 1, strID: "1", p: p}
+	p.currentThread = p.threads[1]
+	return p
+}
+
+func TestContinueSingleThread(t *testing.T) {
+	const regs = "0010000000000000" + "0000000000000000"
+
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"T05thread:1;threads:1;", regs,
+		"T05thread:2;threads:1,2;", "T00", "T05thread:2;", regs,
+		regs,
+	})
+
+	var log bytes.Buffer
+	p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+
+	sentPackets := func() []string {
+		var packets []string
+		for _, line := range strings.Split(log.String(), "\n") {
+			if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+				packets = append(packets, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+			}
+		}
+		log.Reset()
+		sort.Strings(packets)
+		return packets
+	}
+
+	// single thread, the stop reason comes from the stop packet
+	th, err := p.ContinueOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.ThreadID() != 1 {
+		t.Errorf("wrong thread %d", th.ThreadID())
+	}
+	expected := []string{"$g;thread:1;", "$vCont;c"}
+	if packets := sentPackets(); strings.Join(packets, " ") != strings.Join(expected, " ") {
+		t.Errorf("wrong packets sent %q (expected %q)", packets, expected)
+	}
+
+	// a new thread was created, the stop reason of all threads is read
+	th, err = p.ContinueOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th.ThreadID() != 2 || len(p.threads) != 2 {
+		t.Errorf("wrong thread %d (%d threads)", th.ThreadID(), len(p.threads))
+	}
+	// registers are only read for thread 2, which stopped at a breakpoint:
+	// one 'g' packet less than reading the registers of every thread.
+	expected = []string{"$g;thread:2;", "$qThreadStopInfo1", "$qThreadStopInfo2", "$vCont;c"}
+	if packets := sentPackets(); strings.Join(packets, " ") != strings.Join(expected, " ") {
+		t.Errorf("wrong packets sent %q (expected %q)", packets, expected)
+	}
+
+	// the registers of thread 1 are read the first time they are used
+	regs1, err := p.threads[1].Registers(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regs1.PC() != 0x1000 {
+		t.Errorf("wrong PC %#x", regs1.PC())
+	}
+	expected = []string{"$g;thread:1;"}
+	if packets := sentPackets(); strings.Join(packets, " ") != strings.Join(expected, " ") {
+		t.Errorf("wrong packets sent %q (expected %q)", packets, expected)
+	}
+}
+
+func BenchmarkContinueSingleThread(b *testing.B) {
+	resps := make([]string, 0, 2*b.N)
+	for i := 0; i < b.N; i++ {
+		resps = append(resps, "T13thread:1;threads:1;", "0010000000000000"+"0000000000000000")
+	}
+	client, server := net.Pipe()
+	go fakeStub(server, resps)
+	p := newSingleThreadTestProcess(client)
+	p.SetSignalPolicy(func(sig uint8) SignalAction { return SignalStop })
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.ContinueOnce(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSetBreakpoints(t *testing.T) {
+	client, server := net.Pipe()
+	go fakePipelinedStub(server, []string{"OK", "E01", "OK"})
+
+	var log bytes.Buffer
+	p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+
+	errs := p.conn.setBreakpoints([]uint64{0x1000, 0x2000, 0x3000})
+	if len(errs) != 3 {
+		t.Fatalf("got %d results, expected 3", len(errs))
+	}
+	if errs[0] != nil || errs[2] != nil {
+		t.Errorf("unexpected errors %v %v", errs[0], errs[2])
+	}
+	if _, isprotoerr := errs[1].(*GdbProtocolError); !isprotoerr {
+		t.Errorf("expected protocol error, got %v", errs[1])
+	}
+
+	var packets []string
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$`) {
+			packets = append(packets, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+		}
+	}
+	if want := []string{"$Z0,1000,1", "$Z0,2000,1", "$Z0,3000,1"}; fmt.Sprint(packets) != fmt.Sprint(want) {
+		t.Errorf("wrong packets sent %q, expected %q", packets, want)
+	}
+
+	// Addresses that don't belong to any function are rejected without
+	// asking the stub, every address gets a result.
+	results := p.SetBreakpoints([]uint64{0x1, 0x2}, proc.UserBreakpoint)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, expected 2", len(results))
+	}
+	for i, r := range results {
+		if _, isinvalid := r.Err.(proc.InvalidAddressError); !isinvalid || r.Addr != uint64(i+1) || r.Breakpoint != nil {
+			t.Errorf("wrong result %d: %#v", i, r)
+		}
+	}
+	if len(p.breakpoints.M) != 0 {
+		t.Errorf("unexpected breakpoints %v", p.breakpoints.M)
+	}
+}
+
+func TestCurrentInstruction(t *testing.T) {
+	code := func(b ...byte) string {
+		buf := make([]byte, 15)
+		copy(buf, b)
+		return hex.EncodeToString(buf)
+	}
+
+	var log bytes.Buffer
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		code(0x48, 0x8b, 0x45, 0xe8), // mov rax, qword ptr [rbp-0x18]
+		"efbeadde00000000",
+		code(0x48, 0x8d, 0x0d, 0x10, 0x00, 0x00, 0x00),                   // lea rcx, ptr [rip+0x10]
+		code(0xe8, 0xfb, 0x0f, 0x00, 0x00),                               // call 0x2000
+		code(0x48, 0x8d, 0x0d, 0xf0, 0xff, 0xff, 0xff),                   // lea rcx, ptr [rip-0x10]
+		code(0x48, 0xa1, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00), // mov rax, qword ptr [0x80000000]
+		"efbeadde00000000",
+	})
+
+	p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+	th := p.threads[1]
+	u64 := func(v uint64) []byte {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], v)
+		return buf[:]
+	}
+	th.regsLoaded = true
+	th.regs = gdbRegisters{regs: map[string]gdbRegister{
+		regnamePC: {value: u64(0x1000)},
+		"rax":     {value: u64(0x1122334455667788)},
+		"rbp":     {value: u64(0xc000040f40)},
+	}}
+
+	inst, args, err := th.CurrentInstruction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Op != x86asm.MOV || fmt.Sprintf("%#x", args) != "[0x1122334455667788 0xdeadbeef]" {
+		t.Errorf("wrong instruction %v %#x", inst, args)
+	}
+
+	inst, args, err = th.CurrentInstruction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Op != x86asm.LEA || fmt.Sprintf("%#x", args) != "[0x0 0x1017]" {
+		t.Errorf("wrong instruction %v %#x", inst, args)
+	}
+
+	inst, args, err = th.CurrentInstruction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Op != x86asm.CALL || fmt.Sprintf("%#x", args) != "[0x2000]" {
+		t.Errorf("wrong instruction %v %#x", inst, args)
+	}
+
+	inst, args, err = th.CurrentInstruction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Op != x86asm.LEA || fmt.Sprintf("%#x", args) != "[0x0 0xff7]" {
+		t.Errorf("wrong instruction %v %#x", inst, args)
+	}
+
+	inst, args, err = th.CurrentInstruction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Op != x86asm.MOV || fmt.Sprintf("%#x", args) != "[0x1122334455667788 0xdeadbeef]" {
+		t.Errorf("wrong instruction %v %#x", inst, args)
+	}
+	if !strings.Contains(log.String(), "$m80000000,8#") {
+		t.Errorf("moffs operand not read at 0x80000000:\n%s", log.String())
+	}
+
+	if v, err := th.regs.Get(int(x86asm.EAX)); err != nil || v != 0x55667788 {
+		t.Errorf("Get(EAX) = %#x, %v", v, err)
+	}
+	if v, err := th.regs.Get(int(x86asm.AL)); err != nil || v != 0x88 {
+		t.Errorf("Get(AL) = %#x, %v", v, err)
+	}
+}
+
+func TestCurrentInstructionSegment(t *testing.T) {
+	code := func(b ...byte) string {
+		buf := make([]byte, 15)
+		copy(buf, b)
+		return hex.EncodeToString(buf)
+	}
+	loadfs := code(0x64, 0x48, 0x8b, 0x04, 0x25, 0x10, 0x00, 0x00, 0x00) // mov rax, qword ptr fs:[0x10]
+
+	var log bytes.Buffer
+	client, server := net.Pipe()
+	go fakeStub(server, []string{loadfs, "efbeadde00000000", loadfs})
+
+	p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+	th := p.threads[1]
+	u64 := func(v uint64) []byte {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], v)
+		return buf[:]
+	}
+	th.regsLoaded = true
+	th.regs = gdbRegisters{regs: map[string]gdbRegister{
+		regnamePC:     {value: u64(0x1000)},
+		regnameFsBase: {value: u64(0x1ff0)},
+		"rax":         {value: u64(0)},
+	}}
+
+	inst, args, err := th.CurrentInstruction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Op != x86asm.MOV || fmt.Sprintf("%#x", args) != "[0x0 0xdeadbeef]" {
+		t.Errorf("wrong instruction %v %#x", inst, args)
+	}
+	if !strings.Contains(log.String(), "$m2000,8#") {
+		t.Errorf("operand not read at fs_base+0x10:\n%s", log.String())
+	}
+
+	// without fs_base the operand can not be resolved, the thread must not
+	// be resumed to find the segment base.
+	delete(th.regs.regs, regnameFsBase)
+	log.Reset()
+	if _, _, err := th.CurrentInstruction(); err == nil {
+		t.Error("expected error resolving fs relative operand without fs_base")
+	}
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.HasPrefix(line, replaySendPrefix+`"$`) && !strings.HasPrefix(line, replaySendPrefix+`"$m`) {
+			t.Errorf("unexpected packet %s", line)
+		}
+	}
+}
+
+func TestGoroutineStatusName(t *testing.T) {
+	for status, name := range map[uint64]string{
+		proc.Grunnable:              "runnable",
+		proc.Gwaiting:               "waiting",
+		proc.Gwaiting | gscanStatus: "waiting",
+		proc.Gsyscall | gscanStatus: "syscall",
+		9:                           "preempted",
+		42:                          "status 42",
+	} {
+		if got := goroutineStatusName(status); got != name {
+			t.Errorf("goroutineStatusName(%#x) = %q, expected %q", status, got, name)
+		}
+	}
+
+	// The result is cached until the target is resumed.
+	p := New(nil)
+	stats := &GoroutineStats{Total: 1, ByStatus: map[string]int{"running": 1}}
+	p.goroutineStats = stats
+	if got, err := p.GoroutineStats(); err != nil || got != stats {
+		t.Errorf("cached stats not returned: %v %v", got, err)
+	}
+}
+
+func TestGoroutineStats(t *testing.T) {
+	for _, stringWaitReason := range []bool{false, true} {
+		testGoroutineStats(t, stringWaitReason)
+	}
+}
+
+func testGoroutineStats(t *testing.T, stringWaitReason bool) {
+	const (
+		stackAddr   = 0x58000
+		stringsAddr = 0x59000
+		tlsAddr     = 0x60000
+		arrayAddr   = 0x61000
+		gbase       = 0x62000
+	)
+	reasons := []string{"sleep", "chan receive"}
+	mem := map[uint64][]byte{
+		stackAddr: make([]byte, 0x100),
+		tlsAddr:   make([]byte, 8),
+	}
+	strs := make([]byte, 0x20)
+	waitReasonStrings := make([]byte, 32)
+	for i, reason := range reasons {
+		copy(strs[0x10*i:], reason)
+		binary.LittleEndian.PutUint64(waitReasonStrings[16*i:], stringsAddr+uint64(0x10*i))
+		binary.LittleEndian.PutUint64(waitReasonStrings[16*i+8:], uint64(len(reason)))
+	}
+	mem[stringsAddr] = strs
+	mem[fakeWaitReasonsAddr] = waitReasonStrings
+
+	gs := []struct {
+		status uint64
+		reason int // index in reasons, or the numeric wait reason if it's out of range
+	}{
+		{proc.Grunning, 0},
+		{proc.Gwaiting, 1},
+		{proc.Gwaiting | gscanStatus, 1},
+		{proc.Gwaiting, 0},
+		{proc.Gwaiting, 7},
+		{proc.Grunnable, 1},
+		{proc.Gdead, 0},
+	}
+	var gaddrs []uint64
+	for i, g := range gs {
+		gaddr := gbase + uint64(i)*0x100
+		buf := fakeG(int64(i+1), g.status, uint8(g.reason))
+		if stringWaitReason {
+			if g.reason < len(reasons) {
+				binary.LittleEndian.PutUint64(buf[fakeGWaitreason:], stringsAddr+uint64(0x10*g.reason))
+				binary.LittleEndian.PutUint64(buf[fakeGWaitreason+8:], uint64(len(reasons[g.reason])))
+			} else {
+				binary.LittleEndian.PutUint64(buf[fakeGWaitreason:], 0)
+			}
+		}
+		mem[gaddr] = buf
+		gaddrs = append(gaddrs, gaddr)
+		if i == 2 {
+			// nil entries of allgs are skipped
+			gaddrs = append(gaddrs, 0)
+		}
+	}
+	binary.LittleEndian.PutUint64(mem[tlsAddr], gbase)
+	mem[fakeAllgsAddr], mem[arrayAddr] = fakeAllgs(arrayAddr, gaddrs)
+
+	client, server := net.Pipe()
+	go memoryStub(server, mem, func(req string) string {
+		if strings.HasPrefix(req, "g") {
+			return fakeRuntimeRegs(fakeMainAddr, stackAddr+0x80, tlsAddr)
+		}
+		return ""
+	})
+	var log bytes.Buffer
+	p := newFakeRuntimeTestProcess(t, NewRecordingConn(&log, client), stringWaitReason)
+
+	stats, err := p.GoroutineStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &GoroutineStats{
+		Total:        len(gs),
+		ByStatus:     map[string]int{"running": 1, "waiting": 4, "runnable": 1, "dead": 1},
+		ByWaitReason: map[string]int{"sleep": 1, "chan receive": 2, "wait reason 7": 1},
+	}
+	if stringWaitReason {
+		expected.ByWaitReason = map[string]int{"sleep": 1, "chan receive": 2, "": 1}
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("stringWaitReason=%v: wrong stats %#v, expected %#v", stringWaitReason, stats, expected)
+	}
+	if live := stats.Live(); live != 6 {
+		t.Errorf("stringWaitReason=%v: wrong number of live goroutines %d", stringWaitReason, live)
+	}
+
+	// only atomicstatus and waitreason are read from each g
+	size := 0x11
+	if stringWaitReason {
+		size = 0x20
+	}
+	for _, gaddr := range gaddrs {
+		if gaddr == 0 {
+			continue
+		}
+		req := fmt.Sprintf(`%s"$m%x,%x#`, replaySendPrefix, gaddr+fakeGAtomicstatus, size)
+		if n := strings.Count(log.String(), req); n != 1 {
+			t.Errorf("stringWaitReason=%v: g %#x read %d times, expected once", stringWaitReason, gaddr, n)
+		}
+	}
+	client.Close()
+}
+
+func TestContinueUntilGoroutineCount(t *testing.T) {
+	stats := &GoroutineStats{Total: 10, ByStatus: map[string]int{"dead": 3, "idle": 1, "waiting": 4, "running": 2}}
+	if live := stats.Live(); live != 6 {
+		t.Errorf("wrong number of live goroutines %d", live)
+	}
+
+	p := New(nil)
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000, Kind: proc.NextBreakpoint}
+	if _, err := p.ContinueUntilGoroutineCount(10); err == nil || err.Error() != "can not count goroutines while a next or step is in progress" {
+		t.Errorf("wrong error while nexting: %v", err)
+	}
+	p.exited = true
+	if _, err := p.ContinueUntilGoroutineCount(10); err == nil {
+		t.Errorf("no error after the process exited")
+	} else if _, isexited := err.(*proc.ProcessExitedError); !isexited {
+		t.Errorf("wrong error %v", err)
+	}
+}
+
+func TestContinueUntilGoroutineCountReached(t *testing.T) {
+	const (
+		stackAddr = 0x58000
+		tlsAddr   = 0x60000
+		arrayAddr = 0x61000
+		g1        = 0x62000
+		g2        = 0x62100
+		g3        = 0x62200
+	)
+	header, array := fakeAllgs(arrayAddr, []uint64{g1, g2})
+	code := make([]byte, fakeTextEnd-fakeMainAddr)
+	for i := range code {
+		code[i] = 0x90
+	}
+	tls := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tls, g1)
+	mem := map[uint64][]byte{
+		fakeMainAddr:  code,
+		fakeAllgsAddr: header,
+		arrayAddr:     array,
+		tlsAddr:       tls,
+		stackAddr:     make([]byte, 0x100),
+		g1:            fakeG(1, proc.Grunning, 0),
+		g2:            fakeG(2, proc.Gdead, 0),
+	}
+
+	// Every time the target is resumed runtime.newproc is hit again:
+	//  1. allglen is 2, the goroutines aren't counted
+	//  2. g2 is reused and g3 is allocated, allglen is 3 but there are only
+	//     2 live goroutines
+	//  3. g3 starts, there are 3 live goroutines
+	pc := uint64(fakeMainAddr)
+	hits := 0
+	handle := func(req string) string {
+		switch {
+		case strings.HasPrefix(req, "vCont;c"):
+			hits++
+			switch hits {
+			case 2:
+				mem[g2] = fakeG(4, proc.Gwaiting, 0)
+				mem[g3] = fakeG(0, proc.Gdead, 0)
+				header, array := fakeAllgs(arrayAddr, []uint64{g1, g2, g3})
+				mem[fakeAllgsAddr], mem[arrayAddr] = header, array
+			case 3:
+				mem[g3] = fakeG(5, proc.Grunnable, 0)
+			}
+			pc = fakeNewprocAddr
+			return "T05thread:1;threads:1;"
+		case strings.HasPrefix(req, "vCont;s"):
+			pc++
+			return "T05thread:1;threads:1;"
+		case strings.HasPrefix(req, "g"):
+			return fakeRuntimeRegs(pc, stackAddr+0x80, tlsAddr)
+		case strings.HasPrefix(req, "Z0"), strings.HasPrefix(req, "z0"):
+			return "OK"
+		}
+		return ""
+	}
+	client, server := net.Pipe()
+	go memoryStub(server, mem, handle)
+
+	var log bytes.Buffer
+	p := newFakeRuntimeTestProcess(t, NewRecordingConn(&log, client), false)
+
+	stop, err := p.ContinueUntilGoroutineCount(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stop == nil {
+		t.Fatal("goroutine count not reached")
+	}
+	if stop.Live != 3 || stop.Creator == nil || stop.Creator.ID != 1 {
+		t.Errorf("wrong stop %#v", stop)
+	}
+	if hits != 3 {
+		t.Errorf("wrong number of runtime.newproc hits %d", hits)
+	}
+	// runtime.allgs is only walked once allglen reaches the count
+	if n := strings.Count(log.String(), fmt.Sprintf(`%s"$m%x,18#`, replaySendPrefix, fakeAllgsAddr)); n != 2 {
+		t.Errorf("runtime.allgs read %d times, expected 2\n%s", n, log.String())
+	}
+	if len(p.breakpoints.M) != 0 {
+		t.Errorf("breakpoint on runtime.newproc not removed")
+	}
+	client.Close()
+}
+
+func TestCErrnoLocation(t *testing.T) {
+	for _, tc := range []struct {
+		blocks []tlsBlock
+		offs   []uint64
+	}{
+		{[]tlsBlock{{size: 0x35, align: 16}, {size: 0x90, align: 8}}, []uint64{64, 208}},
+		// the third block fits in the gap left by the alignment of the second
+		{[]tlsBlock{{size: 8, align: 8}, {size: 4, align: 64}, {size: 8, align: 8}}, []uint64{8, 64, 16}},
+		{[]tlsBlock{{size: 12, align: 16, firstbyte: 8}}, []uint64{24}},
+	} {
+		if offs := staticTLSOffsets(tc.blocks); fmt.Sprint(offs) != fmt.Sprint(tc.offs) {
+			t.Errorf("staticTLSOffsets(%v) = %v, expected %v", tc.blocks, offs, tc.offs)
+		}
+	}
+
+	for _, tc := range []struct {
+		libs []SharedLibrary
+		kind libcKind
+		idx  int
+	}{
+		{[]SharedLibrary{{Name: "/tmp/a.out"}, {Name: "linux-vdso.so.1"}, {Name: "/lib/x86_64-linux-gnu/libc.so.6"}}, libcGlibc, 2},
+		{[]SharedLibrary{{Name: "/tmp/a.out"}, {Name: "/lib/ld-musl-x86_64.so.1"}}, libcMusl, 1},
+		{[]SharedLibrary{{Name: "/tmp/a.out"}}, libcUnknown, -1},
+	} {
+		if kind, idx := findLibc(tc.libs); kind != tc.kind || idx != tc.idx {
+			t.Errorf("findLibc(%v) = %d %d, expected %d %d", tc.libs, kind, idx, tc.kind, tc.idx)
+		}
+	}
+
+	p := New(nil)
+	p.bi.GOOS = "darwin"
+	th := &Thread{ID: 1, strID: "1", p: p}
+	if _, err := th.CErrno(); err != ErrCErrnoUnsupported {
+		t.Errorf("expected ErrCErrnoUnsupported, got %v", err)
+	}
+
+	// glibc on a stub we didn't start, the local libc may not be the one
+	// loaded by the target
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		`l<library-list-svr4 version="1.0" main-lm="0x7f0000001000">` +
+			`<library name="/lib/x86_64-linux-gnu/libc.so.6" lm="0x7f0000003000" l_addr="0x7f1000000000" l_ld="0x7f1000200000"/>` +
+			`</library-list-svr4>`,
+	})
+	p = newSingleThreadTestProcess(client)
+	p.execPath = os.Args[0]
+	if _, err := p.currentThread.CErrno(); err != ErrCErrnoUnsupported {
+		t.Errorf("expected ErrCErrnoUnsupported for a remote glibc target, got %v", err)
+	}
+	client.Close()
+}
+
+func TestPanicFrames(t *testing.T) {
+	frames := func(names ...string) []proc.Stackframe {
+		r := make([]proc.Stackframe, len(names))
+		for i := range names {
+			r[i].Current.Fn = &proc.Function{Name: names[i]}
+		}
+		return r
+	}
+	for _, tc := range []struct {
+		frames           []proc.Stackframe
+		origin, deferred int
+	}{
+		{frames("runtime.fatalpanic", "runtime.gopanic", "main.f", "main.main", "runtime.main"), 2, -1},
+		{frames("runtime.fatalpanic", "runtime.gopanic", "runtime.panicmem", "runtime.sigpanic", "main.f", "main.main"), 4, -1},
+		// main.f panicked while running the function deferred by main.g
+		{frames("runtime.fatalpanic", "runtime.gopanic", "main.f", "main.g.func1", "runtime.call32", "runtime.gopanic", "main.g", "main.main"), 2, 3},
+		{frames("runtime.fatalpanic", "runtime.gopanic", "main.g.func1", "runtime.call32", "runtime.gopanic", "main.g"), 2, 2},
+		{frames("runtime.fatalthrow", "runtime.throw", "main.main"), -1, -1},
+	} {
+		if origin, deferred := panicFrames(tc.frames); origin != tc.origin || deferred != tc.deferred {
+			t.Errorf("panicFrames(%v) = %d %d, expected %d %d", tc.frames, origin, deferred, tc.origin, tc.deferred)
+		}
+	}
+
+	p := New(nil)
+	p.exited = true
+	if _, err := p.ContinueToPanic(); err == nil {
+		t.Errorf("expected error continuing an exited process")
+	}
+}
+
+func TestContinueThreadWithSignal(t *testing.T) {
+	const regs = "0010000000000000" + "0000000000000000"
+	conn, log := newFakeStubConn([]string{"T05thread:1;threads:1;", regs, "T05thread:1;threads:1;", regs})
+	p := newSingleThreadTestProcess(conn)
+	p.conn.vContActions = map[byte]bool{'c': true, 'C': true, 's': true}
+	p.threadStopInfo = false
+
+	if _, err := p.ContinueThreadWithSignal(2, 0xa); err == nil {
+		t.Errorf("expected error for unknown thread")
+	}
+	p.pendingSignal = 0x1b
+	if _, err := p.ContinueThreadWithSignal(1, 0xa); err == nil {
+		t.Errorf("expected error with a pending signal")
+	}
+	p.pendingSignal = 0
+
+	if _, err := p.ContinueThreadWithSignal(1, 0xa); err != nil {
+		t.Fatal(err)
+	}
+	if p.threadSignal != nil {
+		t.Errorf("thread signal not cleared")
+	}
+	if sent := log.String(); !strings.Contains(sent, "$vCont;C0a:1;c#") {
+		t.Errorf("wrong packets:\n%s", sent)
+	}
+
+	// a pending stop doesn't replace the resume, the signal would be lost
+	log.Reset()
+	p.conn.queueStop([]byte("T13thread:1;"))
+	if _, err := p.ContinueThreadWithSignal(1, 0xa); err != nil {
+		t.Fatal(err)
+	}
+	if sent := log.String(); !strings.Contains(sent, "$vCont;C0a:1;c#") {
+		t.Errorf("signal not delivered with a pending stop:\n%s", sent)
+	}
+	if len(p.conn.pendingStops) != 1 || p.conn.pendingStops[0].sig != 0x13 {
+		t.Errorf("pending stop consumed %#v", p.conn.pendingStops)
+	}
+
+	p.conn.vContActions = map[byte]bool{'c': true, 's': true}
+	if _, err := p.ContinueThreadWithSignal(1, 0xa); err == nil {
+		t.Errorf("expected error when vCont doesn't support C")
+	}
+}
+
+func TestReadValue(t *testing.T) {
+	int64Type := &godwarf.IntType{BasicType: godwarf.BasicType{CommonType: godwarf.CommonType{ByteSize: 8, Name: "int64"}, BitSize: 64}}
+	byteType := &godwarf.UintType{BasicType: godwarf.BasicType{CommonType: godwarf.CommonType{ByteSize: 1, Name: "uint8"}, BitSize: 8}}
+	padType := &godwarf.ArrayType{CommonType: godwarf.CommonType{ByteSize: 1008, Name: "[1008]uint8"}, Type: byteType, StrideBitSize: 8, Count: 1008}
+	ptrType := &godwarf.PtrType{CommonType: godwarf.CommonType{ByteSize: 8, Name: "*int64"}, Type: int64Type}
+	elemType := &godwarf.StructType{
+		CommonType: godwarf.CommonType{ByteSize: 1024, Name: "main.T"},
+		StructName: "main.T",
+		Kind:       "struct",
+		Field: []*godwarf.StructField{
+			{Name: "A", Type: int64Type, ByteOffset: 0},
+			{Name: "Pad", Type: padType, ByteOffset: 8},
+			{Name: "P", Type: ptrType, ByteOffset: 1016},
+		},
+	}
+	// the elements are too large for the array to be prefetched by
+	// LoadVariable, each one is read on its own
+	typ := &godwarf.ArrayType{CommonType: godwarf.CommonType{ByteSize: 4096, Name: "[4]main.T"}, Type: elemType, StrideBitSize: 1024 * 8, Count: 4}
+
+	val := make([]byte, typ.Size())
+	for i := 0; i < 4; i++ {
+		binary.LittleEndian.PutUint64(val[i*1024:], uint64(40+i))
+	}
+	binary.LittleEndian.PutUint64(val[1016:], 0x4000)
+	var pointee [8]byte
+	binary.LittleEndian.PutUint64(pointee[:], 7)
+
+	cfg := proc.LoadConfig{FollowPointers: true, MaxVariableRecurse: 2, MaxArrayValues: 8, MaxStructFields: -1}
+
+	// memReads loads the value with load and returns the 'm' packets sent
+	memReads := func(load func(p *Process) (*proc.Variable, error)) (*proc.Variable, []string) {
+		t.Helper()
+		client, server := net.Pipe()
+		go memoryStub(server, map[uint64][]byte{0x1000: val, 0x4000: pointee[:]}, nil)
+		defer client.Close()
+
+		var log bytes.Buffer
+		p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+		p.conn.packetSize = 0x4000
+		p.bi = proc.NewBinaryInfo("linux", "amd64")
+		v, err := load(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reads []string
+		for _, line := range strings.Split(log.String(), "\n") {
+			if strings.HasPrefix(line, replaySendPrefix+`"$m`) {
+				reads = append(reads, strings.SplitN(line[len(replaySendPrefix)+1:], "#", 2)[0])
+			}
+		}
+		return v, reads
+	}
+
+	_, before := memReads(func(p *Process) (*proc.Variable, error) {
+		return proc.LoadVariable("", 0x1000, typ, &p.bi, p.currentThread, cfg), nil
+	})
+	if len(before) != 5 {
+		t.Fatalf("LoadVariable sent %d reads, expected one per element and one for *P: %v", len(before), before)
+	}
+	v, reads := memReads(func(p *Process) (*proc.Variable, error) {
+		return p.ReadValue(0x1000, typ, cfg)
+	})
+	if fmt.Sprint(reads) != "[$m1000,1000 $m4000,8]" {
+		t.Errorf("wrong reads %v", reads)
+	}
+	if v.Unreadable != nil || len(v.Children) != 4 {
+		t.Fatalf("wrong variable %v %d", v.Unreadable, len(v.Children))
+	}
+	for i, elem := range v.Children {
+		if a := elem.Children[0].Value.String(); a != strconv.Itoa(40+i) {
+			t.Errorf("[%d].A = %s", i, a)
+		}
+	}
+	if pc := v.Children[0].Children[2].Children; len(pc) != 1 || pc[0].Value.String() != "7" {
+		t.Errorf("wrong *[0].P %v", pc)
+	}
+}
+
+func TestWatchpointNoHardwareResources(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "E09", "E1c", "", "OK", "OK", "OK", "E09"})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+
+	if err := p.setWatchpoint(&Watchpoint{Addr: 0x1000, Size: 8, Kind: WatchWrite}); err != nil {
+		t.Fatal(err)
+	}
+	if n := p.HardwareSlotsInUse(); n != 1 {
+		t.Errorf("%d slots in use, expected 1", n)
+	}
+
+	// a generic error with free debug registers is passed through
+	err := p.setWatchpoint(&Watchpoint{Addr: 0x1008, Size: 8, Kind: WatchWrite})
+	if gdberr, ok := err.(*GdbProtocolError); !ok || gdberr.code != "E09" {
+		t.Errorf("wrong error %#v", err)
+	}
+
+	err = p.setWatchpoint(&Watchpoint{Addr: 0x1008, Size: 8, Kind: WatchWrite})
+	if nores, ok := err.(*ErrNoHardwareResources); !ok || nores.InUse != 1 {
+		t.Errorf("wrong error %#v", err)
+	}
+
+	// an unsupported packet is not a lack of resources
+	err = p.setWatchpoint(&Watchpoint{Addr: 0x1010, Size: 8, Kind: WatchRead})
+	if _, ok := err.(*ErrNoHardwareResources); ok || err == nil {
+		t.Errorf("wrong error %#v", err)
+	}
+	if n := p.HardwareSlotsInUse(); n != 1 {
+		t.Errorf("%d slots in use, expected 1", n)
+	}
+
+	for i := 1; i < numDebugRegisters; i++ {
+		if err := p.setWatchpoint(&Watchpoint{Addr: 0x1000 + uint64(i)*8, Size: 8, Kind: WatchWrite}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = p.setWatchpoint(&Watchpoint{Addr: 0x1020, Size: 8, Kind: WatchWrite})
+	if nores, ok := err.(*ErrNoHardwareResources); !ok || nores.InUse != numDebugRegisters {
+		t.Errorf("wrong error %#v", err)
+	}
+}
+
+func TestSyncCurrentThread(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"QC3", "QCp10.2", "QC9", "", "Q"})
+
+	p := New(nil)
+	p.conn = *newTestConn(client)
+	for tid := 1; tid <= 3; tid++ {
+		p.threads[tid] = &Thread{ID: tid, strID: strconv.Itoa(tid), p: p}
+	}
+	p.currentThread = p.threads[1]
+
+	for i, tid := range []int{
+		3,
+		2, // multiprocess thread ID
+		2, // unknown thread, current thread not changed
+		2, // qC unsupported
+		2, // malformed reply
+		2, // the connection is closed
+	} {
+		p.syncCurrentThread()
+		if p.currentThread.ID != tid {
+			t.Errorf("%d: current thread %d, expected %d", i, p.currentThread.ID, tid)
+		}
+	}
+}
+
+func TestPollStop(t *testing.T) {
+	client, server := net.Pipe()
+	release := make(chan struct{})
+	outputSent := make(chan struct{})
+	go func() {
+		rdr := bufio.NewReader(server)
+		if _, err := rdr.ReadBytes('#'); err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2)) // checksum
+		for _, packet := range []string{"O", "T05thread:1;threads:1;"} {
+			buf := []byte("$" + packet + "#")
+			sum := checksum(buf)
+			server.Write(append(buf, hexdigit[sum>>4], hexdigit[sum&0xf]))
+			if packet == "O" {
+				close(outputSent)
+				<-release
+			}
+		}
+		fakeStub(&bufferedConn{server, rdr}, []string{strings.Repeat("00", 16)})
+	}()
+
+	p := newSingleThreadTestProcess(client)
+	p.threadStopInfo = false
+
+	if _, _, err := p.PollStop(0); err == nil {
+		t.Errorf("expected error polling a stopped target")
+	}
+	if err := p.StartContinue(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.StartContinue(); err == nil {
+		t.Errorf("expected error continuing a running target")
+	}
+	// the console output packet is consumed while polling, it isn't a stop
+	for _, timeout := range []time.Duration{0, 10 * time.Millisecond, 10 * time.Millisecond} {
+		if _, running, err := p.PollStop(timeout); err != nil || !running {
+			t.Fatalf("target stopped before the stop reply was sent: %v", err)
+		}
+	}
+	select {
+	case <-outputSent:
+	case <-time.After(time.Second):
+		t.Fatal("console output not read")
+	}
+	if n := p.conn.rdr.Buffered(); n != 0 {
+		t.Errorf("%d bytes left unread", n)
+	}
+	close(release)
+	th, running, err := p.PollStop(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running || th == nil || th.ThreadID() != 1 {
+		t.Errorf("wrong stop %v %v", running, th)
+	}
+	if p.cont != nil || p.conn.running {
+		t.Errorf("target still marked as running")
+	}
+}
+
+func TestCPUCore(t *testing.T) {
+	for _, tc := range []struct {
+		info string
+		core int
+	}{
+		{"CPU#3 [running]", 3},
+		{"Name: worker, Core: 12", 12},
+		{"core=7", 7},
+		{"Name: worker", -1},
+	} {
+		if core := parseThreadExtraInfoCore(tc.info); core != tc.core {
+			t.Errorf("parseThreadExtraInfoCore(%q) = %d, expected %d", tc.info, core, tc.core)
+		}
+	}
+
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"T05thread:1;core:1a;", hex.EncodeToString([]byte("CPU#2 [halted]")), ""})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	th1 := &Thread{ID: 1, strID: "1", p: p, core: -1}
+	th2 := &Thread{ID: 2, strID: "2", p: p, core: -1}
+	p.threads[1], p.threads[2] = th1, th2
+
+	resp, err := p.conn.exec([]byte("$?"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sp, err := p.conn.parseStopPacket(resp, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th1.setStopReason(sp)
+	if core, ok := th1.CPUCore(); !ok || core != 0x1a {
+		t.Errorf("wrong core from stop packet %d %v", core, ok)
+	}
+
+	for i := 0; i < 2; i++ {
+		// the second call uses the cached value
+		if core, ok := th2.CPUCore(); !ok || core != 2 {
+			t.Errorf("wrong core from qThreadExtraInfo %d %v", core, ok)
+		}
+	}
+	p.conn.stopGen++
+	if core, ok := th2.CPUCore(); ok {
+		t.Errorf("unexpected core %d", core)
+	}
+	p.conn.stopGen++
+	if _, ok := th2.CPUCore(); ok || !p.conn.threadExtraInfoUnsupported {
+		t.Errorf("qThreadExtraInfo not marked unsupported")
+	}
+	if n := strings.Count(log.String(), "$qThreadExtraInfo,2#"); n != 2 {
+		t.Errorf("qThreadExtraInfo sent %d times, expected 2", n)
+	}
+	if _, ok := th1.NUMANode(); ok {
+		t.Errorf("NUMA node reported for a remote stub")
+	}
+
+	dir, err := ioutil.TempDir("", "numa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for node, cpulist := range []string{"0-3,8\n", "4-7,9-10\n"} {
+		path := fmt.Sprintf("%s/node%d", dir, node)
+		os.Mkdir(path, 0700)
+		if err := ioutil.WriteFile(path+"/cpulist", []byte(cpulist), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes, err := readNUMANodes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "map[0:0 1:0 2:0 3:0 4:1 5:1 6:1 7:1 8:0 9:1 10:1]"; fmt.Sprint(nodes) != expected {
+		t.Errorf("wrong NUMA nodes %v, expected %s", nodes, expected)
+	}
+}
+
+func TestRunToLineErrors(t *testing.T) {
+	p := New(nil)
+	if _, _, err := p.RunToLine("/tmp/main.go", 10); err == nil || err.Error() != "no code at /tmp/main.go:10" {
+		t.Errorf("wrong error for a line without code: %v", err)
+	}
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000, Kind: proc.NextBreakpoint}
+	if _, _, err := p.RunToLine("/tmp/main.go", 10); err == nil || err.Error() != "can not run to a line while a next or step is in progress" {
+		t.Errorf("wrong error while nexting: %v", err)
+	}
+	p.exited = true
+	if _, _, err := p.RunToLine("/tmp/main.go", 10); err == nil {
+		t.Errorf("no error after the process exited")
+	} else if _, isexited := err.(*proc.ProcessExitedError); !isexited {
+		t.Errorf("wrong error %v", err)
+	}
+}
+
+func TestRunToLine(t *testing.T) {
+	const (
+		stackAddr = 0x58000
+		tlsAddr   = 0x60000
+		g1        = 0x62000
+	)
+	tls := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tls, g1)
+	mem := map[uint64][]byte{
+		tlsAddr:   tls,
+		stackAddr: make([]byte, 0x100),
+		g1:        fakeG(1, proc.Grunning, 0),
+	}
+
+	pc := uint64(fakeMainAddr)
+	bps := make(map[uint64]bool)
+	handle := func(req string) string {
+		var addr uint64
+		switch {
+		case strings.HasPrefix(req, "vCont;c"):
+			// the second address of the line is reached first
+			pc = 0x40130
+			return "T05thread:1;threads:1;"
+		case strings.HasPrefix(req, "g"):
+			return fakeRuntimeRegs(pc, stackAddr+0x80, tlsAddr)
+		case strings.HasPrefix(req, "Z0"):
+			fmt.Sscanf(req, "Z0,%x,1", &addr)
+			bps[addr] = true
+			return "OK"
+		case strings.HasPrefix(req, "z0"):
+			fmt.Sscanf(req, "z0,%x,1", &addr)
+			delete(bps, addr)
+			return "OK"
+		}
+		return ""
+	}
+	client, server := net.Pipe()
+	go memoryStub(server, mem, handle)
+
+	var log bytes.Buffer
+	p := newFakeRuntimeTestProcess(t, NewRecordingConn(&log, client), false)
+
+	if addrs, err := lineAddrs(p, fakeMainFile, 10); err != nil || fmt.Sprintf("%#x", addrs) != "[0x40110 0x40130]" {
+		t.Fatalf("wrong addresses for line 10 %#x %v", addrs, err)
+	}
+
+	th, g, err := p.RunToLine(fakeMainFile, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th == nil || th.ThreadID() != 1 || g == nil || g.ID != 1 {
+		t.Fatalf("wrong stop %v %v", th, g)
+	}
+	for _, addr := range []uint64{0x40110, 0x40130} {
+		if !strings.Contains(log.String(), fmt.Sprintf("$Z0,%x,1#", addr)) {
+			t.Errorf("no breakpoint set at %#x\n%s", addr, log.String())
+		}
+	}
+	if len(bps) != 0 || len(p.breakpoints.M) != 0 {
+		t.Errorf("temporary breakpoints not removed: stub %v, process %v", bps, p.breakpoints.M)
+	}
+	client.Close()
+}
+
+func TestRunToFunction(t *testing.T) {
+	const (
+		stackAddr = 0x58000
+		tlsAddr   = 0x60000
+		arrayAddr = 0x61000
+		g1        = 0x62000
+	)
+	header, array := fakeAllgs(arrayAddr, []uint64{g1})
+	code := make([]byte, fakeTextEnd-fakeMainAddr)
+	for i := range code {
+		code[i] = 0x90
+	}
+	tls := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tls, g1)
+	mem := map[uint64][]byte{
+		fakeMainAddr:  code,
+		fakeAllgsAddr: header,
+		arrayAddr:     array,
+		tlsAddr:       tls,
+		stackAddr:     make([]byte, 0x100),
+		g1:            fakeG(1, proc.Grunning, 0),
+	}
+
+	// the target is stopped in runtime.newproc, before main.main starts
+	pc := uint64(fakeNewprocAddr)
+	bps := make(map[uint64]bool)
+	handle := func(req string) string {
+		var addr uint64
+		switch {
+		case strings.HasPrefix(req, "vCont;c"):
+			pc = fakeMainAddr
+			return "T05thread:1;threads:1;"
+		case strings.HasPrefix(req, "g"):
+			return fakeRuntimeRegs(pc, stackAddr+0x80, tlsAddr)
+		case strings.HasPrefix(req, "Z0"):
+			fmt.Sscanf(req, "Z0,%x,1", &addr)
+			bps[addr] = true
+			return "OK"
+		case strings.HasPrefix(req, "z0"):
+			fmt.Sscanf(req, "z0,%x,1", &addr)
+			delete(bps, addr)
+			return "OK"
+		}
+		return ""
+	}
+	client, server := net.Pipe()
+	go memoryStub(server, mem, handle)
+
+	var log bytes.Buffer
+	p := newFakeRuntimeTestProcess(t, NewRecordingConn(&log, client), false)
+
+	if err := p.RunToMain(); err != nil {
+		t.Fatal(err)
+	}
+	if regs, err := p.CurrentThread().Registers(false); err != nil || regs.PC() != fakeMainAddr {
+		t.Fatalf("main.main not reached: %v %v", regs, err)
+	}
+	if !strings.Contains(log.String(), fmt.Sprintf("$Z0,%x,1#", fakeMainAddr)) {
+		t.Errorf("no breakpoint set on main.main\n%s", log.String())
+	}
+	if len(bps) != 0 || len(p.breakpoints.M) != 0 {
+		t.Errorf("temporary breakpoint not removed: stub %v, process %v", bps, p.breakpoints.M)
+	}
+
+	if err := p.RunToMain(); err == nil || err.Error() != "main.main is already running" {
+		t.Errorf("wrong error with main.main running: %v", err)
+	}
+	client.Close()
+}
+
+func TestReadGAndM(t *testing.T) {
+	const (
+		stackAddr = 0x58000
+		tlsAddr   = 0x60000
+		g1        = 0x62000
+		m1        = 0x63000
+	)
+	tls := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tls, g1)
+	g := fakeG(1, proc.Grunning, 0)
+	binary.LittleEndian.PutUint64(g[fakeGM:], m1)
+	m := make([]byte, 8)
+	binary.LittleEndian.PutUint64(m, 0x1234) // procid
+	mem := map[uint64][]byte{
+		tlsAddr:   tls,
+		stackAddr: make([]byte, 0x100),
+		g1:        g,
+		m1:        m,
+	}
+	handle := func(req string) string {
+		if strings.HasPrefix(req, "g") {
+			return fakeRuntimeRegs(fakeMainAddr, stackAddr+0x80, tlsAddr)
+		}
+		return ""
+	}
+	client, server := net.Pipe()
+	go memoryStub(server, mem, handle)
+	p := newFakeRuntimeTestProcess(t, client, false)
+	th := p.threads[1]
+
+	gr, err := th.ReadG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gr.ID != 1 || gr.Thread == nil || gr.Thread.ThreadID() != 1 {
+		t.Errorf("wrong goroutine %#v", gr)
+	}
+
+	mv, err := th.ReadM(proc.LoadConfig{MaxStructFields: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mv.Addr != m1 || len(mv.Children) != 1 || mv.Children[0].Name != "procid" || fmt.Sprint(mv.Children[0].Value) != "4660" {
+		t.Errorf("wrong m %#v", mv)
+	}
+
+	// the thread is blocked, the stub couldn't tell us where its G is
+	th.regs.gaddr, th.regs.hasgaddr = 0, true
+	if _, err := th.ReadG(); err != ErrGUnavailable {
+		t.Errorf("expected ErrGUnavailable, got %v", err)
+	}
+	if _, err := th.ReadM(proc.LoadConfig{}); err != ErrGUnavailable {
+		t.Errorf("expected ErrGUnavailable, got %v", err)
+	}
+	client.Close()
+}
+
+// stepStub returns a handler for memoryStub simulating a thread of
+// newSingleThreadTestProcess that advances by one byte for every
+// instruction stepped.
+func stepStub(pc *uint64, tlsAddr uint64) func(req string) string {
+	return func(req string) string {
+		switch {
+		case strings.HasPrefix(req, "vCont;s"):
+			*pc++
+			return "T05thread:1;"
+		case strings.HasPrefix(req, "g"):
+			var regs [16]byte
+			binary.LittleEndian.PutUint64(regs[:], *pc)
+			binary.LittleEndian.PutUint64(regs[8:], tlsAddr)
+			return hex.EncodeToString(regs[:])
+		case strings.HasPrefix(req, "Z0"), strings.HasPrefix(req, "z0"):
+			return "OK"
+		}
+		return ""
+	}
+}
+
+func TestStepInstructions(t *testing.T) {
+	const tlsAddr = 0x60000
+	pc := uint64(0x1000)
+	client, server := net.Pipe()
+	go memoryStub(server, map[uint64][]byte{tlsAddr: make([]byte, 8)}, stepStub(&pc, tlsAddr))
+	var log bytes.Buffer
+	p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+	th := p.threads[1]
+	if err := th.reloadRegisters(); err != nil {
+		t.Fatal(err)
+	}
+	p.breakpoints.M[0x1003] = &proc.Breakpoint{Addr: 0x1003, Kind: proc.UserBreakpoint, HitCount: map[int]uint64{}}
+
+	// stepping stops at the breakpoint after 3 instructions
+	log.Reset()
+	if err := th.StepInstructions(10); err != nil {
+		t.Fatal(err)
+	}
+	if th.regs.PC() != 0x1003 || th.CurrentBreakpoint.Breakpoint == nil {
+		t.Errorf("wrong stop at %#x %v", th.regs.PC(), th.CurrentBreakpoint.Breakpoint)
+	}
+	sent := log.String()
+	if n := strings.Count(sent, `"$vCont;s`); n != 3 {
+		t.Errorf("%d instructions stepped, expected 3", n)
+	}
+	// G is read only once, after the last instruction
+	if n := strings.Count(sent, fmt.Sprintf(`"$m%x,`, tlsAddr)); n != 1 {
+		t.Errorf("G read %d times, expected 1\n%s", n, sent)
+	}
+	client.Close()
+}
+
+// BenchmarkStepInstructions compares StepInstructions with a loop calling
+// StepInstruction, which reloads all registers and G after every
+// instruction. The number of packets sent for every instruction is
+// reported as packets/inst.
+func BenchmarkStepInstructions(b *testing.B) {
+	const (
+		tlsAddr = 0x60000
+		n       = 10
+	)
+	for _, loop := range []bool{false, true} {
+		name := "StepInstructions"
+		if loop {
+			name = "StepInstructionLoop"
+		}
+		b.Run(name, func(b *testing.B) {
+			pc := uint64(0x1000)
+			client, server := net.Pipe()
+			go memoryStub(server, map[uint64][]byte{tlsAddr: make([]byte, 8)}, stepStub(&pc, tlsAddr))
+			var log bytes.Buffer
+			p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+			th := p.threads[1]
+			if err := th.reloadRegisters(); err != nil {
+				b.Fatal(err)
+			}
+			log.Reset()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !loop {
+					if err := th.StepInstructions(n); err != nil {
+						b.Fatal(err)
+					}
+					continue
+				}
+				for j := 0; j < n; j++ {
+					if err := th.StepInstruction(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.StopTimer()
+			packets := strings.Count(log.String(), replaySendPrefix+`"$`)
+			b.ReportMetric(float64(packets)/float64(b.N*n), "packets/inst")
+			client.Close()
+		})
+	}
+}
+
+func TestSaveBreakpoints(t *testing.T) {
+	p := New(nil)
+	p.bi.LookupFunc = map[string]*proc.Function{
+		"main.main": {Name: "main.main", Entry: 0x1000, End: 0x1100},
+		"main.f":    {Name: "main.f", Entry: 0x2000, End: 0x2040},
+	}
+	cond, _ := parser.ParseExpr("i == 10")
+	p.breakpoints.M[0x1010] = &proc.Breakpoint{ID: 2, FunctionName: "main.main", File: "main.go", Line: 5, Addr: 0x1010, Kind: proc.UserBreakpoint, Cond: cond}
+	p.breakpoints.M[0x2020] = &proc.Breakpoint{ID: 1, FunctionName: "main.f", File: "main.go", Line: 12, Addr: 0x2020, Kind: proc.UserBreakpoint, Disabled: true, Name: "f"}
+	p.breakpoints.M[0x1020] = &proc.Breakpoint{ID: 1, FunctionName: "main.main", Addr: 0x1020, Kind: proc.NextBreakpoint}
+
+	data, err := p.SaveBreakpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The target is loaded 0x10000 bytes higher and main.f disappeared.
+	q := New(nil)
+	q.bi.LookupFunc = map[string]*proc.Function{
+		"main.main": {Name: "main.main", Entry: 0x11000, End: 0x11100},
+	}
+	if err := q.LoadBreakpoints(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.savedBreakpoints) != 2 {
+		t.Fatalf("wrong number of saved breakpoints: %#v", q.savedBreakpoints)
+	}
+	f, m := &q.savedBreakpoints[0], &q.savedBreakpoints[1]
+	if f.ID != 1 || f.Name != "f" || !f.Disabled || f.FunctionOffset != 0x20 || f.Line != 12 {
+		t.Errorf("wrong saved breakpoint %#v", f)
+	}
+	if m.ID != 2 || m.Cond != "i == 10" || m.Disabled || m.FunctionOffset != 0x10 || m.Line != 5 {
+		t.Errorf("wrong saved breakpoint %#v", m)
+	}
+
+	if addr, err := savedBreakpointAddr(&q.bi, m); err != nil || addr != 0x11010 {
+		t.Errorf("wrong address for main.main breakpoint %#x %v", addr, err)
+	}
+	if _, err := savedBreakpointAddr(&q.bi, f); err == nil {
+		t.Errorf("no error for a breakpoint in a missing function")
+	}
+	m.FunctionOffset = 0x100
+	if _, err := savedBreakpointAddr(&q.bi, m); err == nil {
+		t.Errorf("no error for a breakpoint outside of its function")
+	}
+
+	if err := q.LoadBreakpoints([]byte(`[{"ID":1,"Cond":"i =="}]`)); err == nil {
+		t.Errorf("no error for a wrong condition")
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"OK", "W00"})
+
+	var log bytes.Buffer
+	p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+	p.threadStopInfo = false
+	p.conn.vContActions['C'] = true
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000, Kind: proc.UserBreakpoint}
+
+	killed, err := p.Terminate(0xf)
+	if _, exited := err.(proc.ProcessExitedError); !exited || killed {
+		t.Fatalf("wrong result %v %v", killed, err)
+	}
+	if !p.exited {
+		t.Errorf("process not marked as exited")
+	}
+	if sent := log.String(); !strings.Contains(sent, "$z0,1000,1#") || !strings.Contains(sent, "$vCont;C0f:1;c#") {
+		t.Errorf("wrong packets:\n%s", sent)
+	}
+}
+
+func TestTerminateNoCurrentThread(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"W00"})
+
+	var log bytes.Buffer
+	p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+	p.threadStopInfo = false
+	p.conn.vContActions['C'] = true
+	p.currentThread = nil
+
+	killed, err := p.Terminate(0xf)
+	if _, exited := err.(proc.ProcessExitedError); !exited || killed {
+		t.Fatalf("wrong result %v %v", killed, err)
+	}
+	if sent := log.String(); !strings.Contains(sent, "$vCont;C0f#") {
+		t.Errorf("signal not sent:\n%s", sent)
+	}
+}
+
+func TestTerminateTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		rdr := bufio.NewReader(server)
+		if _, err := rdr.ReadBytes('#'); err != nil {
+			return
+		}
+		rdr.Read(make([]byte, 2)) // checksum
+		// the target ignores the signal, answer the ctrl-c
+		if b, err := rdr.ReadByte(); err != nil || b != 0x03 {
+			server.Close()
+			return
+		}
+		buf := []byte("$T02thread:1;threads:1;#")
+		sum := checksum(buf)
+		server.Write(append(buf, hexdigit[sum>>4], hexdigit[sum&0xf]))
+		fakeStub(&bufferedConn{server, rdr}, []string{strings.Repeat("00", 16), "X09"})
+	}()
+
+	var log bytes.Buffer
+	p := newSingleThreadTestProcess(NewRecordingConn(&log, client))
+	p.threadStopInfo = false
+
+	killed, err := p.terminate(0xf, 20*time.Millisecond)
+	if _, exited := err.(proc.ProcessExitedError); !exited || !killed {
+		t.Fatalf("wrong result %v %v", killed, err)
+	}
+	if !p.exited || p.manualStopRequested {
+		t.Errorf("wrong state after kill: exited %v manual stop %v", p.exited, p.manualStopRequested)
+	}
+	if sent := log.String(); !strings.Contains(sent, "$C0f#") || !strings.Contains(sent, "$k#") {
+		t.Errorf("wrong packets:\n%s", sent)
+	}
+}
+
+func TestStackUsage(t *testing.T) {
+	for _, tc := range []struct {
+		sp, lo, hi  uint64
+		used, total uint64
+		err         bool
+	}{
+		{0xc000040f00, 0xc000040000, 0xc000041000, 0x100, 0x1000, false},
+		{0xc000040000, 0xc000040000, 0xc000041000, 0x1000, 0x1000, false},
+		{0xc00003ff80, 0xc000040000, 0xc000041000, 0x1080, 0x1000, false}, // overflow
+		{0xc000042000, 0xc000040000, 0xc000041000, 0, 0, true},
+		{0xc000040f00, 0, 0, 0, 0, true},
+	} {
+		used, total, err := stackUsage(tc.sp, tc.lo, tc.hi)
+		if (err != nil) != tc.err || used != tc.used || total != tc.total {
+			t.Errorf("stackUsage(%#x, %#x, %#x) = %#x, %#x, %v", tc.sp, tc.lo, tc.hi, used, total, err)
+		}
+	}
+
+	p := New(nil)
+	if _, _, err := p.GoroutineStackUsage(&proc.G{ID: 1}); err == nil {
+		t.Errorf("no error for a goroutine without a stack pointer")
+	}
+	if _, _, err := p.GoroutineStackUsage(&proc.G{ID: 1, SP: 0xc000040f00}); err == nil {
+		t.Errorf("no error for a goroutine without stack bounds")
+	}
+}
+
+func TestMultipleStopReasons(t *testing.T) {
+	conn := newTestConn(nil)
+	description := hex.EncodeToString([]byte("4100 0 4104"))
+	_, sp, err := conn.parseStopPacket([]byte("T05thread:1;reason:breakpoint;reason:watchpoint;description:"+description+";"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sp.reasons.has(stopReasonBreakpoint) || !sp.reasons.has(stopReasonWatchpoint) || sp.reason != "breakpoint,watchpoint" || sp.watchAddr != 4100 {
+		t.Errorf("wrong stop packet %#v", sp)
+	}
+	if !sp.atBreakpoint() {
+		t.Errorf("breakpoint stop reason lost")
+	}
+	for _, tc := range []struct {
+		resp         string
+		atBreakpoint bool
+	}{
+		{"T05thread:1;", true},
+		{"T05thread:1;watch:1004;", false},
+		{"T05thread:1;reason:trace;", false},
+		{"T05thread:1;reason:exec;", false},
+		{"T05thread:1;swbreak:;watch:1004;", true},
+	} {
+		_, sp, err := conn.parseStopPacket([]byte(tc.resp), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sp.atBreakpoint() != tc.atBreakpoint {
+			t.Errorf("%s: expected atBreakpoint %v", tc.resp, tc.atBreakpoint)
+		}
+	}
+
+	pc := func(addr uint64) string {
+		var buf [16]byte
+		binary.LittleEndian.PutUint64(buf[:], addr)
+		return hex.EncodeToString(buf[:])
+	}
+	client, server := net.Pipe()
+	go fakeStub(server, []string{"T05thread:1;threads:1;swbreak:;watch:1004;", pc(0x1000), "0000000000000000"})
+
+	p := newSingleThreadTestProcess(client)
+	p.threadStopInfo = false
+	p.breakpoints.M[0x1000] = &proc.Breakpoint{Addr: 0x1000}
+	wp := &Watchpoint{Expr: "x", Addr: 0x1000, Size: 8, Kind: WatchWrite}
+	p.watchpoints = append(p.watchpoints, wp)
+
+	th, err := p.ContinueOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread := th.(*Thread)
+	if kind, _ := thread.StopReason(); kind != StopBreakpoint || thread.CurrentBreakpoint.Breakpoint == nil || thread.Watchpoint() != wp {
+		t.Errorf("wrong stop %v %v %v", kind, thread.CurrentBreakpoint.Breakpoint, thread.Watchpoint())
+	}
+	if kinds := thread.StopKinds(); fmt.Sprint(kinds) != fmt.Sprint([]StopKind{StopBreakpoint, StopWatchpoint}) {
+		t.Errorf("wrong stop kinds %v", kinds)
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeStub(server, []string{
+		"F5", "Fc;./server\x00-v\x00", "F0;", "F0",
+		"F6", "Fe;A=1\x00PATH=/bin\x00", "F0;", "F0",
+		"F-1,2",
+		"pid:1f;args:2e2f736572766572-2d76;",
+		"E01",
+	})
+
+	var log bytes.Buffer
+	p := New(nil)
+	p.conn = *newTestConn(NewRecordingConn(&log, client))
+	p.conn.pid = 0x1f
+	p.bi.GOOS = "linux"
+
+	args, err := p.CommandLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%q", args) != `["./server" "-v"]` {
+		t.Errorf("wrong command line %q", args)
+	}
+	env, err := p.Environment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%q", env) != `["A=1" "PATH=/bin"]` {
+		t.Errorf("wrong environment %q", env)
+	}
+	if sent := log.String(); !strings.Contains(sent, "$vFile:open:"+hex.EncodeToString([]byte("/proc/31/cmdline"))+",0,0#") {
+		t.Errorf("wrong packets:\n%s", sent)
+	}
+
+	// /proc can't be read, the arguments are reported by qProcessInfoPID
+	args, err = p.CommandLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%q", args) != `["./server" "-v"]` {
+		t.Errorf("wrong command line %q", args)
+	}
+
+	// debugserver doesn't report the arguments and kern.procargs2 is only
+	// read for a local stub
+	p.bi.GOOS = "darwin"
+	if _, err := p.CommandLine(); err != ErrProcessInfoUnavailable {
+		t.Errorf("expected ErrProcessInfoUnavailable, got %v", err)
+	}
+	if _, err := p.Environment(); err != ErrProcessInfoUnavailable {
+		t.Errorf("expected ErrProcessInfoUnavailable, got %v", err)
+	}
+}
+
+func TestSetPassSignals(t *testing.T) {
+	p, log := newFakeStubProcess([]string{"OK"})
+	p.conn.threadSuffixSupported = true
+
+	// the stub didn't list QPassSignals in its qSupported reply
+	if err := p.SetPassSignals([]int{0x17}); err != nil {
+		t.Fatal(err)
+	}
+	if log.Len() != 0 {
+		t.Errorf("packets sent to a stub that doesn't support QPassSignals: %q", log.String())
+	}
+
+	p.conn.passSignalsSupported = true
+	if err := p.SetPassSignals([]int{0x17, 0x1b}); err != nil {
+		t.Fatal(err)
+	}
+	if sent := log.String(); !strings.Contains(sent, "$QPassSignals:17;1b#") {
+		t.Errorf("QPassSignals not sent: %q", sent)
+	}
+	if got := p.PassSignals(); len(got) != 2 || got[0] != 0x17 || got[1] != 0x1b {
+		t.Errorf("wrong pass signals %v", got)
+	}
+}
@@ -0,0 +1,176 @@
+package gdbserial
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/derekparker/delve/pkg/logflags"
+)
+
+// StubTransport starts a stub on a remote host and makes it possible for
+// the stub to connect back to us, see LLDBLaunchTransport.
+type StubTransport interface {
+	// Command returns the (not yet started) command that runs the stub
+	// command line args on the remote host. Connections to 127.0.0.1:port
+	// on the remote host must be forwarded to 127.0.0.1:port on the local
+	// host.
+	Command(port int, args []string) *exec.Cmd
+
+	// Cleanup is called by Detach after the command returned by Command
+	// exited or was killed, it should terminate the stub on the remote host
+	// if it's still running.
+	Cleanup() error
+}
+
+// SSHTransport is a StubTransport that uses the ssh command to start the
+// stub on Target, the forwarding is done with a remote port forward (-R).
+// Authentication must not require user interaction since ssh will run in
+// the background.
+type SSHTransport struct {
+	Target  string   // destination, as passed to ssh, for example "user@host"
+	Options []string // additional options passed to ssh
+
+	pid remotePidWriter
+}
+
+// Command implements StubTransport.
+func (t *SSHTransport) Command(port int, args []string) *exec.Cmd {
+	// The remote shell prints its PID and then replaces itself with the
+	// stub, so that we know what to kill in Cleanup.
+	var remote bytes.Buffer
+	remote.WriteString("echo $$; exec")
+	for _, arg := range args {
+		remote.WriteByte(' ')
+		remote.WriteString(shellQuote(arg))
+	}
+
+	sshargs := make([]string, 0, len(t.Options)+8)
+	sshargs = append(sshargs, t.Options...)
+	sshargs = append(sshargs, "-o", "BatchMode=yes", "-o", "ExitOnForwardFailure=yes")
+	sshargs = append(sshargs, "-R", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", port, port))
+	sshargs = append(sshargs, "--", t.Target, remote.String())
+
+	cmd := exec.Command("ssh", sshargs...)
+	t.pid = remotePidWriter{}
+	if logflags.LLDBServerOutput() || logflags.GdbWire() {
+		t.pid.out = os.Stdout
+	}
+	cmd.Stdout = &t.pid
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// Cleanup implements StubTransport.
+func (t *SSHTransport) Cleanup() error {
+	pid := t.pid.get()
+	if pid <= 0 {
+		return nil
+	}
+	args := make([]string, 0, len(t.Options)+4)
+	args = append(args, t.Options...)
+	args = append(args, "-o", "BatchMode=yes", "--", t.Target, fmt.Sprintf("kill %d 2>/dev/null || true", pid))
+	return exec.Command("ssh", args...).Run()
+}
+
+// remotePidWriter reads the PID of the remote stub from the first line of
+// its output, the rest of the output is copied to out.
+type remotePidWriter struct {
+	mu   sync.Mutex
+	line []byte
+	pid  int
+	done bool
+	out  io.Writer
+}
+
+func (w *remotePidWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(data)
+	if !w.done {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			w.line = append(w.line, data...)
+			return n, nil
+		}
+		w.line = append(w.line, data[:idx]...)
+		w.pid, _ = strconv.Atoi(strings.TrimSpace(string(w.line)))
+		w.done = true
+		data = data[idx+1:]
+	}
+	if w.out != nil && len(data) > 0 {
+		w.out.Write(data)
+	}
+	return n, nil
+}
+
+func (w *remotePidWriter) get() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pid
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// LLDBLaunchRemote starts an instance of lldb-server on sshTarget using
+// ssh and connects to it, asking it to launch the specified target program
+// with the specified arguments (cmd) on the specified directory wd of the
+// remote host.
+// The executable must also be available locally at the path cmd[0], use
+// LLDBLaunchTransport if it isn't.
+func LLDBLaunchRemote(sshTarget string, cmd []string, wd string) (*Process, error) {
+	if len(cmd) == 0 {
+		return nil, errors.New("no command specified")
+	}
+	if strings.HasPrefix(sshTarget, "-") {
+		return nil, fmt.Errorf("invalid ssh destination %q", sshTarget)
+	}
+	return LLDBLaunchTransport(&SSHTransport{Target: sshTarget}, cmd, wd, cmd[0])
+}
+
+// LLDBLaunchTransport starts an instance of lldb-server on a remote host
+// using transport and connects to it, asking it to launch the specified
+// target program with the specified arguments (cmd) on the specified
+// directory wd of the remote host.
+// Path is the path of a local copy of the executable, it is used to load
+// the debug information.
+func LLDBLaunchTransport(transport StubTransport, cmd []string, wd string, path string) (*Process, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	// The same port number is used on the remote host, this only works if
+	// the port isn't already in use there, see unusedPort.
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	stub := transport.Command(port, []string{"lldb-server", "gdbserver", "--reverse-connect", fmt.Sprintf("127.0.0.1:%d", port)})
+	stub.SysProcAttr = backgroundSysProcAttr()
+	if err := stub.Start(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	p := New(stub.Process)
+	p.stubTransport = transport
+	// The command line of the inferior is sent with the 'A' packet during the
+	// handshake.
+	p.conn.launchArgs = cmd
+	p.conn.launchWd = wd
+
+	if err := p.Listen(listener, path, 0); err != nil {
+		p.process.Kill()
+		transport.Cleanup()
+		return nil, err
+	}
+	return p, nil
+}
@@ -246,3 +246,27 @@ func TestCheckpoints(t *testing.T) {
 		}
 	})
 }
+
+func TestRestoreCheckpoint(t *testing.T) {
+	protest.AllowRecording(t)
+	withTestRecording("continuetestprog", t, func(p *gdbserial.Process, fixture protest.Fixture) {
+		setFunctionBreakpoint(p, t, "main.main")
+		assertNoError(proc.Continue(p), t, "Continue")
+		when0, loc0 := getPosition(p, t)
+
+		cpid, err := p.CreateCheckpoint("main.main")
+		assertNoError(err, t, "CreateCheckpoint")
+
+		assertNoError(proc.Next(p), t, "Next")
+		assertNoError(p.RestoreCheckpoint(cpid), t, "RestoreCheckpoint")
+		when1, loc1 := getPosition(p, t)
+		if loc1.PC != loc0.PC || when1 != when0 {
+			t.Fatalf("position mismatch %q %#x != %q %#x", when1, loc1.PC, when0, loc0.PC)
+		}
+
+		assertNoError(p.ClearCheckpoint(cpid), t, "ClearCheckpoint")
+		if err := p.RestoreCheckpoint(cpid); err == nil {
+			t.Fatalf("restored deleted checkpoint")
+		}
+	})
+}
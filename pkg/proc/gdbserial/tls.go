@@ -0,0 +1,201 @@
+package gdbserial
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrCErrnoUnsupported is returned by Thread.CErrno when the location of
+// errno is not known for the target.
+var ErrCErrnoUnsupported = errors.New("reading the C errno is unsupported on this platform")
+
+// muslErrnoOffset is the offset of errno_val in musl's struct pthread, which
+// is pointed to by the thread pointer (fs_base) on amd64.
+const muslErrnoOffset = 0x34
+
+// glibcErrnoSymbols are the names of the TLS variable holding errno in
+// glibc.
+var glibcErrnoSymbols = []string{"__libc_errno", "errno"}
+
+type libcKind uint8
+
+const (
+	libcUnknown libcKind = iota
+	libcGlibc
+	libcMusl
+)
+
+// findLibc returns the kind of C library loaded by the target and its
+// index in libs.
+func findLibc(libs []SharedLibrary) (libcKind, int) {
+	for i, lib := range libs {
+		base := filepath.Base(lib.Name)
+		switch {
+		case strings.HasPrefix(base, "libc.musl-") || strings.HasPrefix(base, "ld-musl-"):
+			return libcMusl, i
+		case base == "libc.so.6":
+			return libcGlibc, i
+		}
+	}
+	return libcUnknown, -1
+}
+
+// CErrno returns the value of the C errno variable of the thread, for
+// example to find out why the last C function called through cgo failed.
+// Only linux/amd64 with glibc or musl is supported, the address of errno
+// is computed from the thread pointer (fs_base): musl stores errno in its
+// thread descriptor while glibc uses a TLS variable, whose offset from the
+// thread pointer depends on the TLS segments of all the images loaded at
+// startup (see staticTLSOffsets), which are read from the local file
+// system and therefore only supported if the stub was started locally.
+// ErrCErrnoUnsupported is returned for other targets.
+func (t *Thread) CErrno() (int, error) {
+	if t.p.bi.GOOS != "linux" {
+		return 0, ErrCErrnoUnsupported
+	}
+	libs, err := t.p.SharedLibraries()
+	if err != nil {
+		return 0, err
+	}
+	kind, idx := findLibc(libs)
+	if kind == libcUnknown {
+		return 0, ErrCErrnoUnsupported
+	}
+	if kind == libcGlibc && (t.p.process == nil || t.p.stubTransport != nil) {
+		// The images are read from the local file system, they are only
+		// known to be the ones loaded by the target if the stub was started
+		// locally by us.
+		return 0, ErrCErrnoUnsupported
+	}
+
+	tp, err := t.FSBase()
+	if err != nil {
+		return 0, err
+	}
+	var addr uint64
+	switch kind {
+	case libcMusl:
+		addr = tp + muslErrnoOffset
+	case libcGlibc:
+		off, err := glibcErrnoOffset(libs[:idx+1])
+		if err != nil {
+			return 0, err
+		}
+		addr = tp - off
+	}
+
+	var buf [4]byte
+	if _, err := t.ReadMemory(buf[:], uintptr(addr)); err != nil {
+		return 0, err
+	}
+	return int(int32(binary.LittleEndian.Uint32(buf[:]))), nil
+}
+
+// glibcErrnoOffset returns the distance between the glibc errno variable
+// and the thread pointer, libc must be the last image of libs.
+func glibcErrnoOffset(libs []SharedLibrary) (uint64, error) {
+	var blocks []tlsBlock
+	var symoff uint64
+	for i, lib := range libs {
+		f, err := elf.Open(lib.Name)
+		if err != nil {
+			if i == 0 || i == len(libs)-1 {
+				return 0, fmt.Errorf("could not open %s: %v", lib.Name, err)
+			}
+			// images that aren't available locally, like the vDSO, are
+			// assumed not to have a TLS segment.
+			continue
+		}
+		block, hastls := tlsSegment(f)
+		if i == len(libs)-1 {
+			var found bool
+			symoff, found = tlsSymbol(f, glibcErrnoSymbols)
+			if !hastls || !found {
+				f.Close()
+				return 0, fmt.Errorf("errno not found in %s", lib.Name)
+			}
+		}
+		f.Close()
+		if hastls {
+			blocks = append(blocks, block)
+		}
+	}
+	offs := staticTLSOffsets(blocks)
+	return offs[len(offs)-1] - symoff, nil
+}
+
+// tlsBlock describes the TLS segment of an image.
+type tlsBlock struct {
+	size      uint64
+	align     uint64
+	firstbyte uint64 // offset of the first byte of the block from an aligned address
+}
+
+// tlsSegment returns the TLS segment of f, if it has one.
+func tlsSegment(f *elf.File) (tlsBlock, bool) {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_TLS {
+			continue
+		}
+		align := prog.Align
+		if align == 0 {
+			align = 1
+		}
+		return tlsBlock{size: prog.Memsz, align: align, firstbyte: -prog.Vaddr & (align - 1)}, true
+	}
+	return tlsBlock{}, false
+}
+
+// tlsSymbol returns the offset, inside the TLS segment of f, of the first
+// TLS symbol in names that f defines.
+func tlsSymbol(f *elf.File, names []string) (uint64, bool) {
+	dynsyms, _ := f.DynamicSymbols()
+	syms, _ := f.Symbols()
+	for _, name := range names {
+		for _, symtab := range [][]elf.Symbol{dynsyms, syms} {
+			for _, sym := range symtab {
+				if sym.Name == name && elf.ST_TYPE(sym.Info) == elf.STT_TLS && sym.Section != elf.SHN_UNDEF {
+					return sym.Value, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// staticTLSOffsets returns, for each block, the distance between the
+// thread pointer and the start of the block, the blocks must be in the
+// order the dynamic linker assigned them module IDs (the order images are
+// loaded). This is the algorithm used by _dl_determine_tlsoffset in glibc
+// on architectures where the TLS blocks are below the thread pointer
+// (TLS_TCB_AT_TP), including amd64: each block is placed below the
+// previous ones, using the gaps left by alignment when possible.
+func staticTLSOffsets(blocks []tlsBlock) []uint64 {
+	roundup := func(x, align uint64) uint64 {
+		return (x + align - 1) &^ (align - 1)
+	}
+	offs := make([]uint64, len(blocks))
+	var offset, freetop, freebottom uint64
+	for i, b := range blocks {
+		if freebottom-freetop >= b.size {
+			off := roundup(freetop+b.size-b.firstbyte, b.align) + b.firstbyte
+			if off <= freebottom {
+				freetop = off
+				offs[i] = off
+				continue
+			}
+		}
+		off := roundup(offset+b.size-b.firstbyte, b.align) + b.firstbyte
+		if off > offset+b.size+(freebottom-freetop) {
+			freetop = offset
+			freebottom = off - b.size
+		}
+		offset = off
+		offs[i] = off
+	}
+	return offs
+}
@@ -45,6 +45,14 @@ func (m *memCache) WriteMemory(addr uintptr, data []byte) (written int, err erro
 	return m.mem.WriteMemory(addr, data)
 }
 
+// CacheMemory returns a MemoryReadWriter that reads the size bytes at addr
+// from mem once and then serves reads inside that range from its copy,
+// all other reads and all writes go to mem. If the range can not be read
+// mem is returned.
+func CacheMemory(mem MemoryReadWriter, addr uintptr, size int) MemoryReadWriter {
+	return cacheMemory(mem, addr, size)
+}
+
 func cacheMemory(mem MemoryReadWriter, addr uintptr, size int) MemoryReadWriter {
 	if !cacheEnabled {
 		return mem
@@ -12,7 +12,7 @@ type moduleData struct {
 }
 
 func loadModuleData(bi *BinaryInfo, mem MemoryReadWriter) (err error) {
-	bi.loadModuleDataOnce.Do(func() {
+	bi.shared.loadModuleDataOnce.Do(func() {
 		scope := globalScope(bi, mem)
 		var md *Variable
 		md, err = scope.findGlobal("runtime.firstmoduledata")
@@ -43,7 +43,7 @@ func loadModuleData(bi *BinaryInfo, mem MemoryReadWriter) (err error) {
 				return
 			}
 
-			bi.moduleData = append(bi.moduleData, moduleData{uintptr(types), uintptr(etypes), typemapVar})
+			bi.shared.moduleData = append(bi.shared.moduleData, moduleData{uintptr(types), uintptr(etypes), typemapVar})
 
 			md = nextVar.maybeDereference()
 			if md.Unreadable != nil {
@@ -63,9 +63,9 @@ func resolveTypeOff(bi *BinaryInfo, typeAddr uintptr, off uintptr, mem MemoryRea
 	}
 
 	var md *moduleData
-	for i := range bi.moduleData {
-		if typeAddr >= bi.moduleData[i].types && typeAddr < bi.moduleData[i].etypes {
-			md = &bi.moduleData[i]
+	for i := range bi.shared.moduleData {
+		if typeAddr >= bi.shared.moduleData[i].types && typeAddr < bi.shared.moduleData[i].etypes {
+			md = &bi.shared.moduleData[i]
 		}
 	}
 
@@ -99,7 +99,7 @@ func resolveNameOff(bi *BinaryInfo, typeAddr uintptr, off uintptr, mem MemoryRea
 		return "", "", 0, err
 	}
 
-	for _, md := range bi.moduleData {
+	for _, md := range bi.shared.moduleData {
 		if typeAddr >= md.types && typeAddr < md.etypes {
 			return loadName(bi, md.types+off, mem)
 		}
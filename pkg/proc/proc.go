@@ -517,7 +517,7 @@ func FrameToScope(bi *BinaryInfo, thread MemoryReadWriter, g *G, frame Stackfram
 	if g != nil {
 		gvar = g.variable
 	}
-	s := &EvalScope{Location: frame.Call, Regs: frame.Regs, Mem: thread, Gvar: gvar, BinInfo: bi, frameOffset: frame.FrameOffset()}
+	s := &EvalScope{Location: frame.Call, Regs: frame.Regs, Mem: thread, Gvar: gvar, BinInfo: bi, g: g, frameOffset: frame.FrameOffset()}
 	s.PC = frame.lastpc
 	return s
 }
@@ -1,7 +1,16 @@
 package proc
 
 import (
+	"bytes"
+	"debug/dwarf"
+	"encoding/binary"
+	"fmt"
+	"go/constant"
+	"reflect"
 	"testing"
+
+	"github.com/derekparker/delve/pkg/dwarf/dwarfbuilder"
+	"github.com/derekparker/delve/pkg/dwarf/op"
 )
 
 func TestIssue554(t *testing.T) {
@@ -12,3 +21,287 @@ func TestIssue554(t *testing.T) {
 		t.Fatalf("should be false")
 	}
 }
+
+// Layout of the goroutine stack used by newFakeStackIterator.
+const (
+	fakeStackLo    = 0xc000100000
+	fakeStackHi    = 0xc000100100
+	fakeStackSP    = fakeStackHi - 0x40
+	fakeStackRetPC = 0x401234 // return address stored at fakeStackSP
+)
+
+// newFakeStackIterator returns a stackIterator for a linux/amd64 goroutine
+// stopped in a function without a frame descriptor entry, whose stack
+// contains only the return address at fakeStackSP. The lower bound of the
+// stack is set to lo and BP to bp.
+func newFakeStackIterator(bi *BinaryInfo, lo, bp uint64) *stackIterator {
+	stack := make([]byte, fakeStackHi-fakeStackLo)
+	binary.LittleEndian.PutUint64(stack[fakeStackSP-fakeStackLo:], fakeStackRetPC)
+	regs := op.DwarfRegisters{ByteOrder: binary.LittleEndian, PCRegNum: amd64DwarfIPRegNum, SPRegNum: amd64DwarfSPRegNum, BPRegNum: amd64DwarfBPRegNum}
+	regs.AddReg(amd64DwarfIPRegNum, op.DwarfRegisterFromUint64(0x450000))
+	regs.AddReg(amd64DwarfSPRegNum, op.DwarfRegisterFromUint64(fakeStackSP))
+	regs.AddReg(amd64DwarfBPRegNum, op.DwarfRegisterFromUint64(bp))
+	return &stackIterator{pc: regs.PC(), regs: regs, top: true, bi: bi, mem: &memCache{fakeStackLo, stack, nil}, stackhi: fakeStackHi, stacklo: lo}
+}
+
+func TestSPUnwindFallback(t *testing.T) {
+	// A frame without a frame descriptor entry and without a valid frame
+	// pointer, like runtime.morestack called from the prologue of a function
+	// or runtime.systemstack switching stacks, must be unwound using SP.
+	bi := NewBinaryInfo("linux", "amd64")
+	bi.SetStrictUnwind(true)
+	sp := uint64(fakeStackSP)
+
+	for _, bp := range []uint64{0, 0x1000, fakeStackHi + 0x100} {
+		it := newFakeStackIterator(&bi, fakeStackLo, bp)
+		callFrameRegs, ret, retaddr := it.advanceRegs()
+		if it.err != nil {
+			t.Fatalf("bp=%#x: unwind error: %v", bp, it.err)
+		}
+		if ret != fakeStackRetPC || retaddr != sp {
+			t.Errorf("bp=%#x: return address %#x at %#x, expected %#x at %#x", bp, ret, retaddr, uint64(fakeStackRetPC), sp)
+		}
+		if got := callFrameRegs.SP(); got != sp+8 {
+			t.Errorf("bp=%#x: caller SP %#x, expected %#x", bp, got, sp+8)
+		}
+		if got := callFrameRegs.BP(); got != bp {
+			t.Errorf("bp=%#x: caller BP %#x, expected %#x", bp, got, bp)
+		}
+	}
+
+	// the default unwinder, used by native and core targets, always follows
+	// BP in frames without a frame descriptor entry
+	bi.SetStrictUnwind(false)
+	bp := sp - 0x20
+	if _, _, retaddr := newFakeStackIterator(&bi, fakeStackLo, bp).advanceRegs(); retaddr != bp+8 {
+		t.Errorf("default unwinder: return address at %#x, expected %#x", retaddr, bp+8)
+	}
+}
+
+func TestParseLabelMap(t *testing.T) {
+	str := func(name, s string) Variable {
+		return Variable{Name: name, Kind: reflect.String, Value: constant.MakeString(s)}
+	}
+	// Go 1.9 to 1.23: map[string]string
+	m := &Variable{Kind: reflect.Map, Children: []Variable{str("", "worker"), str("", "high"), str("", "id"), str("", "3")}}
+	// later versions: struct { list []label }
+	pair := func(k, v string) Variable {
+		return Variable{Kind: reflect.Struct, Children: []Variable{str("key", k), str("value", v)}}
+	}
+	s := &Variable{Kind: reflect.Struct, Children: []Variable{
+		{Name: "LabelSet", Kind: reflect.Struct, Children: []Variable{
+			{Name: "list", Kind: reflect.Slice, Children: []Variable{pair("id", "3"), pair("worker", "high")}},
+		}},
+	}}
+	for _, v := range []*Variable{m, s} {
+		labels := parseLabelMap(v)
+		if len(labels) != 2 || labels["worker"] != "high" || labels["id"] != "3" {
+			t.Errorf("wrong labels %v", labels)
+		}
+	}
+	if labels := parseLabelMap(&Variable{Kind: reflect.Int}); labels != nil {
+		t.Errorf("labels from unknown layout %v", labels)
+	}
+}
+
+func TestStackBoundsCheck(t *testing.T) {
+	// A return address read from outside of the goroutine stack terminates
+	// the stacktrace with a StackCorruptionError.
+	bi := NewBinaryInfo("linux", "amd64")
+	bi.SetStrictUnwind(true)
+	sp := uint64(fakeStackSP)
+
+	frames, err := newFakeStackIterator(&bi, fakeStackLo, 0).stacktrace(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		if _, corrupt := frame.Err.(*StackCorruptionError); corrupt {
+			t.Errorf("stack corruption reported for a valid stack: %v", frame.Err)
+		}
+	}
+	if len(frames) == 0 || frames[0].Ret != fakeStackRetPC {
+		t.Errorf("wrong frames %v", frames)
+	}
+
+	// the slot containing the return address is below stack.lo
+	frames, err = newFakeStackIterator(&bi, sp+8, 0).stacktrace(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("wrong number of frames %d", len(frames))
+	}
+	if serr, corrupt := frames[1].Err.(*StackCorruptionError); !corrupt || serr.Addr != sp {
+		t.Errorf("wrong error %v", frames[1].Err)
+	}
+
+	// the default unwinder, used by native and core targets, doesn't check
+	// the stack bounds
+	bi.SetStrictUnwind(false)
+	frames, err = newFakeStackIterator(&bi, sp+8, sp-8).stacktrace(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, frame := range frames {
+		if _, corrupt := frame.Err.(*StackCorruptionError); corrupt {
+			t.Errorf("stack corruption reported by the default unwinder: %v", frame.Err)
+		}
+	}
+	if len(frames) != 1 || frames[0].Ret != fakeStackRetPC {
+		t.Errorf("wrong frames %v", frames)
+	}
+}
+
+func TestPCToLineCache(t *testing.T) {
+	var c pcToLineCache
+	for pc := uint64(0); pc < pcToLineCacheSize; pc++ {
+		c.add(pcToLineEntry{pc: pc, line: int(pc)})
+	}
+	// make 0 the most recently used entry, 1 is evicted instead
+	if e, ok := c.get(0); !ok || e.line != 0 {
+		t.Fatalf("entry 0 not found")
+	}
+	c.add(pcToLineEntry{pc: pcToLineCacheSize})
+	if _, ok := c.get(1); ok {
+		t.Errorf("entry 1 not evicted")
+	}
+	for _, pc := range []uint64{0, 2, pcToLineCacheSize} {
+		if _, ok := c.get(pc); !ok {
+			t.Errorf("entry %d evicted", pc)
+		}
+	}
+	if c.lru.Len() != pcToLineCacheSize || len(c.entries) != pcToLineCacheSize {
+		t.Errorf("wrong cache size %d %d", c.lru.Len(), len(c.entries))
+	}
+
+	bi := NewBinaryInfo("linux", "amd64")
+	fn := &Function{Name: "main.main"}
+	bi.shared.pcToLineCache.add(pcToLineEntry{pc: 0x401000, file: "main.go", line: 10, fn: fn})
+	if f, ln, fn2 := bi.PCToLine(0x401000); f != "main.go" || ln != 10 || fn2 != fn {
+		t.Errorf("cached entry not used: %s:%d %v", f, ln, fn2)
+	}
+	bi.ResetPCToLineCache()
+	if f, ln, fn2 := bi.PCToLine(0x401000); f != "" || ln != 0 || fn2 != nil {
+		t.Errorf("cache not reset: %s:%d %v", f, ln, fn2)
+	}
+}
+
+// pcToLineBenchBinaryInfo returns a BinaryInfo for nfuncs functions of
+// 0x100 bytes, starting at 0x400000, with a line table entry every 0x10
+// bytes.
+func pcToLineBenchBinaryInfo(b *testing.B, nfuncs int) *BinaryInfo {
+	const (
+		textStart  = 0x400000
+		funcSize   = 0x100
+		lineBase   = -5
+		lineRange  = 14
+		opcodeBase = 10
+	)
+	dwb := dwarfbuilder.New()
+	for i := 0; i < nfuncs; i++ {
+		dwb.AddSubprogram(fmt.Sprintf("main.f%d", i), textStart+uint64(i)*funcSize, textStart+uint64(i+1)*funcSize)
+		dwb.TagClose()
+	}
+	abbrev, aranges, frame, info, _, pubnames, ranges, str, loc, err := dwb.Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var hdr bytes.Buffer
+	// min_inst_length, default_is_stmt, line_base, line_range, opcode_base
+	hdr.Write([]byte{1, 1, byte(lineBase & 0xff), lineRange, opcodeBase})
+	// standard_opcode_lengths
+	hdr.Write([]byte{0, 1, 1, 1, 1, 0, 0, 0, 1})
+	// no include directories, a single file
+	hdr.WriteByte(0)
+	hdr.WriteString("/tmp/main.go\x00")
+	hdr.Write([]byte{0, 0, 0, 0})
+
+	var prog bytes.Buffer
+	prog.Write([]byte{0, 9, 2}) // DW_LNE_set_address
+	binary.Write(&prog, binary.LittleEndian, uint64(textStart))
+	prog.WriteByte(1) // DW_LNS_copy
+	for i := 0; i < nfuncs*funcSize/0x10; i++ {
+		// special opcode advancing the address by 0x10 and the line by 1
+		prog.WriteByte(byte(1 - lineBase + lineRange*0x10 + opcodeBase))
+	}
+	prog.Write([]byte{0, 1, 1}) // DW_LNE_end_sequence
+
+	var line bytes.Buffer
+	binary.Write(&line, binary.LittleEndian, uint32(2+4+hdr.Len()+prog.Len()))
+	binary.Write(&line, binary.LittleEndian, uint16(2))
+	binary.Write(&line, binary.LittleEndian, uint32(hdr.Len()))
+	line.Write(hdr.Bytes())
+	line.Write(prog.Bytes())
+
+	dwdata, err := dwarf.New(abbrev, aranges, frame, info, line.Bytes(), pubnames, ranges, str)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bi := NewBinaryInfo("linux", "amd64")
+	bi.LoadFromData(dwdata, frame, line.Bytes(), loc)
+	return &bi
+}
+
+// BenchmarkPCToLine resolves the PCs of the stack frames of 2000
+// goroutines, 10 frames each, as listing all goroutine stacks does. Most
+// goroutines are parked in the same few functions, so the frames only
+// contain 500 distinct PCs.
+// The "cold" benchmark starts every listing with an empty cache and
+// reports its hit rate as hits/op, "warm" lists the stacks again with the
+// cache filled by the previous listing and "nocache" does the same lookups
+// without the cache.
+func BenchmarkPCToLine(b *testing.B) {
+	const (
+		nfuncs      = 1000
+		ngoroutines = 2000
+		depth       = 10
+		distinct    = 500
+	)
+	bi := pcToLineBenchBinaryInfo(b, nfuncs)
+	pcs := make([]uint64, 0, ngoroutines*depth)
+	for i := 0; i < ngoroutines*depth; i++ {
+		// a PC in the middle of a line, spread over all functions
+		j := uint64(i*7919) % distinct
+		pcs = append(pcs, 0x400000+j*(nfuncs*0x100/distinct)+0x18)
+	}
+	if f, l, fn := bi.PCToLine(pcs[1]); f != "/tmp/main.go" || l == 0 || fn == nil {
+		b.Fatalf("wrong line info %s:%d %v", f, l, fn)
+	}
+
+	b.Run("cold", func(b *testing.B) {
+		bi.ResetPCToLineCache()
+		hits := 0
+		for _, pc := range pcs {
+			if _, ok := bi.shared.pcToLineCache.get(pc); ok {
+				hits++
+			}
+			bi.PCToLine(pc)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			bi.ResetPCToLineCache()
+			for _, pc := range pcs {
+				bi.PCToLine(pc)
+			}
+		}
+		b.ReportMetric(float64(hits)/float64(len(pcs)), "hits/op")
+	})
+	b.Run("warm", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, pc := range pcs {
+				bi.PCToLine(pc)
+			}
+		}
+	})
+	b.Run("nocache", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, pc := range pcs {
+				if fn := bi.PCToFunc(pc); fn != nil {
+					fn.cu.lineInfo.PCToLine(fn.Entry, pc)
+				}
+			}
+		}
+	})
+}
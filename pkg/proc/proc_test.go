@@ -2,6 +2,7 @@ package proc_test
 
 import (
 	"bytes"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"go/ast"
@@ -1615,6 +1616,116 @@ func TestCondBreakpoint(t *testing.T) {
 	})
 }
 
+func TestCondBreakpointGoroutineLabel(t *testing.T) {
+	protest.AllowRecording(t)
+	withTestProcess("goroutinelabels", t, func(p proc.Process, fixture protest.Fixture) {
+		bp := setFileBreakpoint(p, t, fixture, 10)
+		bp.Cond = &ast.BinaryExpr{
+			Op: token.EQL,
+			X:  &ast.CallExpr{Fun: &ast.Ident{Name: "label"}, Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: `"worker"`}}},
+			Y:  &ast.BasicLit{Kind: token.STRING, Value: `"high"`},
+		}
+
+		assertNoError(proc.Continue(p), t, "Continue()")
+
+		n, _ := constant.Int64Val(evalVariable(p, t, "n").Value)
+		if n != 2 {
+			t.Fatalf("stopped with the wrong label, n = %d", n)
+		}
+		if labels := p.SelectedGoroutine().Labels(); labels["worker"] != "high" {
+			t.Errorf("wrong labels %v", labels)
+		}
+	})
+}
+
+func TestBreakpointAsyncPreemption(t *testing.T) {
+	// Go 1.14 and later preempt goroutines with SIGURG, stopping at a
+	// breakpoint in a tight loop while the signal is constantly delivered
+	// must always report the breakpoint with the PC at its address.
+	ver, _ := goversion.Parse(runtime.Version())
+	if ver.Major >= 0 && !ver.AfterOrEqual(goversion.GoVersion{Major: 1, Minor: 14, Rev: -1}) {
+		t.Skip("asynchronous preemption not supported")
+	}
+	protest.AllowRecording(t)
+	withTestProcess("asyncpreempt", t, func(p proc.Process, fixture protest.Fixture) {
+		bp := setFileBreakpoint(p, t, fixture, 12)
+		for i := 0; i < 100; i++ {
+			assertNoError(proc.Continue(p), t, "Continue()")
+			th := p.CurrentThread()
+			if b := th.Breakpoint(); b.Breakpoint != bp || !b.Active {
+				t.Fatalf("iteration %d: stopped at breakpoint %v", i, b.Breakpoint)
+			}
+			regs, err := th.Registers(false)
+			assertNoError(err, t, "Registers()")
+			if regs.PC() != bp.Addr {
+				t.Fatalf("iteration %d: PC %#x, breakpoint at %#x", i, regs.PC(), bp.Addr)
+			}
+		}
+	})
+}
+
+func TestGoroutineDefers(t *testing.T) {
+	protest.AllowRecording(t)
+	withTestProcess("defercall", t, func(p proc.Process, fixture protest.Fixture) {
+		setFileBreakpoint(p, t, fixture, 6)
+
+		// called directly by callAndDeferReturn
+		assertNoError(proc.Continue(p), t, "Continue()")
+		defers, err := p.SelectedGoroutine().Defers()
+		assertNoError(err, t, "Defers()")
+		if len(defers) != 1 || defers[0].Fn == nil || defers[0].Fn.Name != "main.sampleFunction" {
+			t.Fatalf("wrong defers %#v", defers)
+		}
+		if panics, _ := p.SelectedGoroutine().Panics(); len(panics) != 0 {
+			t.Errorf("unexpected panics %#v", panics)
+		}
+
+		// deferred by callAndDeferReturn, deferred by callAndPanic2 and
+		// called by the panic
+		for i := 0; i < 3; i++ {
+			assertNoError(proc.Continue(p), t, "Continue()")
+		}
+		panics, err := p.SelectedGoroutine().Panics()
+		assertNoError(err, t, "Panics()")
+		if len(panics) != 1 || panics[0].Recovered {
+			t.Fatalf("wrong panics %#v", panics)
+		}
+		if arg := panics[0].Arg; arg == nil || len(arg.Children) != 1 || arg.Children[0].Value == nil || constant.StringVal(arg.Children[0].Value) != "panicking" {
+			t.Errorf("wrong panic argument %v", arg)
+		}
+	})
+}
+
+func TestGoroutineWaitReason(t *testing.T) {
+	protest.AllowRecording(t)
+	withTestProcess("goroutinestackprog", t, func(p proc.Process, fixture protest.Fixture) {
+		_, err := setFunctionBreakpoint(p, "main.stacktraceme")
+		assertNoError(err, t, "setFunctionBreakpoint()")
+		assertNoError(proc.Continue(p), t, "Continue()")
+
+		gs, err := proc.GoroutinesInfo(p)
+		assertNoError(err, t, "GoroutinesInfo")
+
+		count := 0
+		for _, g := range gs {
+			goloc := g.Go()
+			if goloc.Fn == nil || goloc.Fn.Name != "main.main" {
+				continue
+			}
+			count++
+			if goloc.Line != 23 {
+				t.Errorf("goroutine %d: wrong creation line %d", g.ID, goloc.Line)
+			}
+			if g.WaitReason != "chan send" {
+				t.Errorf("goroutine %d: wrong wait reason %q", g.ID, g.WaitReason)
+			}
+		}
+		if count != 10 {
+			t.Fatalf("found %d goroutines started by main.main", count)
+		}
+	})
+}
+
 func TestCondBreakpointError(t *testing.T) {
 	protest.AllowRecording(t)
 	withTestProcess("parallel_next", t, func(p proc.Process, fixture protest.Fixture) {
@@ -1904,6 +2015,22 @@ func TestCmdLineArgs(t *testing.T) {
 	withTestProcessArgs("testargs", t, ".", []string{"invalid", "pass flag"}, 0, expectPanic)
 }
 
+func TestCmdLineArgsSpecialChars(t *testing.T) {
+	// arguments containing spaces, quotes and non-ASCII characters must be
+	// received unchanged by the target
+	args := []string{"with space", `"double quoted"`, "'single quoted'", "ünïcødé 世界", "$HOME", `back\slash`, "semi;colon,comma"}
+	withTestProcessArgs("echoargs", t, ".", append([]string{hex.EncodeToString([]byte(strings.Join(args, "\x00")))}, args...), 0, func(p proc.Process, fixture protest.Fixture) {
+		err := proc.Continue(p)
+		exit, exited := err.(proc.ProcessExitedError)
+		if !exited {
+			t.Fatalf("Process did not exit: %v", err)
+		}
+		if exit.Status != 0 {
+			t.Fatalf("arguments were not received correctly, exit status %d", exit.Status)
+		}
+	})
+}
+
 func TestIssue462(t *testing.T) {
 	// Stacktrace of Goroutine 0 fails with an error
 	if runtime.GOOS == "windows" {
@@ -3279,6 +3406,9 @@ func TestSystemstackStacktrace(t *testing.T) {
 		assertNoError(proc.Continue(p), t, "second continue")
 		g, err := proc.GetG(p.CurrentThread())
 		assertNoError(err, t, "GetG")
+		if !g.SystemStack || g.ID == 0 {
+			t.Errorf("expected the user goroutine on the system stack, got goroutine %d (system stack %v)", g.ID, g.SystemStack)
+		}
 		frames, err := g.Stacktrace(100)
 		assertNoError(err, t, "stacktrace")
 		logStacktrace(t, frames)
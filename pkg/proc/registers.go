@@ -130,6 +130,66 @@ func AppendX87Reg(regs []Register, index int, exponent uint16, mantissa uint64)
 	return append(regs, Register{fmt.Sprintf("ST(%d)", index), buf.Bytes(), fmt.Sprintf("%#04x%016x\t%g", exponent, mantissa, f)})
 }
 
+// AppendX87StatusReg appends the x87 FPU status word to regs.
+func AppendX87StatusReg(regs []Register, name string, value uint16) []Register {
+	return appendX87WordReg(regs, name, value, x87StatusDescription)
+}
+
+// AppendX87ControlReg appends the x87 FPU control word to regs.
+func AppendX87ControlReg(regs []Register, name string, value uint16) []Register {
+	return appendX87WordReg(regs, name, value, x87ControlDescription)
+}
+
+func appendX87WordReg(regs []Register, name string, value uint16, descr flagRegisterDescr) []Register {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, value)
+	return append(regs, Register{name, buf.Bytes(), descr.Describe(uint64(value), 16)})
+}
+
+// X87Top returns the TOP field of the x87 FPU status word: the physical
+// register (R0 to R7) that holds ST(0).
+func X87Top(status uint16) int {
+	return int(status>>11) & 7
+}
+
+// AppendX87TagReg appends the x87 FPU tag word to regs, describing the
+// state of each register of the FPU stack: ST(i) is the physical register
+// (top+i)%8. If top is negative the physical registers are described
+// instead.
+// If abridged is true tag is in the format used by FXSAVE, one bit for each
+// physical register, set if the register isn't empty; otherwise it is the
+// full tag word, with two bits for each physical register (valid, zero,
+// special or empty).
+func AppendX87TagReg(regs []Register, name string, tag uint16, abridged bool, top int) []Register {
+	var buf bytes.Buffer
+	var value string
+	if abridged {
+		buf.WriteByte(byte(tag))
+		value = fmt.Sprintf("%#02x", byte(tag))
+	} else {
+		binary.Write(&buf, binary.LittleEndian, tag)
+		value = fmt.Sprintf("%#04x", tag)
+	}
+	descr := make([]string, 8)
+	for i := range descr {
+		reg, phys := fmt.Sprintf("R%d", i), i
+		if top >= 0 {
+			reg, phys = fmt.Sprintf("ST(%d)", i), (top+i)%8
+		}
+		var state string
+		if abridged {
+			state = "empty"
+			if tag&(1<<uint(phys)) != 0 {
+				state = "valid"
+			}
+		} else {
+			state = [...]string{"valid", "zero", "special", "empty"}[(tag>>uint(2*phys))&3]
+		}
+		descr[i] = reg + "=" + state
+	}
+	return append(regs, Register{name, buf.Bytes(), fmt.Sprintf("%s\t[%s]", value, strings.Join(descr, " "))})
+}
+
 // AppendSSEReg appends a 256 bit SSE register to regs.
 func AppendSSEReg(regs []Register, name string, xmm []byte) []Register {
 	buf := bytes.NewReader(xmm)
@@ -193,6 +253,36 @@ var mxcsrDescription flagRegisterDescr = []flagDescr{
 	{"IE", 1 << 0},
 }
 
+var x87StatusDescription flagRegisterDescr = []flagDescr{
+	{"B", 1 << 15},
+	{"C3", 1 << 14},
+	{"TOP", 1<<13 | 1<<12 | 1<<11},
+	{"C2", 1 << 10},
+	{"C1", 1 << 9},
+	{"C0", 1 << 8},
+	{"ES", 1 << 7},
+	{"SF", 1 << 6},
+	{"PE", 1 << 5},
+	{"UE", 1 << 4},
+	{"OE", 1 << 3},
+	{"ZE", 1 << 2},
+	{"DE", 1 << 1},
+	{"IE", 1 << 0},
+}
+
+var x87ControlDescription flagRegisterDescr = []flagDescr{
+	{"X", 1 << 12},
+	{"RC", 1<<11 | 1<<10},
+	{"PC", 1<<9 | 1<<8},
+	{"", 1 << 6},
+	{"PM", 1 << 5},
+	{"UM", 1 << 4},
+	{"OM", 1 << 3},
+	{"ZM", 1 << 2},
+	{"DM", 1 << 1},
+	{"IM", 1 << 0},
+}
+
 var eflagsDescription flagRegisterDescr = []flagDescr{
 	{"CF", 1 << 0},
 	{"", 1 << 1},
@@ -120,6 +120,18 @@ func (g *G) Stacktrace(depth int) ([]Stackframe, error) {
 	return it.stacktrace(depth)
 }
 
+// StackCorruptionError is returned when unwinding the stack of a
+// goroutine reaches a frame whose return address is outside of the bounds
+// of the goroutine stack.
+type StackCorruptionError struct {
+	Addr   uint64 // address the return address would be read from
+	Lo, Hi uint64 // bounds of the goroutine stack
+}
+
+func (err *StackCorruptionError) Error() string {
+	return fmt.Sprintf("stack corruption detected: return address at %#x outside of the goroutine stack [%#x, %#x)", err.Addr, err.Lo, err.Hi)
+}
+
 // NullAddrError is an error for a null address.
 type NullAddrError struct{}
 
@@ -140,6 +152,7 @@ type stackIterator struct {
 	err   error
 
 	stackhi        uint64
+	stacklo        uint64 // lower bound of the goroutine stack, zero if unknown
 	systemstack    bool
 	stackBarrierPC uint64
 	stkbar         []savedLR
@@ -178,10 +191,11 @@ func newStackIterator(bi *BinaryInfo, mem MemoryReadWriter, regs op.DwarfRegiste
 		}
 		stkbar = stkbar[stkbarPos:]
 	}
-	var g0_sched_sp uint64
+	var g0_sched_sp, stacklo uint64
 	systemstack := true
 	if g != nil {
 		systemstack = g.SystemStack
+		stacklo = g.stacklo
 		g0var, _ := g.variable.fieldVariable("m").structMember("g0")
 		if g0var != nil {
 			g0, _ := g0var.parseG()
@@ -190,7 +204,7 @@ func newStackIterator(bi *BinaryInfo, mem MemoryReadWriter, regs op.DwarfRegiste
 			}
 		}
 	}
-	return &stackIterator{pc: regs.PC(), regs: regs, top: true, bi: bi, mem: mem, err: nil, atend: false, stackhi: stackhi, stackBarrierPC: stackBarrierPC, stkbar: stkbar, systemstack: systemstack, g: g, g0_sched_sp: g0_sched_sp, dwarfReader: bi.dwarf.Reader()}
+	return &stackIterator{pc: regs.PC(), regs: regs, top: true, bi: bi, mem: mem, err: nil, atend: false, stackhi: stackhi, stacklo: stacklo, stackBarrierPC: stackBarrierPC, stkbar: stkbar, systemstack: systemstack, g: g, g0_sched_sp: g0_sched_sp, dwarfReader: bi.dwarf.Reader()}
 }
 
 // Next points the iterator to the next stack frame.
@@ -216,12 +230,29 @@ func (it *stackIterator) Next() bool {
 		return true
 	}
 
+	if it.bi.strictUnwind && !it.insideStack(it.frame.addrret) {
+		// The return address was read from outside of the goroutine stack,
+		// following it would produce garbage.
+		it.err = &StackCorruptionError{Addr: it.frame.addrret, Lo: it.stacklo, Hi: it.stackhi}
+		return true
+	}
+
 	it.top = false
 	it.pc = it.frame.Ret
 	it.regs = callFrameRegs
 	return true
 }
 
+// insideStack returns true if addr is inside the bounds of the goroutine
+// stack. Always returns true on the system stack or if the bounds of the
+// goroutine stack are unknown.
+func (it *stackIterator) insideStack(addr uint64) bool {
+	if it.systemstack || it.stacklo == 0 || it.stackhi == 0 {
+		return true
+	}
+	return addr >= it.stacklo && addr < it.stackhi
+}
+
 // asmcgocallSPOffsetSaveSlot is the offset from systemstack.SP where
 // (goroutine.SP - StackHi) is saved in runtime.asmcgocall after the stack
 // switch happens.
@@ -432,10 +463,10 @@ func (it *stackIterator) appendInlineCalls(frames []Stackframe, frame Stackframe
 		frames = append(frames, Stackframe{
 			Current: frame.Current,
 			Call: Location{
-				frame.Call.PC,
-				frame.Call.File,
-				frame.Call.Line,
-				inlfn,
+				PC:   frame.Call.PC,
+				File: frame.Call.File,
+				Line: frame.Call.Line,
+				Fn:   inlfn,
 			},
 			Regs:        frame.Regs,
 			stackHi:     frame.stackHi,
@@ -461,7 +492,11 @@ func (it *stackIterator) advanceRegs() (callFrameRegs op.DwarfRegisters, ret uin
 	fde, err := it.bi.frameEntries.FDEForPC(it.pc)
 	var framectx *frame.FrameContext
 	if _, nofde := err.(*frame.NoFDEForPCError); nofde {
-		framectx = it.bi.Arch.FixFrameUnwindContext(nil, it.pc, it.bi)
+		if !it.bi.strictUnwind || it.framePointerValid() {
+			framectx = it.bi.Arch.FixFrameUnwindContext(nil, it.pc, it.bi)
+		} else {
+			framectx = it.spFrameUnwindContext()
+		}
 	} else {
 		framectx = it.bi.Arch.FixFrameUnwindContext(fde.EstablishFrame(it.pc), it.pc, it.bi)
 	}
@@ -503,6 +538,55 @@ func (it *stackIterator) advanceRegs() (callFrameRegs op.DwarfRegisters, ret uin
 	return callFrameRegs, ret, retaddr
 }
 
+// framePointerValid returns true if the BP register of the current frame
+// looks like a frame pointer, i.e. it points inside the stack above SP.
+// Assembly functions and some parts of the runtime do not maintain BP,
+// following it in those frames produces garbage.
+func (it *stackIterator) framePointerValid() bool {
+	bp, sp := it.regs.BP(), it.regs.SP()
+	if bp == 0 || bp < sp {
+		return false
+	}
+	if it.stackhi != 0 && bp >= it.stackhi {
+		return false
+	}
+	return true
+}
+
+// spFrameUnwindContext returns the frame unwind context used for frames
+// that have neither a frame descriptor entry nor a valid frame pointer.
+// The return address is assumed to be at the top of the stack, which is
+// true at the entry point of a function and for frameless functions:
+// - cfa is sp + ptrSize
+// - return register is [cfa-ptrSize]
+// - bp is unchanged
+// - sp is cfa
+// The register numbers are the ones the architecture used for it.regs.
+func (it *stackIterator) spFrameUnwindContext() *frame.FrameContext {
+	ptrSize := it.bi.Arch.PtrSize()
+	return &frame.FrameContext{
+		RetAddrReg: it.regs.PCRegNum,
+		Regs: map[uint64]frame.DWRule{
+			it.regs.PCRegNum: frame.DWRule{
+				Rule:   frame.RuleOffset,
+				Offset: int64(-ptrSize),
+			},
+			it.regs.BPRegNum: frame.DWRule{
+				Rule: frame.RuleSameVal,
+			},
+			it.regs.SPRegNum: frame.DWRule{
+				Rule:   frame.RuleValOffset,
+				Offset: 0,
+			},
+		},
+		CFA: frame.DWRule{
+			Rule:   frame.RuleCFA,
+			Reg:    it.regs.SPRegNum,
+			Offset: int64(ptrSize),
+		},
+	}
+}
+
 func (it *stackIterator) executeFrameRegRule(regnum uint64, rule frame.DWRule, cfa int64) (*op.DwarfRegister, error) {
 	switch rule.Rule {
 	default:
@@ -510,6 +594,9 @@ func (it *stackIterator) executeFrameRegRule(regnum uint64, rule frame.DWRule, c
 	case frame.RuleUndefined:
 		return nil, nil
 	case frame.RuleSameVal:
+		if it.regs.Reg(regnum) == nil {
+			return nil, nil
+		}
 		reg := *it.regs.Reg(regnum)
 		return &reg, nil
 	case frame.RuleOffset:
@@ -40,6 +40,10 @@ type Location struct {
 	File string
 	Line int
 	Fn   *Function
+	// Desc explains where PC is when it has no debug info, for example
+	// "PC 0x1000 not in any mapped region". Only set by backends that can
+	// inspect the address space of the target.
+	Desc string
 }
 
 // ThreadBlockedError is returned when the thread
@@ -434,11 +438,12 @@ func GetG(thread Thread) (*G, error) {
 	if err != nil {
 		return nil, err
 	}
-	if g.ID == 0 {
-		// The runtime uses a special goroutine with ID == 0 to mark that the
-		// current goroutine is executing on the system stack (sometimes also
-		// referred to as the g0 stack or scheduler stack, I'm not sure if there's
-		// actually any difference between those).
+	if g.isSystemGoroutine() {
+		// The runtime uses special goroutines (m.g0 and m.gsignal, both with
+		// ID == 0) to mark that the current goroutine is executing on the
+		// system stack (sometimes also referred to as the g0 stack or
+		// scheduler stack, I'm not sure if there's actually any difference
+		// between those).
 		// For our purposes it's better if we always return the real goroutine
 		// since the rest of the code assumes the goroutine ID is univocal.
 		// The real 'current goroutine' is stored in g0.m.curg
@@ -459,6 +464,31 @@ func GetG(thread Thread) (*G, error) {
 	return g, nil
 }
 
+// isSystemGoroutine returns true if g is a goroutine used by the runtime
+// to run code on the system stack (m.g0 or m.gsignal). The runtime never
+// assigns ID 0 to a user goroutine.
+func (g *G) isSystemGoroutine() bool {
+	return g.ID == 0
+}
+
+// ThreadStackBounds returns the bounds, [lo, hi), of the stack thread is
+// executing on, read from the g struct its g register points to.
+// Unlike GetG this doesn't switch to the user goroutine when the thread is
+// executing on the system stack: in that case systemStack is true and the
+// bounds are the ones of the g0 (or gsignal) goroutine of the thread's M,
+// a fixed size stack that doesn't grow.
+func ThreadStackBounds(thread Thread) (lo, hi uint64, systemStack bool, err error) {
+	gvar, err := getGVariable(thread)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	g, err := gvar.parseG()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return g.stacklo, g.stackhi, g.isSystemGoroutine(), nil
+}
+
 // ThreadScope returns an EvalScope for this thread.
 func ThreadScope(thread Thread) (*EvalScope, error) {
 	locations, err := ThreadStacktrace(thread, 0)
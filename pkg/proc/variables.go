@@ -137,10 +137,15 @@ type G struct {
 	BP         uint64 // BP of goroutine when it was parked (go >= 1.7).
 	GoPC       uint64 // PC of 'go' statement that created this goroutine.
 	WaitReason string // Reason for goroutine being parked.
+	WaitSince  int64  // Approximate time the goroutine was parked, in runtime.nanotime units, zero if unknown.
 	Status     uint64
 	stkbarVar  *Variable // stkbar field of g struct
 	stkbarPos  int       // stkbarPos field of g struct
 	stackhi    uint64    // value of stack.hi
+	stacklo    uint64    // value of stack.lo
+
+	labels       map[string]string // goroutine labels, see Labels
+	labelsLoaded bool
 
 	SystemStack bool // SystemStack is true if this goroutine is currently executing on a system stack.
 
@@ -162,6 +167,8 @@ type EvalScope struct {
 	Gvar    *Variable
 	BinInfo *BinaryInfo
 
+	g *G // goroutine of Gvar, caches the goroutine's labels
+
 	frameOffset int64
 
 	aordr *dwarf.Reader // extra reader to load DW_AT_abstract_origin entries, do not initialize
@@ -188,6 +195,14 @@ func newVariableFromThread(t Thread, name string, addr uintptr, dwarfType godwar
 	return newVariable(name, addr, dwarfType, t.BinInfo(), t)
 }
 
+// LoadVariable returns a variable called name for the value of type
+// dwarfType stored at addr in mem, loaded using cfg.
+func LoadVariable(name string, addr uintptr, dwarfType godwarf.Type, bi *BinaryInfo, mem MemoryReadWriter, cfg LoadConfig) *Variable {
+	v := newVariable(name, addr, dwarfType, bi, mem)
+	v.loadValue(cfg)
+	return v
+}
+
 func (v *Variable) newVariable(name string, addr uintptr, dwarfType godwarf.Type, mem MemoryReadWriter) *Variable {
 	return newVariable(name, addr, dwarfType, v.bi, mem)
 }
@@ -416,14 +431,28 @@ func (gvar *Variable) parseG() (*G, error) {
 	id, _ := constant.Int64Val(gvar.fieldVariable("goid").Value)
 	gopc, _ := constant.Int64Val(gvar.fieldVariable("gopc").Value)
 	waitReason := ""
-	if wrvar := gvar.fieldVariable("waitreason"); wrvar.Value != nil {
-		waitReason = constant.StringVal(wrvar.Value)
+	if wrvar := gvar.fieldVariable("waitreason"); wrvar != nil && wrvar.Value != nil {
+		switch wrvar.Value.Kind() {
+		case constant.String:
+			// before Go 1.11
+			waitReason = constant.StringVal(wrvar.Value)
+		case constant.Int:
+			n, _ := constant.Int64Val(wrvar.Value)
+			waitReason = gvar.bi.WaitReasonString(gvar.mem, n)
+		}
+	}
+	var waitSince int64
+	if wsvar := gvar.fieldVariable("waitsince"); wsvar != nil && wsvar.Value != nil {
+		waitSince, _ = constant.Int64Val(wsvar.Value)
 	}
-	var stackhi uint64
+	var stackhi, stacklo uint64
 	if stackVar := gvar.fieldVariable("stack"); stackVar != nil {
 		if stackhiVar := stackVar.fieldVariable("hi"); stackhiVar != nil {
 			stackhi, _ = constant.Uint64Val(stackhiVar.Value)
 		}
+		if stackloVar := stackVar.fieldVariable("lo"); stackloVar != nil {
+			stacklo, _ = constant.Uint64Val(stackloVar.Value)
+		}
 	}
 
 	stkbarVar, _ := gvar.structMember("stkbar")
@@ -442,16 +471,44 @@ func (gvar *Variable) parseG() (*G, error) {
 		SP:         uint64(sp),
 		BP:         uint64(bp),
 		WaitReason: waitReason,
+		WaitSince:  waitSince,
 		Status:     uint64(status),
 		CurrentLoc: Location{PC: uint64(pc), File: f, Line: l, Fn: fn},
 		variable:   gvar,
 		stkbarVar:  stkbarVar,
 		stkbarPos:  int(stkbarPos),
 		stackhi:    stackhi,
+		stacklo:    stacklo,
 	}
 	return g, nil
 }
 
+// WaitReasonString returns the description of the wait reason n. Since Go
+// 1.11 g.waitreason is an enum whose values change between versions of Go,
+// the descriptions are read from runtime.waitReasonStrings.
+func (bi *BinaryInfo) WaitReasonString(mem MemoryReadWriter, n int64) string {
+	bi.shared.loadWaitReasonsOnce.Do(func() {
+		v, err := globalScope(bi, mem).findGlobal("runtime.waitReasonStrings")
+		if err != nil {
+			return
+		}
+		v.loadValue(LoadConfig{false, 1, 64, int(v.Len), 0})
+		if v.Unreadable != nil {
+			return
+		}
+		bi.shared.waitReasons = make([]string, len(v.Children))
+		for i := range v.Children {
+			if v.Children[i].Value != nil {
+				bi.shared.waitReasons[i] = constant.StringVal(v.Children[i].Value)
+			}
+		}
+	})
+	if n >= 0 && n < int64(len(bi.shared.waitReasons)) {
+		return bi.shared.waitReasons[n]
+	}
+	return fmt.Sprintf("wait reason %d", n)
+}
+
 func (v *Variable) loadFieldNamed(name string) *Variable {
 	v, err := v.structMember(name)
 	if err != nil {
@@ -473,6 +530,86 @@ func (v *Variable) fieldVariable(name string) *Variable {
 	return nil
 }
 
+// loadLabelsConfig is the configuration used to load goroutine labels.
+var loadLabelsConfig = LoadConfig{FollowPointers: false, MaxVariableRecurse: 2, MaxStringLen: 256, MaxArrayValues: 64, MaxStructFields: -1}
+
+// Labels returns the labels of the goroutine, set with
+// runtime/pprof.SetGoroutineLabels or runtime/pprof.Do. Returns nil if the
+// goroutine doesn't have labels or they can't be read, for example because
+// the runtime predates goroutine labels (Go 1.9) or the layout of the
+// label set isn't one we know.
+// Labels are read from the target only the first time this method is called.
+func (g *G) Labels() map[string]string {
+	if g.labelsLoaded {
+		return g.labels
+	}
+	g.labelsLoaded = true
+	if g.variable == nil || g.variable.Unreadable != nil {
+		return nil
+	}
+	labelsVar := g.variable.fieldVariable("labels")
+	if labelsVar == nil {
+		return nil
+	}
+	ptrbuf := make([]byte, g.variable.bi.Arch.PtrSize())
+	if _, err := g.variable.mem.ReadMemory(ptrbuf, labelsVar.Addr); err != nil {
+		return nil
+	}
+	labelsAddr := binary.LittleEndian.Uint64(ptrbuf)
+	if labelsAddr == 0 {
+		return nil
+	}
+	typ, err := g.variable.bi.findType("runtime/pprof.labelMap")
+	if err != nil {
+		return nil
+	}
+	labelMap := g.variable.newVariable("labels", uintptr(labelsAddr), typ, g.variable.mem)
+	labelMap.loadValue(loadLabelsConfig)
+	if labelMap.Unreadable != nil {
+		return nil
+	}
+	g.labels = parseLabelMap(labelMap)
+	return g.labels
+}
+
+// parseLabelMap converts a runtime/pprof.labelMap variable, which is a
+// map[string]string up to Go 1.23 and a struct containing a slice of
+// key/value pairs afterwards.
+func parseLabelMap(v *Variable) map[string]string {
+	switch v.Kind {
+	case reflect.Map:
+		labels := make(map[string]string, len(v.Children)/2)
+		for i := 0; i+1 < len(v.Children); i += 2 {
+			key, val := &v.Children[i], &v.Children[i+1]
+			if key.Kind != reflect.String || val.Kind != reflect.String || key.Value == nil || val.Value == nil {
+				return nil
+			}
+			labels[constant.StringVal(key.Value)] = constant.StringVal(val.Value)
+		}
+		return labels
+	case reflect.Struct:
+		for i := range v.Children {
+			switch child := &v.Children[i]; child.Kind {
+			case reflect.Struct:
+				if labels := parseLabelMap(child); labels != nil {
+					return labels
+				}
+			case reflect.Slice:
+				labels := make(map[string]string, len(child.Children))
+				for j := range child.Children {
+					key, val := child.Children[j].fieldVariable("key"), child.Children[j].fieldVariable("value")
+					if key == nil || val == nil || key.Value == nil || val.Value == nil {
+						return nil
+					}
+					labels[constant.StringVal(key.Value)] = constant.StringVal(val.Value)
+				}
+				return labels
+			}
+		}
+	}
+	return nil
+}
+
 // PC of entry to top-most deferred function.
 func (g *G) DeferPC() uint64 {
 	if g.variable.Unreadable != nil {
@@ -498,6 +635,136 @@ func (g *G) DeferPC() uint64 {
 	return uint64(deferPC)
 }
 
+// maxDeferChain is the maximum number of records read from the _defer and
+// _panic lists of a goroutine, longer lists are assumed to be corrupted.
+const maxDeferChain = 1000
+
+// DeferRecord describes a deferred call, read from the _defer list of a
+// goroutine.
+type DeferRecord struct {
+	Addr uint64    // address of the _defer struct
+	SP   uint64    // SP of the frame that deferred the call
+	PC   uint64    // return address of the call to deferproc
+	FnPC uint64    // entry point of the deferred function, zero if unknown
+	Fn   *Function // deferred function, nil if unknown
+}
+
+// PanicRecord describes an active panic, read from the _panic list of a
+// goroutine.
+type PanicRecord struct {
+	Addr      uint64    // address of the _panic struct
+	Arg       *Variable // argument of the call to panic
+	Recovered bool
+	Aborted   bool // the panic was aborted by a new panic, Go 1.21 and earlier
+	Goexit    bool // the record was created by runtime.Goexit
+}
+
+// Defers returns the deferred calls that are pending on the goroutine,
+// the most recent first, following the _defer list of its G struct.
+// The layout of the _defer struct changed between runtime versions, fields
+// missing from the struct are left zeroed. Functions that use open-coded
+// defers (Go 1.14 and later, optimized builds only) have no records.
+func (g *G) Defers() ([]DeferRecord, error) {
+	if g.variable.Unreadable != nil {
+		return nil, g.variable.Unreadable
+	}
+	var r []DeferRecord
+	err := followRuntimeList(g.variable.fieldVariable("_defer"), func(d *Variable) {
+		rec := DeferRecord{Addr: uint64(d.Addr), SP: uintField(d, "sp"), PC: uintField(d, "pc")}
+		if fnvar := d.fieldVariable("fn"); fnvar != nil && fnvar.Unreadable == nil {
+			switch fnvar.Kind {
+			case reflect.Func:
+				// Go 1.18 and later: fn func()
+				rec.FnPC = uint64(fnvar.Base)
+			case reflect.Ptr:
+				// fn *funcval
+				if fv := fnvar.maybeDereference(); fv.Addr != 0 {
+					fv.loadValue(LoadConfig{false, 1, 64, 0, -1})
+					rec.FnPC = uintField(fv, "fn")
+				}
+			}
+		}
+		if rec.FnPC != 0 {
+			rec.Fn = g.variable.bi.PCToFunc(rec.FnPC)
+		}
+		r = append(r, rec)
+	})
+	return r, err
+}
+
+// Panics returns the active panics of the goroutine, the most recent
+// first, following the _panic list of its G struct.
+func (g *G) Panics() ([]PanicRecord, error) {
+	if g.variable.Unreadable != nil {
+		return nil, g.variable.Unreadable
+	}
+	var r []PanicRecord
+	err := followRuntimeList(g.variable.fieldVariable("_panic"), func(p *Variable) {
+		rec := PanicRecord{Addr: uint64(p.Addr), Arg: p.fieldVariable("arg")}
+		rec.Recovered = boolField(p, "recovered")
+		rec.Aborted = boolField(p, "aborted")
+		rec.Goexit = boolField(p, "goexit")
+		r = append(r, rec)
+	})
+	return r, err
+}
+
+// followRuntimeList follows a linked list of runtime structs (like _defer
+// or _panic) linked by their link field, starting at the pointer variable
+// head, and calls fn on each element. An error is returned if an element
+// can not be read or if the list is too long or circular, fn is called on
+// all elements read before the error.
+func followRuntimeList(head *Variable, fn func(*Variable)) error {
+	if head == nil {
+		return nil
+	}
+	visited := make(map[uintptr]bool)
+	for ptr := head; ptr != nil; {
+		v := ptr.maybeDereference()
+		if v.Unreadable != nil {
+			return v.Unreadable
+		}
+		if v.Addr == 0 {
+			return nil
+		}
+		if visited[v.Addr] || len(visited) >= maxDeferChain {
+			return fmt.Errorf("list of %s records is corrupted at %#x", v.DwarfType.Common().Name, v.Addr)
+		}
+		visited[v.Addr] = true
+		v.loadValue(LoadConfig{true, 1, 64, 64, -1})
+		if v.Unreadable != nil {
+			return v.Unreadable
+		}
+		fn(v)
+		ptr = v.fieldVariable("link")
+	}
+	return nil
+}
+
+// uintField returns the value of the integer field called name of v, or
+// zero if v doesn't have it.
+func uintField(v *Variable, name string) uint64 {
+	f := v.fieldVariable(name)
+	if f == nil || f.Value == nil {
+		return 0
+	}
+	if n, exact := constant.Uint64Val(f.Value); exact {
+		return n
+	}
+	n, _ := constant.Int64Val(f.Value)
+	return uint64(n)
+}
+
+// boolField returns the value of the boolean field called name of v, or
+// false if v doesn't have it.
+func boolField(v *Variable, name string) bool {
+	f := v.fieldVariable(name)
+	if f == nil || f.Value == nil || f.Value.Kind() != constant.Bool {
+		return false
+	}
+	return constant.BoolVal(f.Value)
+}
+
 // From $GOROOT/src/runtime/traceback.go:597
 // isExportedRuntime reports whether name is an exported runtime function.
 // It is only for runtime functions, so ASCII A-Z is fine.
@@ -532,13 +799,20 @@ func (g *G) Go() Location {
 	fn := g.variable.bi.PCToFunc(pc)
 	// Backup to CALL instruction.
 	// Mimics runtime/traceback.go:677.
-	if g.GoPC > fn.Entry {
+	if fn != nil && g.GoPC > fn.Entry {
 		pc -= 1
 	}
 	f, l, fn := g.variable.bi.PCToLine(pc)
 	return Location{PC: g.GoPC, File: f, Line: l, Fn: fn}
 }
 
+// StackBounds returns the bounds, [lo, hi), of the goroutine stack as
+// read from the stack field of the g struct. Both are zero if they could
+// not be read.
+func (g *G) StackBounds() (lo, hi uint64) {
+	return g.stacklo, g.stackhi
+}
+
 // Returns the list of saved return addresses used by stack barriers
 func (g *G) stkbar() ([]savedLR, error) {
 	if g.stkbarVar == nil { // stack barriers were removed in Go 1.9
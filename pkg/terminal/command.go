@@ -680,6 +680,9 @@ func formatThread(th *api.Thread) string {
 	if th == nil {
 		return "<nil>"
 	}
+	if th.Function == nil && th.Desc != "" {
+		return fmt.Sprintf("%d at %s", th.ID, th.Desc)
+	}
 	return fmt.Sprintf("%d at %s:%d", th.ID, ShortenFilePath(th.File), th.Line)
 }
 
@@ -695,6 +698,8 @@ func formatLocation(loc api.Location) string {
 	fname := ""
 	if loc.Function != nil {
 		fname = loc.Function.Name
+	} else if loc.Desc != "" {
+		return loc.Desc
 	}
 	return fmt.Sprintf("%s:%d %s (%#v)", ShortenFilePath(loc.File), loc.Line, fname, loc.PC)
 }
@@ -1498,6 +1503,10 @@ func printcontext(t *Term, state *api.DebuggerState) error {
 }
 
 func printcontextLocation(loc api.Location) {
+	if loc.Function == nil && loc.Desc != "" {
+		fmt.Printf("> %s\n", loc.Desc)
+		return
+	}
 	fmt.Printf("> %s() %s:%d (PC: %#v)\n", loc.Function.Name, ShortenFilePath(loc.File), loc.Line, loc.PC)
 	if loc.Function != nil && loc.Function.Optimized {
 		fmt.Println(optimizedFunctionWarning)
@@ -1509,7 +1518,7 @@ func printcontextThread(t *Term, th *api.Thread) {
 	fn := th.Function
 
 	if th.Breakpoint == nil {
-		printcontextLocation(api.Location{PC: th.PC, File: th.File, Line: th.Line, Function: th.Function})
+		printcontextLocation(api.Location{PC: th.PC, File: th.File, Line: th.Line, Function: th.Function, Desc: th.Desc})
 		return
 	}
 
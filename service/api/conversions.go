@@ -51,6 +51,7 @@ func ConvertThread(th proc.Thread) *Thread {
 		file     string
 		line     int
 		pc       uint64
+		desc     string
 		gid      int
 	)
 
@@ -60,6 +61,7 @@ func ConvertThread(th proc.Thread) *Thread {
 		file = loc.File
 		line = loc.Line
 		function = ConvertFunction(loc.Fn)
+		desc = loc.Desc
 	}
 
 	var bp *Breakpoint
@@ -78,6 +80,7 @@ func ConvertThread(th proc.Thread) *Thread {
 		File:        file,
 		Line:        line,
 		Function:    function,
+		Desc:        desc,
 		GoroutineID: gid,
 		Breakpoint:  bp,
 	}
@@ -245,6 +248,7 @@ func ConvertLocation(loc proc.Location) Location {
 		File:     loc.File,
 		Line:     loc.Line,
 		Function: ConvertFunction(loc.Fn),
+		Desc:     loc.Desc,
 	}
 }
 
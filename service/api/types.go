@@ -99,6 +99,9 @@ type Thread struct {
 	Line int `json:"line"`
 	// Function is function information at the program counter. May be nil.
 	Function *Function `json:"function,omitempty"`
+	// Desc describes where the program counter is when it has no debug
+	// info. May be empty.
+	Desc string `json:"desc,omitempty"`
 
 	// ID of the goroutine running on this thread
 	GoroutineID int `json:"goroutineID"`
@@ -114,6 +117,7 @@ type Location struct {
 	File     string    `json:"file"`
 	Line     int       `json:"line"`
 	Function *Function `json:"function,omitempty"`
+	Desc     string    `json:"desc,omitempty"`
 }
 
 type Stackframe struct {